@@ -1,9 +1,11 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net/http"
+	"products/middleware"
 	"products/routers"
 
 )
@@ -11,6 +13,7 @@ import (
 func main() {
 
 	r := routers.Router()
+	middleware.StartBackgroundJobs(context.Background())
 	fmt.Println("Starting server on the port 8080..")
 
 	log.Fatal(http.ListenAndServe(":8080", r))
@@ -0,0 +1,519 @@
+package middleware
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"products/models"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/lib/pq"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	roleCustomer = "customer"
+	roleAdmin    = "admin"
+)
+
+var validRoles = map[string]bool{
+	roleCustomer: true,
+	roleAdmin:    true,
+}
+
+const passwordResetTTL = 24 * time.Hour
+
+var errUnauthorized = errors.New("Missing or invalid token")
+
+// authenticate resolves the user behind the x-jwt-token header.
+func authenticate(r *http.Request) (models.User, error) {
+	tokenString := r.Header.Get("x-jwt-token")
+	if tokenString == "" {
+		return models.User{}, errUnauthorized
+	}
+
+	token, err := validateJWT(tokenString)
+	if err != nil || !token.Valid {
+		return models.User{}, errUnauthorized
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return models.User{}, errUnauthorized
+	}
+	email, _ := claims["user"].(string)
+	if email == "" {
+		return models.User{}, errUnauthorized
+	}
+
+	// Erased users keep no session, whatever their token names.
+	user, err := getUserByEmail(email)
+	if err != nil || user.Id == 0 || user.Erased_at != nil {
+		return models.User{}, errUnauthorized
+	}
+	return user, nil
+}
+
+// checkAccount rejects users who may not use their session: disabled
+// accounts and accounts flagged for a password reset, whose existing tokens
+// must stop working until the password is changed.
+func checkAccount(w http.ResponseWriter, user models.User) bool {
+	if user.Disabled {
+		writeError(w, http.StatusForbidden, "Account is disabled")
+		return false
+	}
+	if user.Password_reset_required {
+		writeError(w, http.StatusForbidden, "Password reset required")
+		return false
+	}
+	return true
+}
+
+func WithAdminAuth(handlerFunc http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, err := authenticate(r)
+		if err != nil {
+			writeError(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+		if !checkAccount(w, user) {
+			return
+		}
+		if user.Role != roleAdmin {
+			writeError(w, http.StatusForbidden, "Admin role required")
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), currentUserKey, user)
+		handlerFunc(w, r.WithContext(ctx))
+	}
+}
+
+func insertAuditLog(q dbtx, actorID int64, action string, targetType string, targetID int64, details any) error {
+	var payload []byte
+	if details != nil {
+		var err error
+		payload, err = json.Marshal(details)
+		if err != nil {
+			return err
+		}
+	}
+
+	var actor sql.NullInt64
+	if actorID != 0 {
+		actor = sql.NullInt64{Int64: actorID, Valid: true}
+	}
+
+	sqlStatement := `INSERT INTO audit_log(actor_id, action, target_type, target_id, details, created_at) VALUES ($1, $2, $3, $4, $5, Now())`
+	_, err := q.Exec(sqlStatement, actor, action, targetType, targetID, payload)
+	return err
+}
+
+func isForeignKeyViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23503"
+}
+
+func isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505"
+}
+
+// pagination reads ?page= and ?limit= with sane defaults.
+func pagination(r *http.Request) (page int, limit int) {
+	page, _ = strconv.Atoi(r.URL.Query().Get("page"))
+	if page < 1 {
+		page = 1
+	}
+	limit, _ = strconv.Atoi(r.URL.Query().Get("limit"))
+	if limit < 1 {
+		limit = 20
+	}
+	if limit > 100 {
+		limit = 100
+	}
+	return page, limit
+}
+
+func GetAllUsers(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	page, limit := pagination(r)
+
+	var disabled *bool
+	if value := query.Get("disabled"); value != "" {
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "disabled must be true or false")
+			return
+		}
+		disabled = &parsed
+	}
+
+	users, total, err := searchUsers(query.Get("q"), query.Get("role"), disabled, page, limit)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("Unable to list users %v", err))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, models.UserListResponse{
+		Users: users,
+		Total: total,
+		Page:  page,
+		Limit: limit,
+	})
+}
+
+func searchUsers(search string, role string, disabled *bool, page int, limit int) ([]models.User, int64, error) {
+	db := createConnection()
+	defer db.Close()
+
+	var conditions []string
+	var args []any
+	if search != "" {
+		args = append(args, "%"+search+"%")
+		n := len(args)
+		conditions = append(conditions, fmt.Sprintf("(first_name ILIKE $%d OR last_name ILIKE $%d OR email ILIKE $%d)", n, n, n))
+	}
+	if role != "" {
+		args = append(args, role)
+		conditions = append(conditions, fmt.Sprintf("role = $%d", len(args)))
+	}
+	if disabled != nil {
+		args = append(args, *disabled)
+		conditions = append(conditions, fmt.Sprintf("disabled = $%d", len(args)))
+	}
+
+	where := ""
+	if len(conditions) > 0 {
+		where = " WHERE " + strings.Join(conditions, " AND ")
+	}
+
+	var total int64
+	err := db.QueryRow(`SELECT COUNT(*) FROM users`+where, args...).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	args = append(args, limit, (page-1)*limit)
+	sqlStatement := fmt.Sprintf(`SELECT %s FROM users%s ORDER BY id LIMIT $%d OFFSET $%d`, userColumns, where, len(args)-1, len(args))
+
+	rows, err := db.Query(sqlStatement, args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	users := []models.User{}
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		user.Password = ""
+		users = append(users, user)
+	}
+	return users, total, rows.Err()
+}
+
+func DisableUser(w http.ResponseWriter, r *http.Request) {
+	setUserDisabled(w, r, true)
+}
+
+func EnableUser(w http.ResponseWriter, r *http.Request) {
+	setUserDisabled(w, r, false)
+}
+
+func setUserDisabled(w http.ResponseWriter, r *http.Request, disabled bool) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	admin, _ := currentUser(r)
+	if admin.Id == id {
+		writeError(w, http.StatusBadRequest, "Admins cannot disable their own account")
+		return
+	}
+
+	action := "user.enable"
+	if disabled {
+		action = "user.disable"
+	}
+
+	err = runAdminUserUpdate(admin.Id, id, action, nil, `UPDATE users SET disabled=$2 WHERE id=$1`, id, disabled)
+	if err != nil {
+		writeAdminUserError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, response{
+		Id:      id,
+		Message: fmt.Sprintf("User disabled set to %v", disabled),
+	})
+}
+
+func AssignUserRole(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var req models.RoleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Unable to decode the request body %v", err))
+		return
+	}
+	if !validRoles[req.Role] {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Unknown role %q", req.Role))
+		return
+	}
+
+	admin, _ := currentUser(r)
+	if admin.Id == id && req.Role != roleAdmin {
+		writeError(w, http.StatusBadRequest, "Admins cannot remove their own admin role")
+		return
+	}
+
+	err = runAdminUserUpdate(admin.Id, id, "user.role", req, `UPDATE users SET role=$2 WHERE id=$1`, id, req.Role)
+	if err != nil {
+		writeAdminUserError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, response{
+		Id:      id,
+		Message: "User role updated successfully",
+	})
+}
+
+func ForcePasswordReset(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	token, err := randomToken(32)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Unable to generate reset token")
+		return
+	}
+	expires := time.Now().Add(passwordResetTTL)
+
+	admin, _ := currentUser(r)
+	sqlStatement := `UPDATE users SET password_reset_required=true, password_reset_token=$2, password_reset_expires=$3 WHERE id=$1`
+	err = runAdminUserUpdate(admin.Id, id, "user.password_reset", nil, sqlStatement, id, hashToken(token), expires)
+	if err != nil {
+		writeAdminUserError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, models.PasswordResetResponse{
+		Response: models.Response{
+			Status:  "success",
+			Message: "Password reset required on next login",
+		},
+		Reset_token: token,
+		Expires_at:  expires,
+	})
+}
+
+func AdminDeleteUser(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	admin, _ := currentUser(r)
+	if admin.Id == id {
+		writeError(w, http.StatusBadRequest, "Admins cannot delete their own account")
+		return
+	}
+
+	err = runAdminUserUpdate(admin.Id, id, "user.delete", nil, `DELETE FROM users WHERE id=$1`, id)
+	if err != nil {
+		writeAdminUserError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, response{
+		Id:      id,
+		Message: "User deleted successfully",
+	})
+}
+
+var errUserNotFound = errors.New("User not found")
+
+// runAdminUserUpdate executes a single statement against the users table and
+// records it in the audit log within the same transaction.
+func runAdminUserUpdate(actorID int64, userID int64, action string, details any, sqlStatement string, args ...any) error {
+	db := createConnection()
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(sqlStatement, args...)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return errUserNotFound
+	}
+
+	if err := insertAuditLog(tx, actorID, action, "user", userID, details); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func writeAdminUserError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errUserNotFound):
+		writeError(w, http.StatusNotFound, err.Error())
+	case isForeignKeyViolation(err):
+		writeError(w, http.StatusConflict, "User still has related records")
+	default:
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("Unable to execute the query %v", err))
+	}
+}
+
+func ResetPassword(w http.ResponseWriter, r *http.Request) {
+	var req models.PasswordResetRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Unable to decode the request body %v", err))
+		return
+	}
+	if req.Token == "" || req.Password == "" {
+		writeError(w, http.StatusBadRequest, "token and password are required")
+		return
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Unable to hash password")
+		return
+	}
+
+	db := createConnection()
+	defer db.Close()
+
+	sqlStatement := `UPDATE users SET password=$2, password_reset_required=false, password_reset_token=NULL, password_reset_expires=NULL
+	WHERE password_reset_token=$1 AND password_reset_expires > Now() RETURNING id`
+
+	var id int64
+	err = db.QueryRow(sqlStatement, hashToken(req.Token), string(hashedPassword)).Scan(&id)
+	if err == sql.ErrNoRows {
+		writeError(w, http.StatusBadRequest, "Reset token is invalid or expired")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("Unable to execute the query %v", err))
+		return
+	}
+
+	if err := insertAuditLog(db, id, "user.password_changed", "user", id, nil); err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("Unable to write audit log %v", err))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, response{
+		Id:      id,
+		Message: "Password changed successfully",
+	})
+}
+
+func GetAuditLog(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	page, limit := pagination(r)
+
+	var conditions []string
+	var args []any
+	if targetType := query.Get("target_type"); targetType != "" {
+		args = append(args, targetType)
+		conditions = append(conditions, fmt.Sprintf("target_type = $%d", len(args)))
+	}
+	for _, name := range []string{"target_id", "actor_id"} {
+		if value := query.Get(name); value != "" {
+			id, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, fmt.Sprintf("Unable to convert %s into int", name))
+				return
+			}
+			args = append(args, id)
+			conditions = append(conditions, fmt.Sprintf("%s = $%d", name, len(args)))
+		}
+	}
+
+	where := ""
+	if len(conditions) > 0 {
+		where = " WHERE " + strings.Join(conditions, " AND ")
+	}
+	args = append(args, limit, (page-1)*limit)
+	sqlStatement := fmt.Sprintf(`SELECT %s FROM audit_log%s ORDER BY id DESC LIMIT $%d OFFSET $%d`, auditColumns, where, len(args)-1, len(args))
+
+	db := createConnection()
+	defer db.Close()
+
+	entries, err := queryAuditLog(db, sqlStatement, args...)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("Unable to get the audit log %v", err))
+		return
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
+
+const auditColumns = `id, actor_id, action, target_type, target_id, details, created_at`
+
+func queryAuditLog(q dbtx, sqlStatement string, args ...any) ([]models.AuditEntry, error) {
+	rows, err := q.Query(sqlStatement, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []models.AuditEntry{}
+	for rows.Next() {
+		var entry models.AuditEntry
+		var details []byte
+		err := rows.Scan(&entry.Id, &entry.Actor_id, &entry.Action, &entry.Target_type, &entry.Target_id, &details, &entry.Created_at)
+		if err != nil {
+			return nil, err
+		}
+		if len(details) > 0 {
+			entry.Details = json.RawMessage(details)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+func randomToken(size int) (string, error) {
+	buf := make([]byte, size)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
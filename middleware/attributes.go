@@ -0,0 +1,242 @@
+package middleware
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"net/url"
+	"products/models"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var attributeNamePattern = regexp.MustCompile(`^[a-z][a-z0-9_]{0,63}$`)
+
+func validateAttributeSchema(schema models.AttributeSchema) error {
+	seen := map[string]bool{}
+	for i := range schema {
+		definition := &schema[i]
+		definition.Name = strings.ToLower(strings.TrimSpace(definition.Name))
+		if !attributeNamePattern.MatchString(definition.Name) {
+			return validationError(fmt.Sprintf("attribute name %q must start with a letter and contain only lowercase letters, digits and '_'", definition.Name))
+		}
+		if seen[definition.Name] {
+			return validationError(fmt.Sprintf("attribute %q is declared twice", definition.Name))
+		}
+		seen[definition.Name] = true
+
+		switch definition.Type {
+		case models.AttributeString, models.AttributeNumber, models.AttributeInteger, models.AttributeBoolean:
+		case models.AttributeEnum:
+			if len(definition.Allowed_values) == 0 {
+				return validationError(fmt.Sprintf("enum attribute %q needs allowed_values", definition.Name))
+			}
+		default:
+			return validationError(fmt.Sprintf("attribute %q has unknown type %q", definition.Name, definition.Type))
+		}
+	}
+	return nil
+}
+
+// validateProductAttributes checks attribute values against the schema of the
+// product's category and returns them converted to their declared types.
+func validateProductAttributes(q dbtx, categoryID int64, attributes models.Attributes) (models.Attributes, error) {
+	var schema models.AttributeSchema
+	if categoryID != 0 {
+		err := q.QueryRow(`SELECT attribute_schema FROM categories WHERE category_id=$1`, categoryID).Scan(&schema)
+		if err == sql.ErrNoRows {
+			return nil, validationError("Referenced category does not exist")
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	values := models.Attributes{}
+	for name, value := range attributes {
+		if value != nil {
+			values[strings.ToLower(strings.TrimSpace(name))] = value
+		}
+	}
+
+	normalized := models.Attributes{}
+	for _, definition := range schema {
+		value, ok := values[definition.Name]
+		delete(values, definition.Name)
+		if !ok {
+			if definition.Required {
+				return nil, validationError(fmt.Sprintf("attribute %q is required", definition.Name))
+			}
+			continue
+		}
+
+		converted, err := convertAttribute(definition, value)
+		if err != nil {
+			return nil, err
+		}
+		normalized[definition.Name] = converted
+	}
+
+	if len(values) > 0 {
+		var unknown []string
+		for name := range values {
+			unknown = append(unknown, name)
+		}
+		sort.Strings(unknown)
+		return nil, validationError(fmt.Sprintf("attributes not declared by the category: %s", strings.Join(unknown, ", ")))
+	}
+	return normalized, nil
+}
+
+func convertAttribute(definition models.AttributeDefinition, value any) (any, error) {
+	invalid := validationError(fmt.Sprintf("attribute %q must be of type %s", definition.Name, definition.Type))
+
+	switch definition.Type {
+	case models.AttributeNumber:
+		number, ok := value.(float64)
+		if !ok {
+			return nil, invalid
+		}
+		return number, nil
+	case models.AttributeInteger:
+		number, ok := value.(float64)
+		if !ok || number != math.Trunc(number) {
+			return nil, invalid
+		}
+		return int64(number), nil
+	case models.AttributeBoolean:
+		flag, ok := value.(bool)
+		if !ok {
+			return nil, invalid
+		}
+		return flag, nil
+	default:
+		text, ok := value.(string)
+		if !ok {
+			return nil, invalid
+		}
+		text = strings.TrimSpace(text)
+		if definition.Required && text == "" {
+			return nil, validationError(fmt.Sprintf("attribute %q is required", definition.Name))
+		}
+		if len(definition.Allowed_values) > 0 && !containsString(definition.Allowed_values, text) {
+			return nil, validationError(fmt.Sprintf("%q is not an allowed value for attribute %q", text, definition.Name))
+		}
+		return text, nil
+	}
+}
+
+var decimalNumberPattern = regexp.MustCompile(`^[+-]?([0-9]+\.?[0-9]*|\.[0-9]+)([eE][+-]?[0-9]+)?$`)
+
+// isDecimalNumber accepts plain decimal numbers that fit a float64. Unlike
+// strconv.ParseFloat it rejects NaN, infinities and hexadecimal notation,
+// which the numeric cast in filters cannot take.
+func isDecimalNumber(value string) bool {
+	if !decimalNumberPattern.MatchString(value) {
+		return false
+	}
+	number, err := strconv.ParseFloat(value, 64)
+	return err == nil && !math.IsInf(number, 0) && !math.IsNaN(number)
+}
+
+// productFilter narrows GetAllProducts. Attribute filters come from query
+// parameters of the form attr.<name>=value, attr.<name>.min=n and
+// attr.<name>.max=n.
+type productFilter struct {
+	categoryID      int64
+	includeArchived bool
+	attributes      []attributeFilter
+}
+
+type attributeFilter struct {
+	name     string
+	operator string
+	value    string
+}
+
+func parseProductFilter(query url.Values) (productFilter, error) {
+	var filter productFilter
+
+	if value := query.Get("category_id"); value != "" {
+		id, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return filter, validationError("Unable to convert category_id into int")
+		}
+		filter.categoryID = id
+	}
+	if value := query.Get("include_archived"); value != "" {
+		include, err := strconv.ParseBool(value)
+		if err != nil {
+			return filter, validationError("include_archived must be true or false")
+		}
+		filter.includeArchived = include
+	}
+
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if !strings.HasPrefix(key, "attr.") {
+			continue
+		}
+		name := strings.TrimPrefix(key, "attr.")
+		operator := "="
+		if strings.HasSuffix(name, ".min") {
+			name, operator = strings.TrimSuffix(name, ".min"), ">="
+		} else if strings.HasSuffix(name, ".max") {
+			name, operator = strings.TrimSuffix(name, ".max"), "<="
+		}
+		if !attributeNamePattern.MatchString(name) {
+			return filter, validationError(fmt.Sprintf("invalid attribute filter %q", key))
+		}
+
+		value := query.Get(key)
+		if operator != "=" && !isDecimalNumber(value) {
+			return filter, validationError(fmt.Sprintf("%s must be a finite decimal number", key))
+		}
+		filter.attributes = append(filter.attributes, attributeFilter{name: name, operator: operator, value: value})
+	}
+	return filter, nil
+}
+
+// where renders the filter as SQL conditions on the products alias p,
+// appending bind values to args.
+func (f productFilter) where(args []any) ([]string, []any) {
+	var conditions []string
+	if !f.includeArchived {
+		conditions = append(conditions, "p.archived_at IS NULL")
+	}
+	if f.categoryID != 0 {
+		// Secondary categories count as well as the primary one.
+		args = append(args, f.categoryID)
+		conditions = append(conditions, fmt.Sprintf("(p.category_id = $%d OR EXISTS(SELECT 1 FROM product_categories pc WHERE pc.product_id = p.id AND pc.category_id = $%d))", len(args), len(args)))
+	}
+
+	for _, attribute := range f.attributes {
+		args = append(args, attribute.name)
+		nameArg := len(args)
+
+		args = append(args, attribute.value)
+		valueArg := len(args)
+
+		numeric := fmt.Sprintf("(CASE WHEN jsonb_typeof(p.attributes->$%d::text) = 'number' THEN (p.attributes->>$%d::text)::numeric END)", nameArg, nameArg)
+		if attribute.operator != "=" {
+			conditions = append(conditions, fmt.Sprintf("%s %s $%d::text::numeric", numeric, attribute.operator, valueArg))
+			continue
+		}
+
+		// Compare numbers numerically so that 16 matches 16.0, and
+		// everything else by its text representation.
+		if isDecimalNumber(attribute.value) {
+			conditions = append(conditions, fmt.Sprintf("(%s = $%d::text::numeric OR p.attributes->>$%d::text = $%d::text)", numeric, valueArg, nameArg, valueArg))
+			continue
+		}
+		conditions = append(conditions, fmt.Sprintf("p.attributes->>$%d::text = $%d::text", nameArg, valueArg))
+	}
+	return conditions, args
+}
@@ -0,0 +1,588 @@
+package middleware
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"products/models"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Cart statuses. Merged carts were folded into a user's cart at login and
+// ordered carts were checked out.
+const (
+	cartActive  = "active"
+	cartMerged  = "merged"
+	cartOrdered = "ordered"
+)
+
+// Issues reported on cart lines that cannot be checked out as they are.
+const (
+	cartIssueUnavailable       = "unavailable"
+	cartIssueInsufficientStock = "insufficient_stock"
+)
+
+const maxCartLineQuantity = 1000
+
+var (
+	errCartNotFound     = notFoundError("Cart not found")
+	errCartLineNotFound = notFoundError("Cart line not found")
+)
+
+const cartColumns = `id, user_id, currency, COALESCE(coupon_code, ''), created_at, updated_at`
+
+func scanCart(row scanner) (models.Cart, error) {
+	var cart models.Cart
+	err := row.Scan(&cart.Id, &cart.User_id, &cart.Currency, &cart.Coupon_code, &cart.Created_at, &cart.Updated_at)
+	return cart, err
+}
+
+// cartResolver finds the cart a request works on. With create a missing
+// cart is created first; with forUpdate the cart row is locked until the
+// transaction ends.
+type cartResolver func(q dbtx, r *http.Request, create bool, forUpdate bool) (models.Cart, error)
+
+// userCart resolves the active cart of the user in the path, which
+// WithJWTAuth has checked against the token.
+func userCart(q dbtx, r *http.Request, create bool, forUpdate bool) (models.Cart, error) {
+	userID, err := pathID(r, "id")
+	if err != nil {
+		return models.Cart{}, validationError(err.Error())
+	}
+	return getUserCart(q, userID, create, forUpdate)
+}
+
+func getUserCart(q dbtx, userID int64, create bool, forUpdate bool) (models.Cart, error) {
+	if create {
+		sqlStatement := `INSERT INTO carts(user_id, currency, status, created_at, updated_at) VALUES ($1, $2, $3, Now(), Now())
+		ON CONFLICT (user_id) WHERE status = 'active' DO NOTHING`
+		if _, err := q.Exec(sqlStatement, userID, models.BaseCurrency(), cartActive); err != nil {
+			return models.Cart{}, err
+		}
+	}
+	sqlStatement := `SELECT ` + cartColumns + ` FROM carts WHERE user_id=$1 AND status=$2`
+	if forUpdate {
+		sqlStatement += ` FOR UPDATE`
+	}
+	cart, err := scanCart(q.QueryRow(sqlStatement, userID, cartActive))
+	if err == sql.ErrNoRows {
+		// A user without a cart has an empty one.
+		return models.Cart{User_id: &userID, Currency: models.BaseCurrency()}, nil
+	}
+	return cart, err
+}
+
+// tokenCart resolves an anonymous cart by the token in the path. Anonymous
+// carts are created explicitly by CreateAnonymousCart.
+func tokenCart(q dbtx, r *http.Request, create bool, forUpdate bool) (models.Cart, error) {
+	return getTokenCart(q, mux.Vars(r)["token"], forUpdate)
+}
+
+func getTokenCart(q dbtx, token string, forUpdate bool) (models.Cart, error) {
+	sqlStatement := `SELECT ` + cartColumns + ` FROM carts WHERE token_hash=$1 AND user_id IS NULL AND status=$2`
+	if forUpdate {
+		sqlStatement += ` FOR UPDATE`
+	}
+	cart, err := scanCart(q.QueryRow(sqlStatement, hashToken(token), cartActive))
+	if err == sql.ErrNoRows {
+		return cart, errCartNotFound
+	}
+	return cart, err
+}
+
+// priceCart fills in the lines of a cart at current prices and stock, the
+// coupon discount and, when a country is given, the tax. It returns the priced
+// products by id.
+func priceCart(q dbtx, cart *models.Cart, country string, region string) (map[int64]models.Product, error) {
+	cart.Lines = []models.CartLine{}
+	cart.Subtotal = models.NewMoney(0, cart.Currency)
+	cart.Discount = models.NewMoney(0, cart.Currency)
+	cart.Total = cart.Subtotal
+
+	rows, err := q.Query(`SELECT id, product_id, quantity, added_price FROM cart_lines WHERE cart_id=$1 ORDER BY id`, cart.Id)
+	if err != nil {
+		return nil, err
+	}
+	ids := []int64{}
+	for rows.Next() {
+		line := models.CartLine{Added_price: models.NewMoney(0, cart.Currency)}
+		if err := rows.Scan(&line.Id, &line.Product_id, &line.Quantity, &line.Added_price); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		cart.Lines = append(cart.Lines, line)
+		ids = append(ids, line.Product_id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(cart.Lines) == 0 {
+		return nil, nil
+	}
+
+	products, err := loadPricedProducts(q, cart.Currency, ids)
+	if err != nil {
+		return nil, err
+	}
+	cart.Valid = true
+	for i := range cart.Lines {
+		line := &cart.Lines[i]
+		product := products[line.Product_id]
+		line.Product_name = product.Name
+		line.Sku = product.Sku
+		line.Available = product.Available
+		line.Unit_price = sellingPrice(product)
+		line.Price_changed = line.Unit_price.Cmp(line.Added_price) != 0
+		line.Line_total = line.Unit_price.Mul(line.Quantity)
+		if product.Archived_at != nil {
+			line.Issues = append(line.Issues, cartIssueUnavailable)
+		}
+		if line.Quantity > product.Available {
+			line.Issues = append(line.Issues, cartIssueInsufficientStock)
+		}
+		cart.Valid = cart.Valid && len(line.Issues) == 0
+		cart.Subtotal = cart.Subtotal.Add(line.Line_total)
+	}
+
+	if cart.Coupon_code != "" {
+		discount, err := cartCouponDiscount(q, cart)
+		var invalid validationError
+		var notFound notFoundError
+		switch {
+		case errors.As(err, &invalid) || errors.As(err, &notFound):
+			cart.Coupon_error = err.Error()
+		case err != nil:
+			return nil, err
+		default:
+			cart.Discount = discount
+		}
+	}
+	cart.Total = cart.Subtotal.Sub(cart.Discount)
+
+	if country != "" {
+		lines := make([]taxableLine, len(cart.Lines))
+		for i, amount := range allocateDiscount(cart.Lines, cart.Discount) {
+			lines[i] = taxableLine{productID: cart.Lines[i].Product_id, amount: amount}
+		}
+		breakdown, err := calculateTax(q, country, region, lines)
+		if err != nil {
+			return nil, err
+		}
+		cart.Tax = &breakdown
+		cart.Total = breakdown.Gross_total
+	}
+	return products, nil
+}
+
+func cartCouponDiscount(q dbtx, cart *models.Cart) (models.Money, error) {
+	coupon, err := getCouponByCode(q, cart.Coupon_code, false)
+	if err != nil {
+		return models.Money{}, err
+	}
+	return couponDiscount(q, coupon, cart.User_id, cart.Subtotal)
+}
+
+// allocateDiscount spreads an order discount over the lines in proportion to
+// their totals and returns the discounted line amounts. Rounding leftovers go
+// to the last line so the amounts add up exactly.
+func allocateDiscount(lines []models.CartLine, discount models.Money) []models.Money {
+	amounts := make([]models.Money, len(lines))
+	subtotal := models.NewMoney(0, discount.Currency())
+	for _, line := range lines {
+		subtotal = subtotal.Add(line.Line_total)
+	}
+	remaining := discount
+	for i, line := range lines {
+		share := remaining
+		if i < len(lines)-1 && !subtotal.IsZero() {
+			share = models.NewMoney(line.Line_total.Minor()*discount.Minor()/subtotal.Minor(), discount.Currency())
+		}
+		remaining = remaining.Sub(share)
+		amounts[i] = line.Line_total.Sub(share)
+	}
+	return amounts
+}
+
+// checkCartQuantity checks that a product can be bought in quantity.
+func checkCartQuantity(q dbtx, productID int64, quantity int64) error {
+	if quantity <= 0 || quantity > maxCartLineQuantity {
+		return validationError(fmt.Sprintf("quantity must be between 1 and %d", maxCartLineQuantity))
+	}
+	var available int64
+	var archived bool
+	err := q.QueryRow(`SELECT quantity - reserved, archived_at IS NOT NULL FROM products WHERE id=$1`, productID).Scan(&available, &archived)
+	if err == sql.ErrNoRows {
+		return errProductNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if archived {
+		return validationError("Product is no longer available")
+	}
+	if quantity > available {
+		return errInsufficientStock
+	}
+	return nil
+}
+
+// currentUnitPrice is the selling price a line is added at.
+func currentUnitPrice(q dbtx, currency string, productID int64) (models.Money, error) {
+	products, err := loadPricedProducts(q, currency, []int64{productID})
+	if err != nil {
+		return models.Money{}, err
+	}
+	product, ok := products[productID]
+	if !ok {
+		return models.Money{}, errProductNotFound
+	}
+	return sellingPrice(product), nil
+}
+
+// addCartLine adds quantity of a product to a cart, on top of what the
+// cart already holds of it.
+func addCartLine(q dbtx, cart models.Cart, productID int64, quantity int64) error {
+	var current int64
+	err := q.QueryRow(`SELECT quantity FROM cart_lines WHERE cart_id=$1 AND product_id=$2`, cart.Id, productID).Scan(&current)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if err := checkCartQuantity(q, productID, current+quantity); err != nil {
+		return err
+	}
+	price, err := currentUnitPrice(q, cart.Currency, productID)
+	if err != nil {
+		return err
+	}
+
+	sqlStatement := `INSERT INTO cart_lines(cart_id, product_id, quantity, added_price, created_at, updated_at) VALUES ($1, $2, $3, $4, Now(), Now())
+	ON CONFLICT (cart_id, product_id) DO UPDATE SET quantity=cart_lines.quantity+EXCLUDED.quantity, added_price=EXCLUDED.added_price, updated_at=Now()`
+	if _, err := q.Exec(sqlStatement, cart.Id, productID, quantity, price); err != nil {
+		return err
+	}
+	return touchCart(q, cart.Id)
+}
+
+func touchCart(q dbtx, cartID int64) error {
+	_, err := q.Exec(`UPDATE carts SET updated_at=Now() WHERE id=$1`, cartID)
+	return err
+}
+
+// writeCart prices the cart and writes it. The tax breakdown is included
+// when the request names a country.
+func writeCart(w http.ResponseWriter, r *http.Request, q dbtx, cart models.Cart, status int) {
+	query := r.URL.Query()
+	if _, err := priceCart(q, &cart, query.Get("country"), query.Get("region")); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, status, cart)
+}
+
+func getCart(w http.ResponseWriter, r *http.Request, resolve cartResolver) {
+	db := createConnection()
+	defer db.Close()
+
+	cart, err := resolve(db, r, false, false)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeCart(w, r, db, cart, http.StatusOK)
+}
+
+// runCartUpdate locks the cart, applies update and responds with the
+// repriced cart.
+func runCartUpdate(w http.ResponseWriter, r *http.Request, resolve cartResolver, update func(tx *sql.Tx, cart *models.Cart) error) {
+	db := createConnection()
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	defer tx.Rollback()
+
+	cart, err := resolve(tx, r, true, true)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	if err := update(tx, &cart); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	cart, err = resolve(db, r, false, false)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeCart(w, r, db, cart, http.StatusOK)
+}
+
+func addLine(w http.ResponseWriter, r *http.Request, resolve cartResolver) {
+	var req models.CartLineRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Unable to decode the request body %v", err))
+		return
+	}
+	runCartUpdate(w, r, resolve, func(tx *sql.Tx, cart *models.Cart) error {
+		return addCartLine(tx, *cart, req.Product_id, req.Quantity)
+	})
+}
+
+func updateLine(w http.ResponseWriter, r *http.Request, resolve cartResolver) {
+	lineID, err := pathID(r, "lineId")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	var req models.CartLineRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Unable to decode the request body %v", err))
+		return
+	}
+	runCartUpdate(w, r, resolve, func(tx *sql.Tx, cart *models.Cart) error {
+		if req.Quantity == 0 {
+			return deleteCartLine(tx, cart.Id, lineID)
+		}
+		var productID int64
+		err := tx.QueryRow(`SELECT product_id FROM cart_lines WHERE id=$1 AND cart_id=$2`, lineID, cart.Id).Scan(&productID)
+		if err == sql.ErrNoRows {
+			return errCartLineNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if err := checkCartQuantity(tx, productID, req.Quantity); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`UPDATE cart_lines SET quantity=$2, updated_at=Now() WHERE id=$1`, lineID, req.Quantity); err != nil {
+			return err
+		}
+		return touchCart(tx, cart.Id)
+	})
+}
+
+func deleteCartLine(q dbtx, cartID int64, lineID int64) error {
+	res, err := q.Exec(`DELETE FROM cart_lines WHERE id=$1 AND cart_id=$2`, lineID, cartID)
+	if err != nil {
+		return err
+	}
+	if affected, err := res.RowsAffected(); err != nil || affected == 0 {
+		if err == nil {
+			err = errCartLineNotFound
+		}
+		return err
+	}
+	return touchCart(q, cartID)
+}
+
+func removeLine(w http.ResponseWriter, r *http.Request, resolve cartResolver) {
+	lineID, err := pathID(r, "lineId")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	runCartUpdate(w, r, resolve, func(tx *sql.Tx, cart *models.Cart) error {
+		return deleteCartLine(tx, cart.Id, lineID)
+	})
+}
+
+// updateSettings changes the currency or coupon of a cart. Lines are
+// re-priced in a new currency so price changes are reported from there.
+func updateSettings(w http.ResponseWriter, r *http.Request, resolve cartResolver) {
+	var settings models.CartSettings
+	if err := json.NewDecoder(r.Body).Decode(&settings); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Unable to decode the request body %v", err))
+		return
+	}
+	settings.Currency = strings.ToUpper(strings.TrimSpace(settings.Currency))
+	if settings.Currency != "" && !models.ValidCurrency(settings.Currency) {
+		writeError(w, http.StatusBadRequest, "currency must be a three-letter ISO 4217 code")
+		return
+	}
+	settings.Coupon_code = normalizeCouponCode(settings.Coupon_code)
+
+	runCartUpdate(w, r, resolve, func(tx *sql.Tx, cart *models.Cart) error {
+		if settings.Coupon_code != "" {
+			if _, err := getCouponByCode(tx, settings.Coupon_code, false); err != nil {
+				return err
+			}
+		}
+		if settings.Currency != "" && settings.Currency != cart.Currency {
+			if err := repriceCartLines(tx, cart.Id, settings.Currency); err != nil {
+				return err
+			}
+			cart.Currency = settings.Currency
+		}
+		sqlStatement := `UPDATE carts SET currency=$2, coupon_code=NULLIF($3, ''), updated_at=Now() WHERE id=$1`
+		_, err := tx.Exec(sqlStatement, cart.Id, cart.Currency, settings.Coupon_code)
+		return err
+	})
+}
+
+func repriceCartLines(q dbtx, cartID int64, currency string) error {
+	ids, err := queryInt64s(q, `SELECT product_id FROM cart_lines WHERE cart_id=$1`, cartID)
+	if err != nil || len(ids) == 0 {
+		return err
+	}
+	products, err := loadPricedProducts(q, currency, ids)
+	if err != nil {
+		return err
+	}
+	for _, product := range products {
+		if _, err := q.Exec(`UPDATE cart_lines SET added_price=$3 WHERE cart_id=$1 AND product_id=$2`, cartID, product.Id, sellingPrice(product)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func clearCart(w http.ResponseWriter, r *http.Request, resolve cartResolver) {
+	runCartUpdate(w, r, resolve, func(tx *sql.Tx, cart *models.Cart) error {
+		if _, err := tx.Exec(`DELETE FROM cart_lines WHERE cart_id=$1`, cart.Id); err != nil {
+			return err
+		}
+		_, err := tx.Exec(`UPDATE carts SET coupon_code=NULL, updated_at=Now() WHERE id=$1`, cart.Id)
+		return err
+	})
+}
+
+func GetUserCart(w http.ResponseWriter, r *http.Request)        { getCart(w, r, userCart) }
+func AddUserCartLine(w http.ResponseWriter, r *http.Request)    { addLine(w, r, userCart) }
+func UpdateUserCartLine(w http.ResponseWriter, r *http.Request) { updateLine(w, r, userCart) }
+func RemoveUserCartLine(w http.ResponseWriter, r *http.Request) { removeLine(w, r, userCart) }
+func UpdateUserCart(w http.ResponseWriter, r *http.Request)     { updateSettings(w, r, userCart) }
+func ClearUserCart(w http.ResponseWriter, r *http.Request)      { clearCart(w, r, userCart) }
+
+func GetAnonymousCart(w http.ResponseWriter, r *http.Request)        { getCart(w, r, tokenCart) }
+func AddAnonymousCartLine(w http.ResponseWriter, r *http.Request)    { addLine(w, r, tokenCart) }
+func UpdateAnonymousCartLine(w http.ResponseWriter, r *http.Request) { updateLine(w, r, tokenCart) }
+func RemoveAnonymousCartLine(w http.ResponseWriter, r *http.Request) { removeLine(w, r, tokenCart) }
+func UpdateAnonymousCart(w http.ResponseWriter, r *http.Request)     { updateSettings(w, r, tokenCart) }
+func ClearAnonymousCart(w http.ResponseWriter, r *http.Request)      { clearCart(w, r, tokenCart) }
+
+// CreateAnonymousCart starts a cart for a shopper who is not logged in. The
+// token in the response is the only way to reach the cart; only its hash is
+// stored.
+func CreateAnonymousCart(w http.ResponseWriter, r *http.Request) {
+	var settings models.CartSettings
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&settings); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("Unable to decode the request body %v", err))
+			return
+		}
+	}
+	currency := strings.ToUpper(strings.TrimSpace(settings.Currency))
+	if currency == "" {
+		currency = models.BaseCurrency()
+	}
+	if !models.ValidCurrency(currency) {
+		writeError(w, http.StatusBadRequest, "currency must be a three-letter ISO 4217 code")
+		return
+	}
+	token, err := randomToken(24)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	db := createConnection()
+	defer db.Close()
+
+	sqlStatement := `INSERT INTO carts(token_hash, currency, status, created_at, updated_at) VALUES ($1, $2, $3, Now(), Now())
+	RETURNING ` + cartColumns
+	cart, err := scanCart(db.QueryRow(sqlStatement, hashToken(token), currency, cartActive))
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	if _, err := priceCart(db, &cart, "", ""); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, models.AnonymousCart{Token: token, Cart: cart})
+}
+
+// mergeAnonymousCart moves the lines of an anonymous cart into the active
+// cart of a user, adding up quantities of products in both. The user's
+// coupon is kept; the anonymous one is used when the user had none.
+func mergeAnonymousCart(userID int64, token string) error {
+	db := createConnection()
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	anonymous, err := getTokenCart(tx, token, true)
+	if err != nil {
+		return err
+	}
+	// An anonymous cart only creates the user cart in its own currency.
+	sqlStatement := `INSERT INTO carts(user_id, currency, status, created_at, updated_at) VALUES ($1, $2, $3, Now(), Now())
+	ON CONFLICT (user_id) WHERE status = 'active' DO NOTHING`
+	if _, err := tx.Exec(sqlStatement, userID, anonymous.Currency, cartActive); err != nil {
+		return err
+	}
+	cart, err := getUserCart(tx, userID, false, true)
+	if err != nil {
+		return err
+	}
+
+	if cart.Currency != anonymous.Currency {
+		if err := repriceCartLines(tx, anonymous.Id, cart.Currency); err != nil {
+			return err
+		}
+	}
+	sqlStatement = `INSERT INTO cart_lines(cart_id, product_id, quantity, added_price, created_at, updated_at)
+	SELECT $1, product_id, quantity, added_price, created_at, Now() FROM cart_lines WHERE cart_id=$2
+	ON CONFLICT (cart_id, product_id) DO UPDATE SET quantity=LEAST(cart_lines.quantity+EXCLUDED.quantity, $3), updated_at=Now()`
+	if _, err := tx.Exec(sqlStatement, cart.Id, anonymous.Id, maxCartLineQuantity); err != nil {
+		return err
+	}
+	sqlStatement = `UPDATE carts SET coupon_code=COALESCE(coupon_code, NULLIF($2, '')), updated_at=Now() WHERE id=$1`
+	if _, err := tx.Exec(sqlStatement, cart.Id, anonymous.Coupon_code); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE carts SET status=$2, updated_at=Now() WHERE id=$1`, anonymous.Id, cartMerged); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// mergeCartAtLogin merges the anonymous cart a shopper brought to login.
+// Failing to merge never fails the login itself.
+func mergeCartAtLogin(userID int64, token string) {
+	if token == "" {
+		return
+	}
+	if err := mergeAnonymousCart(userID, token); err != nil && !errors.Is(err, errCartNotFound) {
+		log.Printf("Unable to merge cart into user %d: %v", userID, err)
+	}
+}
+
+// expireAnonymousCarts deletes anonymous carts that were not touched for
+// CART_TTL and carts that were merged.
+func expireAnonymousCarts(db *sql.DB) error {
+	ttl := durationFromEnv("CART_TTL", 30*24*time.Hour)
+	sqlStatement := `DELETE FROM carts WHERE user_id IS NULL AND (status=$1 OR updated_at < Now() - make_interval(secs => $2))`
+	_, err := db.Exec(sqlStatement, cartMerged, int64(ttl/time.Second))
+	return err
+}
@@ -0,0 +1,45 @@
+package middleware
+
+import (
+	"products/models"
+	"testing"
+)
+
+func TestAllocateDiscount(t *testing.T) {
+	tests := []struct {
+		name     string
+		totals   []int64
+		discount int64
+		want     []int64
+	}{
+		{"no discount", []int64{1000, 2000}, 0, []int64{1000, 2000}},
+		{"single line", []int64{1999}, 500, []int64{1499}},
+		{"proportional", []int64{1000, 3000}, 400, []int64{900, 2700}},
+		{"leftover to last line", []int64{1000, 1000, 1000}, 100, []int64{967, 967, 966}},
+		{"whole subtotal", []int64{333, 667}, 1000, []int64{0, 0}},
+		{"zero subtotal", []int64{0, 0}, 0, []int64{0, 0}},
+		{"no lines", nil, 0, []int64{}},
+	}
+	for _, tt := range tests {
+		lines := make([]models.CartLine, len(tt.totals))
+		for i, total := range tt.totals {
+			lines[i].Line_total = models.NewMoney(total, "EUR")
+		}
+		amounts := allocateDiscount(lines, models.NewMoney(tt.discount, "EUR"))
+		if len(amounts) != len(tt.want) {
+			t.Errorf("%s: allocateDiscount returned %d amounts, want %d", tt.name, len(amounts), len(tt.want))
+			continue
+		}
+		var before, after int64
+		for i, amount := range amounts {
+			if amount.Minor() != tt.want[i] {
+				t.Errorf("%s: line %d = %d, want %d", tt.name, i, amount.Minor(), tt.want[i])
+			}
+			before += tt.totals[i]
+			after += amount.Minor()
+		}
+		if before-after != tt.discount {
+			t.Errorf("%s: lines were discounted by %d, want %d", tt.name, before-after, tt.discount)
+		}
+	}
+}
@@ -0,0 +1,297 @@
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"products/models"
+	"strconv"
+)
+
+type categoryDeleteStrategy string
+
+const (
+	// deleteRefuse fails with a conflict when products still use the category.
+	deleteRefuse categoryDeleteStrategy = "refuse"
+	// deleteReassign moves the products to another category first.
+	deleteReassign categoryDeleteStrategy = "reassign"
+	// deleteArchive archives the products and detaches them from the category.
+	deleteArchive categoryDeleteStrategy = "archive"
+)
+
+func (s categoryDeleteStrategy) pastTense() string {
+	switch s {
+	case deleteReassign:
+		return "reassigned"
+	case deleteArchive:
+		return "archived"
+	default:
+		return "affected"
+	}
+}
+
+type categoryDeleteOptions struct {
+	strategy categoryDeleteStrategy
+	targetID int64
+}
+
+// categoryInUseError lists what still references a category that cannot be
+// deleted.
+type categoryInUseError struct {
+	message  string
+	products []models.ProductRef
+	children []int64
+}
+
+func (e *categoryInUseError) Error() string {
+	return e.message
+}
+
+func parseCategoryDeleteOptions(query url.Values) (categoryDeleteOptions, error) {
+	options := categoryDeleteOptions{strategy: deleteRefuse}
+	if value := query.Get("strategy"); value != "" {
+		options.strategy = categoryDeleteStrategy(value)
+	}
+
+	switch options.strategy {
+	case deleteRefuse, deleteArchive:
+	case deleteReassign:
+		target, err := strconv.ParseInt(query.Get("target"), 10, 64)
+		if err != nil {
+			return options, validationError("strategy=reassign requires a numeric target category")
+		}
+		options.targetID = target
+	default:
+		return options, validationError(fmt.Sprintf("unknown strategy %q, expected refuse, reassign or archive", options.strategy))
+	}
+	return options, nil
+}
+
+// deleteCategory removes a category after dealing with the products that
+// reference it according to the chosen strategy. Everything happens in one
+// transaction so a failure leaves products and categories untouched.
+func deleteCategory(id int64, options categoryDeleteOptions) (int64, error) {
+	db := createConnection()
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if _, err := lockCategoryTree(tx, id); err != nil {
+		return 0, err
+	}
+
+	children, err := queryInt64s(tx, `SELECT category_id FROM categories WHERE parent_id=$1 ORDER BY category_id`, id)
+	if err != nil {
+		return 0, err
+	}
+	if len(children) > 0 {
+		return 0, &categoryInUseError{
+			message:  "Category has subcategories, move or delete them first",
+			children: children,
+		}
+	}
+
+	sqlStatement := `SELECT p.id, p.name, p.sku FROM products p
+	WHERE p.category_id=$1 OR EXISTS(SELECT 1 FROM product_categories pc WHERE pc.product_id=p.id AND pc.category_id=$1)
+	ORDER BY p.id FOR UPDATE OF p`
+	rows, err := tx.Query(sqlStatement, id)
+	if err != nil {
+		return 0, err
+	}
+	products := []models.ProductRef{}
+	for rows.Next() {
+		var product models.ProductRef
+		if err := rows.Scan(&product.Id, &product.Name, &product.Sku); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		products = append(products, product)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	switch options.strategy {
+	case deleteRefuse:
+		if len(products) > 0 {
+			return 0, &categoryInUseError{
+				message:  fmt.Sprintf("Category is used by %d products", len(products)),
+				products: products,
+			}
+		}
+	case deleteReassign:
+		if options.targetID == id {
+			return 0, validationError("target must be a different category")
+		}
+		if _, err := getCategoryByID(tx, options.targetID); err != nil {
+			if err == errCategoryNotFound {
+				return 0, validationError("Target category does not exist")
+			}
+			return 0, err
+		}
+		if err := conformPrimaryCategory(tx, id, options.targetID); err != nil {
+			return 0, err
+		}
+		if err := reassignCategoryLinks(tx, id, options.targetID); err != nil {
+			return 0, err
+		}
+	case deleteArchive:
+		// Only products whose primary category is deleted are archived;
+		// products merely linked to it keep their other categories.
+		sqlStatement := `UPDATE products SET category_id=NULL, archived_at=COALESCE(archived_at, Now()), updated=Now() WHERE category_id=$1`
+		if _, err := tx.Exec(sqlStatement, id); err != nil {
+			return 0, err
+		}
+		if _, err := tx.Exec(`DELETE FROM product_categories WHERE category_id=$1`, id); err != nil {
+			return 0, err
+		}
+	}
+
+	if _, err := tx.Exec(`DELETE FROM categories WHERE category_id=$1`, id); err != nil {
+		return 0, err
+	}
+	return int64(len(products)), tx.Commit()
+}
+
+// conformPrimaryCategory moves the products whose primary category is fromID
+// to toID, which may be the same category after its schema changed. Attribute
+// values the target does not declare are dropped; products that would still be
+// invalid against its schema, for example because they lack a required
+// attribute, make the move fail with their ids.
+func conformPrimaryCategory(tx dbtx, fromID int64, toID int64) error {
+	rows, err := tx.Query(`SELECT id, name, sku, attributes FROM products WHERE category_id=$1 ORDER BY id FOR UPDATE`, fromID)
+	if err != nil {
+		return err
+	}
+	type move struct {
+		product    models.ProductRef
+		attributes models.Attributes
+	}
+	var moves []move
+	for rows.Next() {
+		var item move
+		if err := rows.Scan(&item.product.Id, &item.product.Name, &item.product.Sku, &item.attributes); err != nil {
+			rows.Close()
+			return err
+		}
+		moves = append(moves, item)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	var schema models.AttributeSchema
+	if err := tx.QueryRow(`SELECT attribute_schema FROM categories WHERE category_id=$1`, toID).Scan(&schema); err != nil {
+		return err
+	}
+	declared := map[string]bool{}
+	for _, definition := range schema {
+		declared[definition.Name] = true
+	}
+
+	invalid := []models.ProductRef{}
+	for i := range moves {
+		kept := models.Attributes{}
+		for name, value := range moves[i].attributes {
+			if declared[name] {
+				kept[name] = value
+			}
+		}
+		normalized, err := validateProductAttributes(tx, toID, kept)
+		var validation validationError
+		if errors.As(err, &validation) {
+			invalid = append(invalid, moves[i].product)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		moves[i].attributes = normalized
+	}
+	if len(invalid) > 0 {
+		return &categoryInUseError{
+			message:  fmt.Sprintf("%d products do not satisfy the attribute schema of the category", len(invalid)),
+			products: invalid,
+		}
+	}
+
+	for _, item := range moves {
+		sqlStatement := `UPDATE products SET category_id=$2, attributes=$3, updated=Now() WHERE id=$1`
+		if _, err := tx.Exec(sqlStatement, item.product.Id, toID, item.attributes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reassignCategoryLinks moves product_categories rows from one category to
+// another, keeping the primary flag and merging with existing links.
+func reassignCategoryLinks(tx dbtx, fromID int64, toID int64) error {
+	rows, err := tx.Query(`DELETE FROM product_categories WHERE category_id=$1 RETURNING product_id, is_primary, position`, fromID)
+	if err != nil {
+		return err
+	}
+	var links []models.ProductCategory
+	for rows.Next() {
+		var link models.ProductCategory
+		if err := rows.Scan(&link.Product_id, &link.Is_primary, &link.Position); err != nil {
+			rows.Close()
+			return err
+		}
+		links = append(links, link)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	sqlStatement := `INSERT INTO product_categories(product_id, category_id, is_primary, position, created_at) VALUES ($1, $2, $3, $4, Now())
+	ON CONFLICT (product_id, category_id) DO UPDATE SET is_primary = product_categories.is_primary OR EXCLUDED.is_primary`
+	for _, link := range links {
+		if _, err := tx.Exec(sqlStatement, link.Product_id, toID, link.Is_primary, link.Position); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeCategoryInUseError(w http.ResponseWriter, err error) {
+	inUse, ok := err.(*categoryInUseError)
+	if !ok {
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusConflict, models.CategoryConflictResponse{
+		Response: models.Response{
+			Status:  "error",
+			Message: inUse.message,
+		},
+		Products: inUse.products,
+		Children: inUse.children,
+	})
+}
+
+func queryInt64s(q dbtx, sqlStatement string, args ...any) ([]int64, error) {
+	rows, err := q.Query(sqlStatement, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var values []int64
+	for rows.Next() {
+		var value int64
+		if err := rows.Scan(&value); err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, rows.Err()
+}
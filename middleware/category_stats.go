@@ -0,0 +1,101 @@
+package middleware
+
+import (
+	"database/sql"
+	"net/http"
+	"products/models"
+	"strconv"
+)
+
+// categoryStatsQuery returns every category with aggregates over its own
+// products (direct) and over the products of its whole subtree (rollup).
+// A product is in stock when units are available after reservations, as in
+// its available field. Archived products are ignored and a product linked to
+// several categories in the same subtree is only counted once in the rollup.
+const categoryStatsQuery = `WITH live AS (
+		SELECT p.id, p.price,
+		(p.quantity - p.reserved > 0 OR EXISTS(SELECT 1 FROM product_variants v WHERE v.product_id = p.id AND v.quantity > 0)) AS in_stock
+		FROM products p WHERE p.archived_at IS NULL
+	), direct AS (
+		SELECT pc.category_id, COUNT(*) AS product_count, COUNT(*) FILTER (WHERE l.in_stock) AS in_stock_count,
+		MIN(l.price) AS min_price, MAX(l.price) AS max_price, AVG(l.price) AS avg_price
+		FROM product_categories pc JOIN live l ON l.id = pc.product_id
+		GROUP BY pc.category_id
+	), rollup AS (
+		SELECT x.category_id, COUNT(*) AS product_count, COUNT(*) FILTER (WHERE x.in_stock) AS in_stock_count,
+		MIN(x.price) AS min_price, MAX(x.price) AS max_price, AVG(x.price) AS avg_price
+		FROM (
+			SELECT DISTINCT a.category_id, l.id, l.price, l.in_stock
+			FROM categories a
+			JOIN categories d ON d.path LIKE a.path || '%'
+			JOIN product_categories pc ON pc.category_id = d.category_id
+			JOIN live l ON l.id = pc.product_id
+		) x
+		GROUP BY x.category_id
+	)
+	SELECT ` + categoryColumns + `,
+	d.product_count, d.in_stock_count, d.min_price, d.max_price, d.avg_price,
+	r.product_count, r.in_stock_count, r.min_price, r.max_price, r.avg_price
+	FROM categories c
+	LEFT JOIN direct d ON d.category_id = c.category_id
+	LEFT JOIN rollup r ON r.category_id = c.category_id`
+
+// nullAggregate receives one LEFT JOINed aggregate, which is NULL for
+// categories without products.
+type nullAggregate struct {
+	count    sql.NullInt64
+	inStock  sql.NullInt64
+	minPrice *models.Money
+	maxPrice *models.Money
+	avgPrice *models.Money
+}
+
+func (a *nullAggregate) dest() []any {
+	return []any{&a.count, &a.inStock, &a.minPrice, &a.maxPrice, &a.avgPrice}
+}
+
+func (a *nullAggregate) value() models.ProductAggregate {
+	return models.ProductAggregate{
+		Product_count:  a.count.Int64,
+		In_stock_count: a.inStock.Int64,
+		Min_price:      a.minPrice,
+		Max_price:      a.maxPrice,
+		Avg_price:      a.avgPrice,
+	}
+}
+
+func getCategoriesWithStats(q dbtx, orderBy string) ([]models.Category, error) {
+	rows, err := q.Query(categoryStatsQuery + ` ORDER BY ` + orderBy)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	categories := []models.Category{}
+	for rows.Next() {
+		var direct, rollup nullAggregate
+		category, err := scanCategory(rows, append(direct.dest(), rollup.dest()...)...)
+		if err != nil {
+			return nil, err
+		}
+		category.Stats = &models.CategoryStats{
+			Direct: direct.value(),
+			Rollup: rollup.value(),
+		}
+		categories = append(categories, category)
+	}
+	return categories, rows.Err()
+}
+
+// wantsStats reports whether the request asked for ?stats=true.
+func wantsStats(r *http.Request) (bool, error) {
+	value := r.URL.Query().Get("stats")
+	if value == "" {
+		return false, nil
+	}
+	stats, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, validationError("stats must be true or false")
+	}
+	return stats, nil
+}
@@ -0,0 +1,541 @@
+package middleware
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"products/models"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	couponAlphabet      = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+	defaultCouponLength = 10
+	maxCouponBatch      = 10000
+)
+
+var (
+	errCouponNotFound           = notFoundError("Coupon not found")
+	errCouponRedemptionNotFound = notFoundError("Coupon redemption not found")
+	// errCouponInvalid is the one answer shoppers get for unknown, inactive
+	// and expired codes, so codes cannot be probed for.
+	errCouponInvalid = validationError("Coupon code is not valid")
+
+	couponCodePattern = regexp.MustCompile(`^[A-Z0-9][A-Z0-9-]{2,63}$`)
+)
+
+const couponColumns = `id, code, description, discount_type, percentage, amount, min_order, max_uses, max_uses_per_user,
+	times_used, expires_at, active, batch, created_at, updated_at`
+
+func scanCoupon(row scanner) (models.Coupon, error) {
+	var coupon models.Coupon
+	var percentage sql.NullString
+	err := row.Scan(&coupon.Id, &coupon.Code, &coupon.Description, &coupon.Discount_type, &percentage, &coupon.Amount, &coupon.Min_order,
+		&coupon.Max_uses, &coupon.Max_uses_per_user, &coupon.Times_used, &coupon.Expires_at, &coupon.Active, &coupon.Batch,
+		&coupon.Created_at, &coupon.Updated_at)
+	coupon.Percentage = percentage.String
+	return coupon, err
+}
+
+func normalizeCouponCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// getCouponByCode looks a coupon up by its code. With forUpdate the row stays
+// locked until the transaction ends, which serializes redemptions of a code.
+func getCouponByCode(q dbtx, code string, forUpdate bool) (models.Coupon, error) {
+	sqlStatement := `SELECT ` + couponColumns + ` FROM coupons WHERE code=$1`
+	if forUpdate {
+		sqlStatement += ` FOR UPDATE`
+	}
+	coupon, err := scanCoupon(q.QueryRow(sqlStatement, normalizeCouponCode(code)))
+	if err == sql.ErrNoRows {
+		return coupon, errCouponInvalid
+	}
+	return coupon, err
+}
+
+// couponDiscount checks that a coupon can be used by a user on an order with
+// the given subtotal and returns the discount it gives. userID is nil for
+// anonymous shoppers, who cannot use coupons capped per user because their
+// redemptions could not be counted.
+func couponDiscount(q dbtx, coupon models.Coupon, userID *int64, subtotal models.Money) (models.Money, error) {
+	var discount models.Money
+	if !coupon.Active || (coupon.Expires_at != nil && !coupon.Expires_at.After(time.Now())) {
+		return discount, errCouponInvalid
+	}
+	if coupon.Max_uses != nil && coupon.Times_used >= *coupon.Max_uses {
+		return discount, validationError("Coupon has already been used up")
+	}
+	if coupon.Max_uses_per_user != nil {
+		if userID == nil {
+			return discount, validationError("Sign in to use this coupon")
+		}
+		var used int64
+		err := q.QueryRow(`SELECT count(*) FROM coupon_redemptions WHERE coupon_id=$1 AND user_id=$2 AND released_at IS NULL`, coupon.Id, *userID).Scan(&used)
+		if err != nil {
+			return discount, err
+		}
+		if used >= *coupon.Max_uses_per_user {
+			return discount, validationError("Coupon has already been used the maximum number of times by this user")
+		}
+	}
+
+	// Amounts on the coupon are in the base currency.
+	rate, err := getExchangeRate(q, subtotal.Currency())
+	if err != nil {
+		return discount, err
+	}
+	if rate == nil {
+		return discount, validationError(fmt.Sprintf("No exchange rate for %s", subtotal.Currency()))
+	}
+	if subtotal.Cmp(coupon.Min_order.Convert(rate, subtotal.Currency())) < 0 {
+		return discount, validationError(fmt.Sprintf("Coupon requires a minimum order of %s %s", coupon.Min_order, coupon.Min_order.Currency()))
+	}
+	return discountValue(coupon.Discount_type, coupon.Percentage, coupon.Amount, rate, subtotal)
+}
+
+// redeemCoupon uses a coupon once. The coupon row is locked while the caps
+// are checked and the counter is bumped, so concurrent checkouts cannot
+// redeem a code more often than allowed. It must run inside the transaction
+// that places the order.
+func redeemCoupon(q dbtx, code string, userID *int64, subtotal models.Money, reference string) (models.CouponRedemption, error) {
+	var redemption models.CouponRedemption
+	coupon, err := getCouponByCode(q, code, true)
+	if err != nil {
+		return redemption, err
+	}
+	discount, err := couponDiscount(q, coupon, userID, subtotal)
+	if err != nil {
+		return redemption, err
+	}
+
+	if _, err := q.Exec(`UPDATE coupons SET times_used=times_used+1, updated_at=Now() WHERE id=$1`, coupon.Id); err != nil {
+		return redemption, err
+	}
+	sqlStatement := `INSERT INTO coupon_redemptions(coupon_id, user_id, reference, discount, created_at)
+	VALUES ($1, $2, $3, $4, Now()) RETURNING id, created_at`
+	redemption = models.CouponRedemption{Coupon_id: coupon.Id, Code: coupon.Code, User_id: userID, Reference: reference, Discount: discount}
+	err = q.QueryRow(sqlStatement, coupon.Id, userID, reference, discount).Scan(&redemption.Id, &redemption.Created_at)
+	return redemption, err
+}
+
+// releaseCouponRedemption gives a redemption back, for example when the
+// order that used it is cancelled.
+func releaseCouponRedemption(q dbtx, redemptionID int64) error {
+	var couponID int64
+	sqlStatement := `UPDATE coupon_redemptions SET released_at=Now() WHERE id=$1 AND released_at IS NULL RETURNING coupon_id`
+	err := q.QueryRow(sqlStatement, redemptionID).Scan(&couponID)
+	if err == sql.ErrNoRows {
+		return errCouponRedemptionNotFound
+	}
+	if err != nil {
+		return err
+	}
+	_, err = q.Exec(`UPDATE coupons SET times_used=times_used-1, updated_at=Now() WHERE id=$1`, couponID)
+	return err
+}
+
+func normalizeCoupon(coupon *models.Coupon) error {
+	coupon.Code = normalizeCouponCode(coupon.Code)
+	if !couponCodePattern.MatchString(coupon.Code) {
+		return validationError("code must be 3 to 64 letters, digits or dashes")
+	}
+	var err error
+	coupon.Percentage, coupon.Amount, err = normalizeDiscount(coupon.Discount_type, coupon.Percentage, coupon.Amount)
+	if err != nil {
+		return err
+	}
+	if err := checkBasePrice("min_order", coupon.Min_order); err != nil {
+		return err
+	}
+	if coupon.Max_uses != nil && *coupon.Max_uses <= 0 {
+		return validationError("max_uses must be positive")
+	}
+	if coupon.Max_uses_per_user != nil && *coupon.Max_uses_per_user <= 0 {
+		return validationError("max_uses_per_user must be positive")
+	}
+	coupon.Batch = strings.TrimSpace(coupon.Batch)
+	return nil
+}
+
+// randomCouponCode returns prefix followed by length characters that are
+// easy to read out, leaving out 0/O and 1/I.
+func randomCouponCode(prefix string, length int) (string, error) {
+	buf := make([]byte, length)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	for i, b := range buf {
+		buf[i] = couponAlphabet[int(b)%len(couponAlphabet)]
+	}
+	return prefix + string(buf), nil
+}
+
+func insertCoupon(q dbtx, coupon models.Coupon) (int64, error) {
+	sqlStatement := `INSERT INTO coupons(code, description, discount_type, percentage, amount, min_order, max_uses, max_uses_per_user,
+	expires_at, active, batch, created_at, updated_at)
+	VALUES ($1, $2, $3, NULLIF($4, '')::numeric, $5, $6, $7, $8, $9, $10, $11, Now(), Now()) RETURNING id`
+	var id int64
+	err := q.QueryRow(sqlStatement, coupon.Code, coupon.Description, coupon.Discount_type, coupon.Percentage, coupon.Amount, coupon.Min_order,
+		coupon.Max_uses, coupon.Max_uses_per_user, coupon.Expires_at, coupon.Active, coupon.Batch).Scan(&id)
+	return id, err
+}
+
+func GetAllCoupons(w http.ResponseWriter, r *http.Request) {
+	page, limit := pagination(r)
+
+	db := createConnection()
+	defer db.Close()
+
+	sqlStatement := `SELECT ` + couponColumns + ` FROM coupons WHERE ($1::text = '' OR batch = $1) ORDER BY id DESC LIMIT $2 OFFSET $3`
+	rows, err := db.Query(sqlStatement, r.URL.Query().Get("batch"), limit, (page-1)*limit)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	defer rows.Close()
+
+	coupons := []models.Coupon{}
+	for rows.Next() {
+		coupon, err := scanCoupon(rows)
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		coupons = append(coupons, coupon)
+	}
+	if err := rows.Err(); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, coupons)
+}
+
+func GetCoupon(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	db := createConnection()
+	defer db.Close()
+
+	coupon, err := scanCoupon(db.QueryRow(`SELECT `+couponColumns+` FROM coupons WHERE id=$1`, id))
+	if err == sql.ErrNoRows {
+		err = errCouponNotFound
+	}
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, coupon)
+}
+
+// CreateCoupon creates a single coupon. Without a code one is generated.
+func CreateCoupon(w http.ResponseWriter, r *http.Request) {
+	coupon := models.Coupon{Active: true}
+	if err := json.NewDecoder(r.Body).Decode(&coupon); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Unable to decode the request body %v", err))
+		return
+	}
+	if strings.TrimSpace(coupon.Code) == "" {
+		code, err := randomCouponCode("", defaultCouponLength)
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		coupon.Code = code
+	}
+	if err := normalizeCoupon(&coupon); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	db := createConnection()
+	defer db.Close()
+
+	id, err := insertCoupon(db, coupon)
+	if isUniqueViolation(err) {
+		writeError(w, http.StatusConflict, "A coupon with this code already exists")
+		return
+	}
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, response{
+		Id:      id,
+		Message: "Coupon created successfully",
+	})
+}
+
+// GenerateCoupons creates count coupons with random unique codes from one
+// template. Codes that collide with existing ones are drawn again.
+func GenerateCoupons(w http.ResponseWriter, r *http.Request) {
+	req := models.CouponBatchRequest{Template: models.Coupon{Active: true}}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Unable to decode the request body %v", err))
+		return
+	}
+	if req.Count <= 0 || req.Count > maxCouponBatch {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("count must be between 1 and %d", maxCouponBatch))
+		return
+	}
+	if req.Length == 0 {
+		req.Length = defaultCouponLength
+	}
+	if req.Length < 6 || req.Length > 32 {
+		writeError(w, http.StatusBadRequest, "length must be between 6 and 32")
+		return
+	}
+	prefix := normalizeCouponCode(req.Prefix)
+	if req.Batch = strings.TrimSpace(req.Batch); req.Batch == "" {
+		req.Batch = fmt.Sprintf("%s%s", prefix, time.Now().UTC().Format("20060102150405"))
+	}
+
+	template := req.Template
+	template.Code = prefix + strings.Repeat("A", req.Length)
+	template.Batch = req.Batch
+	if err := normalizeCoupon(&template); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	db := createConnection()
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	defer tx.Rollback()
+
+	batch := models.CouponBatch{Batch: req.Batch, Codes: make([]string, 0, req.Count)}
+	sqlStatement := `INSERT INTO coupons(code, description, discount_type, percentage, amount, min_order, max_uses, max_uses_per_user,
+	expires_at, active, batch, created_at, updated_at)
+	SELECT code, $2, $3, NULLIF($4, '')::numeric, $5, $6, $7, $8, $9, $10, $11, Now(), Now() FROM unnest($1::text[]) AS code
+	ON CONFLICT (code) DO NOTHING RETURNING code`
+	for attempt := 0; len(batch.Codes) < req.Count; attempt++ {
+		if attempt == 5 {
+			writeError(w, http.StatusConflict, "Unable to generate enough unique codes, use a longer length")
+			return
+		}
+		codes := make([]string, 0, req.Count-len(batch.Codes))
+		seen := map[string]bool{}
+		for len(codes) < cap(codes) {
+			code, err := randomCouponCode(prefix, req.Length)
+			if err != nil {
+				writeStoreError(w, err)
+				return
+			}
+			if !seen[code] {
+				seen[code] = true
+				codes = append(codes, code)
+			}
+		}
+		rows, err := tx.Query(sqlStatement, pq.Array(codes), template.Description, template.Discount_type, template.Percentage, template.Amount,
+			template.Min_order, template.Max_uses, template.Max_uses_per_user, template.Expires_at, template.Active, template.Batch)
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		for rows.Next() {
+			var code string
+			if err := rows.Scan(&code); err != nil {
+				rows.Close()
+				writeStoreError(w, err)
+				return
+			}
+			batch.Codes = append(batch.Codes, code)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			writeStoreError(w, err)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, batch)
+}
+
+func UpdateCoupon(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	coupon := models.Coupon{Active: true}
+	if err := json.NewDecoder(r.Body).Decode(&coupon); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Unable to decode the request body %v", err))
+		return
+	}
+	if err := normalizeCoupon(&coupon); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	db := createConnection()
+	defer db.Close()
+
+	sqlStatement := `UPDATE coupons SET code=$2, description=$3, discount_type=$4, percentage=NULLIF($5, '')::numeric, amount=$6, min_order=$7,
+	max_uses=$8, max_uses_per_user=$9, expires_at=$10, active=$11, batch=$12, updated_at=Now() WHERE id=$1`
+	res, err := db.Exec(sqlStatement, id, coupon.Code, coupon.Description, coupon.Discount_type, coupon.Percentage, coupon.Amount, coupon.Min_order,
+		coupon.Max_uses, coupon.Max_uses_per_user, coupon.Expires_at, coupon.Active, coupon.Batch)
+	if isUniqueViolation(err) {
+		writeError(w, http.StatusConflict, "A coupon with this code already exists")
+		return
+	}
+	if err != nil {
+		// Lowering max_uses below times_used violates coupons_usage_check.
+		writeStoreError(w, err)
+		return
+	}
+	if affected, err := res.RowsAffected(); err != nil || affected == 0 {
+		if err == nil {
+			err = errCouponNotFound
+		}
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, response{
+		Id:      id,
+		Message: "Coupon updated successfully",
+	})
+}
+
+// DeleteCoupon removes a coupon that was never redeemed. Used coupons
+// should be deactivated instead.
+func DeleteCoupon(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	db := createConnection()
+	defer db.Close()
+
+	res, err := db.Exec(`DELETE FROM coupons WHERE id=$1`, id)
+	if isForeignKeyViolation(err) {
+		writeError(w, http.StatusConflict, "Coupon has been redeemed, deactivate it instead")
+		return
+	}
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	if affected, err := res.RowsAffected(); err != nil || affected == 0 {
+		if err == nil {
+			err = errCouponNotFound
+		}
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, response{
+		Id:      id,
+		Message: "Coupon deleted successfully",
+	})
+}
+
+func GetCouponRedemptions(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	page, limit := pagination(r)
+
+	db := createConnection()
+	defer db.Close()
+
+	sqlStatement := `SELECT ` + redemptionColumns + ` FROM coupon_redemptions cr JOIN coupons c ON c.id = cr.coupon_id
+	WHERE cr.coupon_id=$1 ORDER BY cr.id DESC LIMIT $2 OFFSET $3`
+	redemptions, err := queryRedemptions(db, sqlStatement, id, limit, (page-1)*limit)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, redemptions)
+}
+
+// redemptionColumns are read from coupon_redemptions cr joined to coupons c.
+const redemptionColumns = `cr.id, cr.coupon_id, c.code, cr.user_id, cr.reference, cr.discount, cr.created_at, cr.released_at`
+
+func queryRedemptions(q dbtx, sqlStatement string, args ...any) ([]models.CouponRedemption, error) {
+	rows, err := q.Query(sqlStatement, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	redemptions := []models.CouponRedemption{}
+	for rows.Next() {
+		var redemption models.CouponRedemption
+		err := rows.Scan(&redemption.Id, &redemption.Coupon_id, &redemption.Code, &redemption.User_id, &redemption.Reference, &redemption.Discount, &redemption.Created_at, &redemption.Released_at)
+		if err != nil {
+			return nil, err
+		}
+		redemptions = append(redemptions, redemption)
+	}
+	return redemptions, rows.Err()
+}
+
+// CheckCoupon quotes the discount a code gives on a subtotal without
+// redeeming it.
+func CheckCoupon(w http.ResponseWriter, r *http.Request) {
+	var req models.CouponCheckRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Unable to decode the request body %v", err))
+		return
+	}
+	if req.Subtotal.IsNegative() {
+		writeError(w, http.StatusBadRequest, "subtotal must not be negative")
+		return
+	}
+	// The route is public; a token is optional and only adds the per-user cap.
+	var userID *int64
+	if r.Header.Get("x-jwt-token") != "" {
+		user, err := authenticate(r)
+		if err != nil {
+			writeError(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+		if !checkAccount(w, user) {
+			return
+		}
+		userID = &user.Id
+	}
+
+	db := createConnection()
+	defer db.Close()
+
+	coupon, err := getCouponByCode(db, req.Code, false)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	discount, err := couponDiscount(db, coupon, userID, req.Subtotal)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, models.CouponQuote{
+		Code:     coupon.Code,
+		Subtotal: req.Subtotal,
+		Discount: discount,
+		Total:    req.Subtotal.Sub(discount),
+	})
+}
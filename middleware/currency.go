@@ -0,0 +1,651 @@
+package middleware
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"products/models"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// Price sources reported on products priced in a non-base currency.
+const (
+	priceSourceList      = "price_list"
+	priceSourceConverted = "converted"
+)
+
+const maxExchangeRateFileBytes = 1 << 20
+
+var (
+	errExchangeRateNotFound = notFoundError("Exchange rate not found")
+	errProductPriceNotFound = notFoundError("Product has no price in this currency")
+)
+
+// requestedCurrency reads the currency query parameter, defaulting to the
+// base currency.
+func requestedCurrency(r *http.Request) (string, error) {
+	currency := strings.ToUpper(strings.TrimSpace(r.URL.Query().Get("currency")))
+	if currency == "" {
+		return models.BaseCurrency(), nil
+	}
+	if !models.ValidCurrency(currency) {
+		return "", validationError("currency must be a three-letter ISO 4217 code")
+	}
+	return currency, nil
+}
+
+func pathCurrency(r *http.Request) (string, error) {
+	currency := strings.ToUpper(mux.Vars(r)["currency"])
+	if !models.ValidCurrency(currency) {
+		return "", validationError("currency must be a three-letter ISO 4217 code")
+	}
+	return currency, nil
+}
+
+// getExchangeRate returns how many units of currency one unit of the base
+// currency buys, or nil when no rate is configured.
+func getExchangeRate(q dbtx, currency string) (*big.Rat, error) {
+	if currency == models.BaseCurrency() {
+		return big.NewRat(1, 1), nil
+	}
+	var value string
+	err := q.QueryRow(`SELECT rate::text FROM exchange_rates WHERE currency=$1`, currency).Scan(&value)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return models.ParseRate(value)
+}
+
+// priceList prices products in a currency other than the base currency:
+// explicit product prices win, everything else is converted.
+type priceList struct {
+	currency  string
+	rate      *big.Rat
+	overrides map[int64]models.Money
+	// variantPrices holds the base price range of the variants with their
+	// own price, for products with an override. Their summary cannot simply
+	// be converted because inheriting variants follow the override.
+	variantPrices map[int64]variantPriceRange
+}
+
+type variantPriceRange struct {
+	min, max *models.Money
+	inherits bool
+}
+
+func loadPriceList(q dbtx, currency string, productIDs []int64) (*priceList, error) {
+	rate, err := getExchangeRate(q, currency)
+	if err != nil {
+		return nil, err
+	}
+	list := &priceList{currency: currency, rate: rate, overrides: map[int64]models.Money{}, variantPrices: map[int64]variantPriceRange{}}
+
+	rows, err := q.Query(`SELECT product_id, price FROM product_prices WHERE currency=$1 AND product_id = ANY($2)`, currency, pq.Array(productIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	overridden := []int64{}
+	for rows.Next() {
+		var productID int64
+		price := models.NewMoney(0, currency)
+		if err := rows.Scan(&productID, &price); err != nil {
+			return nil, err
+		}
+		list.overrides[productID] = price
+		overridden = append(overridden, productID)
+	}
+	if err := rows.Err(); err != nil || len(overridden) == 0 {
+		return list, err
+	}
+
+	rows, err = q.Query(`SELECT product_id, MIN(price), MAX(price), BOOL_OR(price IS NULL) FROM product_variants
+	WHERE product_id = ANY($1) GROUP BY product_id`, pq.Array(overridden))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var productID int64
+		var prices variantPriceRange
+		if err := rows.Scan(&productID, &prices.min, &prices.max, &prices.inherits); err != nil {
+			return nil, err
+		}
+		list.variantPrices[productID] = prices
+	}
+	return list, rows.Err()
+}
+
+func (l *priceList) convert(price models.Money) (models.Money, error) {
+	if l.rate == nil {
+		return price, validationError(fmt.Sprintf("No exchange rate for %s", l.currency))
+	}
+	return price.Convert(l.rate, l.currency), nil
+}
+
+// apply prices a product and its variants. Variants without their own price
+// follow the product price, and the variant summary is worked out from the
+// resolved prices.
+func (l *priceList) apply(product *models.Product) error {
+	var err error
+	price, overridden := l.overrides[product.Id]
+	if overridden {
+		product.Price = price
+		product.Price_source = priceSourceList
+	} else {
+		if product.Price, err = l.convert(product.Price); err != nil {
+			return err
+		}
+		product.Price_source = priceSourceConverted
+	}
+
+	for i := range product.Variants {
+		variant := &product.Variants[i]
+		if variant.Price == nil {
+			variant.Effective_price = product.Price
+			continue
+		}
+		price, err := l.convert(*variant.Price)
+		if err != nil {
+			return err
+		}
+		variant.Price = &price
+		variant.Effective_price = price
+	}
+
+	summary := product.Variant_summary
+	switch {
+	case summary == nil:
+	case len(product.Variants) > 0:
+		product.Variant_summary = summarizeVariants(product.Variants)
+	case overridden:
+		return l.summarizeOverridden(product)
+	default:
+		// Conversion keeps the order of prices, so the converted range is
+		// the range of the converted prices.
+		if summary.Min_price, err = l.convert(summary.Min_price); err != nil {
+			return err
+		}
+		if summary.Max_price, err = l.convert(summary.Max_price); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// summarizeOverridden sets the price range of a list summary for a product
+// with an override: variants with their own price are converted and the
+// inheriting ones take the override.
+func (l *priceList) summarizeOverridden(product *models.Product) error {
+	summary := product.Variant_summary
+	prices := l.variantPrices[product.Id]
+	var bounds []models.Money
+	if prices.inherits {
+		bounds = append(bounds, product.Price)
+	}
+	for _, own := range []*models.Money{prices.min, prices.max} {
+		if own == nil {
+			continue
+		}
+		price, err := l.convert(*own)
+		if err != nil {
+			return err
+		}
+		bounds = append(bounds, price)
+	}
+	if len(bounds) == 0 {
+		return nil
+	}
+	summary.Min_price, summary.Max_price = bounds[0], bounds[0]
+	for _, price := range bounds[1:] {
+		if price.Cmp(summary.Min_price) < 0 {
+			summary.Min_price = price
+		}
+		if price.Cmp(summary.Max_price) > 0 {
+			summary.Max_price = price
+		}
+	}
+	return nil
+}
+
+// priceProducts expresses product prices in currency. Products in the base
+// currency are left untouched.
+func priceProducts(q dbtx, currency string, products []models.Product) error {
+	if currency == models.BaseCurrency() || len(products) == 0 {
+		return nil
+	}
+	ids := make([]int64, len(products))
+	for i, product := range products {
+		ids[i] = product.Id
+	}
+	list, err := loadPriceList(q, currency, ids)
+	if err != nil {
+		return err
+	}
+	for i := range products {
+		if err := list.apply(&products[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func GetExchangeRates(w http.ResponseWriter, r *http.Request) {
+	db := createConnection()
+	defer db.Close()
+
+	rows, err := db.Query(`SELECT currency, rate::text, updated_at FROM exchange_rates ORDER BY currency`)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	defer rows.Close()
+
+	rates := []models.ExchangeRate{}
+	for rows.Next() {
+		var rate models.ExchangeRate
+		if err := rows.Scan(&rate.Currency, &rate.Rate, &rate.Updated_at); err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		rates = append(rates, rate)
+	}
+	if err := rows.Err(); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, rates)
+}
+
+func normalizeExchangeRate(rate *models.ExchangeRate) error {
+	rate.Currency = strings.ToUpper(strings.TrimSpace(rate.Currency))
+	if !models.ValidCurrency(rate.Currency) {
+		return validationError(fmt.Sprintf("invalid currency %q", rate.Currency))
+	}
+	if rate.Currency == models.BaseCurrency() {
+		return validationError(fmt.Sprintf("%s is the base currency", rate.Currency))
+	}
+	value, err := models.ParseRate(rate.Rate)
+	if err != nil {
+		return validationError(err.Error())
+	}
+	if value.Sign() <= 0 {
+		return validationError(fmt.Sprintf("rate for %s must be positive", rate.Currency))
+	}
+	rate.Rate = strings.TrimSpace(rate.Rate)
+	return nil
+}
+
+// parseExchangeRates reads "currency,rate" lines. A header line and lines
+// starting with # are skipped.
+func parseExchangeRates(r io.Reader) ([]models.ExchangeRate, error) {
+	reader := csv.NewReader(r)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = 2
+	reader.TrimLeadingSpace = true
+
+	rates := []models.ExchangeRate{}
+	for line := 1; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, validationError(err.Error())
+		}
+		if line == 1 && strings.EqualFold(record[0], "currency") {
+			continue
+		}
+		rate := models.ExchangeRate{Currency: record[0], Rate: record[1]}
+		if err := normalizeExchangeRate(&rate); err != nil {
+			return nil, validationError(fmt.Sprintf("line %d: %v", line, err))
+		}
+		rates = append(rates, rate)
+	}
+	if len(rates) == 0 {
+		return nil, validationError("no exchange rates given")
+	}
+	return rates, nil
+}
+
+// saveExchangeRates upserts rates in one transaction. Currencies that are
+// not mentioned keep their current rate.
+func saveExchangeRates(db *sql.DB, rates []models.ExchangeRate, actorID int64, source string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	sqlStatement := `INSERT INTO exchange_rates(currency, rate, updated_at) VALUES ($1, $2, Now())
+	ON CONFLICT (currency) DO UPDATE SET rate=EXCLUDED.rate, updated_at=Now()`
+	for _, rate := range rates {
+		if _, err := tx.Exec(sqlStatement, rate.Currency, rate.Rate); err != nil {
+			return err
+		}
+	}
+	details := map[string]any{"source": source, "rates": rates}
+	if err := insertAuditLog(tx, actorID, "exchange_rates.update", "exchange_rate", 0, details); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// SetExchangeRates upserts a JSON list of rates.
+func SetExchangeRates(w http.ResponseWriter, r *http.Request) {
+	var rates []models.ExchangeRate
+	if err := json.NewDecoder(r.Body).Decode(&rates); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Unable to decode the request body %v", err))
+		return
+	}
+	if len(rates) == 0 {
+		writeError(w, http.StatusBadRequest, "no exchange rates given")
+		return
+	}
+	for i := range rates {
+		if err := normalizeExchangeRate(&rates[i]); err != nil {
+			writeStoreError(w, err)
+			return
+		}
+	}
+
+	db := createConnection()
+	defer db.Close()
+
+	admin, _ := currentUser(r)
+	if err := saveExchangeRates(db, rates, admin.Id, "api"); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, response{
+		Message: fmt.Sprintf("%d exchange rates saved successfully", len(rates)),
+	})
+}
+
+// ImportExchangeRates loads rates from an uploaded CSV file, sent either as
+// the multipart field "file" or as the request body.
+func ImportExchangeRates(w http.ResponseWriter, r *http.Request) {
+	var source io.Reader = http.MaxBytesReader(w, r.Body, maxExchangeRateFileBytes)
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/") {
+		if err := r.ParseMultipartForm(maxExchangeRateFileBytes); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("Unable to parse the multipart form %v", err))
+			return
+		}
+		file, _, err := r.FormFile("file")
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "file is required")
+			return
+		}
+		defer file.Close()
+		source = file
+	}
+
+	rates, err := parseExchangeRates(source)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	db := createConnection()
+	defer db.Close()
+
+	admin, _ := currentUser(r)
+	if err := saveExchangeRates(db, rates, admin.Id, "upload"); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, response{
+		Message: fmt.Sprintf("%d exchange rates imported successfully", len(rates)),
+	})
+}
+
+// importExchangeRatesFile loads EXCHANGE_RATES_FILE when it is configured.
+func importExchangeRatesFile(db *sql.DB) error {
+	path := os.Getenv("EXCHANGE_RATES_FILE")
+	if path == "" {
+		return nil
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	rates, err := parseExchangeRates(io.LimitReader(file, maxExchangeRateFileBytes))
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	return saveExchangeRates(db, rates, 0, "file")
+}
+
+func DeleteExchangeRate(w http.ResponseWriter, r *http.Request) {
+	currency, err := pathCurrency(r)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	db := createConnection()
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`DELETE FROM exchange_rates WHERE currency=$1`, currency)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	if affected, err := res.RowsAffected(); err != nil || affected == 0 {
+		if err == nil {
+			err = errExchangeRateNotFound
+		}
+		writeStoreError(w, err)
+		return
+	}
+	admin, _ := currentUser(r)
+	if err := insertAuditLog(tx, admin.Id, "exchange_rates.delete", "exchange_rate", 0, map[string]string{"currency": currency}); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, response{
+		Message: "Exchange rate deleted successfully",
+	})
+}
+
+func GetProductPrices(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	db := createConnection()
+	defer db.Close()
+
+	if err := productExists(db, id); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	rows, err := db.Query(`SELECT product_id, currency, price, updated_at FROM product_prices WHERE product_id=$1 ORDER BY currency`, id)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	defer rows.Close()
+
+	prices := []models.ProductPrice{}
+	for rows.Next() {
+		var price models.ProductPrice
+		var amount string
+		if err := rows.Scan(&price.Product_id, &price.Currency, &amount, &price.Updated_at); err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		if price.Price, err = models.ParseMoney(amount, price.Currency); err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		prices = append(prices, price)
+	}
+	if err := rows.Err(); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, prices)
+}
+
+// SetProductPrice sets an explicit price in a non-base currency. The body
+// is {"price":{"amount":"1990","currency":"RSD"}}.
+func SetProductPrice(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	currency, err := pathCurrency(r)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	if currency == models.BaseCurrency() {
+		writeError(w, http.StatusBadRequest, "The base price is set on the product itself")
+		return
+	}
+
+	var price models.ProductPrice
+	if err := json.NewDecoder(r.Body).Decode(&price); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Unable to decode the request body %v", err))
+		return
+	}
+	if err := checkPrice("price", price.Price, currency); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	db := createConnection()
+	defer db.Close()
+
+	sqlStatement := `INSERT INTO product_prices(product_id, currency, price, created_at, updated_at) VALUES ($1, $2, $3, Now(), Now())
+	ON CONFLICT (product_id, currency) DO UPDATE SET price=EXCLUDED.price, updated_at=Now()`
+	_, err = db.Exec(sqlStatement, id, currency, price.Price)
+	if isForeignKeyViolation(err) {
+		err = errProductNotFound
+	}
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, response{
+		Id:      id,
+		Message: "Product price saved successfully",
+	})
+}
+
+func DeleteProductPrice(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	currency, err := pathCurrency(r)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	db := createConnection()
+	defer db.Close()
+
+	res, err := db.Exec(`DELETE FROM product_prices WHERE product_id=$1 AND currency=$2`, id, currency)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	if affected, err := res.RowsAffected(); err != nil || affected == 0 {
+		if err == nil {
+			err = errProductPriceNotFound
+		}
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, response{
+		Id:      id,
+		Message: "Product price deleted successfully",
+	})
+}
+
+// loadPricedProducts loads products by id, priced in currency with the
+// running promotions applied. Missing ids are left out of the result.
+func loadPricedProducts(q dbtx, currency string, ids []int64) (map[int64]models.Product, error) {
+	rows, err := q.Query(`SELECT `+productColumns+` FROM products p WHERE p.id = ANY($1)`, pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	products := []models.Product{}
+	for rows.Next() {
+		product, err := scanProduct(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		products = append(products, product)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if err := priceProducts(q, currency, products); err != nil {
+		return nil, err
+	}
+	if err := applyPromotions(q, currency, products); err != nil {
+		return nil, err
+	}
+	byID := make(map[int64]models.Product, len(products))
+	for _, product := range products {
+		byID[product.Id] = product
+	}
+	return byID, nil
+}
+
+// priceProduct prices a single product in currency, with promotions, the
+// same way product listings are priced.
+func priceProduct(q dbtx, currency string, product *models.Product) error {
+	priced := []models.Product{*product}
+	if err := priceProducts(q, currency, priced); err != nil {
+		return err
+	}
+	if err := applyPromotions(q, currency, priced); err != nil {
+		return err
+	}
+	*product = priced[0]
+	return nil
+}
+
+// sellingPrice is what a customer pays for one unit of a priced product.
+func sellingPrice(product models.Product) models.Money {
+	if product.Discounted_price != nil {
+		return *product.Discounted_price
+	}
+	return product.Price
+}
@@ -1,14 +1,17 @@
 package middleware
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"products/models"
 	"strconv"
+	"strings"
 
 	"github.com/golang-jwt/jwt/v4"
 	"github.com/gorilla/mux"
@@ -18,7 +21,7 @@ import (
 )
 
 type response struct {
-	Id int64 `json:"id, omitempty"`
+	Id int64 `json:"id,omitempty"`
 	Message string `json:"message,omitempty"`
 }
 
@@ -43,11 +46,107 @@ func createConnection() *sql.DB {
 	return db
 }
 
-/*func writeJSON(w http.ResponseWriter, status int, v any) error {
+// dbtx is satisfied by both *sql.DB and *sql.Tx so query helpers can run
+// inside or outside of a transaction.
+type dbtx interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	Query(query string, args ...any) (*sql.Rows, error)
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// scanner is satisfied by both *sql.Row and *sql.Rows.
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+// validationError marks an error caused by bad client input.
+type validationError string
+
+func (e validationError) Error() string {
+	return string(e)
+}
+
+// notFoundError marks a lookup of a record that does not exist.
+type notFoundError string
+
+func (e notFoundError) Error() string {
+	return string(e)
+}
+
+// conflictError marks a request that clashes with the current state of a
+// record.
+type conflictError string
+
+func (e conflictError) Error() string {
+	return string(e)
+}
+
+type contextKey string
+
+const currentUserKey contextKey = "currentUser"
+
+func writeJSON(w http.ResponseWriter, status int, v any) error {
 	w.Header().Add("Content-Type", "application/json")
 	w.WriteHeader(status)
 	return json.NewEncoder(w).Encode(v)
-}*/
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, models.Response{
+		Status:  "error",
+		Message: message,
+	})
+}
+
+// writeStoreError maps errors returned by the query helpers onto HTTP status
+// codes.
+func writeStoreError(w http.ResponseWriter, err error) {
+	var invalid validationError
+	var notFound notFoundError
+	var conflict conflictError
+	switch {
+	case errors.As(err, &invalid):
+		writeError(w, http.StatusBadRequest, err.Error())
+	case errors.As(err, &notFound):
+		writeError(w, http.StatusNotFound, err.Error())
+	case errors.As(err, &conflict):
+		writeError(w, http.StatusConflict, err.Error())
+	case isUniqueViolation(err):
+		writeError(w, http.StatusConflict, "Record already exists")
+	default:
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("Unable to execute the query %v", err))
+	}
+}
+
+// pathID reads a numeric route variable such as {id}.
+func pathID(r *http.Request, name string) (int64, error) {
+	id, err := strconv.ParseInt(mux.Vars(r)[name], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Unable to convert %s into int", name)
+	}
+	return id, nil
+}
+
+// queryID reads an optional id from the query string. It is 0 when the
+// parameter is absent.
+func queryID(r *http.Request, name string) (int64, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return 0, nil
+	}
+	id, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || id < 1 {
+		return 0, fmt.Errorf("Unable to convert %s into int", name)
+	}
+	return id, nil
+}
+
+// currentUser returns the user stored in the request context by WithJWTAuth
+// or WithAdminAuth.
+func currentUser(r *http.Request) (models.User, bool) {
+	user, ok := r.Context().Value(currentUserKey).(models.User)
+	return user, ok
+}
 
 func GetProduct(w http.ResponseWriter, r *http.Request) {
 	params := mux.Vars(r)
@@ -55,24 +154,45 @@ func GetProduct(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		log.Fatalf("Unable to convert string into int, %v", err)
 	}
+	currency, err := requestedCurrency(r)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
 
 	product, err := getProduct(int64(id))
 	if err != nil {
 		log.Fatalf("Unable to get product. %v", err)
 	}
 
+	if product.Id != 0 {
+		db := createConnection()
+		defer db.Close()
+
+		if err := loadProductVariants(&product); err != nil {
+			writeError(w, http.StatusInternalServerError, fmt.Sprintf("Unable to get product variants %v", err))
+			return
+		}
+		if err := loadPrimaryImage(db, &product); err != nil {
+			writeError(w, http.StatusInternalServerError, fmt.Sprintf("Unable to get product image %v", err))
+			return
+		}
+		if err := priceProduct(db, currency, &product); err != nil {
+			writeStoreError(w, err)
+			return
+		}
+	}
+
 	json.NewEncoder(w).Encode(product)
 }
 
 func getProduct(id int64) (models.Product, error) {
 	db := createConnection()
 	defer db.Close()
-	sqlStatement := `SELECT * FROM products WHERE id=$1`
-
-	var product models.Product
+	sqlStatement := `SELECT ` + productColumns + ` FROM products p WHERE p.id=$1`
 
 	row := db.QueryRow(sqlStatement, id)
-	err := row.Scan(&product.Id, &product.Name, &product.ShortDescription, &product.Description, &product.Price, &product.Created, &product.Updated, &product.Quantity, &product.Category_id)
+	product, err := scanProduct(row)
 
 	switch err {
 	case sql.ErrNoRows:
@@ -87,46 +207,104 @@ func getProduct(id int64) (models.Product, error) {
 }
 
 func GetAllProducts(w http.ResponseWriter, r *http.Request) {
-	products, err := getAllProducts()
+	filter, err := parseProductFilter(r.URL.Query())
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	currency, err := requestedCurrency(r)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	products, err := getAllProducts(filter)
 	if err != nil {
 		log.Fatalf("Unable to get all the products %v", err)
 	}
+
+	db := createConnection()
+	defer db.Close()
+	if err := priceProducts(db, currency, products); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	if err := applyPromotions(db, currency, products); err != nil {
+		writeStoreError(w, err)
+		return
+	}
 	json.NewEncoder(w).Encode(products)
 }
 
-func getAllProducts() ([]models.Product, error) {
+func getAllProducts(filter productFilter) ([]models.Product, error) {
 	db := createConnection()
 	defer db.Close()
-	sqlStatement := `SELECT * FROM products`
+	sqlStatement := `SELECT ` + productColumns + `, vs.variant_count, vs.min_price, vs.max_price, vs.total_stock
+	FROM products p
+	LEFT JOIN (` + variantSummaryQuery + `) vs ON vs.product_id = p.id`
+
+	conditions, args := filter.where(nil)
+	if len(conditions) > 0 {
+		sqlStatement += ` WHERE ` + strings.Join(conditions, ` AND `)
+	}
+	sqlStatement += ` ORDER BY p.id`
 
 	var products []models.Product
 
-	rows, err := db.Query(sqlStatement)
+	rows, err := db.Query(sqlStatement, args...)
 	if err != nil {
 		log.Fatalf("Unable to execute the query, %v", err)
 	}
 
 	defer rows.Close()
 	for rows.Next() {
-		var product models.Product
-		err := rows.Scan(&product.Id, &product.Name, &product.ShortDescription, &product.Description, &product.Price, &product.Created, &product.Updated, &product.Quantity, &product.Category_id)
+		var summary nullVariantSummary
+		product, err := scanProduct(rows, summary.dest()...)
 		if err != nil {
 			log.Fatalf("Unable to scan the row %v", err)
 		}
+		product.Variant_summary = summary.value()
 		products = append(products, product)
 	}
+	if err := attachPrimaryImages(db, products); err != nil {
+		return nil, err
+	}
 	return products, err
 }
 
+const productColumns = `p.id, p.name, p.shortdescription, p.description, p.price, p.created, p.updated, p.quantity, p.category_id, p.sku, p.barcode, p.slug, p.attributes, p.archived_at, p.reserved, p.reorder_point, p.reorder_quantity, p.tax_class_id`
+
+// scanProduct scans productColumns followed by any extra selected columns.
+func scanProduct(row scanner, extra ...any) (models.Product, error) {
+	var product models.Product
+	var categoryID sql.NullInt64
+	dest := []any{&product.Id, &product.Name, &product.ShortDescription, &product.Description, &product.Price, &product.Created, &product.Updated, &product.Quantity, &categoryID, &product.Sku, &product.Barcode, &product.Slug, &product.Attributes, &product.Archived_at, &product.Reserved, &product.Reorder_point, &product.Reorder_quantity, &product.Tax_class_id}
+	err := row.Scan(append(dest, extra...)...)
+	product.Category_id = categoryID.Int64
+	product.Available = product.Quantity - product.Reserved
+	return product, err
+}
+
 func CreateProduct(w http.ResponseWriter, r *http.Request) {
 	var product models.Product
 
 	err := json.NewDecoder(r.Body).Decode(&product)
 	if err != nil {
-		log.Fatalf("Unable to decode the request body, %v", err)
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Unable to decode the request body, %v", err))
+		return
 	}
 
-	insertID := insertProduct(product)
+	var actorID *int64
+	if user, ok := currentUser(r); ok {
+		actorID = &user.Id
+	}
+
+	insertID, err := insertProduct(product, actorID)
+	if err != nil {
+		writeProductError(w, err)
+		return
+	}
 
 	res := response{
 		Id:      insertID,
@@ -135,35 +313,79 @@ func CreateProduct(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(res)
 }
 
-func insertProduct(product models.Product) int64 {
+func insertProduct(product models.Product, actorID *int64) (int64, error) {
 	db := createConnection()
 	defer db.Close()
-	sqlStatement := `INSERT INTO products(name, shortDescription, description, price, created, updated, quantity, category_id) VALUES($1,$2,$3,$4,Now(),Now(),$5, $6) RETURNING id`
+
+	if err := checkBasePrice("price", product.Price); err != nil {
+		return 0, err
+	}
+	if err := prepareProductIdentifiers(db, &product, 0); err != nil {
+		return 0, err
+	}
+	attributes, err := validateProductAttributes(db, product.Category_id, product.Attributes)
+	if err != nil {
+		return 0, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// Stock starts at zero and is booked through the ledger.
+	sqlStatement := `INSERT INTO products(name, shortDescription, description, price, created, updated, quantity, category_id, sku, barcode, slug, attributes) VALUES($1,$2,$3,$4,Now(),Now(),0, NULLIF($5, 0), $6, $7, $8, $9) RETURNING id`
 
 	var id int64
 
-	err := db.QueryRow(sqlStatement, product.Name, product.ShortDescription, product.Description, product.Price, product.Quantity, product.Category_id).Scan(&id)
+	err = tx.QueryRow(sqlStatement, product.Name, product.ShortDescription, product.Description, product.Price, product.Category_id, product.Sku, product.Barcode, product.Slug, attributes).Scan(&id)
 	if err != nil {
-		log.Fatalf("Unable to execute the query %v", err)
+		return 0, err
 	}
-	return id
+	if err := syncPrimaryCategory(tx, id, product.Category_id); err != nil {
+		return 0, err
+	}
+	if err := recordPriceChange(tx, id, nil, product.Price, priceChangeFromCreate, "", actorID); err != nil {
+		return 0, err
+	}
+	if err := setStockLevel(tx, id, product.Quantity, "Initial stock", actorID); err != nil {
+		return 0, err
+	}
+	return id, tx.Commit()
 }
 
 func UpdateProduct(w http.ResponseWriter, r *http.Request) {
 	params := mux.Vars(r)
 	id, err := strconv.Atoi(params["id"])
 	if err != nil {
-		log.Fatalf("Unable to convert string into int %v", err)
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Unable to convert string into int %v", err))
+		return
 	}
 
-	var product models.Product
+	// quantity is optional here: stock is only touched when the client sends it.
+	var body struct {
+		models.Product
+		Quantity *int64 `json:"quantity"`
+	}
 
-	err = json.NewDecoder(r.Body).Decode(&product)
+	err = json.NewDecoder(r.Body).Decode(&body)
 	if err != nil {
-		log.Fatalf("Unable to decode the request %v", err)
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Unable to decode the request %v", err))
+		return
 	}
 
-	updatedRows := updateProduct(int64(id), product)
+	var actorID *int64
+	if user, ok := currentUser(r); ok {
+		actorID = &user.Id
+	}
+
+	updatedRows, err := updateProduct(int64(id), body.Product, body.Quantity, actorID)
+	if err != nil {
+		writeProductError(w, err)
+		return
+	}
+	stockChanged()
 	msg := fmt.Sprintf("Product updated successfully %v", updatedRows)
 	res := response{
 		Id:      int64(id),
@@ -172,53 +394,105 @@ func UpdateProduct(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(res)
 }
 
-func updateProduct(id int64, product models.Product) int64 {
+// updateProduct writes the product fields. When quantity is set the change is
+// booked as a ledger adjustment; otherwise stock is left alone.
+func updateProduct(id int64, product models.Product, quantity *int64, actorID *int64) (int64, error) {
 	db := createConnection()
 	defer db.Close()
-	sqlStatement := `UPDATE products SET name=$2, shortdescription=$3, description=$4, price=$5, updated=Now(), quantity=$6, category_id=$7 WHERE id=$1`
 
-	res, err := db.Exec(sqlStatement, id, product.Name, product.ShortDescription, product.Description, product.Price, product.Quantity, product.Category_id)
+	if err := checkBasePrice("price", product.Price); err != nil {
+		return 0, err
+	}
+	if err := prepareProductIdentifiers(db, &product, id); err != nil {
+		return 0, err
+	}
+	attributes, err := validateProductAttributes(db, product.Category_id, product.Attributes)
 	if err != nil {
-		log.Fatalf("Unable to execute the query %v", err)
+		return 0, err
 	}
 
-	rowAffected, err := res.RowsAffected()
+	sqlStatement := `UPDATE products SET name=$2, shortdescription=$3, description=$4, price=$5, updated=Now(), category_id=NULLIF($6, 0),
+	sku=$7, barcode=$8, slug=COALESCE(NULLIF($9, ''), slug), attributes=$10 WHERE id=$1`
+
+	tx, err := db.Begin()
 	if err != nil {
-		log.Fatalf("Error while checking the affected rows %v", err)
+		return 0, err
 	}
-	return rowAffected
+	defer tx.Rollback()
+
+	oldPrice, err := lockProductPrice(tx, id)
+	if err == errProductNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	res, err := tx.Exec(sqlStatement, id, product.Name, product.ShortDescription, product.Description, product.Price, product.Category_id, product.Sku, product.Barcode, product.Slug, attributes)
+	if err != nil {
+		return 0, err
+	}
+
+	rowAffected, err := res.RowsAffected()
+	if err != nil || rowAffected == 0 {
+		return rowAffected, err
+	}
+	if err := syncPrimaryCategory(tx, id, product.Category_id); err != nil {
+		return 0, err
+	}
+	// A changed quantity is recorded as an adjustment instead of being
+	// overwritten, so the ledger keeps explaining the stock level.
+	if quantity != nil {
+		if err := setStockLevel(tx, id, *quantity, "Set by product update", actorID); err != nil {
+			return 0, err
+		}
+	}
+	if priceChanged(oldPrice, product.Price) {
+		if err := recordPriceChange(tx, id, oldPrice, product.Price, priceChangeFromUpdate, "", actorID); err != nil {
+			return 0, err
+		}
+		if err := recordInheritedVariantPrices(tx, id, oldPrice, product.Price, actorID); err != nil {
+			return 0, err
+		}
+	}
+	return rowAffected, tx.Commit()
 }
 
 func DeleteProduct(w http.ResponseWriter, r *http.Request) {
-	params := mux.Vars(r)
-	id, err := strconv.Atoi(params["id"])
+	id, err := pathID(r, "id")
 	if err != nil {
-		log.Fatalf("Unable to convert string into int, %v", err)
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
 	}
 
-	deletedRow := deleteProduct(int64(id))
+	deletedRow, err := deleteProduct(id)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
 	msg := fmt.Sprintf("Product deleted successfully %v", deletedRow)
 	res := response{
-		Id:      int64(id),
+		Id:      id,
 		Message: msg,
 	}
 	json.NewEncoder(w).Encode(res)
 }
 
-func deleteProduct(id int64) int64 {
+// deleteProduct removes a product. Products on a purchase order are kept so
+// the order can still be received and audited.
+func deleteProduct(id int64) (int64, error) {
 	db := createConnection()
 	defer db.Close()
 	sqlStatement := `DELETE FROM products WHERE id=$1`
 
 	res, err := db.Exec(sqlStatement, id)
-	if err != nil {
-		log.Fatalf("Unable to execute the query %v", err)
+	if isForeignKeyViolation(err) {
+		return 0, conflictError("Product is on a purchase order and cannot be deleted")
 	}
-	rowsAffected, err := res.RowsAffected()
 	if err != nil {
-		log.Fatalf("Error while checking the affected rows %v", err)
+		return 0, err
 	}
-	return rowsAffected
+	return res.RowsAffected()
 }
 
 func CreateCategory(w http.ResponseWriter, r *http.Request) {
@@ -226,10 +500,15 @@ func CreateCategory(w http.ResponseWriter, r *http.Request) {
 
 	err := json.NewDecoder(r.Body).Decode(&category)
 	if err != nil {
-		log.Fatalf("Unable to decode the request body %v", err)
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Unable to decode the request body %v", err))
+		return
 	}
 
-	insertID := insertCategory(category)
+	insertID, err := insertCategory(category)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
 
 	res := response{
 		Id:      insertID,
@@ -239,21 +518,55 @@ func CreateCategory(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(res)
 }
 
-func insertCategory(category models.Category) int64 {
+func insertCategory(category models.Category) (int64, error) {
+	if err := validateAttributeSchema(category.Attribute_schema); err != nil {
+		return 0, err
+	}
+
 	db := createConnection()
 	defer db.Close()
-	sqlStatement := `INSERT INTO categories(category_name,created_at,updated_at) VALUES ($1, Now(), Now()) RETURNING category_id`
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	parentPath, depth := "/", int64(0)
+	if category.Parent_id != nil {
+		parent, err := lockCategoryTree(tx, *category.Parent_id)
+		if err == errCategoryNotFound {
+			return 0, validationError("Parent category does not exist")
+		}
+		if err != nil {
+			return 0, err
+		}
+		parentPath, depth = parent.Path, parent.Depth+1
+	}
+
+	sqlStatement := `INSERT INTO categories(category_name,created_at,updated_at,attribute_schema,parent_id,depth) VALUES ($1, Now(), Now(), $2, $3, $4) RETURNING category_id`
 
 	var id int64
 
-	err := db.QueryRow(sqlStatement, category.Category_name).Scan(&id)
+	err = tx.QueryRow(sqlStatement, category.Category_name, category.Attribute_schema, category.Parent_id, depth).Scan(&id)
 	if err != nil {
-		log.Fatalf("Unable to execute the query %v", err)
+		return 0, err
+	}
+
+	// The materialized path includes the category's own id, which is only
+	// known after the insert.
+	_, err = tx.Exec(`UPDATE categories SET path=$2 WHERE category_id=$1`, id, fmt.Sprintf("%s%d/", parentPath, id))
+	if err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
 	}
 
 	fmt.Printf("Inserted a single record %v", id)
 
-	return id
+	return id, nil
 }
 
 func GetCategory(w http.ResponseWriter, r *http.Request) {
@@ -274,12 +587,10 @@ func GetCategory(w http.ResponseWriter, r *http.Request) {
 func getCategory(id int64) (models.Category, error) {
 	db := createConnection()
 	defer db.Close()
-	sqlStatement := `SELECT * FROM categories WHERE category_id=$1`
-
-	var category models.Category
+	sqlStatement := `SELECT ` + categoryColumns + ` FROM categories c WHERE c.category_id=$1`
 
 	row := db.QueryRow(sqlStatement, id)
-	err := row.Scan(&category.Category_id, &category.Category_name, &category.Created_at, &category.Updated_at)
+	category, err := scanCategory(row)
 
 	switch err {
 	case sql.ErrNoRows:
@@ -294,6 +605,24 @@ func getCategory(id int64) (models.Category, error) {
 }
 
 func GetAllCategories(w http.ResponseWriter, r *http.Request) {
+	stats, err := wantsStats(r)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	if stats {
+		db := createConnection()
+		defer db.Close()
+
+		categories, err := getCategoriesWithStats(db, `c.category_id`)
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		json.NewEncoder(w).Encode(categories)
+		return
+	}
+
 	categories, err := getAllCategories()
 	if err != nil {
 		log.Fatalf("Unable to get all the categories %v", err)
@@ -305,7 +634,7 @@ func GetAllCategories(w http.ResponseWriter, r *http.Request) {
 func getAllCategories() ([]models.Category, error) {
 	db := createConnection()
 	defer db.Close()
-	sqlStatement := `SELECT * FROM categories`
+	sqlStatement := `SELECT ` + categoryColumns + ` FROM categories c`
 
 	var categories []models.Category
 
@@ -316,8 +645,7 @@ func getAllCategories() ([]models.Category, error) {
 
 	defer rows.Close()
 	for rows.Next() {
-		var category models.Category
-		err := rows.Scan(&category.Category_id, &category.Category_name, &category.Created_at, &category.Updated_at)
+		category, err := scanCategory(rows)
 		if err != nil {
 			log.Fatalf("Unable to scan the row %v", err)
 		}
@@ -326,21 +654,37 @@ func getAllCategories() ([]models.Category, error) {
 	return categories, err
 }
 
+const categoryColumns = `c.category_id, c.category_name, c.created_at, c.updated_at, c.attribute_schema, c.parent_id, c.path, c.depth, c.tax_class_id`
+
+// scanCategory scans categoryColumns followed by any extra selected columns.
+func scanCategory(row scanner, extra ...any) (models.Category, error) {
+	var category models.Category
+	dest := []any{&category.Category_id, &category.Category_name, &category.Created_at, &category.Updated_at, &category.Attribute_schema, &category.Parent_id, &category.Path, &category.Depth, &category.Tax_class_id}
+	err := row.Scan(append(dest, extra...)...)
+	return category, err
+}
+
 func UpdateCategory(w http.ResponseWriter, r *http.Request) {
 	params := mux.Vars(r)
 	id, err := strconv.Atoi(params["id"])
 	if err != nil {
-		log.Fatalf("Unable to convert strig into int %v", err)
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Unable to convert strig into int %v", err))
+		return
 	}
 
 	var category models.Category
 
 	err = json.NewDecoder(r.Body).Decode(&category)
 	if err != nil {
-		log.Fatalf("Unable to decode the request %v", err)
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Unable to decode the request %v", err))
+		return
 	}
 
-	updatedRow := updateCategory(int64(id), category)
+	updatedRow, err := updateCategory(int64(id), category)
+	if err != nil {
+		writeCategoryInUseError(w, err)
+		return
+	}
 	msg := fmt.Sprintf("Category updated successfully  %v", updatedRow)
 	res := response{
 		Id:      int64(id),
@@ -349,55 +693,65 @@ func UpdateCategory(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(res)
 }
 
-func updateCategory(id int64, category models.Category) int64 {
+// updateCategory writes a category. Products whose primary category it is
+// are checked against the new attribute schema in the same transaction, so a
+// schema change that would leave them invalid is refused.
+func updateCategory(id int64, category models.Category) (int64, error) {
+	if err := validateAttributeSchema(category.Attribute_schema); err != nil {
+		return 0, err
+	}
+
 	db := createConnection()
 	defer db.Close()
-	sqlStatement := `UPDATE categories SET category_name=$2, updated_at=Now() WHERE category_id=$1`
 
-	res, err := db.Exec(sqlStatement, id, category.Category_name)
+	tx, err := db.Begin()
 	if err != nil {
-		log.Fatalf("Unable to execute the query %v", err)
+		return 0, err
 	}
+	defer tx.Rollback()
 
-	rowAffected, err := res.RowsAffected()
+	sqlStatement := `UPDATE categories SET category_name=$2, attribute_schema=$3, updated_at=Now() WHERE category_id=$1`
+
+	res, err := tx.Exec(sqlStatement, id, category.Category_name, category.Attribute_schema)
 	if err != nil {
-		log.Fatalf("Error while checking the affected rows %v", err)
+		return 0, err
 	}
-	return rowAffected
+
+	rowsAffected, err := res.RowsAffected()
+	if err != nil || rowsAffected == 0 {
+		return rowsAffected, err
+	}
+	if err := conformPrimaryCategory(tx, id, id); err != nil {
+		return 0, err
+	}
+	return rowsAffected, tx.Commit()
 }
 
 func DeleteCategory(w http.ResponseWriter, r *http.Request) {
 	params := mux.Vars(r)
 	id, err := strconv.Atoi(params["id"])
 	if err != nil {
-		log.Fatalf("Unable to convert string into int %v", err)
-	}
-
-	deletedRows := deleteCategory(int64(id))
-	msg := fmt.Sprintf("Category deleted successfully %v", deletedRows)
-	res := response{
-		Id:      int64(id),
-		Message: msg,
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Unable to convert string into int %v", err))
+		return
 	}
-	json.NewEncoder(w).Encode(res)
-}
 
-func deleteCategory(id int64) int64 {
-	db := createConnection()
-	defer db.Close()
-	sqlStatement := `DELETE FROM categories WHERE category_id=$1`
-
-	res, err := db.Exec(sqlStatement, id)
+	options, err := parseCategoryDeleteOptions(r.URL.Query())
 	if err != nil {
-		log.Fatalf("Unable to execute the query %v", err)
+		writeStoreError(w, err)
+		return
 	}
 
-	rowsAffected, err := res.RowsAffected()
+	affectedProducts, err := deleteCategory(int64(id), options)
 	if err != nil {
-		log.Fatalf("Error while checking the affected rows, %v", rowsAffected)
+		writeCategoryInUseError(w, err)
+		return
 	}
-
-	return rowsAffected
+	msg := fmt.Sprintf("Category deleted successfully, %v products %s", affectedProducts, options.strategy.pastTense())
+	res := response{
+		Id:      int64(id),
+		Message: msg,
+	}
+	json.NewEncoder(w).Encode(res)
 }
 
 func UserRegister(w http.ResponseWriter, r *http.Request){
@@ -419,7 +773,8 @@ func UserRegister(w http.ResponseWriter, r *http.Request){
 	res.Response = resp
 	res.User,err = getUserByID(userID)
 	if err!=nil{
-		log.Fatalf("Error %v", err)
+		writeStoreError(w, err)
+		return
 	}
 	json.NewEncoder(w).Encode(res)
 }
@@ -476,6 +831,15 @@ func UserLogin(w http.ResponseWriter, r *http.Request) {
 	if !validPassword(req.Password, user){
 		log.Fatalf("In database we dont have user with this password.")
 	}
+
+	if user.Disabled {
+		writeError(w, http.StatusForbidden, "Account is disabled")
+		return
+	}
+	if user.Password_reset_required {
+		writeError(w, http.StatusForbidden, "Password reset required")
+		return
+	}
  
 
 	tokenString, err := createJWT(req.Email, req.Password)
@@ -484,6 +848,8 @@ func UserLogin(w http.ResponseWriter, r *http.Request) {
 	}
 	fmt.Println(tokenString)
 
+	mergeCartAtLogin(user.Id, req.Cart_token)
+
 	resp := models.Response{
 		Status: "Success",
 		Message: "User login successfully",
@@ -493,7 +859,8 @@ func UserLogin(w http.ResponseWriter, r *http.Request) {
 	res.Response = resp 
 	res.User, err = getUserByID(user.Id)
 	if err!=nil{
-		log.Fatalf("Error %v", err)
+		writeStoreError(w, err)
+		return
 	}
 	res.Token = tokenString
 	json.NewEncoder(w).Encode(res)
@@ -549,34 +916,30 @@ func validateJWT(tokenString string) (*jwt.Token, error) {
 	})
 }
 
+// WithJWTAuth lets users reach their own resources: the token must belong to
+// the user whose id is in the path.
 func WithJWTAuth(handlerFunc http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-
-		tokenString := r.Header.Get("x-jwt-token")
-
-		token, err := validateJWT(tokenString)
+		user, err := authenticate(r)
 		if err != nil {
-			log.Fatalf("token invalid %v", err)
+			writeError(w, http.StatusUnauthorized, err.Error())
+			return
 		}
-		if !token.Valid{
-			log.Fatalf("token invalid %v", err)
+		if !checkAccount(w, user) {
+			return
 		}
-
-		params := mux.Vars(r)
-		userid, err := strconv.Atoi(params["id"])
-		if err!=nil {
-			log.Fatalf("Unable to convert string into int %v", err)
+		id, err := pathID(r, "id")
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
 		}
-		user, err := getUserByID(int64(userid))
-
-		claims := token.Claims.(jwt.MapClaims)
-	
-		if user.Email != claims["user"] {
-			log.Fatalf("unable user %v", err)
+		if user.Id != id {
+			writeError(w, http.StatusForbidden, "Token does not belong to this user")
+			return
 		}
 
-		handlerFunc(w, r)
-
+		ctx := context.WithValue(r.Context(), currentUserKey, user)
+		handlerFunc(w, r.WithContext(ctx))
 	}
 }
 
@@ -605,8 +968,13 @@ func UpdateUser(w http.ResponseWriter, r *http.Request) {
 	var res models.UserResponse
 	res.Response= resp
 	res.User, err=getUserByID(int64(id))
+	if errors.Is(err, errUserNotFound) {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
 	if err!=nil{
-		log.Fatalf("Dont have user with this id %v", err)
+		writeStoreError(w, err)
+		return
 	}
 
 	json.NewEncoder(w).Encode(res)
@@ -630,15 +998,20 @@ func updateUser(id int64, user models.User) int64 {
 }
 
 func GetUserByID(w http.ResponseWriter, r *http.Request) {
-	params := mux.Vars(r)
-	id, err := strconv.Atoi(params["id"])
+	id, err := pathID(r, "id")
 	if err != nil {
-		log.Fatalf("Unable to convert string into int %v", err)
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
 	}
 
-	user, err := getUserByID(int64(id))
+	user, err := getUserByID(id)
+	if errors.Is(err, errUserNotFound) {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
 	if err != nil {
-		log.Fatalf("Unable to get user %v", err)
+		writeStoreError(w, err)
+		return
 	}
 
 	json.NewEncoder(w).Encode(user)
@@ -647,21 +1020,12 @@ func GetUserByID(w http.ResponseWriter, r *http.Request) {
 func getUserByID(id int64) (models.User, error) {
 	db := createConnection()
 	defer db.Close()
-	sqlStatement := `SELECT * FROM users WHERE id=$1`
-
-	var user models.User
+	sqlStatement := `SELECT ` + userColumns + ` FROM users WHERE id=$1`
 
 	row := db.QueryRow(sqlStatement, id)
-	err := row.Scan(&user.Id, &user.First_name, &user.Last_name, &user.Email, &user.Password, &user.Created_at)
-
-	switch err {
-	case sql.ErrNoRows:
-		fmt.Println("Now rows were returned")
-		return user, nil
-	case nil:
-		return user, nil
-	default:
-		log.Fatalf("Unable to scan the row %v", err)
+	user, err := scanUser(row)
+	if err == sql.ErrNoRows {
+		return user, errUserNotFound
 	}
 	return user, err
 }
@@ -681,12 +1045,10 @@ func GetUserByEmail(w http.ResponseWriter, r *http.Request) {
 func getUserByEmail(email string) (models.User, error) {
 	db := createConnection()
 	defer db.Close()
-	sqlStatement := `SELECT * FROM users WHERE email=$1`
-
-	var user models.User
+	sqlStatement := `SELECT ` + userColumns + ` FROM users WHERE email=$1`
 
 	row := db.QueryRow(sqlStatement, email)
-	err := row.Scan(&user.Id, &user.First_name, &user.Last_name, &user.Email, &user.Password, &user.Created_at)
+	user, err := scanUser(row)
 
 	switch err {
 	case sql.ErrNoRows:
@@ -699,3 +1061,11 @@ func getUserByEmail(email string) (models.User, error) {
 	}
 	return user, err
 }
+
+const userColumns = `id, first_name, last_name, email, password, created_at, role, disabled, password_reset_required, erased_at`
+
+func scanUser(row scanner) (models.User, error) {
+	var user models.User
+	err := row.Scan(&user.Id, &user.First_name, &user.Last_name, &user.Email, &user.Password, &user.Created_at, &user.Role, &user.Disabled, &user.Password_reset_required, &user.Erased_at)
+	return user, err
+}
@@ -0,0 +1,220 @@
+package middleware
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"products/models"
+	"regexp"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+var skuPattern = regexp.MustCompile(`^[A-Z0-9][A-Z0-9_-]{0,63}$`)
+
+var slugPattern = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+
+// slugReplacements folds the accented letters we see in product names into
+// plain ASCII before slugifying.
+var slugReplacements = strings.NewReplacer(
+	"č", "c", "ć", "c", "š", "s", "ž", "z", "đ", "dj",
+	"á", "a", "à", "a", "â", "a", "ä", "a", "ã", "a", "å", "a",
+	"é", "e", "è", "e", "ê", "e", "ë", "e",
+	"í", "i", "ì", "i", "î", "i", "ï", "i",
+	"ó", "o", "ò", "o", "ô", "o", "ö", "o", "õ", "o", "ø", "o",
+	"ú", "u", "ù", "u", "û", "u", "ü", "u",
+	"ñ", "n", "ç", "c", "ß", "ss",
+)
+
+var errProductNotFound = notFoundError("Product not found")
+
+// prepareProductIdentifiers normalizes and validates the SKU, barcode and
+// slug of a product before it is written. id is 0 for new products.
+func prepareProductIdentifiers(q dbtx, product *models.Product, id int64) error {
+	product.Sku = strings.ToUpper(strings.TrimSpace(product.Sku))
+	if !skuPattern.MatchString(product.Sku) {
+		return validationError("sku is required and may only contain letters, digits, '-' and '_' (max 64)")
+	}
+
+	if product.Barcode != nil {
+		barcode := strings.TrimSpace(*product.Barcode)
+		if barcode == "" {
+			product.Barcode = nil
+		} else {
+			if !validGTIN(barcode) {
+				return validationError(fmt.Sprintf("barcode %q is not a valid GTIN-8, UPC-A, EAN-13 or GTIN-14", barcode))
+			}
+			product.Barcode = &barcode
+		}
+	}
+
+	product.Slug = strings.TrimSpace(product.Slug)
+	if product.Slug != "" {
+		if !slugPattern.MatchString(product.Slug) {
+			return validationError("slug may only contain lowercase letters, digits and single dashes")
+		}
+		return nil
+	}
+	if id != 0 {
+		// Keep the existing slug so published URLs do not break on rename.
+		return nil
+	}
+
+	base := slugify(product.Name)
+	if base == "" {
+		base = slugify(product.Sku)
+	}
+	slug, err := uniqueSlug(q, base, id)
+	if err != nil {
+		return err
+	}
+	product.Slug = slug
+	return nil
+}
+
+// validGTIN checks the length and GS1 check digit of GTIN-8, UPC-A (GTIN-12),
+// EAN-13 and GTIN-14 codes.
+func validGTIN(code string) bool {
+	switch len(code) {
+	case 8, 12, 13, 14:
+	default:
+		return false
+	}
+
+	sum := 0
+	for i := len(code) - 1; i >= 0; i-- {
+		c := code[i]
+		if c < '0' || c > '9' {
+			return false
+		}
+		digit := int(c - '0')
+		if i == len(code)-1 {
+			continue
+		}
+		// Weights alternate 3,1,3,... starting from the digit left of the
+		// check digit.
+		if (len(code)-1-i)%2 == 1 {
+			digit *= 3
+		}
+		sum += digit
+	}
+
+	check := (10 - sum%10) % 10
+	return check == int(code[len(code)-1]-'0')
+}
+
+func slugify(name string) string {
+	name = slugReplacements.Replace(strings.ToLower(name))
+
+	var b strings.Builder
+	dash := false
+	for _, r := range name {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			b.WriteRune(r)
+			dash = false
+			continue
+		}
+		if !dash && b.Len() > 0 {
+			b.WriteByte('-')
+			dash = true
+		}
+	}
+
+	slug := strings.TrimSuffix(b.String(), "-")
+	if len(slug) > 80 {
+		slug = strings.TrimSuffix(slug[:80], "-")
+	}
+	return slug
+}
+
+// uniqueSlug appends -2, -3, ... to base until it no longer collides with
+// another product's slug.
+func uniqueSlug(q dbtx, base string, id int64) (string, error) {
+	sqlStatement := `SELECT slug FROM products WHERE (slug = $1 OR slug LIKE $1::text || '-%') AND id <> $2`
+	rows, err := q.Query(sqlStatement, base, id)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	taken := map[string]bool{}
+	for rows.Next() {
+		var slug string
+		if err := rows.Scan(&slug); err != nil {
+			return "", err
+		}
+		taken[slug] = true
+	}
+	if err := rows.Err(); err != nil {
+		return "", err
+	}
+
+	slug := base
+	for n := 2; taken[slug]; n++ {
+		slug = fmt.Sprintf("%s-%d", base, n)
+	}
+	return slug, nil
+}
+
+func writeProductError(w http.ResponseWriter, err error) {
+	switch {
+	case isUniqueViolation(err):
+		writeError(w, http.StatusConflict, "A product with this sku, barcode or slug already exists")
+	case isForeignKeyViolation(err):
+		writeError(w, http.StatusBadRequest, "Referenced category does not exist")
+	default:
+		writeStoreError(w, err)
+	}
+}
+
+func GetProductBySku(w http.ResponseWriter, r *http.Request) {
+	getProductByIdentifier(w, r, "sku", strings.ToUpper(mux.Vars(r)["sku"]))
+}
+
+func GetProductByBarcode(w http.ResponseWriter, r *http.Request) {
+	getProductByIdentifier(w, r, "barcode", mux.Vars(r)["barcode"])
+}
+
+func GetProductBySlug(w http.ResponseWriter, r *http.Request) {
+	getProductByIdentifier(w, r, "slug", mux.Vars(r)["slug"])
+}
+
+// getProductByIdentifier looks a product up by sku, barcode or slug and
+// prices it like GetProduct, honouring ?currency.
+func getProductByIdentifier(w http.ResponseWriter, r *http.Request, column string, value string) {
+	currency, err := requestedCurrency(r)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	db := createConnection()
+	defer db.Close()
+
+	// column is one of the fixed identifiers above, never user input.
+	sqlStatement := `SELECT ` + productColumns + ` FROM products p WHERE p.` + column + `=$1`
+
+	product, err := scanProduct(db.QueryRow(sqlStatement, value))
+	if err == sql.ErrNoRows {
+		writeError(w, http.StatusNotFound, errProductNotFound.Error())
+		return
+	}
+	if err != nil {
+		writeProductError(w, err)
+		return
+	}
+	if err := loadProductVariants(&product); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	if err := loadPrimaryImage(db, &product); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	if err := priceProduct(db, currency, &product); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, product)
+}
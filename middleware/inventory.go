@@ -0,0 +1,516 @@
+package middleware
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"products/models"
+	"strings"
+)
+
+const (
+	movementReceipt    = "receipt"
+	movementSale       = "sale"
+	movementAdjustment = "adjustment"
+	movementReturn     = "return"
+	movementTransfer   = "transfer"
+)
+
+var errInsufficientStock = conflictError("Insufficient stock available")
+
+const movementColumns = `id, product_id, variant_id, warehouse_id, movement_type, quantity, balance_after, reason, reference, actor_id, created_at`
+
+func scanMovement(row scanner) (models.StockMovement, error) {
+	var movement models.StockMovement
+	var reference sql.NullString
+	var variantID, warehouseID sql.NullInt64
+	err := row.Scan(&movement.Id, &movement.Product_id, &variantID, &warehouseID, &movement.Type, &movement.Quantity, &movement.Balance_after, &movement.Reason, &reference, &movement.Actor_id, &movement.Created_at)
+	movement.Reference = reference.String
+	movement.Variant_id = variantID.Int64
+	movement.Warehouse_id = warehouseID.Int64
+	return movement, err
+}
+
+// validateMovement checks that the sign of a movement matches its type:
+// receipts and returns add stock, sales remove it, adjustments and transfers
+// go either way.
+func validateMovement(movement *models.StockMovement) error {
+	movement.Type = strings.ToLower(strings.TrimSpace(movement.Type))
+	movement.Reason = strings.TrimSpace(movement.Reason)
+
+	if movement.Quantity == 0 {
+		return validationError("quantity must not be zero")
+	}
+	switch movement.Type {
+	case movementReceipt, movementReturn:
+		if movement.Quantity < 0 {
+			return validationError(fmt.Sprintf("a %s must have a positive quantity", movement.Type))
+		}
+	case movementSale:
+		if movement.Quantity > 0 {
+			return validationError("a sale must have a negative quantity")
+		}
+	case movementAdjustment, movementTransfer:
+		if movement.Reason == "" {
+			return validationError(fmt.Sprintf("a %s requires a reason", movement.Type))
+		}
+	default:
+		return validationError(fmt.Sprintf("unknown movement type %q, expected receipt, sale, adjustment, return or transfer", movement.Type))
+	}
+	return nil
+}
+
+// postStockMovement applies a movement to the stock of one warehouse and to
+// the product total, and appends it to the ledger. Movements without a
+// warehouse go to the default warehouse. Quantities are changed with
+// conditional UPDATEs so concurrent movements can never drive stock below
+// zero or below what is reserved. q should be a transaction so the ledger and
+// the stock levels change together.
+func postStockMovement(q dbtx, movement models.StockMovement) (models.StockMovement, error) {
+	if err := prepareMovement(q, &movement); err != nil {
+		return movement, err
+	}
+
+	sqlStatement := `UPDATE products SET quantity = quantity + $2, updated=Now() WHERE id=$1 AND quantity + $2 >= reserved RETURNING quantity`
+	err := q.QueryRow(sqlStatement, movement.Product_id, movement.Quantity).Scan(&movement.Balance_after)
+	if err == sql.ErrNoRows {
+		if err := productExists(q, movement.Product_id); err != nil {
+			return movement, err
+		}
+		return movement, errInsufficientStock
+	}
+	if err != nil {
+		return movement, err
+	}
+	return bookWarehouseMovement(q, movement)
+}
+
+// prepareMovement validates a movement and sends it to the default warehouse
+// when it names none.
+func prepareMovement(q dbtx, movement *models.StockMovement) error {
+	if err := validateMovement(movement); err != nil {
+		return err
+	}
+	if movement.Warehouse_id == 0 {
+		id, err := defaultWarehouseID(q)
+		if err != nil {
+			return err
+		}
+		movement.Warehouse_id = id
+	}
+	return nil
+}
+
+// bookWarehouseMovement applies a prepared movement to the stock of its
+// warehouse and appends it to the ledger without touching the product total.
+func bookWarehouseMovement(q dbtx, movement models.StockMovement) (models.StockMovement, error) {
+	if err := changeWarehouseStock(q, movement.Warehouse_id, movement.Product_id, movement.Quantity); err != nil {
+		return movement, err
+	}
+	return insertMovement(q, movement)
+}
+
+func insertMovement(q dbtx, movement models.StockMovement) (models.StockMovement, error) {
+	sqlStatement := `INSERT INTO stock_movements(product_id, variant_id, warehouse_id, movement_type, quantity, balance_after, reason, reference, actor_id, created_at)
+	VALUES ($1, NULLIF($2, 0), NULLIF($3, 0), $4, $5, $6, $7, NULLIF($8, ''), $9, Now()) RETURNING id, created_at`
+	err := q.QueryRow(sqlStatement, movement.Product_id, movement.Variant_id, movement.Warehouse_id, movement.Type, movement.Quantity, movement.Balance_after, movement.Reason, movement.Reference, movement.Actor_id).Scan(&movement.Id, &movement.Created_at)
+	return movement, err
+}
+
+// removeStock takes quantity units of a product out of stock, drawing from
+// the default warehouse first and then from the warehouses holding the most.
+// One ledger entry is posted per warehouse touched.
+func removeStock(q dbtx, movement models.StockMovement) error {
+	if movement.Warehouse_id != 0 {
+		_, err := postStockMovement(q, movement)
+		return err
+	}
+
+	// Lock the product before its warehouse rows, in the same order as
+	// postStockMovement, so concurrent removals cannot deadlock.
+	if _, err := q.Exec(`SELECT 1 FROM products WHERE id=$1 FOR UPDATE`, movement.Product_id); err != nil {
+		return err
+	}
+	sqlStatement := `SELECT s.warehouse_id, s.quantity FROM warehouse_stock s JOIN warehouses w ON w.id = s.warehouse_id
+	WHERE s.product_id=$1 AND s.quantity > 0 ORDER BY w.is_default DESC, s.quantity DESC, w.id FOR UPDATE OF s`
+	rows, err := q.Query(sqlStatement, movement.Product_id)
+	if err != nil {
+		return err
+	}
+	type allocation struct {
+		warehouseID int64
+		quantity    int64
+	}
+	var allocations []allocation
+	remaining := -movement.Quantity
+	for rows.Next() && remaining > 0 {
+		var item allocation
+		if err := rows.Scan(&item.warehouseID, &item.quantity); err != nil {
+			rows.Close()
+			return err
+		}
+		if item.quantity > remaining {
+			item.quantity = remaining
+		}
+		remaining -= item.quantity
+		allocations = append(allocations, item)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if remaining > 0 {
+		return errInsufficientStock
+	}
+
+	for _, item := range allocations {
+		part := movement
+		part.Warehouse_id = item.warehouseID
+		part.Quantity = -item.quantity
+		if _, err := postStockMovement(q, part); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setStockLevel records the adjustment needed to bring a product to quantity.
+// It is used where clients still send an absolute quantity.
+func setStockLevel(q dbtx, productID int64, quantity int64, reason string, actorID *int64) error {
+	if quantity < 0 {
+		return validationError("quantity must not be negative")
+	}
+	var current int64
+	err := q.QueryRow(`SELECT quantity FROM products WHERE id=$1 FOR UPDATE`, productID).Scan(&current)
+	if err == sql.ErrNoRows {
+		return errProductNotFound
+	}
+	if err != nil || current == quantity {
+		return err
+	}
+	return adjustStock(q, models.StockMovement{
+		Product_id: productID,
+		Type:       movementAdjustment,
+		Quantity:   quantity - current,
+		Reason:     reason,
+		Actor_id:   actorID,
+	})
+}
+
+// setVariantStockLevel records the adjustment needed to bring a variant to
+// quantity. Variant stock is not split over warehouses, so the movement only
+// names the variant.
+func setVariantStockLevel(q dbtx, productID int64, variantID int64, quantity int64, reason string, actorID *int64) error {
+	if quantity < 0 {
+		return validationError("quantity must not be negative")
+	}
+	var current int64
+	err := q.QueryRow(`SELECT quantity FROM product_variants WHERE id=$1 AND product_id=$2 FOR UPDATE`, variantID, productID).Scan(&current)
+	if err == sql.ErrNoRows {
+		return errVariantNotFound
+	}
+	if err != nil || current == quantity {
+		return err
+	}
+	if _, err := q.Exec(`UPDATE product_variants SET quantity=$2, updated=Now() WHERE id=$1`, variantID, quantity); err != nil {
+		return err
+	}
+	_, err = insertMovement(q, models.StockMovement{
+		Product_id:    productID,
+		Variant_id:    variantID,
+		Type:          movementAdjustment,
+		Quantity:      quantity - current,
+		Balance_after: quantity,
+		Reason:        reason,
+		Actor_id:      actorID,
+	})
+	return err
+}
+
+// adjustStock posts increases to the default warehouse and spreads decreases
+// over the warehouses that hold the product.
+func adjustStock(q dbtx, movement models.StockMovement) error {
+	if movement.Quantity < 0 {
+		return removeStock(q, movement)
+	}
+	_, err := postStockMovement(q, movement)
+	return err
+}
+
+func PostStockMovement(w http.ResponseWriter, r *http.Request) {
+	productID, err := pathID(r, "id")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var movement models.StockMovement
+	if err := json.NewDecoder(r.Body).Decode(&movement); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Unable to decode the request body %v", err))
+		return
+	}
+	movement.Product_id = productID
+	movement.Actor_id = nil
+	if movement.Type == movementTransfer {
+		writeError(w, http.StatusBadRequest, "Transfers are posted through /api/warehouses/transfers")
+		return
+	}
+	if user, ok := currentUser(r); ok {
+		movement.Actor_id = &user.Id
+	}
+
+	db := createConnection()
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	defer tx.Rollback()
+
+	movement, err = postStockMovement(tx, movement)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	stockChanged()
+	writeJSON(w, http.StatusCreated, movement)
+}
+
+// GetStockMovements lists the ledger of a product, or of one of its variants
+// when ?variant is given.
+func GetStockMovements(w http.ResponseWriter, r *http.Request) {
+	productID, err := pathID(r, "id")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	page, limit := pagination(r)
+	variantID, err := queryID(r, "variant")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	args := []any{productID, variantID}
+	where := "product_id = $1 AND COALESCE(variant_id, 0) = $2"
+	if movementType := r.URL.Query().Get("type"); movementType != "" {
+		args = append(args, movementType)
+		where += " AND movement_type = $3"
+	}
+
+	db := createConnection()
+	defer db.Close()
+
+	history := models.StockHistoryResponse{Product_id: productID, Variant_id: variantID, Page: page, Limit: limit}
+	if variantID == 0 {
+		err = db.QueryRow(`SELECT quantity, (SELECT COALESCE(SUM(quantity), 0) FROM stock_movements WHERE product_id=$1 AND variant_id IS NULL) FROM products WHERE id=$1`, productID).
+			Scan(&history.Quantity, &history.Ledger_total)
+		if err == sql.ErrNoRows {
+			err = errProductNotFound
+		}
+	} else {
+		err = db.QueryRow(`SELECT quantity, (SELECT COALESCE(SUM(quantity), 0) FROM stock_movements WHERE variant_id=$1) FROM product_variants WHERE id=$1 AND product_id=$2`, variantID, productID).
+			Scan(&history.Quantity, &history.Ledger_total)
+		if err == sql.ErrNoRows {
+			err = errVariantNotFound
+		}
+	}
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	args = append(args, limit, (page-1)*limit)
+	sqlStatement := fmt.Sprintf(`SELECT %s FROM stock_movements WHERE %s ORDER BY id DESC LIMIT $%d OFFSET $%d`, movementColumns, where, len(args)-1, len(args))
+	history.Movements, err = queryMovements(db, sqlStatement, args...)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, history)
+}
+
+func queryMovements(q dbtx, sqlStatement string, args ...any) ([]models.StockMovement, error) {
+	rows, err := q.Query(sqlStatement, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	movements := []models.StockMovement{}
+	for rows.Next() {
+		movement, err := scanMovement(rows)
+		if err != nil {
+			return nil, err
+		}
+		movements = append(movements, movement)
+	}
+	return movements, rows.Err()
+}
+
+// GetStockDiscrepancies lists products whose quantity no longer matches the
+// sum of their ledger or of their warehouse stock, e.g. after a manual
+// database edit.
+func GetStockDiscrepancies(w http.ResponseWriter, r *http.Request) {
+	db := createConnection()
+	defer db.Close()
+
+	sqlStatement := `SELECT p.id, p.name, p.sku, p.quantity, COALESCE(m.total, 0), COALESCE(s.total, 0)
+	FROM products p
+	LEFT JOIN (SELECT product_id, SUM(quantity) AS total FROM stock_movements WHERE variant_id IS NULL GROUP BY product_id) m ON m.product_id = p.id
+	LEFT JOIN (SELECT product_id, SUM(quantity) AS total FROM warehouse_stock GROUP BY product_id) s ON s.product_id = p.id
+	WHERE p.quantity <> COALESCE(m.total, 0) OR p.quantity <> COALESCE(s.total, 0) ORDER BY p.id`
+	rows, err := db.Query(sqlStatement)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	defer rows.Close()
+
+	discrepancies := []models.StockDiscrepancy{}
+	for rows.Next() {
+		var item models.StockDiscrepancy
+		if err := rows.Scan(&item.Product.Id, &item.Product.Name, &item.Product.Sku, &item.Quantity, &item.Ledger_total, &item.Warehouse_total); err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		discrepancies = append(discrepancies, item)
+	}
+	if err := rows.Err(); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, discrepancies)
+}
+
+// ReconcileStock brings the ledger and the warehouse stock of a product back
+// in line with its quantity. Warehouse rows that drifted from their ledger are
+// booked as they stand, then the difference between the quantity and the
+// warehouse total is posted to the warehouse in the body, or the default one.
+func ReconcileStock(w http.ResponseWriter, r *http.Request) {
+	productID, err := pathID(r, "id")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	// The body is optional.
+	var req models.StockReconcileRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Unable to decode the request body %v", err))
+		return
+	}
+	var actorID *int64
+	if user, ok := currentUser(r); ok {
+		actorID = &user.Id
+	}
+
+	db := createConnection()
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	defer tx.Rollback()
+
+	adjusted, err := reconcileStock(tx, productID, req.Warehouse_id, actorID)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, response{
+		Id:      productID,
+		Message: fmt.Sprintf("Stock reconciled, adjusted ledger by %d", adjusted),
+	})
+}
+
+// reconcileStock makes the ledger total and the warehouse total of a product
+// equal its quantity and returns how much the ledger was adjusted by.
+func reconcileStock(tx dbtx, productID int64, warehouseID int64, actorID *int64) (int64, error) {
+	var quantity, ledger int64
+	sqlStatement := `SELECT quantity, (SELECT COALESCE(SUM(quantity), 0) FROM stock_movements WHERE product_id=$1 AND variant_id IS NULL) FROM products WHERE id=$1 FOR UPDATE`
+	err := tx.QueryRow(sqlStatement, productID).Scan(&quantity, &ledger)
+	if err == sql.ErrNoRows {
+		return 0, errProductNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+	defaultID, err := defaultWarehouseID(tx)
+	if err != nil {
+		return 0, err
+	}
+
+	// Ledger rows without a warehouse predate warehouses and count towards
+	// the default one.
+	sqlStatement = `SELECT COALESCE(s.warehouse_id, m.warehouse_id), COALESCE(s.quantity, 0) - COALESCE(m.total, 0)
+	FROM (SELECT warehouse_id, quantity FROM warehouse_stock WHERE product_id=$1) s
+	FULL JOIN (SELECT COALESCE(warehouse_id, $2) AS warehouse_id, SUM(quantity) AS total FROM stock_movements
+		WHERE product_id=$1 AND variant_id IS NULL GROUP BY 1) m ON m.warehouse_id = s.warehouse_id
+	WHERE COALESCE(s.quantity, 0) <> COALESCE(m.total, 0)`
+	rows, err := tx.Query(sqlStatement, productID, defaultID)
+	if err != nil {
+		return 0, err
+	}
+	var drifts []models.StockMovement
+	for rows.Next() {
+		var drift models.StockMovement
+		if err := rows.Scan(&drift.Warehouse_id, &drift.Quantity); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		drifts = append(drifts, drift)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, drift := range drifts {
+		drift.Product_id = productID
+		drift.Type = movementAdjustment
+		drift.Balance_after = quantity
+		drift.Reason = "Ledger reconciliation"
+		drift.Actor_id = actorID
+		if _, err := insertMovement(tx, drift); err != nil {
+			return 0, err
+		}
+	}
+	var stocked int64
+	if err := tx.QueryRow(`SELECT COALESCE(SUM(quantity), 0) FROM warehouse_stock WHERE product_id=$1`, productID).Scan(&stocked); err != nil {
+		return 0, err
+	}
+
+	if quantity != stocked {
+		movement := models.StockMovement{
+			Product_id:    productID,
+			Warehouse_id:  warehouseID,
+			Type:          movementAdjustment,
+			Quantity:      quantity - stocked,
+			Balance_after: quantity,
+			Reason:        "Ledger reconciliation",
+			Actor_id:      actorID,
+		}
+		if err := prepareMovement(tx, &movement); err != nil {
+			return 0, err
+		}
+		if _, err := bookWarehouseMovement(tx, movement); err != nil {
+			return 0, err
+		}
+	}
+	return quantity - ledger, nil
+}
@@ -0,0 +1,358 @@
+package middleware
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"products/models"
+	"strings"
+)
+
+var errInvoiceNotFound = notFoundError("Invoice not found")
+
+const invoiceColumns = `id, number, order_id, customer_name, email, shipping_address, country, region, currency, lines,
+subtotal::text, discount::text, tax_total::text, total::text, prices_include_tax, tax_rates, issued_at`
+
+func scanInvoice(row scanner) (models.Invoice, error) {
+	var invoice models.Invoice
+	var lines, rates []byte
+	var subtotal, discount, taxTotal, total string
+	err := row.Scan(&invoice.Id, &invoice.Number, &invoice.Order_id, &invoice.Customer_name, &invoice.Email, &invoice.Shipping_address,
+		&invoice.Country, &invoice.Region, &invoice.Currency, &lines, &subtotal, &discount, &taxTotal, &total,
+		&invoice.Prices_include_tax, &rates, &invoice.Issued_at)
+	if err != nil {
+		return invoice, err
+	}
+	amounts := []struct {
+		text string
+		dest *models.Money
+	}{{subtotal, &invoice.Subtotal}, {discount, &invoice.Discount}, {taxTotal, &invoice.Tax_total}, {total, &invoice.Total}}
+	for _, amount := range amounts {
+		if *amount.dest, err = models.ParseMoney(amount.text, invoice.Currency); err != nil {
+			return invoice, err
+		}
+	}
+	if err := json.Unmarshal(lines, &invoice.Lines); err != nil {
+		return invoice, err
+	}
+	err = json.Unmarshal(rates, &invoice.Tax_rates)
+	return invoice, err
+}
+
+// nextInvoiceNumber takes the next number from the invoice counter. The
+// counter row stays locked until the transaction ends, so invoices are
+// numbered in the order they commit and a rollback gives the number back.
+func nextInvoiceNumber(q dbtx) (int64, string, error) {
+	var sequence int64
+	err := q.QueryRow(`UPDATE invoice_sequences SET last_number=last_number+1 WHERE name='invoice' RETURNING last_number`).Scan(&sequence)
+	if err != nil {
+		return 0, "", err
+	}
+	return sequence, fmt.Sprintf("%s%06d", envOrDefault("INVOICE_PREFIX", "INV-"), sequence), nil
+}
+
+// issueInvoice invoices an order once it has been paid. An order is invoiced
+// only once; issuing again returns the existing invoice.
+func issueInvoice(q dbtx, orderID int64) (int64, error) {
+	if _, err := q.Exec(`SELECT 1 FROM orders WHERE id=$1 FOR UPDATE`, orderID); err != nil {
+		return 0, err
+	}
+	var id int64
+	err := q.QueryRow(`SELECT id FROM invoices WHERE order_id=$1`, orderID).Scan(&id)
+	if err != sql.ErrNoRows {
+		return id, err
+	}
+
+	order, err := getOrder(q, orderID, nil)
+	if err != nil {
+		return 0, err
+	}
+	if order.Status == orderPending || order.Status == orderCancelled {
+		return 0, conflictError(fmt.Sprintf("Order is %s and cannot be invoiced", order.Status))
+	}
+
+	includeTax := false
+	rates := []models.TaxRateTotal{}
+	if order.Tax != nil {
+		includeTax = order.Tax.Prices_include_tax
+		rates = order.Tax.Rates
+	}
+	lines := make([]models.InvoiceLine, len(order.Lines))
+	for i, line := range order.Lines {
+		total := line.Line_total.Sub(line.Discount)
+		if !includeTax {
+			total = total.Add(line.Tax)
+		}
+		lines[i] = models.InvoiceLine{
+			Description: line.Product_name,
+			Sku:         line.Sku,
+			Quantity:    line.Quantity,
+			Unit_price:  line.Unit_price,
+			Discount:    line.Discount,
+			Tax:         line.Tax,
+			Total:       total,
+		}
+		if order.Tax != nil && i < len(order.Tax.Lines) {
+			lines[i].Tax_rate = order.Tax.Lines[i].Rate
+		}
+	}
+	encodedLines, err := json.Marshal(lines)
+	if err != nil {
+		return 0, err
+	}
+	encodedRates, err := json.Marshal(rates)
+	if err != nil {
+		return 0, err
+	}
+
+	sequence, number, err := nextInvoiceNumber(q)
+	if err != nil {
+		return 0, err
+	}
+	sqlStatement := `INSERT INTO invoices(sequence_number, number, order_id, customer_name, email, shipping_address, country, region, currency, lines,
+	subtotal, discount, tax_total, total, prices_include_tax, tax_rates, issued_at)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, Now()) RETURNING id`
+	err = q.QueryRow(sqlStatement, sequence, number, order.Id, order.Customer_name, order.Email, order.Shipping_address, order.Country, order.Region,
+		order.Currency, encodedLines, order.Subtotal, order.Discount, order.Tax_total, order.Total, includeTax, encodedRates).Scan(&id)
+	return id, err
+}
+
+// invoiceForOrder issues the invoice of an order if needed and reads it.
+// Orders paid before invoicing existed are invoiced on first request. With
+// userID set only that user's orders are found.
+func invoiceForOrder(orderID int64, userID *int64) (models.Invoice, error) {
+	db := createConnection()
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return models.Invoice{}, err
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	err = tx.QueryRow(`SELECT EXISTS(SELECT 1 FROM orders WHERE id=$1 AND ($2::int8 IS NULL OR user_id=$2))`, orderID, userID).Scan(&exists)
+	if err != nil {
+		return models.Invoice{}, err
+	}
+	if !exists {
+		return models.Invoice{}, errOrderNotFound
+	}
+	id, err := issueInvoice(tx, orderID)
+	if err != nil {
+		return models.Invoice{}, err
+	}
+	invoice, err := scanInvoice(tx.QueryRow(`SELECT `+invoiceColumns+` FROM invoices WHERE id=$1`, id))
+	if err != nil {
+		return invoice, err
+	}
+	return invoice, tx.Commit()
+}
+
+func formatInvoiceAmount(amount models.Money) string {
+	return amount.String() + " " + amount.Currency()
+}
+
+// renderInvoicePDF lays the invoice out on A4 pages. The seller block comes
+// from INVOICE_SELLER_NAME and INVOICE_SELLER_ADDRESS.
+func renderInvoicePDF(invoice models.Invoice) []byte {
+	doc := newPDFDocument()
+	const left, right = 50.0, pdfPageWidth - 50
+	// Right edges of the amount columns; description and SKU are left aligned.
+	columns := []struct {
+		title string
+		x     float64
+	}{{"Qty", 300}, {"Unit price", 370}, {"Discount", 425}, {"Tax", 480}, {"Total", right}}
+
+	y := pdfPageHeight - 60
+	doc.text(left, y, 20, true, "INVOICE")
+	doc.textRight(right, y, 10, true, invoice.Number)
+	doc.textRight(right, y-14, 9, false, "Date: "+invoice.Issued_at.Format("2006-01-02"))
+	doc.textRight(right, y-27, 9, false, fmt.Sprintf("Order: %d", invoice.Order_id))
+
+	y -= 50
+	location := invoice.Country
+	if invoice.Region != "" {
+		location = invoice.Region + ", " + location
+	}
+	seller := invoiceBlock(os.Getenv("INVOICE_SELLER_NAME"), os.Getenv("INVOICE_SELLER_ADDRESS"))
+	customer := invoiceBlock(invoice.Customer_name, invoice.Email, invoice.Shipping_address, location)
+
+	doc.text(left, y, 9, true, "From")
+	doc.text(300, y, 9, true, "Bill to")
+	for i := 0; i < len(seller) || i < len(customer); i++ {
+		y -= 12
+		if i < len(seller) {
+			doc.text(left, y, 9, false, seller[i])
+		}
+		if i < len(customer) {
+			doc.text(300, y, 9, false, customer[i])
+		}
+	}
+
+	header := func() {
+		doc.text(left, y, 9, true, "Description")
+		doc.text(205, y, 9, true, "SKU")
+		for _, column := range columns {
+			doc.textRight(column.x, y, 9, true, column.title)
+		}
+		doc.line(left, y-4, right, y-4)
+		y -= 18
+	}
+	y -= 30
+	header()
+	for _, line := range invoice.Lines {
+		if y < 120 {
+			doc.addPage()
+			y = pdfPageHeight - 60
+			header()
+		}
+		doc.text(left, y, 9, false, pdfTruncate(line.Description, 9, 150))
+		doc.text(205, y, 9, false, pdfTruncate(line.Sku, 9, 65))
+		values := []string{fmt.Sprintf("%d", line.Quantity), line.Unit_price.String(), line.Discount.String(), line.Tax.String(), line.Total.String()}
+		for i, value := range values {
+			doc.textRight(columns[i].x, y, 9, false, value)
+		}
+		y -= 14
+	}
+	doc.line(left, y+6, right, y+6)
+
+	if y < 160 {
+		doc.addPage()
+		y = pdfPageHeight - 60
+	}
+	y -= 14
+	type summaryLine struct {
+		label  string
+		amount models.Money
+	}
+	summary := []summaryLine{{"Subtotal", invoice.Subtotal}}
+	if !invoice.Discount.IsZero() {
+		summary = append(summary, summaryLine{"Discount", invoice.Discount.Neg()})
+	}
+	for _, line := range summary {
+		doc.text(370, y, 9, false, line.label)
+		doc.textRight(right, y, 9, false, formatInvoiceAmount(line.amount))
+		y -= 14
+	}
+	for _, rate := range invoice.Tax_rates {
+		label := fmt.Sprintf("%s %s%%", rate.Name, rate.Rate)
+		if invoice.Prices_include_tax {
+			label = "incl. " + label
+		}
+		doc.text(370, y, 9, false, pdfTruncate(strings.TrimSpace(label), 9, 100))
+		doc.textRight(right, y, 9, false, formatInvoiceAmount(rate.Tax))
+		y -= 14
+	}
+	doc.line(370, y+8, right, y+8)
+	y -= 4
+	doc.text(370, y, 10, true, "Total")
+	doc.textRight(right, y, 10, true, formatInvoiceAmount(invoice.Total))
+	return doc.bytes()
+}
+
+// invoiceBlock splits values into the lines of an address block, dropping
+// empty ones.
+func invoiceBlock(values ...string) []string {
+	lines := []string{}
+	for _, value := range values {
+		for _, line := range strings.Split(value, "\n") {
+			if line = strings.TrimSpace(line); line != "" {
+				lines = append(lines, line)
+			}
+		}
+	}
+	return lines
+}
+
+// writeInvoice responds with the invoice of an order as a PDF, or as JSON
+// with ?format=json.
+func writeInvoice(w http.ResponseWriter, r *http.Request, orderID int64, userID *int64) {
+	invoice, err := invoiceForOrder(orderID, userID)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	if r.URL.Query().Get("format") == "json" {
+		writeJSON(w, http.StatusOK, invoice)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.pdf"`, invoice.Number))
+	w.WriteHeader(http.StatusOK)
+	w.Write(renderInvoicePDF(invoice))
+}
+
+func GetOrderInvoice(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeInvoice(w, r, id, nil)
+}
+
+func GetUserOrderInvoice(w http.ResponseWriter, r *http.Request) {
+	userID, orderID, err := userOrderIDs(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeInvoice(w, r, orderID, &userID)
+}
+
+func GetAllInvoices(w http.ResponseWriter, r *http.Request) {
+	page, limit := pagination(r)
+
+	db := createConnection()
+	defer db.Close()
+
+	invoices, err := queryInvoices(db, `SELECT `+invoiceColumns+` FROM invoices ORDER BY sequence_number DESC LIMIT $1 OFFSET $2`, limit, (page-1)*limit)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, invoices)
+}
+
+func queryInvoices(q dbtx, sqlStatement string, args ...any) ([]models.Invoice, error) {
+	rows, err := q.Query(sqlStatement, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	invoices := []models.Invoice{}
+	for rows.Next() {
+		invoice, err := scanInvoice(rows)
+		if err != nil {
+			return nil, err
+		}
+		invoices = append(invoices, invoice)
+	}
+	return invoices, rows.Err()
+}
+
+func GetInvoice(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	db := createConnection()
+	defer db.Close()
+
+	invoice, err := scanInvoice(db.QueryRow(`SELECT `+invoiceColumns+` FROM invoices WHERE id=$1`, id))
+	if err == sql.ErrNoRows {
+		err = errInvoiceNotFound
+	}
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, invoice)
+}
@@ -0,0 +1,92 @@
+package middleware
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"os"
+	"time"
+
+	"github.com/joho/godotenv"
+)
+
+// backgroundJob is a task that runs periodically next to the HTTP server.
+// The interval can be overridden with the environment variable intervalEnv.
+// A job with a trigger channel also runs whenever a value is received, and a
+// job marked runAtStart runs once before the first tick.
+type backgroundJob struct {
+	name        string
+	intervalEnv string
+	interval    time.Duration
+	trigger     <-chan struct{}
+	runAtStart  bool
+	run         func(db *sql.DB) error
+}
+
+// backgroundJobs are started by StartBackgroundJobs.
+var backgroundJobs = []backgroundJob{
+	{name: "reservation sweeper", intervalEnv: "RESERVATION_SWEEP_INTERVAL", interval: time.Minute, run: expireReservations},
+	{name: "low-stock scan", intervalEnv: "LOW_STOCK_SCAN_INTERVAL", interval: 5 * time.Minute, trigger: lowStockScans, run: scanLowStock},
+	{name: "exchange-rate import", intervalEnv: "EXCHANGE_RATES_RELOAD_INTERVAL", interval: time.Hour, runAtStart: true, run: importExchangeRatesFile},
+	{name: "price scheduler", intervalEnv: "PRICE_SCHEDULE_INTERVAL", interval: time.Minute, run: applyScheduledPrices},
+	{name: "cart cleanup", intervalEnv: "CART_CLEANUP_INTERVAL", interval: time.Hour, run: expireAnonymousCarts},
+	{name: "order expiry", intervalEnv: "ORDER_EXPIRY_INTERVAL", interval: time.Minute, run: expirePendingOrders},
+}
+
+// StartBackgroundJobs runs every registered job on its own ticker until ctx
+// is cancelled.
+func StartBackgroundJobs(ctx context.Context) {
+	godotenv.Load(".env")
+	for _, job := range backgroundJobs {
+		job.interval = durationFromEnv(job.intervalEnv, job.interval)
+		go job.loop(ctx)
+	}
+}
+
+func (job backgroundJob) loop(ctx context.Context) {
+	if job.runAtStart {
+		job.runOnce()
+	}
+	ticker := time.NewTicker(job.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			job.runOnce()
+		case <-job.trigger:
+			job.runOnce()
+		}
+	}
+}
+
+// runOnce runs the job with its own connection. createConnection panics when
+// the database is unreachable, which must not take the server down here.
+func (job backgroundJob) runOnce() {
+	defer func() {
+		if err := recover(); err != nil {
+			log.Printf("%s failed: %v", job.name, err)
+		}
+	}()
+
+	db := createConnection()
+	defer db.Close()
+
+	if err := job.run(db); err != nil {
+		log.Printf("%s failed: %v", job.name, err)
+	}
+}
+
+func durationFromEnv(name string, fallback time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration <= 0 {
+		log.Printf("Ignoring invalid %s %q", name, value)
+		return fallback
+	}
+	return duration
+}
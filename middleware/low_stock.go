@@ -0,0 +1,173 @@
+package middleware
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"products/models"
+	"sync"
+
+	"github.com/lib/pq"
+)
+
+// lowStockItemColumns selects a product below its reorder point. The
+// suggested order is the reorder quantity, or the shortfall when none is set.
+const lowStockItemColumns = `id, name, sku, quantity, reserved, reorder_point, reorder_quantity,
+	CASE WHEN reorder_quantity > 0 THEN reorder_quantity ELSE reorder_point - quantity END`
+
+const lowStockCondition = `reorder_point IS NOT NULL AND quantity < reorder_point AND archived_at IS NULL`
+
+func queryLowStock(q dbtx, sqlStatement string, args ...any) ([]models.LowStockItem, error) {
+	rows, err := q.Query(sqlStatement, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := []models.LowStockItem{}
+	for rows.Next() {
+		var item models.LowStockItem
+		err := rows.Scan(&item.Product.Id, &item.Product.Name, &item.Product.Sku, &item.Quantity, &item.Reserved, &item.Reorder_point, &item.Reorder_quantity, &item.Suggested_order)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
+var (
+	lowStockNotifierOnce sync.Once
+	lowStockNotifier     multiNotifier
+	lowStockNotifierErr  error
+
+	// lowStockScans wakes the low-stock job early after stock went down.
+	lowStockScans = make(chan struct{}, 1)
+)
+
+// stockChanged asks for a low-stock scan without waiting for the schedule.
+// It never blocks; pending requests are coalesced.
+func stockChanged() {
+	select {
+	case lowStockScans <- struct{}{}:
+	default:
+	}
+}
+
+// scanLowStock alerts once for every product that dropped below its reorder
+// point since the last scan. Products that were restocked are re-armed so a
+// later drop alerts again.
+func scanLowStock(db *sql.DB) error {
+	lowStockNotifierOnce.Do(func() {
+		lowStockNotifier, lowStockNotifierErr = newNotifier()
+	})
+	if lowStockNotifierErr != nil {
+		return lowStockNotifierErr
+	}
+
+	sqlStatement := `UPDATE products SET low_stock_alerted_at=NULL, low_stock_pending='{}'
+	WHERE low_stock_alerted_at IS NOT NULL AND NOT COALESCE(` + lowStockCondition + `, false)`
+	if _, err := db.Exec(sqlStatement); err != nil {
+		return err
+	}
+
+	// A new drop is queued for every notifier, which then clears its own
+	// entry once delivered.
+	sqlStatement = `UPDATE products SET low_stock_alerted_at=Now(), low_stock_pending=$1
+	WHERE low_stock_alerted_at IS NULL AND ` + lowStockCondition
+	if _, err := db.Exec(sqlStatement, pq.Array(lowStockNotifier.names())); err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, notifier := range lowStockNotifier {
+		if err := deliverLowStock(db, notifier); err != nil {
+			errs = append(errs, fmt.Errorf("%s notifier: %w", notifier.name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// deliverLowStock sends the alerts still pending for one notifier. Failed
+// alerts stay pending and are retried on the next scan, without repeating
+// them on the notifiers that already delivered.
+func deliverLowStock(db *sql.DB, notifier namedNotifier) error {
+	sqlStatement := `SELECT ` + lowStockItemColumns + ` FROM products WHERE $1 = ANY(low_stock_pending) ORDER BY id`
+	alerts, err := queryLowStock(db, sqlStatement, notifier.name)
+	if err != nil || len(alerts) == 0 {
+		return err
+	}
+	if err := notifier.Notify(context.Background(), alerts); err != nil {
+		return err
+	}
+
+	ids := make([]int64, len(alerts))
+	for i, alert := range alerts {
+		ids[i] = alert.Product.Id
+	}
+	_, err = db.Exec(`UPDATE products SET low_stock_pending=array_remove(low_stock_pending, $1) WHERE id = ANY($2)`, notifier.name, pq.Array(ids))
+	return err
+}
+
+func GetLowStockReport(w http.ResponseWriter, r *http.Request) {
+	page, limit := pagination(r)
+
+	db := createConnection()
+	defer db.Close()
+
+	sqlStatement := `SELECT ` + lowStockItemColumns + ` FROM products WHERE ` + lowStockCondition + `
+	ORDER BY quantity::float / reorder_point, id LIMIT $1 OFFSET $2`
+	items, err := queryLowStock(db, sqlStatement, limit, (page-1)*limit)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, items)
+}
+
+func UpdateReorderSettings(w http.ResponseWriter, r *http.Request) {
+	productID, err := pathID(r, "id")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var settings models.ReorderSettings
+	if err := json.NewDecoder(r.Body).Decode(&settings); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Unable to decode the request body %v", err))
+		return
+	}
+	if settings.Reorder_point != nil && *settings.Reorder_point < 0 {
+		writeError(w, http.StatusBadRequest, "reorder_point must not be negative")
+		return
+	}
+	if settings.Reorder_quantity < 0 {
+		writeError(w, http.StatusBadRequest, "reorder_quantity must not be negative")
+		return
+	}
+
+	db := createConnection()
+	defer db.Close()
+
+	res, err := db.Exec(`UPDATE products SET reorder_point=$2, reorder_quantity=$3, updated=Now() WHERE id=$1`, productID, settings.Reorder_point, settings.Reorder_quantity)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	if affected, err := res.RowsAffected(); err != nil || affected == 0 {
+		if err == nil {
+			err = errProductNotFound
+		}
+		writeStoreError(w, err)
+		return
+	}
+	stockChanged()
+
+	writeJSON(w, http.StatusOK, response{
+		Id:      productID,
+		Message: "Reorder settings updated successfully",
+	})
+}
@@ -0,0 +1,613 @@
+package middleware
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"net/http"
+	"products/models"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+const (
+	maxImageBytes     = 10 << 20
+	maxImageDimension = 8000
+	maxImagePixels    = 40000000
+	thumbnailQuality  = 85
+)
+
+// thumbnailSizes are the bounding boxes, in pixels, of the generated
+// thumbnails. Images smaller than a box are not upscaled.
+var thumbnailSizes = []struct {
+	name string
+	size int
+}{
+	{"small", 150},
+	{"medium", 400},
+	{"large", 800},
+}
+
+var allowedImageTypes = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+}
+
+var errImageNotFound = notFoundError("Product image not found")
+
+const imageColumns = `id, product_id, storage_key, content_type, width, height, size_bytes, alt_text, position, is_primary, thumbnails, created_at`
+
+func scanImage(row scanner, store BlobStore) (models.ProductImage, error) {
+	var image models.ProductImage
+	var key string
+	var thumbnails []byte
+	err := row.Scan(&image.Id, &image.Product_id, &key, &image.Content_type, &image.Width, &image.Height, &image.Size_bytes, &image.Alt_text, &image.Position, &image.Is_primary, &thumbnails, &image.Created_at)
+	if err != nil {
+		return image, err
+	}
+
+	keys := map[string]string{}
+	if err := json.Unmarshal(thumbnails, &keys); err != nil {
+		return image, err
+	}
+	image.Url = store.URL(key)
+	image.Thumbnails = map[string]string{}
+	for size, thumbnailKey := range keys {
+		image.Thumbnails[size] = store.URL(thumbnailKey)
+	}
+	return image, nil
+}
+
+func getProductImages(q dbtx, store BlobStore, productID int64) ([]models.ProductImage, error) {
+	rows, err := q.Query(`SELECT `+imageColumns+` FROM product_images WHERE product_id=$1 ORDER BY position, id`, productID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	images := []models.ProductImage{}
+	for rows.Next() {
+		image, err := scanImage(rows, store)
+		if err != nil {
+			return nil, err
+		}
+		images = append(images, image)
+	}
+	return images, rows.Err()
+}
+
+// attachPrimaryImages sets Primary_image on a batch of products with a single
+// query.
+func attachPrimaryImages(q dbtx, products []models.Product) error {
+	if len(products) == 0 {
+		return nil
+	}
+	store, err := mediaStore()
+	if err != nil {
+		return err
+	}
+
+	ids := make([]int64, len(products))
+	index := map[int64]int{}
+	for i, product := range products {
+		ids[i] = product.Id
+		index[product.Id] = i
+	}
+
+	rows, err := q.Query(`SELECT `+imageColumns+` FROM product_images WHERE is_primary AND product_id = ANY($1)`, pq.Array(ids))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		image, err := scanImage(rows, store)
+		if err != nil {
+			return err
+		}
+		products[index[image.Product_id]].Primary_image = &image
+	}
+	return rows.Err()
+}
+
+// loadPrimaryImage sets Primary_image on a single product.
+func loadPrimaryImage(q dbtx, product *models.Product) error {
+	products := []models.Product{*product}
+	if err := attachPrimaryImages(q, products); err != nil {
+		return err
+	}
+	product.Primary_image = products[0].Primary_image
+	return nil
+}
+
+func GetProductImages(w http.ResponseWriter, r *http.Request) {
+	productID, err := pathID(r, "id")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	store, err := mediaStore()
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	db := createConnection()
+	defer db.Close()
+
+	if err := productExists(db, productID); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	images, err := getProductImages(db, store, productID)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, images)
+}
+
+func UploadProductImage(w http.ResponseWriter, r *http.Request) {
+	productID, err := pathID(r, "id")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	store, err := mediaStore()
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxImageBytes+1<<20)
+	if err := r.ParseMultipartForm(maxImageBytes); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Unable to parse the multipart form %v", err))
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	file, _, err := r.FormFile("image")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "image file is required")
+		return
+	}
+	data, err := io.ReadAll(io.LimitReader(file, maxImageBytes+1))
+	file.Close()
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	position, _ := strconv.ParseInt(r.FormValue("position"), 10, 64)
+	primary, _ := strconv.ParseBool(r.FormValue("primary"))
+	upload := models.ProductImage{
+		Product_id: productID,
+		Alt_text:   strings.TrimSpace(r.FormValue("alt_text")),
+		Position:   position,
+		Is_primary: primary,
+	}
+
+	id, err := storeProductImage(r, store, upload, data)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, response{
+		Id:      id,
+		Message: "Product image uploaded successfully",
+	})
+}
+
+// storeProductImage validates an upload, writes the original and its
+// thumbnails to the blob store and records them in product_images.
+func storeProductImage(r *http.Request, store BlobStore, upload models.ProductImage, data []byte) (int64, error) {
+	if len(data) > maxImageBytes {
+		return 0, validationError(fmt.Sprintf("image must not be larger than %d bytes", maxImageBytes))
+	}
+	contentType := http.DetectContentType(data)
+	ext, ok := allowedImageTypes[contentType]
+	if !ok {
+		return 0, validationError(fmt.Sprintf("unsupported image type %q, expected JPEG, PNG or GIF", contentType))
+	}
+
+	// Check the header before decoding so huge images are rejected cheaply.
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return 0, validationError(fmt.Sprintf("image could not be read %v", err))
+	}
+	if config.Width > maxImageDimension || config.Height > maxImageDimension {
+		return 0, validationError(fmt.Sprintf("image must not be larger than %dx%d pixels", maxImageDimension, maxImageDimension))
+	}
+	if config.Width*config.Height > maxImagePixels {
+		return 0, validationError(fmt.Sprintf("image must not have more than %d pixels", maxImagePixels))
+	}
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return 0, validationError(fmt.Sprintf("image could not be decoded %v", err))
+	}
+
+	db := createConnection()
+	defer db.Close()
+
+	if err := productExists(db, upload.Product_id); err != nil {
+		return 0, err
+	}
+
+	name, err := randomToken(12)
+	if err != nil {
+		return 0, err
+	}
+	base := fmt.Sprintf("products/%d/%s", upload.Product_id, name)
+
+	ctx := r.Context()
+	var written []string
+	cleanup := func() {
+		for _, key := range written {
+			store.Delete(ctx, key)
+		}
+	}
+
+	originalKey := base + ext
+	if err := store.Put(ctx, originalKey, data, contentType); err != nil {
+		return 0, err
+	}
+	written = append(written, originalKey)
+
+	flat := flattenImage(src)
+	thumbnails := map[string]string{}
+	for _, size := range thumbnailSizes {
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, resizeToFit(flat, size.size), &jpeg.Options{Quality: thumbnailQuality}); err != nil {
+			cleanup()
+			return 0, err
+		}
+		key := fmt.Sprintf("%s_%s.jpg", base, size.name)
+		if err := store.Put(ctx, key, buf.Bytes(), "image/jpeg"); err != nil {
+			cleanup()
+			return 0, err
+		}
+		written = append(written, key)
+		thumbnails[size.name] = key
+	}
+	encodedThumbnails, err := json.Marshal(thumbnails)
+	if err != nil {
+		cleanup()
+		return 0, err
+	}
+
+	id, err := insertProductImage(db, upload, originalKey, contentType, config, len(data), encodedThumbnails)
+	if err != nil {
+		cleanup()
+		return 0, err
+	}
+	return id, nil
+}
+
+func insertProductImage(db *sql.DB, upload models.ProductImage, key string, contentType string, config image.Config, size int, thumbnails []byte) (int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`SELECT 1 FROM products WHERE id=$1 FOR UPDATE`, upload.Product_id); err != nil {
+		return 0, err
+	}
+
+	// The first image of a product always becomes its primary image.
+	var hasPrimary bool
+	if err := tx.QueryRow(`SELECT EXISTS(SELECT 1 FROM product_images WHERE product_id=$1 AND is_primary)`, upload.Product_id).Scan(&hasPrimary); err != nil {
+		return 0, err
+	}
+	primary := upload.Is_primary || !hasPrimary
+	if primary && hasPrimary {
+		if _, err := tx.Exec(`UPDATE product_images SET is_primary=false WHERE product_id=$1 AND is_primary`, upload.Product_id); err != nil {
+			return 0, err
+		}
+	}
+
+	sqlStatement := `INSERT INTO product_images(product_id, storage_key, content_type, width, height, size_bytes, alt_text, position, is_primary, thumbnails, created_at)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, Now()) RETURNING id`
+	var id int64
+	err = tx.QueryRow(sqlStatement, upload.Product_id, key, contentType, config.Width, config.Height, size, upload.Alt_text, upload.Position, primary, thumbnails).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+	return id, tx.Commit()
+}
+
+func UpdateProductImage(w http.ResponseWriter, r *http.Request) {
+	productID, err := pathID(r, "id")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	imageID, err := pathID(r, "imageId")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var update models.ProductImage
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Unable to decode the request %v", err))
+		return
+	}
+
+	db := createConnection()
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	defer tx.Rollback()
+
+	var wasPrimary bool
+	err = tx.QueryRow(`SELECT is_primary FROM product_images WHERE id=$1 AND product_id=$2 FOR UPDATE`, imageID, productID).Scan(&wasPrimary)
+	if err == sql.ErrNoRows {
+		writeStoreError(w, errImageNotFound)
+		return
+	}
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	// The primary image can only be changed by promoting another image.
+	if update.Is_primary && !wasPrimary {
+		if _, err := tx.Exec(`UPDATE product_images SET is_primary=false WHERE product_id=$1 AND is_primary`, productID); err != nil {
+			writeStoreError(w, err)
+			return
+		}
+	}
+
+	sqlStatement := `UPDATE product_images SET alt_text=$3, position=$4, is_primary=$5 WHERE id=$1 AND product_id=$2`
+	if _, err := tx.Exec(sqlStatement, imageID, productID, strings.TrimSpace(update.Alt_text), update.Position, wasPrimary || update.Is_primary); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, response{
+		Id:      imageID,
+		Message: "Product image updated successfully",
+	})
+}
+
+func ReorderProductImages(w http.ResponseWriter, r *http.Request) {
+	productID, err := pathID(r, "id")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var req models.ImageOrderRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Unable to decode the request %v", err))
+		return
+	}
+
+	db := createConnection()
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	defer tx.Rollback()
+
+	existing, err := queryInt64s(tx, `SELECT id FROM product_images WHERE product_id=$1 ORDER BY id FOR UPDATE`, productID)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	if len(existing) != len(req.Image_ids) {
+		writeStoreError(w, validationError("image_ids must list every image of the product exactly once"))
+		return
+	}
+	known := map[int64]bool{}
+	for _, id := range existing {
+		known[id] = true
+	}
+	for position, id := range req.Image_ids {
+		if !known[id] {
+			writeStoreError(w, validationError("image_ids must list every image of the product exactly once"))
+			return
+		}
+		delete(known, id)
+		if _, err := tx.Exec(`UPDATE product_images SET position=$2 WHERE id=$1`, id, position); err != nil {
+			writeStoreError(w, err)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, response{
+		Id:      productID,
+		Message: "Product images reordered successfully",
+	})
+}
+
+func DeleteProductImage(w http.ResponseWriter, r *http.Request) {
+	productID, err := pathID(r, "id")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	imageID, err := pathID(r, "imageId")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	store, err := mediaStore()
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	db := createConnection()
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	defer tx.Rollback()
+
+	var key string
+	var thumbnails []byte
+	var wasPrimary bool
+	sqlStatement := `DELETE FROM product_images WHERE id=$1 AND product_id=$2 RETURNING storage_key, thumbnails, is_primary`
+	err = tx.QueryRow(sqlStatement, imageID, productID).Scan(&key, &thumbnails, &wasPrimary)
+	if err == sql.ErrNoRows {
+		writeStoreError(w, errImageNotFound)
+		return
+	}
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	if wasPrimary {
+		sqlStatement := `UPDATE product_images SET is_primary=true WHERE id=(SELECT id FROM product_images WHERE product_id=$1 ORDER BY position, id LIMIT 1)`
+		if _, err := tx.Exec(sqlStatement, productID); err != nil {
+			writeStoreError(w, err)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	// Blobs are removed after the commit; a failure here only leaves an
+	// unreferenced file behind.
+	keys := map[string]string{}
+	json.Unmarshal(thumbnails, &keys)
+	store.Delete(r.Context(), key)
+	for _, thumbnailKey := range keys {
+		store.Delete(r.Context(), thumbnailKey)
+	}
+
+	writeJSON(w, http.StatusOK, response{
+		Id:      imageID,
+		Message: "Product image deleted successfully",
+	})
+}
+
+// ServeMedia streams a blob from the configured store.
+func ServeMedia(w http.ResponseWriter, r *http.Request) {
+	store, err := mediaStore()
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	key := mux.Vars(r)["key"]
+	if !validBlobKey(key) {
+		writeStoreError(w, errBlobNotFound)
+		return
+	}
+
+	body, contentType, err := store.Get(r.Context(), key)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	defer body.Close()
+
+	if contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	// Keys are random and never reused, so blobs can be cached forever.
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	io.Copy(w, body)
+}
+
+// flattenImage draws src onto a white background so transparent images can
+// be stored as JPEG. Thumbnails are all resized from the one copy.
+func flattenImage(src image.Image) *image.RGBA {
+	bounds := src.Bounds()
+	flat := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(flat, flat.Bounds(), &image.Uniform{C: color.White}, image.Point{}, draw.Src)
+	draw.Draw(flat, flat.Bounds(), src, bounds.Min, draw.Over)
+	return flat
+}
+
+// resizeToFit scales flat down to fit a size x size box using area averaging.
+func resizeToFit(flat *image.RGBA, size int) image.Image {
+	srcW, srcH := flat.Bounds().Dx(), flat.Bounds().Dy()
+
+	dstW, dstH := srcW, srcH
+	if srcW > size || srcH > size {
+		if srcW >= srcH {
+			dstW, dstH = size, max1(srcH*size/srcW)
+		} else {
+			dstW, dstH = max1(srcW*size/srcH), size
+		}
+	}
+	if dstW == srcW && dstH == srcH {
+		return flat
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dstW, dstH))
+	for y := 0; y < dstH; y++ {
+		y0, y1 := y*srcH/dstH, (y+1)*srcH/dstH
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+		for x := 0; x < dstW; x++ {
+			x0, x1 := x*srcW/dstW, (x+1)*srcW/dstW
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+
+			var r, g, b, n int
+			for sy := y0; sy < y1; sy++ {
+				row := flat.Pix[sy*flat.Stride:]
+				for sx := x0; sx < x1; sx++ {
+					r += int(row[sx*4])
+					g += int(row[sx*4+1])
+					b += int(row[sx*4+2])
+					n++
+				}
+			}
+			offset := y*dst.Stride + x*4
+			dst.Pix[offset] = uint8(r / n)
+			dst.Pix[offset+1] = uint8(g / n)
+			dst.Pix[offset+2] = uint8(b / n)
+			dst.Pix[offset+3] = 0xff
+		}
+	}
+	return dst
+}
+
+func max1(n int) int {
+	if n < 1 {
+		return 1
+	}
+	return n
+}
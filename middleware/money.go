@@ -0,0 +1,22 @@
+package middleware
+
+import (
+	"fmt"
+	"products/models"
+)
+
+// checkBasePrice validates an amount that is stored without a currency and
+// is therefore always in the base currency.
+func checkBasePrice(field string, price models.Money) error {
+	return checkPrice(field, price, models.BaseCurrency())
+}
+
+func checkPrice(field string, price models.Money, currency string) error {
+	if price.Currency() != currency {
+		return validationError(fmt.Sprintf("%s must be in %s", field, currency))
+	}
+	if price.IsNegative() {
+		return validationError(fmt.Sprintf("%s must not be negative", field))
+	}
+	return nil
+}
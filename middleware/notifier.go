@@ -0,0 +1,170 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/smtp"
+	"os"
+	"products/models"
+	"strings"
+	"time"
+)
+
+// Notifier delivers low-stock alerts to people or systems that restock.
+type Notifier interface {
+	Notify(ctx context.Context, alerts []models.LowStockItem) error
+}
+
+// newNotifier builds the notifiers listed in LOW_STOCK_NOTIFIERS, a comma
+// separated list of "log", "webhook" and "email". The default is "log".
+func newNotifier() (multiNotifier, error) {
+	kinds := envOrDefault("LOW_STOCK_NOTIFIERS", "log")
+
+	var notifiers multiNotifier
+	seen := map[string]bool{}
+	for _, kind := range strings.Split(kinds, ",") {
+		kind = strings.TrimSpace(kind)
+		if kind == "" || seen[kind] {
+			continue
+		}
+		seen[kind] = true
+
+		switch kind {
+		case "log":
+			notifiers = append(notifiers, namedNotifier{kind, LogNotifier{}})
+		case "webhook":
+			notifier := &WebhookNotifier{
+				URL:    os.Getenv("LOW_STOCK_WEBHOOK_URL"),
+				Secret: os.Getenv("LOW_STOCK_WEBHOOK_SECRET"),
+			}
+			if notifier.URL == "" {
+				return nil, errors.New("LOW_STOCK_WEBHOOK_URL is required for the webhook notifier")
+			}
+			notifiers = append(notifiers, namedNotifier{kind, notifier})
+		case "email":
+			notifier := &EmailNotifier{
+				Addr:     os.Getenv("SMTP_ADDR"),
+				Username: os.Getenv("SMTP_USERNAME"),
+				Password: os.Getenv("SMTP_PASSWORD"),
+				From:     os.Getenv("SMTP_FROM"),
+				To:       strings.Split(os.Getenv("LOW_STOCK_EMAIL_TO"), ","),
+			}
+			if notifier.Addr == "" || notifier.From == "" || os.Getenv("LOW_STOCK_EMAIL_TO") == "" {
+				return nil, errors.New("SMTP_ADDR, SMTP_FROM and LOW_STOCK_EMAIL_TO are required for the email notifier")
+			}
+			notifiers = append(notifiers, namedNotifier{kind, notifier})
+		default:
+			return nil, fmt.Errorf("unknown notifier %q", kind)
+		}
+	}
+	return notifiers, nil
+}
+
+// namedNotifier pairs a notifier with its LOW_STOCK_NOTIFIERS name, which is
+// how delivery is tracked in products.low_stock_pending.
+type namedNotifier struct {
+	name string
+	Notifier
+}
+
+// multiNotifier holds the configured notifiers. Each one delivers on its own
+// so a failing notifier does not make the others send alerts twice.
+type multiNotifier []namedNotifier
+
+func (m multiNotifier) names() []string {
+	names := make([]string, len(m))
+	for i, notifier := range m {
+		names[i] = notifier.name
+	}
+	return names
+}
+
+// LogNotifier writes alerts to the server log.
+type LogNotifier struct{}
+
+func (LogNotifier) Notify(ctx context.Context, alerts []models.LowStockItem) error {
+	for _, alert := range alerts {
+		log.Printf("Low stock: product %d (%s) has %d units, reorder point %d, suggested order %d",
+			alert.Product.Id, alert.Product.Sku, alert.Quantity, alert.Reorder_point, alert.Suggested_order)
+	}
+	return nil
+}
+
+// WebhookNotifier POSTs alerts as JSON. When Secret is set the body is
+// signed with HMAC-SHA256 in the X-Signature header.
+type WebhookNotifier struct {
+	URL    string
+	Secret string
+	Client *http.Client
+}
+
+func (n *WebhookNotifier) Notify(ctx context.Context, alerts []models.LowStockItem) error {
+	body, err := json.Marshal(map[string]any{"event": "low_stock", "alerts": alerts})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if n.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(n.Secret))
+		mac.Write(body)
+		req.Header.Set("X-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	client := n.Client
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("webhook responded with %s", res.Status)
+	}
+	return nil
+}
+
+// EmailNotifier sends one plain text message per batch of alerts.
+type EmailNotifier struct {
+	Addr     string
+	Username string
+	Password string
+	From     string
+	To       []string
+}
+
+func (n *EmailNotifier) Notify(ctx context.Context, alerts []models.LowStockItem) error {
+	var body strings.Builder
+	fmt.Fprintf(&body, "From: %s\r\n", n.From)
+	fmt.Fprintf(&body, "To: %s\r\n", strings.Join(n.To, ", "))
+	fmt.Fprintf(&body, "Subject: Low stock on %d products\r\n", len(alerts))
+	body.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	for _, alert := range alerts {
+		fmt.Fprintf(&body, "%s (%s): %d in stock, reorder point %d, suggested order %d\r\n",
+			alert.Product.Name, alert.Product.Sku, alert.Quantity, alert.Reorder_point, alert.Suggested_order)
+	}
+
+	var auth smtp.Auth
+	if n.Username != "" {
+		host := n.Addr
+		if i := strings.LastIndex(host, ":"); i >= 0 {
+			host = host[:i]
+		}
+		auth = smtp.PlainAuth("", n.Username, n.Password, host)
+	}
+	return smtp.SendMail(n.Addr, auth, n.From, n.To, []byte(body.String()))
+}
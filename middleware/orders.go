@@ -0,0 +1,739 @@
+package middleware
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/mail"
+	"products/models"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Order statuses. An order is pending until paid and is then fulfilled,
+// shipped and delivered. Pending orders can be cancelled; paid ones are
+// refunded instead.
+const (
+	orderPending   = "pending"
+	orderPaid      = "paid"
+	orderFulfilled = "fulfilled"
+	orderShipped   = "shipped"
+	orderDelivered = "delivered"
+	orderCancelled = "cancelled"
+	orderRefunded  = "refunded"
+)
+
+// orderTransitions lists the statuses each status may move to. Cancelled and
+// refunded orders are final.
+var orderTransitions = map[string][]string{
+	orderPending:   {orderPaid, orderCancelled},
+	orderPaid:      {orderFulfilled, orderRefunded},
+	orderFulfilled: {orderShipped, orderRefunded},
+	orderShipped:   {orderDelivered, orderRefunded},
+	orderDelivered: {orderRefunded},
+}
+
+var (
+	errOrderNotFound = notFoundError("Order not found")
+	errCartEmpty     = validationError("Cart is empty")
+)
+
+func canTransitionOrder(from string, to string) bool {
+	for _, status := range orderTransitions[from] {
+		if status == to {
+			return true
+		}
+	}
+	return false
+}
+
+func validOrderStatus(status string) bool {
+	switch status {
+	case orderPending, orderPaid, orderFulfilled, orderShipped, orderDelivered, orderCancelled, orderRefunded:
+		return true
+	}
+	return false
+}
+
+// orderPaymentTTL is how long a pending order holds its stock.
+func orderPaymentTTL() time.Duration {
+	ttl := durationFromEnv("ORDER_PAYMENT_TTL", 30*time.Minute)
+	if ttl > maxReservationTTL {
+		ttl = maxReservationTTL
+	}
+	return ttl
+}
+
+func orderReference(id int64) string {
+	return fmt.Sprintf("order:%d", id)
+}
+
+const orderColumns = `id, user_id, status, email, customer_name, shipping_address, country, region, currency, COALESCE(coupon_code, ''),
+subtotal::text, discount::text, tax_total::text, total::text, tax, expires_at, created_at, updated_at`
+
+func scanOrder(row scanner) (models.Order, error) {
+	var order models.Order
+	var subtotal, discount, taxTotal, total string
+	var tax []byte
+	err := row.Scan(&order.Id, &order.User_id, &order.Status, &order.Email, &order.Customer_name, &order.Shipping_address, &order.Country, &order.Region,
+		&order.Currency, &order.Coupon_code, &subtotal, &discount, &taxTotal, &total, &tax, &order.Expires_at, &order.Created_at, &order.Updated_at)
+	if err != nil {
+		return order, err
+	}
+	// Amounts are parsed once the order currency is known.
+	amounts := []struct {
+		text string
+		dest *models.Money
+	}{{subtotal, &order.Subtotal}, {discount, &order.Discount}, {taxTotal, &order.Tax_total}, {total, &order.Total}}
+	for _, amount := range amounts {
+		if *amount.dest, err = models.ParseMoney(amount.text, order.Currency); err != nil {
+			return order, err
+		}
+	}
+	if tax != nil {
+		order.Tax = &models.TaxBreakdown{}
+		if err := json.Unmarshal(tax, order.Tax); err != nil {
+			return order, err
+		}
+	}
+	return order, nil
+}
+
+// getOrder reads an order with its lines and transitions. With userID set
+// only that user's orders are found.
+func getOrder(q dbtx, id int64, userID *int64) (models.Order, error) {
+	sqlStatement := `SELECT ` + orderColumns + ` FROM orders WHERE id=$1 AND ($2::int8 IS NULL OR user_id=$2)`
+	order, err := scanOrder(q.QueryRow(sqlStatement, id, userID))
+	if err == sql.ErrNoRows {
+		return order, errOrderNotFound
+	}
+	if err != nil {
+		return order, err
+	}
+	err = loadOrderDetails(q, &order)
+	return order, err
+}
+
+// loadOrderDetails reads the lines, transitions and payments of an order.
+func loadOrderDetails(q dbtx, order *models.Order) error {
+	var err error
+	if order.Lines, err = getOrderLines(q, *order); err != nil {
+		return err
+	}
+	if order.Transitions, err = getOrderTransitions(q, order.Id); err != nil {
+		return err
+	}
+	order.Payments, err = getOrderPayments(q, *order)
+	return err
+}
+
+func getOrderLines(q dbtx, order models.Order) ([]models.OrderLine, error) {
+	sqlStatement := `SELECT id, product_id, product_name, sku, quantity, unit_price, line_total, discount, tax, product
+	FROM order_lines WHERE order_id=$1 ORDER BY id`
+	rows, err := q.Query(sqlStatement, order.Id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	lines := []models.OrderLine{}
+	for rows.Next() {
+		line := models.OrderLine{
+			Unit_price: models.NewMoney(0, order.Currency),
+			Line_total: models.NewMoney(0, order.Currency),
+			Discount:   models.NewMoney(0, order.Currency),
+			Tax:        models.NewMoney(0, order.Currency),
+		}
+		var product []byte
+		err := rows.Scan(&line.Id, &line.Product_id, &line.Product_name, &line.Sku, &line.Quantity, &line.Unit_price, &line.Line_total, &line.Discount, &line.Tax, &product)
+		if err != nil {
+			return nil, err
+		}
+		line.Product = product
+		lines = append(lines, line)
+	}
+	return lines, rows.Err()
+}
+
+func getOrderTransitions(q dbtx, orderID int64) ([]models.OrderTransition, error) {
+	sqlStatement := `SELECT id, COALESCE(from_status, ''), to_status, COALESCE(reason, ''), actor_id, created_at
+	FROM order_transitions WHERE order_id=$1 ORDER BY id`
+	rows, err := q.Query(sqlStatement, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	transitions := []models.OrderTransition{}
+	for rows.Next() {
+		var transition models.OrderTransition
+		if err := rows.Scan(&transition.Id, &transition.From_status, &transition.To_status, &transition.Reason, &transition.Actor_id, &transition.Created_at); err != nil {
+			return nil, err
+		}
+		transitions = append(transitions, transition)
+	}
+	return transitions, rows.Err()
+}
+
+func recordOrderTransition(q dbtx, orderID int64, from string, to string, reason string, actorID *int64) error {
+	sqlStatement := `INSERT INTO order_transitions(order_id, from_status, to_status, reason, actor_id, created_at)
+	VALUES ($1, NULLIF($2, ''), $3, NULLIF($4, ''), $5, Now())`
+	_, err := q.Exec(sqlStatement, orderID, from, to, reason, actorID)
+	return err
+}
+
+func normalizeCheckout(req *models.CheckoutRequest, user *models.User) error {
+	req.Email = strings.TrimSpace(req.Email)
+	req.Customer_name = strings.TrimSpace(req.Customer_name)
+	req.Shipping_address = strings.TrimSpace(req.Shipping_address)
+	req.Country = strings.ToUpper(strings.TrimSpace(req.Country))
+	req.Region = strings.ToUpper(strings.TrimSpace(req.Region))
+	if user != nil {
+		if req.Email == "" {
+			req.Email = user.Email
+		}
+		if req.Customer_name == "" {
+			req.Customer_name = strings.TrimSpace(user.First_name + " " + user.Last_name)
+		}
+	}
+	if _, err := mail.ParseAddress(req.Email); err != nil {
+		return validationError("email must be a valid address")
+	}
+	if !countryPattern.MatchString(req.Country) {
+		return validationError("country must be a two-letter ISO 3166 code")
+	}
+	return nil
+}
+
+// checkout turns a cart into a pending order. In one transaction it reprices
+// the cart, reserves stock for every line until the payment deadline, redeems
+// the coupon, snapshots the products and marks the cart as ordered.
+func checkout(q dbtx, cart models.Cart, req models.CheckoutRequest, actorID *int64) (int64, error) {
+	products, err := priceCart(q, &cart, req.Country, req.Region)
+	if err != nil {
+		return 0, err
+	}
+	if len(cart.Lines) == 0 {
+		return 0, errCartEmpty
+	}
+	if cart.Coupon_error != "" {
+		return 0, validationError(cart.Coupon_error)
+	}
+	if !cart.Valid {
+		return 0, conflictError("Cart has lines that cannot be ordered")
+	}
+
+	ttl := orderPaymentTTL()
+	var orderID int64
+	sqlStatement := `INSERT INTO orders(user_id, cart_id, status, email, customer_name, shipping_address, country, region, currency, coupon_code, expires_at, created_at, updated_at)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, NULLIF($10, ''), Now() + $11 * interval '1 second', Now(), Now()) RETURNING id`
+	err = q.QueryRow(sqlStatement, cart.User_id, cart.Id, orderPending, req.Email, req.Customer_name, req.Shipping_address, req.Country, req.Region,
+		cart.Currency, cart.Coupon_code, int64(ttl/time.Second)).Scan(&orderID)
+	if err != nil {
+		return 0, err
+	}
+	reference := orderReference(orderID)
+
+	var redemptionID *int64
+	if cart.Coupon_code != "" {
+		redemption, err := redeemCoupon(q, cart.Coupon_code, cart.User_id, cart.Subtotal, reference)
+		if err != nil {
+			return 0, err
+		}
+		if redemption.Discount.Cmp(cart.Discount) != 0 {
+			return 0, conflictError("Coupon discount has changed, please review the cart")
+		}
+		redemptionID = &redemption.Id
+	}
+
+	discounts := make([]models.Money, len(cart.Lines))
+	for i, amount := range allocateDiscount(cart.Lines, cart.Discount) {
+		discounts[i] = cart.Lines[i].Line_total.Sub(amount)
+	}
+	for i, line := range cart.Lines {
+		reservation, err := reserveStock(q, line.Product_id, line.Quantity, ttl, reference, actorID)
+		if err != nil {
+			return 0, err
+		}
+		snapshot, err := json.Marshal(products[line.Product_id])
+		if err != nil {
+			return 0, err
+		}
+		sqlStatement := `INSERT INTO order_lines(order_id, product_id, reservation_id, product_name, sku, quantity, unit_price, line_total, discount, tax, product)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)`
+		_, err = q.Exec(sqlStatement, orderID, line.Product_id, reservation.Id, line.Product_name, line.Sku, line.Quantity,
+			line.Unit_price, line.Line_total, discounts[i], cart.Tax.Lines[i].Tax, snapshot)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	tax, err := json.Marshal(cart.Tax)
+	if err != nil {
+		return 0, err
+	}
+	sqlStatement = `UPDATE orders SET coupon_redemption_id=$2, subtotal=$3, discount=$4, tax_total=$5, total=$6, tax=$7 WHERE id=$1`
+	if _, err := q.Exec(sqlStatement, orderID, redemptionID, cart.Subtotal, cart.Discount, cart.Tax.Tax_total, cart.Total, tax); err != nil {
+		return 0, err
+	}
+	if err := recordOrderTransition(q, orderID, "", orderPending, "Checkout", actorID); err != nil {
+		return 0, err
+	}
+	if _, err := q.Exec(`UPDATE carts SET status=$2, updated_at=Now() WHERE id=$1`, cart.Id, cartOrdered); err != nil {
+		return 0, err
+	}
+	return orderID, nil
+}
+
+func checkoutCart(w http.ResponseWriter, r *http.Request, resolve cartResolver) {
+	var req models.CheckoutRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Unable to decode the request body %v", err))
+		return
+	}
+	var actorID *int64
+	user, ok := currentUser(r)
+	if ok {
+		actorID = &user.Id
+	}
+	var customer *models.User
+	if ok {
+		customer = &user
+	}
+	if err := normalizeCheckout(&req, customer); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	db := createConnection()
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	defer tx.Rollback()
+
+	cart, err := resolve(tx, r, false, true)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	orderID, err := checkout(tx, cart, req, actorID)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	// The order stands even when payment fails; it can be paid again until
+	// it expires, through /api/user/{id}/orders/{orderId}/pay or, for
+	// anonymous carts, /api/carts/{token}/orders/{orderId}/pay.
+	if err := payOrder(r.Context(), orderID, req.Payment_method); err != nil {
+		log.Printf("Unable to pay order %d: %v", orderID, err)
+	}
+
+	order, err := getOrder(db, orderID, nil)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, order)
+}
+
+func CheckoutUserCart(w http.ResponseWriter, r *http.Request)      { checkoutCart(w, r, userCart) }
+func CheckoutAnonymousCart(w http.ResponseWriter, r *http.Request) { checkoutCart(w, r, tokenCart) }
+
+// transitionOrder moves an order to a new status and records the change.
+// Leaving pending for paid turns the stock reservations into sales; cancelling
+// gives them back. Refunding an order that was paid but not yet fulfilled
+// returns its stock; later refunds only do so when RefundOrder is asked to
+// restock. Cancelled and refunded orders give their coupon back.
+// Paid orders are invoiced in the same transaction.
+func transitionOrder(q dbtx, id int64, to string, reason string, actorID *int64) error {
+	var from string
+	var redemptionID *int64
+	err := q.QueryRow(`SELECT status, coupon_redemption_id FROM orders WHERE id=$1 FOR UPDATE`, id).Scan(&from, &redemptionID)
+	if err == sql.ErrNoRows {
+		return errOrderNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if !canTransitionOrder(from, to) {
+		return conflictError(fmt.Sprintf("Order cannot go from %s to %s", from, to))
+	}
+
+	switch {
+	case to == orderPaid:
+		if err := commitOrderStock(q, id, actorID); err != nil {
+			return err
+		}
+	case to == orderCancelled:
+		if err := releaseOrderStock(q, id); err != nil {
+			return err
+		}
+	case to == orderRefunded && from == orderPaid:
+		if err := returnOrderStock(q, id, actorID); err != nil {
+			return err
+		}
+	}
+	if (to == orderCancelled || to == orderRefunded) && redemptionID != nil {
+		if err := releaseCouponRedemption(q, *redemptionID); err != nil && !errors.Is(err, errCouponRedemptionNotFound) {
+			return err
+		}
+	}
+
+	if _, err := q.Exec(`UPDATE orders SET status=$2, expires_at=NULL, updated_at=Now() WHERE id=$1`, id, to); err != nil {
+		return err
+	}
+	if err := recordOrderTransition(q, id, from, to, reason, actorID); err != nil {
+		return err
+	}
+	if to == orderPaid {
+		_, err := issueInvoice(q, id)
+		return err
+	}
+	return nil
+}
+
+func orderReservations(q dbtx, orderID int64) ([]int64, error) {
+	return queryInt64s(q, `SELECT reservation_id FROM order_lines WHERE order_id=$1 AND reservation_id IS NOT NULL ORDER BY id`, orderID)
+}
+
+// lockOrderReservations locks the reservations of an order and fails with a
+// conflict when one of them is no longer active, before any of them is
+// committed.
+func lockOrderReservations(q dbtx, orderID int64) error {
+	ids, err := orderReservations(q, orderID)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if _, err := lockActiveReservation(q, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func commitOrderStock(q dbtx, orderID int64, actorID *int64) error {
+	ids, err := orderReservations(q, orderID)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if _, err := commitReservation(q, id, orderReference(orderID), actorID); err != nil {
+			var conflict conflictError
+			if errors.As(err, &conflict) {
+				return conflictError("The stock held for this order has been released")
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// releaseOrderStock releases the reservations of a pending order. Ones the
+// reservation sweeper already expired have nothing left to release.
+func releaseOrderStock(q dbtx, orderID int64) error {
+	ids, err := orderReservations(q, orderID)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		_, err := releaseReservation(q, id)
+		var conflict conflictError
+		if err != nil && !errors.As(err, &conflict) && !errors.Is(err, errReservationNotFound) {
+			return err
+		}
+	}
+	return nil
+}
+
+func returnOrderStock(q dbtx, orderID int64, actorID *int64) error {
+	sqlStatement := `SELECT product_id, quantity FROM order_lines WHERE order_id=$1 AND product_id IS NOT NULL ORDER BY id`
+	rows, err := q.Query(sqlStatement, orderID)
+	if err != nil {
+		return err
+	}
+	var movements []models.StockMovement
+	for rows.Next() {
+		movement := models.StockMovement{
+			Type:      movementReturn,
+			Reason:    fmt.Sprintf("Order %d refunded", orderID),
+			Reference: orderReference(orderID),
+			Actor_id:  actorID,
+		}
+		if err := rows.Scan(&movement.Product_id, &movement.Quantity); err != nil {
+			rows.Close()
+			return err
+		}
+		movements = append(movements, movement)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, movement := range movements {
+		if err := adjustStock(q, movement); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// changeOrderStatus runs transitionOrder in its own transaction. Payments
+// still open on a cancelled order are voided afterwards.
+func changeOrderStatus(id int64, to string, reason string, actorID *int64) (models.Order, error) {
+	db := createConnection()
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return models.Order{}, err
+	}
+	defer tx.Rollback()
+
+	if err := transitionOrder(tx, id, to, reason, actorID); err != nil {
+		return models.Order{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return models.Order{}, err
+	}
+	if to == orderCancelled {
+		voidOpenPayments(context.Background(), db, id)
+	}
+	return getOrder(db, id, nil)
+}
+
+// expirePendingOrders cancels orders that were not paid before their stock
+// hold ran out. It runs as a background job.
+func expirePendingOrders(db *sql.DB) error {
+	ids, err := queryInt64s(db, `SELECT id FROM orders WHERE status=$1 AND expires_at <= Now() ORDER BY id`, orderPending)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		_, err := changeOrderStatus(id, orderCancelled, "Payment not received in time", nil)
+		var conflict conflictError
+		// An order paid in the meantime is left alone. Other failures are
+		// retried on the next run without holding up the remaining orders.
+		if err != nil && !errors.As(err, &conflict) {
+			log.Printf("Unable to expire order %d: %v", id, err)
+		}
+	}
+	return nil
+}
+
+func queryOrders(q dbtx, sqlStatement string, args ...any) ([]models.Order, error) {
+	rows, err := q.Query(sqlStatement, args...)
+	if err != nil {
+		return nil, err
+	}
+	orders := []models.Order{}
+	for rows.Next() {
+		order, err := scanOrder(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		orders = append(orders, order)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for i := range orders {
+		if err := loadOrderDetails(q, &orders[i]); err != nil {
+			return nil, err
+		}
+	}
+	return orders, nil
+}
+
+func GetAllOrders(w http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+	if status != "" && !validOrderStatus(status) {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("unknown order status %q", status))
+		return
+	}
+	page, limit := pagination(r)
+
+	db := createConnection()
+	defer db.Close()
+
+	sqlStatement := `SELECT ` + orderColumns + ` FROM orders WHERE ($1::text = '' OR status = $1) ORDER BY id DESC LIMIT $2 OFFSET $3`
+	orders, err := queryOrders(db, sqlStatement, status, limit, (page-1)*limit)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, orders)
+}
+
+func GetOrder(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	db := createConnection()
+	defer db.Close()
+
+	order, err := getOrder(db, id, nil)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, order)
+}
+
+func TransitionOrder(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	var req models.OrderTransitionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Unable to decode the request body %v", err))
+		return
+	}
+	req.Status = strings.ToLower(strings.TrimSpace(req.Status))
+	if !validOrderStatus(req.Status) {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("unknown order status %q", req.Status))
+		return
+	}
+	// Payment status follows the money: orders are paid by a captured payment
+	// and refunded through RefundOrder.
+	if req.Status == orderPaid || req.Status == orderRefunded {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Orders become %s through their payment, not by hand", req.Status))
+		return
+	}
+	var actorID *int64
+	if user, ok := currentUser(r); ok {
+		actorID = &user.Id
+	}
+
+	order, err := changeOrderStatus(id, req.Status, strings.TrimSpace(req.Reason), actorID)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, order)
+}
+
+func GetUserOrders(w http.ResponseWriter, r *http.Request) {
+	userID, err := pathID(r, "id")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	page, limit := pagination(r)
+
+	db := createConnection()
+	defer db.Close()
+
+	sqlStatement := `SELECT ` + orderColumns + ` FROM orders WHERE user_id=$1 ORDER BY id DESC LIMIT $2 OFFSET $3`
+	orders, err := queryOrders(db, sqlStatement, userID, limit, (page-1)*limit)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, orders)
+}
+
+func userOrderIDs(r *http.Request) (int64, int64, error) {
+	userID, err := pathID(r, "id")
+	if err != nil {
+		return 0, 0, err
+	}
+	orderID, err := pathID(r, "orderId")
+	return userID, orderID, err
+}
+
+func GetUserOrder(w http.ResponseWriter, r *http.Request) {
+	userID, orderID, err := userOrderIDs(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	db := createConnection()
+	defer db.Close()
+
+	order, err := getOrder(db, orderID, &userID)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, order)
+}
+
+// getTokenOrder returns an order placed from the anonymous cart with token.
+// The cart no longer needs to be active, as checkout marks it ordered.
+func getTokenOrder(q dbtx, token string, id int64) (models.Order, error) {
+	var exists bool
+	sqlStatement := `SELECT EXISTS(SELECT 1 FROM orders o JOIN carts c ON c.id = o.cart_id WHERE o.id=$1 AND o.user_id IS NULL AND c.token_hash=$2)`
+	if err := q.QueryRow(sqlStatement, id, hashToken(token)).Scan(&exists); err != nil {
+		return models.Order{}, err
+	}
+	if !exists {
+		return models.Order{}, errOrderNotFound
+	}
+	return getOrder(q, id, nil)
+}
+
+// GetAnonymousOrder lets anonymous shoppers follow an order they placed, for
+// example while an asynchronous payment completes.
+func GetAnonymousOrder(w http.ResponseWriter, r *http.Request) {
+	orderID, err := pathID(r, "orderId")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	db := createConnection()
+	defer db.Close()
+
+	order, err := getTokenOrder(db, mux.Vars(r)["token"], orderID)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, order)
+}
+
+// CancelUserOrder lets customers cancel their own orders while unpaid.
+func CancelUserOrder(w http.ResponseWriter, r *http.Request) {
+	userID, orderID, err := userOrderIDs(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	db := createConnection()
+	defer db.Close()
+
+	if _, err := getOrder(db, orderID, &userID); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	order, err := changeOrderStatus(orderID, orderCancelled, "Cancelled by customer", &userID)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, order)
+}
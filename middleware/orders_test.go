@@ -0,0 +1,28 @@
+package middleware
+
+import "testing"
+
+func TestCanTransitionOrder(t *testing.T) {
+	statuses := []string{orderPending, orderPaid, orderFulfilled, orderShipped, orderDelivered, orderCancelled, orderRefunded}
+	allowed := map[[2]string]bool{
+		{orderPending, orderPaid}:       true,
+		{orderPending, orderCancelled}:  true,
+		{orderPaid, orderFulfilled}:     true,
+		{orderPaid, orderRefunded}:      true,
+		{orderFulfilled, orderShipped}:  true,
+		{orderFulfilled, orderRefunded}: true,
+		{orderShipped, orderDelivered}:  true,
+		{orderShipped, orderRefunded}:   true,
+		{orderDelivered, orderRefunded}: true,
+	}
+	for _, from := range statuses {
+		for _, to := range statuses {
+			if got := canTransitionOrder(from, to); got != allowed[[2]string{from, to}] {
+				t.Errorf("canTransitionOrder(%q, %q) = %v", from, to, got)
+			}
+		}
+	}
+	if canTransitionOrder("unknown", orderPaid) || canTransitionOrder(orderPending, "unknown") {
+		t.Error("canTransitionOrder allowed an unknown status")
+	}
+}
@@ -0,0 +1,716 @@
+package middleware
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"products/models"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+	"github.com/joho/godotenv"
+)
+
+// Payment statuses. A payment is authorized, then captured, and may later be
+// refunded. An authorization that is not captured is voided.
+const (
+	paymentPending    = "pending"
+	paymentAuthorized = "authorized"
+	paymentCaptured   = "captured"
+	paymentVoided     = "voided"
+	paymentRefunded   = "refunded"
+	paymentFailed     = "failed"
+)
+
+// paymentTransitions lists the statuses each payment status may move to.
+// Updates that do not follow them, such as a webhook redelivered after the
+// payment moved on, are ignored.
+var paymentTransitions = map[string][]string{
+	paymentPending:    {paymentAuthorized, paymentCaptured, paymentVoided, paymentFailed},
+	paymentAuthorized: {paymentCaptured, paymentVoided, paymentFailed},
+	paymentCaptured:   {paymentRefunded},
+}
+
+var (
+	errPaymentNotFound   = notFoundError("Payment not found")
+	errInvalidSignature  = errors.New("Invalid webhook signature")
+	errNoCapturedPayment = conflictError("Order has no captured payment")
+	errPaymentInProgress = conflictError("Order already has a payment in progress")
+)
+
+// PaymentRequest asks a provider to authorize an amount. Providers use the
+// idempotency key to recognise a retried request.
+type PaymentRequest struct {
+	Order_id        int64
+	Amount          models.Money
+	Email           string
+	Method          string
+	Idempotency_key string
+}
+
+// PaymentResult is the provider's answer: its reference for the payment, the
+// resulting status and, for failures, a message.
+type PaymentResult struct {
+	Reference string
+	Status    string
+	Message   string
+}
+
+// PaymentEvent is an asynchronous status update delivered by webhook.
+type PaymentEvent struct {
+	Id        string `json:"id"`
+	Reference string `json:"reference"`
+	Status    string `json:"status"`
+	Message   string `json:"message"`
+}
+
+// PaymentProvider moves money through a payment gateway.
+type PaymentProvider interface {
+	Name() string
+	Authorize(ctx context.Context, req PaymentRequest) (PaymentResult, error)
+	Capture(ctx context.Context, reference string, amount models.Money) (PaymentResult, error)
+	Void(ctx context.Context, reference string) (PaymentResult, error)
+	Refund(ctx context.Context, reference string, amount models.Money) (PaymentResult, error)
+	// ParseWebhook verifies the signature of a webhook body and decodes the
+	// event it carries.
+	ParseWebhook(header http.Header, body []byte) (PaymentEvent, error)
+}
+
+var (
+	paymentProviderOnce sync.Once
+	paymentProvider     PaymentProvider
+	paymentProviderErr  error
+)
+
+// paymentGateway returns the PaymentProvider configured through
+// PAYMENT_PROVIDER ("mock" is the default and only built-in provider).
+func paymentGateway() (PaymentProvider, error) {
+	paymentProviderOnce.Do(func() {
+		godotenv.Load(".env")
+		paymentProvider, paymentProviderErr = newPaymentProvider(os.Getenv("PAYMENT_PROVIDER"))
+	})
+	return paymentProvider, paymentProviderErr
+}
+
+func newPaymentProvider(kind string) (PaymentProvider, error) {
+	switch kind {
+	case "", "mock":
+		return &MockPaymentProvider{Secret: os.Getenv("PAYMENT_WEBHOOK_SECRET")}, nil
+	default:
+		return nil, fmt.Errorf("unknown PAYMENT_PROVIDER %q", kind)
+	}
+}
+
+// Payment methods understood by MockPaymentProvider.
+const (
+	mockMethodDeclined = "mock_declined"
+	mockMethodAsync    = "mock_async"
+)
+
+// MockPaymentProvider is a local gateway for development and tests. Outcomes
+// depend only on the payment method: mock_declined is declined, mock_async
+// stays pending until a webhook settles it and anything else is authorized.
+// References are derived from the idempotency key, so a retried request gets
+// the same reference. Webhooks are signed like WebhookNotifier's, with
+// HMAC-SHA256 of the body in the X-Signature header.
+type MockPaymentProvider struct {
+	Secret string
+}
+
+func (p *MockPaymentProvider) Name() string {
+	return "mock"
+}
+
+func (p *MockPaymentProvider) Authorize(ctx context.Context, req PaymentRequest) (PaymentResult, error) {
+	sum := sha256.Sum256([]byte(req.Idempotency_key))
+	result := PaymentResult{Reference: "mock_" + hex.EncodeToString(sum[:12])}
+	switch req.Method {
+	case mockMethodDeclined:
+		result.Status = paymentFailed
+		result.Message = "Card declined"
+	case mockMethodAsync:
+		result.Status = paymentPending
+	default:
+		result.Status = paymentAuthorized
+	}
+	return result, nil
+}
+
+func (p *MockPaymentProvider) Capture(ctx context.Context, reference string, amount models.Money) (PaymentResult, error) {
+	return p.settle(reference, paymentCaptured)
+}
+
+func (p *MockPaymentProvider) Void(ctx context.Context, reference string) (PaymentResult, error) {
+	return p.settle(reference, paymentVoided)
+}
+
+func (p *MockPaymentProvider) Refund(ctx context.Context, reference string, amount models.Money) (PaymentResult, error) {
+	return p.settle(reference, paymentRefunded)
+}
+
+func (p *MockPaymentProvider) settle(reference string, status string) (PaymentResult, error) {
+	if !strings.HasPrefix(reference, "mock_") {
+		return PaymentResult{}, fmt.Errorf("unknown payment reference %q", reference)
+	}
+	return PaymentResult{Reference: reference, Status: status}, nil
+}
+
+func (p *MockPaymentProvider) ParseWebhook(header http.Header, body []byte) (PaymentEvent, error) {
+	var event PaymentEvent
+	if p.Secret == "" {
+		return event, errors.New("PAYMENT_WEBHOOK_SECRET is required to accept webhooks")
+	}
+	signature, err := hex.DecodeString(strings.TrimPrefix(header.Get("X-Signature"), "sha256="))
+	if err != nil {
+		return event, errInvalidSignature
+	}
+	mac := hmac.New(sha256.New, []byte(p.Secret))
+	mac.Write(body)
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return event, errInvalidSignature
+	}
+	if err := json.Unmarshal(body, &event); err != nil {
+		return event, validationError(fmt.Sprintf("Unable to decode the webhook body %v", err))
+	}
+	if event.Id == "" || event.Reference == "" {
+		return event, validationError("id and reference are required")
+	}
+	return event, nil
+}
+
+func canTransitionPayment(from string, to string) bool {
+	for _, status := range paymentTransitions[from] {
+		if status == to {
+			return true
+		}
+	}
+	return false
+}
+
+func validPaymentStatus(status string) bool {
+	switch status {
+	case paymentPending, paymentAuthorized, paymentCaptured, paymentVoided, paymentRefunded, paymentFailed:
+		return true
+	}
+	return false
+}
+
+const paymentColumns = `id, order_id, provider, COALESCE(reference, ''), status, amount::text, COALESCE(message, ''), created_at, updated_at`
+
+func getOrderPayments(q dbtx, order models.Order) ([]models.Payment, error) {
+	rows, err := q.Query(`SELECT `+paymentColumns+` FROM payments WHERE order_id=$1 ORDER BY id`, order.Id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	payments := []models.Payment{}
+	for rows.Next() {
+		var payment models.Payment
+		var amount string
+		err := rows.Scan(&payment.Id, &payment.Order_id, &payment.Provider, &payment.Reference, &payment.Status, &amount, &payment.Message, &payment.Created_at, &payment.Updated_at)
+		if err != nil {
+			return nil, err
+		}
+		if payment.Amount, err = models.ParseMoney(amount, order.Currency); err != nil {
+			return nil, err
+		}
+		payments = append(payments, payment)
+	}
+	return payments, rows.Err()
+}
+
+// reconcilePayment applies a status reported by the provider to a payment and
+// brings its order along: a captured payment pays the order and a refunded one
+// refunds it. Reconciling the same status twice changes nothing, so results
+// and webhooks for one payment may arrive in any order and more than once.
+// It reports whether the payment was captured for an order that no longer
+// waits for it, which the caller must refund once the transaction commits.
+func reconcilePayment(q dbtx, paymentID int64, result PaymentResult) (bool, error) {
+	var orderID int64
+	var status string
+	err := q.QueryRow(`SELECT order_id, status FROM payments WHERE id=$1 FOR UPDATE`, paymentID).Scan(&orderID, &status)
+	if err == sql.ErrNoRows {
+		return false, errPaymentNotFound
+	}
+	if err != nil {
+		return false, err
+	}
+
+	sqlStatement := `UPDATE payments SET reference=COALESCE(reference, NULLIF($2, '')), updated_at=Now() WHERE id=$1`
+	if _, err := q.Exec(sqlStatement, paymentID, result.Reference); err != nil {
+		return false, err
+	}
+	if !canTransitionPayment(status, result.Status) {
+		return false, nil
+	}
+	sqlStatement = `UPDATE payments SET status=$2, message=NULLIF($3, ''), updated_at=Now() WHERE id=$1`
+	if _, err := q.Exec(sqlStatement, paymentID, result.Status, result.Message); err != nil {
+		return false, err
+	}
+
+	switch result.Status {
+	case paymentCaptured:
+		return capturePayment(q, orderID, paymentID)
+	case paymentRefunded:
+		return false, refundPayment(q, orderID, paymentID)
+	}
+	return false, nil
+}
+
+// capturePayment pays a pending order with a captured payment. A capture for
+// an order that was cancelled, expired or paid by another payment in the
+// meantime leaves the order alone and is reported for a refund. So is a late
+// capture whose stock reservations were already released: the order cannot
+// be fulfilled any more, so it is cancelled.
+func capturePayment(q dbtx, orderID int64, paymentID int64) (bool, error) {
+	var status string
+	if err := q.QueryRow(`SELECT status FROM orders WHERE id=$1 FOR UPDATE`, orderID).Scan(&status); err != nil {
+		return false, err
+	}
+	if status != orderPending {
+		log.Printf("Payment %d was captured for order %d, which is %s; refunding it", paymentID, orderID, status)
+		return true, nil
+	}
+	if err := lockOrderReservations(q, orderID); err != nil {
+		var conflict conflictError
+		if !errors.As(err, &conflict) && !errors.Is(err, errReservationNotFound) {
+			return false, err
+		}
+		log.Printf("Payment %d was captured for order %d, but %v; cancelling the order and refunding it", paymentID, orderID, err)
+		reason := fmt.Sprintf("Payment %d captured after the stock was released", paymentID)
+		return true, transitionOrder(q, orderID, orderCancelled, reason, nil)
+	}
+	if _, err := q.Exec(`UPDATE orders SET payment_id=$2 WHERE id=$1`, orderID, paymentID); err != nil {
+		return false, err
+	}
+	return false, transitionOrder(q, orderID, orderPaid, fmt.Sprintf("Payment %d captured", paymentID), nil)
+}
+
+// refundPayment refunds the order a payment paid. Refunds of captures that
+// never paid the order leave it as it is.
+func refundPayment(q dbtx, orderID int64, paymentID int64) error {
+	var status string
+	var paidBy *int64
+	err := q.QueryRow(`SELECT status, payment_id FROM orders WHERE id=$1 FOR UPDATE`, orderID).Scan(&status, &paidBy)
+	if err != nil {
+		return err
+	}
+	if paidBy == nil || *paidBy != paymentID || status == orderRefunded {
+		return nil
+	}
+	if !canTransitionOrder(status, orderRefunded) {
+		log.Printf("Order %d is %s and cannot become %s: payment %d refunded", orderID, status, orderRefunded, paymentID)
+		return nil
+	}
+	return transitionOrder(q, orderID, orderRefunded, fmt.Sprintf("Payment %d refunded", paymentID), nil)
+}
+
+// runPaymentUpdate reconciles a provider result in its own transaction and
+// refunds the payment when it was captured for an order that no longer waits
+// for it.
+func runPaymentUpdate(ctx context.Context, db *sql.DB, provider PaymentProvider, paymentID int64, result PaymentResult) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	refundDue, err := reconcilePayment(tx, paymentID, result)
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if refundDue {
+		refundStrayCapture(ctx, db, provider, paymentID)
+	}
+	return nil
+}
+
+// refundStrayCapture gives back a payment captured for an order that no
+// longer waits for it. Failures are logged for a manual refund; the payment
+// stays captured so it is easy to find.
+func refundStrayCapture(ctx context.Context, db *sql.DB, provider PaymentProvider, paymentID int64) {
+	var reference, amount, currency string
+	sqlStatement := `SELECT COALESCE(p.reference, ''), p.amount::text, o.currency FROM payments p JOIN orders o ON o.id = p.order_id WHERE p.id=$1`
+	err := db.QueryRow(sqlStatement, paymentID).Scan(&reference, &amount, &currency)
+	if err != nil {
+		log.Printf("Unable to refund payment %d: %v", paymentID, err)
+		return
+	}
+	total, err := models.ParseMoney(amount, currency)
+	if err != nil {
+		log.Printf("Unable to refund payment %d: %v", paymentID, err)
+		return
+	}
+	result, err := provider.Refund(ctx, reference, total)
+	if err != nil {
+		log.Printf("Unable to refund payment %d: %v", paymentID, err)
+		return
+	}
+	if err := runPaymentUpdate(ctx, db, provider, paymentID, result); err != nil {
+		log.Printf("Unable to record the refund of payment %d: %v", paymentID, err)
+	}
+}
+
+// voidOpenPayments voids the payments of a cancelled order that are still
+// pending or authorized, so the customer's funds are released. A capture
+// that slips through anyway is refunded by runPaymentUpdate.
+func voidOpenPayments(ctx context.Context, db *sql.DB, orderID int64) {
+	provider, err := paymentGateway()
+	if err != nil {
+		log.Printf("Unable to void the payments of order %d: %v", orderID, err)
+		return
+	}
+	sqlStatement := `SELECT id, reference FROM payments WHERE order_id=$1 AND provider=$2 AND status IN ($3, $4) AND reference IS NOT NULL ORDER BY id`
+	rows, err := db.Query(sqlStatement, orderID, provider.Name(), paymentPending, paymentAuthorized)
+	if err != nil {
+		log.Printf("Unable to void the payments of order %d: %v", orderID, err)
+		return
+	}
+	type openPayment struct {
+		id        int64
+		reference string
+	}
+	var open []openPayment
+	for rows.Next() {
+		var payment openPayment
+		if err := rows.Scan(&payment.id, &payment.reference); err != nil {
+			log.Printf("Unable to void the payments of order %d: %v", orderID, err)
+			break
+		}
+		open = append(open, payment)
+	}
+	rows.Close()
+
+	for _, payment := range open {
+		result, err := provider.Void(ctx, payment.reference)
+		if err != nil {
+			log.Printf("Unable to void payment %d: %v", payment.id, err)
+			continue
+		}
+		if err := runPaymentUpdate(ctx, db, provider, payment.id, result); err != nil {
+			log.Printf("Unable to void payment %d: %v", payment.id, err)
+		}
+	}
+}
+
+// runRefundUpdate records a refund result. With restock the goods of the
+// order are booked back in, in the same transaction, once it is refunded.
+func runRefundUpdate(db *sql.DB, orderID int64, paymentID int64, result PaymentResult, restock bool, actorID *int64) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := reconcilePayment(tx, paymentID, result); err != nil {
+		return err
+	}
+	if restock {
+		var status string
+		if err := tx.QueryRow(`SELECT status FROM orders WHERE id=$1`, orderID).Scan(&status); err != nil {
+			return err
+		}
+		if status == orderRefunded {
+			if err := returnOrderStock(tx, orderID, actorID); err != nil {
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+// payOrder authorizes the total of a pending order and captures it right
+// away. Declines and provider errors are recorded on the payment and leave
+// the order pending, so the customer can try again until it expires. Only one
+// attempt may be open at a time. An authorization for an order that stopped
+// waiting for payment is voided.
+func payOrder(ctx context.Context, orderID int64, method string) error {
+	provider, err := paymentGateway()
+	if err != nil {
+		return err
+	}
+
+	db := createConnection()
+	defer db.Close()
+
+	order, err := getOrder(db, orderID, nil)
+	if err != nil {
+		return err
+	}
+	if order.Status != orderPending {
+		return conflictError(fmt.Sprintf("Order is %s and cannot be paid", order.Status))
+	}
+	for _, payment := range order.Payments {
+		if payment.Status == paymentPending || payment.Status == paymentAuthorized {
+			return errPaymentInProgress
+		}
+	}
+
+	var paymentID int64
+	key := fmt.Sprintf("%s:%d", orderReference(order.Id), len(order.Payments)+1)
+	sqlStatement := `INSERT INTO payments(order_id, provider, idempotency_key, status, amount, created_at, updated_at)
+	VALUES ($1, $2, $3, $4, $5, Now(), Now()) RETURNING id`
+	err = db.QueryRow(sqlStatement, order.Id, provider.Name(), key, paymentPending, order.Total).Scan(&paymentID)
+	if isUniqueViolation(err) {
+		// A concurrent attempt got in first.
+		return errPaymentInProgress
+	}
+	if err != nil {
+		return err
+	}
+
+	result, err := provider.Authorize(ctx, PaymentRequest{
+		Order_id:        order.Id,
+		Amount:          order.Total,
+		Email:           order.Email,
+		Method:          method,
+		Idempotency_key: key,
+	})
+	if err != nil {
+		return runPaymentUpdate(ctx, db, provider, paymentID, PaymentResult{Status: paymentFailed, Message: err.Error()})
+	}
+	if err := runPaymentUpdate(ctx, db, provider, paymentID, result); err != nil {
+		return err
+	}
+	if result.Status != paymentAuthorized {
+		return nil
+	}
+
+	var status string
+	if err := db.QueryRow(`SELECT status FROM orders WHERE id=$1`, order.Id).Scan(&status); err != nil {
+		return err
+	}
+	if status != orderPending {
+		result, err = provider.Void(ctx, result.Reference)
+	} else {
+		result, err = provider.Capture(ctx, result.Reference, order.Total)
+	}
+	if err != nil {
+		// The authorization stands; a webhook or a retry settles it.
+		log.Printf("Unable to settle payment %d: %v", paymentID, err)
+		return nil
+	}
+	return runPaymentUpdate(ctx, db, provider, paymentID, result)
+}
+
+// PayUserOrder retries the payment of a customer's pending order.
+func PayUserOrder(w http.ResponseWriter, r *http.Request) {
+	userID, orderID, err := userOrderIDs(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	var req models.PaymentMethodRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Unable to decode the request body %v", err))
+		return
+	}
+
+	db := createConnection()
+	defer db.Close()
+
+	if _, err := getOrder(db, orderID, &userID); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	if err := payOrder(r.Context(), orderID, req.Payment_method); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	order, err := getOrder(db, orderID, &userID)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, order)
+}
+
+// PayAnonymousOrder retries the payment of an order placed from an anonymous
+// cart, which has no user to go through PayUserOrder.
+func PayAnonymousOrder(w http.ResponseWriter, r *http.Request) {
+	orderID, err := pathID(r, "orderId")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	var req models.PaymentMethodRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Unable to decode the request body %v", err))
+		return
+	}
+	token := mux.Vars(r)["token"]
+
+	db := createConnection()
+	defer db.Close()
+
+	if _, err := getTokenOrder(db, token, orderID); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	if err := payOrder(r.Context(), orderID, req.Payment_method); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	order, err := getTokenOrder(db, token, orderID)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, order)
+}
+
+// RefundOrder refunds the captured payment of an order through the provider
+// and marks the order refunded. The stock of a paid order is returned; for an
+// order that already left the warehouse it is only returned with
+// {"restock": true}, once the goods are back.
+func RefundOrder(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	var req models.RefundRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Unable to decode the request body %v", err))
+		return
+	}
+	var actorID *int64
+	if user, ok := currentUser(r); ok {
+		actorID = &user.Id
+	}
+	provider, err := paymentGateway()
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	db := createConnection()
+	defer db.Close()
+
+	order, err := getOrder(db, id, nil)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	// The payment that paid the order is captured before any stray one.
+	var captured *models.Payment
+	for i := range order.Payments {
+		if order.Payments[i].Status == paymentCaptured && order.Payments[i].Provider == provider.Name() {
+			captured = &order.Payments[i]
+			break
+		}
+	}
+	if captured == nil {
+		writeStoreError(w, errNoCapturedPayment)
+		return
+	}
+
+	result, err := provider.Refund(r.Context(), captured.Reference, captured.Amount)
+	if err != nil {
+		writeError(w, http.StatusBadGateway, fmt.Sprintf("Unable to refund the payment %v", err))
+		return
+	}
+	restock := req.Restock && order.Status != orderPaid
+	if err := runRefundUpdate(db, id, captured.Id, result, restock, actorID); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	order, err = getOrder(db, id, nil)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, order)
+}
+
+// PaymentWebhook receives asynchronous status updates from the provider.
+// Events are recorded by id, so a redelivered event is acknowledged without
+// being applied again.
+func PaymentWebhook(w http.ResponseWriter, r *http.Request) {
+	provider, err := paymentGateway()
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Unable to read the request body %v", err))
+		return
+	}
+	event, err := provider.ParseWebhook(r.Header, body)
+	if errors.Is(err, errInvalidSignature) {
+		writeError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	if !validPaymentStatus(event.Status) {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("unknown payment status %q", event.Status))
+		return
+	}
+
+	db := createConnection()
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	defer tx.Rollback()
+
+	var paymentID int64
+	err = tx.QueryRow(`SELECT id FROM payments WHERE provider=$1 AND reference=$2`, provider.Name(), event.Reference).Scan(&paymentID)
+	if err == sql.ErrNoRows {
+		err = errPaymentNotFound
+	}
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	var eventID int64
+	sqlStatement := `INSERT INTO payment_events(provider, event_id, payment_id, status, payload, received_at) VALUES ($1, $2, $3, $4, $5, Now())
+	ON CONFLICT (provider, event_id) DO NOTHING RETURNING id`
+	err = tx.QueryRow(sqlStatement, provider.Name(), event.Id, paymentID, event.Status, body).Scan(&eventID)
+	if err == sql.ErrNoRows {
+		writeJSON(w, http.StatusOK, response{Id: paymentID, Message: "Event already processed"})
+		return
+	}
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	result := PaymentResult{Reference: event.Reference, Status: event.Status, Message: event.Message}
+	refundDue, err := reconcilePayment(tx, paymentID, result)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	if refundDue {
+		refundStrayCapture(r.Context(), db, provider, paymentID)
+	}
+	writeJSON(w, http.StatusOK, response{Id: paymentID, Message: "Event processed"})
+}
@@ -0,0 +1,93 @@
+package middleware
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func signWebhook(secret string, body []byte) http.Header {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	header := http.Header{}
+	header.Set("X-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	return header
+}
+
+func TestMockParseWebhook(t *testing.T) {
+	provider := &MockPaymentProvider{Secret: "whsec"}
+	body := []byte(`{"id":"evt_1","reference":"mock_abc","status":"captured"}`)
+
+	event, err := provider.ParseWebhook(signWebhook("whsec", body), body)
+	if err != nil {
+		t.Fatalf("ParseWebhook: %v", err)
+	}
+	if event.Id != "evt_1" || event.Reference != "mock_abc" || event.Status != paymentCaptured {
+		t.Errorf("ParseWebhook = %+v", event)
+	}
+}
+
+func TestMockParseWebhookRejectsBadSignatures(t *testing.T) {
+	provider := &MockPaymentProvider{Secret: "whsec"}
+	body := []byte(`{"id":"evt_1","reference":"mock_abc","status":"captured"}`)
+
+	tampered := signWebhook("whsec", body)
+	tampered.Set("X-Signature", tampered.Get("X-Signature")[:20]+"00")
+
+	tests := map[string]http.Header{
+		"missing":      {},
+		"wrong secret": signWebhook("other", body),
+		"other body":   signWebhook("whsec", []byte(`{"id":"evt_1","reference":"mock_abc","status":"refunded"}`)),
+		"tampered":     tampered,
+		"not hex":      {"X-Signature": []string{"sha256=zz"}},
+	}
+	for name, header := range tests {
+		if _, err := provider.ParseWebhook(header, body); !errors.Is(err, errInvalidSignature) {
+			t.Errorf("%s: ParseWebhook error = %v, want errInvalidSignature", name, err)
+		}
+	}
+}
+
+func TestMockParseWebhookRequiresSecret(t *testing.T) {
+	body := []byte(`{"id":"evt_1","reference":"mock_abc","status":"captured"}`)
+	provider := &MockPaymentProvider{}
+	// Without a secret an empty signature would verify, so nothing is accepted.
+	if _, err := provider.ParseWebhook(signWebhook("", body), body); err == nil {
+		t.Error("ParseWebhook accepted a webhook without a configured secret")
+	}
+}
+
+func TestMockParseWebhookValidatesEvent(t *testing.T) {
+	provider := &MockPaymentProvider{Secret: "whsec"}
+	for _, body := range []string{`not json`, `{"reference":"mock_abc"}`, `{"id":"evt_1"}`} {
+		_, err := provider.ParseWebhook(signWebhook("whsec", []byte(body)), []byte(body))
+		var invalid validationError
+		if !errors.As(err, &invalid) {
+			t.Errorf("ParseWebhook(%s) error = %v, want a validation error", body, err)
+		}
+	}
+}
+
+func TestCanTransitionPayment(t *testing.T) {
+	statuses := []string{paymentPending, paymentAuthorized, paymentCaptured, paymentVoided, paymentRefunded, paymentFailed}
+	allowed := map[[2]string]bool{
+		{paymentPending, paymentAuthorized}:  true,
+		{paymentPending, paymentCaptured}:    true,
+		{paymentPending, paymentVoided}:      true,
+		{paymentPending, paymentFailed}:      true,
+		{paymentAuthorized, paymentCaptured}: true,
+		{paymentAuthorized, paymentVoided}:   true,
+		{paymentAuthorized, paymentFailed}:   true,
+		{paymentCaptured, paymentRefunded}:   true,
+	}
+	for _, from := range statuses {
+		for _, to := range statuses {
+			if got := canTransitionPayment(from, to); got != allowed[[2]string{from, to}] {
+				t.Errorf("canTransitionPayment(%q, %q) = %v", from, to, got)
+			}
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package middleware
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// pdfDocument writes simple text documents as PDF. It only uses the standard
+// Helvetica fonts, which every reader provides, so nothing is embedded. Text
+// outside their WinAnsiEncoding is transliterated.
+// Coordinates are in points from the bottom left corner of an A4 page.
+type pdfDocument struct {
+	pages []*bytes.Buffer
+}
+
+const (
+	pdfPageWidth  = 595.0
+	pdfPageHeight = 842.0
+)
+
+func newPDFDocument() *pdfDocument {
+	doc := &pdfDocument{}
+	doc.addPage()
+	return doc
+}
+
+func (d *pdfDocument) addPage() {
+	d.pages = append(d.pages, &bytes.Buffer{})
+}
+
+func (d *pdfDocument) page() *bytes.Buffer {
+	return d.pages[len(d.pages)-1]
+}
+
+// text draws s with its left edge at x.
+func (d *pdfDocument) text(x float64, y float64, size float64, bold bool, s string) {
+	font := "F1"
+	if bold {
+		font = "F2"
+	}
+	fmt.Fprintf(d.page(), "BT /%s %.1f Tf %.2f %.2f Td (%s) Tj ET\n", font, size, x, y, pdfEscape(pdfTransliterate(s)))
+}
+
+// textRight draws s with its right edge at x.
+func (d *pdfDocument) textRight(x float64, y float64, size float64, bold bool, s string) {
+	s = pdfTransliterate(s)
+	d.text(x-pdfTextWidth(s, size), y, size, bold, s)
+}
+
+func (d *pdfDocument) line(x1 float64, y1 float64, x2 float64, y2 float64) {
+	fmt.Fprintf(d.page(), "0.5 w %.2f %.2f m %.2f %.2f l S\n", x1, y1, x2, y2)
+}
+
+// bytes assembles the document: catalog, page tree, fonts and one content
+// stream per page, followed by the cross-reference table.
+func (d *pdfDocument) bytes() []byte {
+	var out bytes.Buffer
+	var offsets []int
+	object := func(body string) {
+		offsets = append(offsets, out.Len())
+		fmt.Fprintf(&out, "%d 0 obj\n%s\nendobj\n", len(offsets), body)
+	}
+
+	out.WriteString("%PDF-1.4\n")
+	// Objects 1 to 4 are the catalog, the page tree and the two fonts. Each
+	// page then takes two objects: the page and its content stream.
+	kids := make([]string, len(d.pages))
+	for i := range d.pages {
+		kids[i] = fmt.Sprintf("%d 0 R", 5+2*i)
+	}
+	object("<< /Type /Catalog /Pages 2 0 R >>")
+	object(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(d.pages)))
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>")
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding >>")
+	for i, page := range d.pages {
+		object(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %.0f %.0f] /Resources << /Font << /F1 3 0 R /F2 4 0 R >> >> /Contents %d 0 R >>",
+			pdfPageWidth, pdfPageHeight, 6+2*i))
+		object(fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", page.Len(), page.String()))
+	}
+
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+	return out.Bytes()
+}
+
+// pdfWinAnsi maps the characters WinAnsiEncoding places in 0x80 to 0x9F.
+var pdfWinAnsi = map[rune]byte{
+	'€': 0x80, '‚': 0x82, 'ƒ': 0x83, '„': 0x84, '…': 0x85, '†': 0x86, '‡': 0x87, 'ˆ': 0x88,
+	'‰': 0x89, 'Š': 0x8a, '‹': 0x8b, 'Œ': 0x8c, 'Ž': 0x8e, '‘': 0x91, '’': 0x92, '“': 0x93,
+	'”': 0x94, '•': 0x95, '–': 0x96, '—': 0x97, '˜': 0x98, '™': 0x99, 'š': 0x9a, '›': 0x9b,
+	'œ': 0x9c, 'ž': 0x9e, 'Ÿ': 0x9f,
+}
+
+// pdfTransliterations spell characters the standard fonts cannot show with
+// ones they can, so names and addresses stay readable on invoices.
+var pdfTransliterations = strings.NewReplacer(
+	// Latin letters with diacritics outside Latin-1, as in slugReplacements.
+	"Ā", "A", "ā", "a", "Ă", "A", "ă", "a", "Ą", "A", "ą", "a", "Ć", "C", "ć", "c",
+	"Ĉ", "C", "ĉ", "c", "Ċ", "C", "ċ", "c", "Č", "C", "č", "c", "Ď", "D", "ď", "d",
+	"Đ", "Dj", "đ", "dj", "Ē", "E", "ē", "e", "Ĕ", "E", "ĕ", "e", "Ė", "E", "ė", "e",
+	"Ę", "E", "ę", "e", "Ě", "E", "ě", "e", "Ĝ", "G", "ĝ", "g", "Ğ", "G", "ğ", "g",
+	"Ġ", "G", "ġ", "g", "Ģ", "G", "ģ", "g", "Ĥ", "H", "ĥ", "h", "Ħ", "H", "ħ", "h",
+	"Ĩ", "I", "ĩ", "i", "Ī", "I", "ī", "i", "Ĭ", "I", "ĭ", "i", "Į", "I", "į", "i",
+	"İ", "I", "ı", "i", "Ĳ", "IJ", "ĳ", "ij", "Ĵ", "J", "ĵ", "j", "Ķ", "K", "ķ", "k",
+	"ĸ", "k", "Ĺ", "L", "ĺ", "l", "Ļ", "L", "ļ", "l", "Ľ", "L", "ľ", "l", "Ŀ", "L",
+	"ŀ", "l", "Ł", "L", "ł", "l", "Ń", "N", "ń", "n", "Ņ", "N", "ņ", "n", "Ň", "N",
+	"ň", "n", "ŉ", "n", "Ŋ", "N", "ŋ", "n", "Ō", "O", "ō", "o", "Ŏ", "O", "ŏ", "o",
+	"Ő", "O", "ő", "o", "Ŕ", "R", "ŕ", "r", "Ŗ", "R", "ŗ", "r", "Ř", "R", "ř", "r",
+	"Ś", "S", "ś", "s", "Ŝ", "S", "ŝ", "s", "Ş", "S", "ş", "s", "Ţ", "T", "ţ", "t",
+	"Ť", "T", "ť", "t", "Ŧ", "T", "ŧ", "t", "Ũ", "U", "ũ", "u", "Ū", "U", "ū", "u",
+	"Ŭ", "U", "ŭ", "u", "Ů", "U", "ů", "u", "Ű", "U", "ű", "u", "Ų", "U", "ų", "u",
+	"Ŵ", "W", "ŵ", "w", "Ŷ", "Y", "ŷ", "y", "Ź", "Z", "ź", "z", "Ż", "Z", "ż", "z",
+	"ſ", "s", "Ș", "S", "ș", "s", "Ț", "T", "ț", "t", "Ə", "E", "ə", "e",
+	// Serbian Cyrillic, with the Russian, Ukrainian and Belarusian extras.
+	"А", "A", "а", "a", "Б", "B", "б", "b", "В", "V", "в", "v", "Г", "G", "г", "g",
+	"Д", "D", "д", "d", "Ђ", "Dj", "ђ", "dj", "Е", "E", "е", "e", "Ж", "Ž", "ж", "ž",
+	"З", "Z", "з", "z", "И", "I", "и", "i", "Ј", "J", "ј", "j", "К", "K", "к", "k",
+	"Л", "L", "л", "l", "Љ", "Lj", "љ", "lj", "М", "M", "м", "m", "Н", "N", "н", "n",
+	"Њ", "Nj", "њ", "nj", "О", "O", "о", "o", "П", "P", "п", "p", "Р", "R", "р", "r",
+	"С", "S", "с", "s", "Т", "T", "т", "t", "Ћ", "C", "ћ", "c", "У", "U", "у", "u",
+	"Ф", "F", "ф", "f", "Х", "H", "х", "h", "Ц", "C", "ц", "c", "Ч", "C", "ч", "c",
+	"Џ", "Dž", "џ", "dž", "Ш", "Š", "ш", "š", "Й", "J", "й", "j", "Ё", "E", "ё", "e",
+	"Щ", "Šc", "щ", "šc", "Ъ", "", "ъ", "", "Ы", "Y", "ы", "y", "Ь", "", "ь", "",
+	"Э", "E", "э", "e", "Ю", "Ju", "ю", "ju", "Я", "Ja", "я", "ja", "Є", "Je", "є", "je",
+	"І", "I", "і", "i", "Ї", "Ji", "ї", "ji", "Ґ", "G", "ґ", "g", "Ў", "U", "ў", "u",
+	// Greek.
+	"Α", "A", "α", "a", "Β", "B", "β", "b", "Γ", "G", "γ", "g", "Δ", "D", "δ", "d",
+	"Ε", "E", "ε", "e", "Ζ", "Z", "ζ", "z", "Η", "I", "η", "i", "Θ", "Th", "θ", "th",
+	"Ι", "I", "ι", "i", "Κ", "K", "κ", "k", "Λ", "L", "λ", "l", "Μ", "M", "μ", "m",
+	"Ν", "N", "ν", "n", "Ξ", "X", "ξ", "x", "Ο", "O", "ο", "o", "Π", "P", "π", "p",
+	"Ρ", "R", "ρ", "r", "Σ", "S", "σ", "s", "Τ", "T", "τ", "t", "Υ", "Y", "υ", "y",
+	"Φ", "F", "φ", "f", "Χ", "Ch", "χ", "ch", "Ψ", "Ps", "ψ", "ps", "Ω", "O", "ω", "o",
+	"Ά", "A", "ά", "a", "Έ", "E", "έ", "e", "Ή", "I", "ή", "i", "Ί", "I", "ί", "i",
+	"Ό", "O", "ό", "o", "Ύ", "Y", "ύ", "y", "Ώ", "O", "ώ", "o", "Ϊ", "I", "ϊ", "i",
+	"Ϋ", "Y", "ϋ", "y", "ς", "s", "ΐ", "i", "ΰ", "y",
+	// Dashes, primes, spaces and symbols missing from WinAnsiEncoding.
+	"\u2010", "-", "\u2011", "-", "\u2012", "-", "\u2015", "-", "\u2212", "-", "\u2032", "'", "\u2033", "\"",
+	"\u2007", " ", "\u2009", " ", "\u202f", " ", "\u2264", "<=", "\u2265", ">=", "\u2192", "->",
+)
+
+// pdfTransliterate rewrites s into characters WinAnsiEncoding can show.
+// Anything without a transliteration is written as its code point, such as
+// U+4E2D, rather than dropped.
+func pdfTransliterate(s string) string {
+	s = pdfTransliterations.Replace(s)
+	var b strings.Builder
+	for _, r := range s {
+		_, winAnsi := pdfWinAnsi[r]
+		if r < 128 || (r >= 160 && r <= 255) || winAnsi {
+			b.WriteRune(r)
+			continue
+		}
+		fmt.Fprintf(&b, "U+%04X", r)
+	}
+	return b.String()
+}
+
+// pdfEscape encodes s for a PDF string in WinAnsiEncoding. s must already be
+// transliterated.
+func pdfEscape(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r == '\t':
+			b.WriteByte(' ')
+		case r < 32:
+		case r < 128:
+			b.WriteRune(r)
+		case r >= 160 && r <= 255:
+			fmt.Fprintf(&b, "\\%03o", r)
+		default:
+			if code, ok := pdfWinAnsi[r]; ok {
+				fmt.Fprintf(&b, "\\%03o", code)
+			}
+		}
+	}
+	return b.String()
+}
+
+// pdfTextWidth estimates the width of s in Helvetica. Digits and common
+// punctuation use their exact widths, which is what right aligned amounts
+// need; other characters use an average.
+func pdfTextWidth(s string, size float64) float64 {
+	units := 0
+	for _, r := range s {
+		switch {
+		case r >= '0' && r <= '9', r == '$', r == '€':
+			units += 556
+		case r == '.' || r == ',' || r == ' ' || r == ':' || r == '/':
+			units += 278
+		case r == '-':
+			units += 333
+		case r == '%':
+			units += 889
+		case r >= 'A' && r <= 'Z':
+			units += 667
+		default:
+			units += 556
+		}
+	}
+	return float64(units) * size / 1000
+}
+
+// pdfTruncate shortens s so it fits in width, marking the cut with "...".
+func pdfTruncate(s string, size float64, width float64) string {
+	s = pdfTransliterate(s)
+	if pdfTextWidth(s, size) <= width {
+		return s
+	}
+	runes := []rune(s)
+	for len(runes) > 0 && pdfTextWidth(string(runes)+"...", size) > width {
+		runes = runes[:len(runes)-1]
+	}
+	return string(runes) + "..."
+}
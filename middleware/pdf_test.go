@@ -0,0 +1,35 @@
+package middleware
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPDFTransliterate(t *testing.T) {
+	tests := map[string]string{
+		"Đorđe Čolić":        "Djordje Colic",
+		"Šime Žužić":         "Šime Žužic",
+		"Жарко Шћепановић":   "Žarko Šcepanovic",
+		"Łódź, ul. Piękna 1": "Lódz, ul. Piekna 1",
+		"Αθήνα":              "Athina",
+		"Café “Noir” – 5 €":  "Café “Noir” – 5 €",
+		"李":                  "U+674E",
+	}
+	for input, want := range tests {
+		if got := pdfTransliterate(input); got != want {
+			t.Errorf("pdfTransliterate(%q) = %q, want %q", input, got, want)
+		}
+	}
+}
+
+func TestPDFEscapeNeverWritesQuestionMarks(t *testing.T) {
+	for _, input := range []string{"Đorđe (Čolić) \\", "Жарко", "東京都", "Ωmega ≥ 5"} {
+		got := pdfEscape(pdfTransliterate(input))
+		if strings.Contains(got, "?") {
+			t.Errorf("pdfEscape(%q) = %q contains a question mark", input, got)
+		}
+	}
+	if got := pdfEscape("(Š) €"); got != `\(\212\) \200` {
+		t.Errorf("pdfEscape = %q", got)
+	}
+}
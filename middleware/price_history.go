@@ -0,0 +1,298 @@
+package middleware
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"products/models"
+	"strings"
+	"time"
+)
+
+// Price change statuses.
+const (
+	priceChangeScheduled = "scheduled"
+	priceChangeApplied   = "applied"
+	priceChangeCancelled = "cancelled"
+)
+
+// Price change sources.
+const (
+	priceChangeFromCreate   = "product_create"
+	priceChangeFromUpdate   = "product_update"
+	priceChangeFromVariant  = "variant"
+	priceChangeFromSchedule = "schedule"
+)
+
+var errPriceChangeNotFound = notFoundError("Price change not found")
+
+const priceChangeColumns = `id, product_id, variant_id, old_price, new_price, effective_at, status, source, reason, actor_id, created_at, applied_at`
+
+func scanPriceChange(row scanner) (models.PriceChange, error) {
+	var change models.PriceChange
+	var variantID sql.NullInt64
+	err := row.Scan(&change.Id, &change.Product_id, &variantID, &change.Old_price, &change.New_price, &change.Effective_at, &change.Status, &change.Source, &change.Reason, &change.Actor_id, &change.Created_at, &change.Applied_at)
+	change.Variant_id = variantID.Int64
+	return change, err
+}
+
+// recordPriceChange adds an applied change to the price history. oldPrice
+// is nil for a new product.
+func recordPriceChange(q dbtx, productID int64, oldPrice *models.Money, newPrice models.Money, source string, reason string, actorID *int64) error {
+	sqlStatement := `INSERT INTO price_changes(product_id, old_price, new_price, effective_at, status, source, reason, actor_id, created_at, applied_at)
+	VALUES ($1, $2, $3, Now(), $4, $5, $6, $7, Now(), Now())`
+	_, err := q.Exec(sqlStatement, productID, oldPrice, newPrice, priceChangeApplied, source, reason, actorID)
+	return err
+}
+
+// recordVariantPriceChange adds an applied change to the price history of a
+// variant. Prices are effective prices, so a variant that starts inheriting
+// the product price records that price.
+func recordVariantPriceChange(q dbtx, productID int64, variantID int64, oldPrice *models.Money, newPrice models.Money, actorID *int64) error {
+	sqlStatement := `INSERT INTO price_changes(product_id, variant_id, old_price, new_price, effective_at, status, source, reason, actor_id, created_at, applied_at)
+	VALUES ($1, $2, $3, $4, Now(), $5, $6, '', $7, Now(), Now())`
+	_, err := q.Exec(sqlStatement, productID, variantID, oldPrice, newPrice, priceChangeApplied, priceChangeFromVariant, actorID)
+	return err
+}
+
+// recordInheritedVariantPrices adds a change to the history of every variant
+// that follows the product price, after the product price changed.
+func recordInheritedVariantPrices(q dbtx, productID int64, oldPrice *models.Money, newPrice models.Money, actorID *int64) error {
+	sqlStatement := `INSERT INTO price_changes(product_id, variant_id, old_price, new_price, effective_at, status, source, reason, actor_id, created_at, applied_at)
+	SELECT product_id, id, $2, $3, Now(), $4, $5, 'Follows the product price', $6, Now(), Now() FROM product_variants WHERE product_id=$1 AND price IS NULL`
+	_, err := q.Exec(sqlStatement, productID, oldPrice, newPrice, priceChangeApplied, priceChangeFromVariant, actorID)
+	return err
+}
+
+// lockVariantPrice returns the effective price of a variant and locks the
+// variant row until the transaction ends.
+func lockVariantPrice(q dbtx, productID int64, variantID int64) (*models.Money, error) {
+	var price *models.Money
+	sqlStatement := `SELECT COALESCE(v.price, p.price) FROM product_variants v JOIN products p ON p.id = v.product_id
+	WHERE v.id=$1 AND v.product_id=$2 FOR UPDATE OF v`
+	err := q.QueryRow(sqlStatement, variantID, productID).Scan(&price)
+	if err == sql.ErrNoRows {
+		return nil, errVariantNotFound
+	}
+	return price, err
+}
+
+// lockProductPrice returns the current price of a product and locks the row
+// until the transaction ends. The price is nil when it was never set.
+func lockProductPrice(q dbtx, productID int64) (*models.Money, error) {
+	var price *models.Money
+	err := q.QueryRow(`SELECT price FROM products WHERE id=$1 FOR UPDATE`, productID).Scan(&price)
+	if err == sql.ErrNoRows {
+		return nil, errProductNotFound
+	}
+	return price, err
+}
+
+func priceChanged(oldPrice *models.Money, newPrice models.Money) bool {
+	return oldPrice == nil || oldPrice.Cmp(newPrice) != 0
+}
+
+// applyScheduledPrices applies every scheduled change that became effective,
+// oldest first, so the latest one wins when several are due for a product.
+func applyScheduledPrices(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	sqlStatement := `SELECT ` + priceChangeColumns + ` FROM price_changes
+	WHERE status=$1 AND effective_at <= Now() ORDER BY effective_at, id FOR UPDATE SKIP LOCKED`
+	rows, err := tx.Query(sqlStatement, priceChangeScheduled)
+	if err != nil {
+		return err
+	}
+	due := []models.PriceChange{}
+	for rows.Next() {
+		change, err := scanPriceChange(rows)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		due = append(due, change)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil || len(due) == 0 {
+		return err
+	}
+
+	for _, change := range due {
+		oldPrice, err := lockProductPrice(tx, change.Product_id)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`UPDATE products SET price=$2, updated=Now() WHERE id=$1`, change.Product_id, change.New_price); err != nil {
+			return err
+		}
+		if priceChanged(oldPrice, change.New_price) {
+			if err := recordInheritedVariantPrices(tx, change.Product_id, oldPrice, change.New_price, change.Actor_id); err != nil {
+				return err
+			}
+		}
+		sqlStatement := `UPDATE price_changes SET status=$2, old_price=$3, applied_at=Now() WHERE id=$1`
+		if _, err := tx.Exec(sqlStatement, change.Id, priceChangeApplied, oldPrice); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// GetPriceHistory returns the price timeline of a product: every applied
+// change, pending scheduled changes and cancelled ones, in effective order.
+// With ?variant it returns the timeline of that variant instead.
+func GetPriceHistory(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	variantID, err := queryID(r, "variant")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	db := createConnection()
+	defer db.Close()
+
+	timeline := models.PriceTimeline{Product_id: id, Variant_id: variantID, Changes: []models.PriceChange{}}
+	if variantID == 0 {
+		err = db.QueryRow(`SELECT COALESCE(price, 0) FROM products WHERE id=$1`, id).Scan(&timeline.Current_price)
+		if err == sql.ErrNoRows {
+			err = errProductNotFound
+		}
+	} else {
+		sqlStatement := `SELECT COALESCE(v.price, p.price, 0) FROM product_variants v JOIN products p ON p.id = v.product_id WHERE v.id=$1 AND v.product_id=$2`
+		err = db.QueryRow(sqlStatement, variantID, id).Scan(&timeline.Current_price)
+		if err == sql.ErrNoRows {
+			err = errVariantNotFound
+		}
+	}
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	sqlStatement := `SELECT ` + priceChangeColumns + ` FROM price_changes WHERE product_id=$1 AND COALESCE(variant_id, 0)=$2 ORDER BY effective_at, id`
+	rows, err := db.Query(sqlStatement, id, variantID)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		change, err := scanPriceChange(rows)
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		timeline.Changes = append(timeline.Changes, change)
+	}
+	if err := rows.Err(); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, timeline)
+}
+
+// SchedulePriceChange records a price that the scheduler applies once
+// effective_at has passed.
+func SchedulePriceChange(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var req models.PriceChangeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Unable to decode the request body %v", err))
+		return
+	}
+	if err := checkBasePrice("price", req.Price); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	if !req.Effective_at.After(time.Now()) {
+		writeError(w, http.StatusBadRequest, "effective_at must be in the future")
+		return
+	}
+	var actorID *int64
+	if user, ok := currentUser(r); ok {
+		actorID = &user.Id
+	}
+
+	db := createConnection()
+	defer db.Close()
+
+	sqlStatement := `INSERT INTO price_changes(product_id, new_price, effective_at, status, source, reason, actor_id, created_at)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, Now()) RETURNING id`
+	var changeID int64
+	err = db.QueryRow(sqlStatement, id, req.Price, req.Effective_at, priceChangeScheduled, priceChangeFromSchedule, strings.TrimSpace(req.Reason), actorID).Scan(&changeID)
+	if isForeignKeyViolation(err) {
+		err = errProductNotFound
+	}
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, response{
+		Id:      changeID,
+		Message: "Price change scheduled successfully",
+	})
+}
+
+// CancelPriceChange cancels a scheduled change that has not been applied.
+func CancelPriceChange(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	changeID, err := pathID(r, "changeId")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	db := createConnection()
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	defer tx.Rollback()
+
+	change, err := scanPriceChange(tx.QueryRow(`SELECT `+priceChangeColumns+` FROM price_changes WHERE id=$1 AND product_id=$2 AND variant_id IS NULL FOR UPDATE`, changeID, id))
+	if err == sql.ErrNoRows {
+		err = errPriceChangeNotFound
+	}
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	if change.Status != priceChangeScheduled {
+		writeError(w, http.StatusConflict, fmt.Sprintf("Price change is %s and can no longer be cancelled", change.Status))
+		return
+	}
+	if _, err := tx.Exec(`UPDATE price_changes SET status=$2 WHERE id=$1`, changeID, priceChangeCancelled); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, response{
+		Id:      changeID,
+		Message: "Price change cancelled successfully",
+	})
+}
@@ -0,0 +1,199 @@
+package middleware
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"products/models"
+	"time"
+)
+
+// erasureStatements scrub personal data from records that reference a user.
+// Each statement receives the user id as $1. Rows are anonymized rather than
+// deleted so that foreign keys from other tables stay valid. Issued invoices
+// are deliberately left untouched: they are legal records that must be kept
+// as issued for the retention period, which overrides erasure.
+var erasureStatements = []string{
+	`UPDATE users SET first_name='Deleted', last_name='User', email='erased-' || id || '@invalid', password='',
+	disabled=true, password_reset_required=false, password_reset_token=NULL, password_reset_expires=NULL, erased_at=Now()
+	WHERE id=$1`,
+	`UPDATE audit_log SET details=NULL WHERE target_type='user' AND target_id=$1`,
+	`UPDATE orders SET email='erased-' || user_id || '@invalid', customer_name='Deleted User', shipping_address='' WHERE user_id=$1`,
+	`DELETE FROM carts WHERE user_id=$1`,
+}
+
+var errUserAlreadyErased = errors.New("User has already been erased")
+
+func ExportUserData(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	export, err := exportUserData(id)
+	if errors.Is(err, errUserNotFound) {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("Unable to export user data %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="user-%d-export.json"`, id))
+	writeJSON(w, http.StatusOK, export)
+}
+
+func exportUserData(id int64) (models.UserExport, error) {
+	db := createConnection()
+	defer db.Close()
+
+	var export models.UserExport
+
+	user, err := scanUser(db.QueryRow(`SELECT `+userColumns+` FROM users WHERE id=$1`, id))
+	if err == sql.ErrNoRows {
+		return export, errUserNotFound
+	}
+	if err != nil {
+		return export, err
+	}
+	user.Password = ""
+
+	sqlStatement := `SELECT ` + auditColumns + ` FROM audit_log WHERE actor_id=$1 OR (target_type='user' AND target_id=$1) ORDER BY id`
+	entries, err := queryAuditLog(db, sqlStatement, id)
+	if err != nil {
+		return export, err
+	}
+
+	orders, err := queryOrders(db, `SELECT `+orderColumns+` FROM orders WHERE user_id=$1 ORDER BY id`, id)
+	if err != nil {
+		return export, err
+	}
+
+	payments := []models.Payment{}
+	for _, order := range orders {
+		orderPayments, err := getOrderPayments(db, order)
+		if err != nil {
+			return export, err
+		}
+		payments = append(payments, orderPayments...)
+	}
+
+	invoices, err := queryInvoices(db, `SELECT `+invoiceColumns+` FROM invoices WHERE order_id IN (SELECT id FROM orders WHERE user_id=$1) ORDER BY id`, id)
+	if err != nil {
+		return export, err
+	}
+
+	sqlStatement = `SELECT ` + redemptionColumns + ` FROM coupon_redemptions cr JOIN coupons c ON c.id = cr.coupon_id WHERE cr.user_id=$1 ORDER BY cr.id`
+	redemptions, err := queryRedemptions(db, sqlStatement, id)
+	if err != nil {
+		return export, err
+	}
+
+	carts, err := getUserCarts(db, id)
+	if err != nil {
+		return export, err
+	}
+
+	export.Exported_at = time.Now()
+	export.User = user
+	export.Audit_entries = entries
+	export.Orders = orders
+	export.Payments = payments
+	export.Invoices = invoices
+	export.Coupon_redemptions = redemptions
+	export.Carts = carts
+	return export, nil
+}
+
+// getUserCarts returns every cart of a user, including merged and ordered
+// ones, with their lines at current prices.
+func getUserCarts(q dbtx, userID int64) ([]models.Cart, error) {
+	rows, err := q.Query(`SELECT `+cartColumns+` FROM carts WHERE user_id=$1 ORDER BY id`, userID)
+	if err != nil {
+		return nil, err
+	}
+	carts := []models.Cart{}
+	for rows.Next() {
+		cart, err := scanCart(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		carts = append(carts, cart)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range carts {
+		if _, err := priceCart(q, &carts[i], "", ""); err != nil {
+			return nil, err
+		}
+	}
+	return carts, nil
+}
+
+func EraseUser(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	actor, _ := currentUser(r)
+
+	err = eraseUser(actor.Id, id)
+	switch {
+	case errors.Is(err, errUserNotFound):
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	case errors.Is(err, errUserAlreadyErased):
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	case err != nil:
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("Unable to erase user %v", err))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, response{
+		Id:      id,
+		Message: "User personal data erased successfully",
+	})
+}
+
+func eraseUser(actorID int64, id int64) error {
+	db := createConnection()
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var erasedAt sql.NullTime
+	err = tx.QueryRow(`SELECT erased_at FROM users WHERE id=$1 FOR UPDATE`, id).Scan(&erasedAt)
+	if err == sql.ErrNoRows {
+		return errUserNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if erasedAt.Valid {
+		return errUserAlreadyErased
+	}
+
+	for _, sqlStatement := range erasureStatements {
+		if _, err := tx.Exec(sqlStatement, id); err != nil {
+			return err
+		}
+	}
+
+	if err := insertAuditLog(tx, actorID, "user.erase", "user", id, nil); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
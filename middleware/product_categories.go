@@ -0,0 +1,262 @@
+package middleware
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"products/models"
+)
+
+var errProductCategoryNotFound = notFoundError("Product is not in this category")
+
+// syncPrimaryCategory makes categoryID the primary category of a product in
+// product_categories, replacing the previous primary link. It keeps the join
+// table consistent with writes to the legacy products.category_id column.
+func syncPrimaryCategory(q dbtx, productID int64, categoryID int64) error {
+	_, err := q.Exec(`DELETE FROM product_categories WHERE product_id=$1 AND is_primary AND category_id<>$2`, productID, categoryID)
+	if err != nil || categoryID == 0 {
+		return err
+	}
+
+	sqlStatement := `INSERT INTO product_categories(product_id, category_id, is_primary, position, created_at) VALUES ($1, $2, true, 0, Now())
+	ON CONFLICT (product_id, category_id) DO UPDATE SET is_primary=true`
+	_, err = q.Exec(sqlStatement, productID, categoryID)
+	return err
+}
+
+func getProductCategories(q dbtx, productID int64) ([]models.ProductCategory, error) {
+	sqlStatement := `SELECT pc.product_id, pc.category_id, c.category_name, pc.is_primary, pc.position
+	FROM product_categories pc JOIN categories c ON c.category_id = pc.category_id
+	WHERE pc.product_id=$1 ORDER BY pc.is_primary DESC, pc.position, pc.category_id`
+	rows, err := q.Query(sqlStatement, productID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	links := []models.ProductCategory{}
+	for rows.Next() {
+		var link models.ProductCategory
+		if err := rows.Scan(&link.Product_id, &link.Category_id, &link.Category_name, &link.Is_primary, &link.Position); err != nil {
+			return nil, err
+		}
+		links = append(links, link)
+	}
+	return links, rows.Err()
+}
+
+func GetProductCategories(w http.ResponseWriter, r *http.Request) {
+	productID, err := pathID(r, "id")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	db := createConnection()
+	defer db.Close()
+
+	if err := productExists(db, productID); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	links, err := getProductCategories(db, productID)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, links)
+}
+
+func AttachProductCategory(w http.ResponseWriter, r *http.Request) {
+	productID, err := pathID(r, "id")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var link models.ProductCategory
+	if err := json.NewDecoder(r.Body).Decode(&link); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Unable to decode the request body %v", err))
+		return
+	}
+
+	if err := attachProductCategory(productID, link); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, response{
+		Id:      productID,
+		Message: "Product attached to category successfully",
+	})
+}
+
+func attachProductCategory(productID int64, link models.ProductCategory) error {
+	db := createConnection()
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var attributes models.Attributes
+	err = tx.QueryRow(`SELECT attributes FROM products WHERE id=$1 FOR UPDATE`, productID).Scan(&attributes)
+	if err == sql.ErrNoRows {
+		return errProductNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := getCategoryByID(tx, link.Category_id); err != nil {
+		return err
+	}
+
+	if link.Is_primary {
+		// The primary category's schema governs the product's attributes.
+		if _, err := validateProductAttributes(tx, link.Category_id, attributes); err != nil {
+			return err
+		}
+		_, err := tx.Exec(`UPDATE product_categories SET is_primary=false WHERE product_id=$1 AND is_primary AND category_id<>$2`, productID, link.Category_id)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`UPDATE products SET category_id=$2, updated=Now() WHERE id=$1`, productID, link.Category_id); err != nil {
+			return err
+		}
+	}
+
+	sqlStatement := `INSERT INTO product_categories(product_id, category_id, is_primary, position, created_at) VALUES ($1, $2, $3, $4, Now())
+	ON CONFLICT (product_id, category_id) DO UPDATE SET is_primary = product_categories.is_primary OR EXCLUDED.is_primary, position = EXCLUDED.position`
+	if _, err := tx.Exec(sqlStatement, productID, link.Category_id, link.Is_primary, link.Position); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func DetachProductCategory(w http.ResponseWriter, r *http.Request) {
+	productID, err := pathID(r, "id")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	categoryID, err := pathID(r, "categoryId")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := detachProductCategory(productID, categoryID); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, response{
+		Id:      productID,
+		Message: "Product detached from category successfully",
+	})
+}
+
+// detachProductCategory removes a category link. When the primary category is
+// detached, the next linked category by position is promoted, provided the
+// product's attributes satisfy its schema. A product left without categories
+// keeps its attribute values, like an archived one.
+func detachProductCategory(productID int64, categoryID int64) error {
+	db := createConnection()
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var attributes models.Attributes
+	err = tx.QueryRow(`SELECT attributes FROM products WHERE id=$1 FOR UPDATE`, productID).Scan(&attributes)
+	if err == sql.ErrNoRows {
+		return errProductNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	var wasPrimary bool
+	err = tx.QueryRow(`DELETE FROM product_categories WHERE product_id=$1 AND category_id=$2 RETURNING is_primary`, productID, categoryID).Scan(&wasPrimary)
+	if err == sql.ErrNoRows {
+		return errProductCategoryNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	if wasPrimary {
+		var next sql.NullInt64
+		err := tx.QueryRow(`SELECT category_id FROM product_categories WHERE product_id=$1 ORDER BY position, category_id LIMIT 1`, productID).Scan(&next)
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+		if next.Valid {
+			if _, err := validateProductAttributes(tx, next.Int64, attributes); err != nil {
+				var validation validationError
+				if errors.As(err, &validation) {
+					return validationError(fmt.Sprintf("category %d would become the primary category: %s", next.Int64, err))
+				}
+				return err
+			}
+			if _, err := tx.Exec(`UPDATE product_categories SET is_primary=true WHERE product_id=$1 AND category_id=$2`, productID, next.Int64); err != nil {
+				return err
+			}
+		}
+		if _, err := tx.Exec(`UPDATE products SET category_id=$2, updated=Now() WHERE id=$1`, productID, next); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func GetCategoryProducts(w http.ResponseWriter, r *http.Request) {
+	categoryID, err := pathID(r, "id")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	page, limit := pagination(r)
+
+	db := createConnection()
+	defer db.Close()
+
+	if _, err := getCategoryByID(db, categoryID); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	sqlStatement := `SELECT ` + productColumns + `, pc.is_primary, pc.position
+	FROM product_categories pc JOIN products p ON p.id = pc.product_id
+	WHERE pc.category_id=$1 AND p.archived_at IS NULL
+	ORDER BY pc.position, p.id LIMIT $2 OFFSET $3`
+	rows, err := db.Query(sqlStatement, categoryID, limit, (page-1)*limit)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	defer rows.Close()
+
+	products := []models.CategoryProduct{}
+	for rows.Next() {
+		var item models.CategoryProduct
+		item.Product, err = scanProduct(rows, &item.Is_primary, &item.Position)
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		products = append(products, item)
+	}
+	if err := rows.Err(); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, products)
+}
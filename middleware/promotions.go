@@ -0,0 +1,446 @@
+package middleware
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"products/models"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// Promotion discount types.
+const (
+	discountPercentage = "percentage"
+	discountFixed      = "fixed"
+)
+
+// Promotion scopes.
+const (
+	scopeCatalogue = "catalogue"
+	scopeCategory  = "category"
+	scopeProduct   = "product"
+)
+
+var errPromotionNotFound = notFoundError("Promotion not found")
+
+const promotionColumns = `id, name, description, discount_type, percentage, amount, scope, product_ids, category_ids,
+	priority, stackable, active, starts_at, ends_at, created_at, updated_at`
+
+// activePromotionCondition selects promotions whose validity window is open.
+const activePromotionCondition = `active AND (starts_at IS NULL OR starts_at <= Now()) AND (ends_at IS NULL OR ends_at > Now())`
+
+func scanPromotion(row scanner) (models.Promotion, error) {
+	var promotion models.Promotion
+	var percentage sql.NullString
+	err := row.Scan(&promotion.Id, &promotion.Name, &promotion.Description, &promotion.Discount_type, &percentage, &promotion.Amount, &promotion.Scope,
+		pq.Array(&promotion.Product_ids), pq.Array(&promotion.Category_ids), &promotion.Priority, &promotion.Stackable, &promotion.Active,
+		&promotion.Starts_at, &promotion.Ends_at, &promotion.Created_at, &promotion.Updated_at)
+	promotion.Percentage = percentage.String
+	return promotion, err
+}
+
+func queryPromotions(q dbtx, sqlStatement string, args ...any) ([]models.Promotion, error) {
+	rows, err := q.Query(sqlStatement, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	promotions := []models.Promotion{}
+	for rows.Next() {
+		promotion, err := scanPromotion(rows)
+		if err != nil {
+			return nil, err
+		}
+		promotions = append(promotions, promotion)
+	}
+	return promotions, rows.Err()
+}
+
+// promotionSet evaluates the promotions that are running now against
+// products priced in one currency.
+type promotionSet struct {
+	promotions []models.Promotion
+	rate       *big.Rat
+	// categories holds, per product, its categories and all their ancestors.
+	categories map[int64]map[int64]bool
+}
+
+func loadPromotions(q dbtx, currency string, productIDs []int64) (*promotionSet, error) {
+	promotions, err := queryPromotions(q, `SELECT `+promotionColumns+` FROM promotions WHERE `+activePromotionCondition+` ORDER BY priority DESC, id`)
+	if err != nil {
+		return nil, err
+	}
+	set := &promotionSet{promotions: promotions, categories: map[int64]map[int64]bool{}}
+
+	needRate, needCategories := false, false
+	for _, promotion := range promotions {
+		needRate = needRate || promotion.Discount_type == discountFixed
+		needCategories = needCategories || promotion.Scope == scopeCategory
+	}
+	if needRate {
+		if set.rate, err = getExchangeRate(q, currency); err != nil {
+			return nil, err
+		}
+	}
+	if needCategories {
+		if set.categories, err = productCategoryPaths(q, productIDs); err != nil {
+			return nil, err
+		}
+	}
+	return set, nil
+}
+
+// productCategoryPaths returns the categories of each product including
+// their ancestors, read from the category paths.
+func productCategoryPaths(q dbtx, productIDs []int64) (map[int64]map[int64]bool, error) {
+	rows, err := q.Query(`SELECT pc.product_id, c.path FROM product_categories pc
+	JOIN categories c ON c.category_id = pc.category_id
+	WHERE pc.product_id = ANY($1)`, pq.Array(productIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	categories := map[int64]map[int64]bool{}
+	for rows.Next() {
+		var productID int64
+		var path string
+		if err := rows.Scan(&productID, &path); err != nil {
+			return nil, err
+		}
+		if categories[productID] == nil {
+			categories[productID] = map[int64]bool{}
+		}
+		for _, part := range strings.Split(strings.Trim(path, "/"), "/") {
+			if id, err := strconv.ParseInt(part, 10, 64); err == nil {
+				categories[productID][id] = true
+			}
+		}
+	}
+	return categories, rows.Err()
+}
+
+func (s *promotionSet) matches(promotion models.Promotion, productID int64) bool {
+	switch promotion.Scope {
+	case scopeCatalogue:
+		return true
+	case scopeProduct:
+		for _, id := range promotion.Product_ids {
+			if id == productID {
+				return true
+			}
+		}
+	case scopeCategory:
+		for _, id := range promotion.Category_ids {
+			if s.categories[productID][id] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// discountValue is what a percentage or fixed discount takes off price,
+// never more than price. Fixed amounts are in the base currency and are
+// converted with rate, which is nil when no exchange rate is configured.
+func discountValue(discountType string, percentage string, amount *models.Money, rate *big.Rat, price models.Money) (models.Money, error) {
+	value := models.NewMoney(0, price.Currency())
+	switch discountType {
+	case discountPercentage:
+		factor, err := models.ParseRate(percentage)
+		if err != nil {
+			return value, err
+		}
+		value = price.MulRate(factor.Quo(factor, big.NewRat(100, 1)))
+	case discountFixed:
+		if rate == nil {
+			return value, validationError(fmt.Sprintf("No exchange rate for %s", price.Currency()))
+		}
+		if amount == nil {
+			return value, validationError("amount is required for fixed discounts")
+		}
+		value = amount.Convert(rate, price.Currency())
+	default:
+		return value, fmt.Errorf("unknown discount type %q", discountType)
+	}
+	if value.Cmp(price) > 0 {
+		value = price
+	}
+	return value, nil
+}
+
+// discount applies the matching promotions to the price of a product. The
+// highest priority match always applies. When it is stackable, the other
+// matching stackable promotions apply after it on the reduced price; when it
+// is not, it is the only one.
+func (s *promotionSet) discount(productID int64, price models.Money) (models.Money, []models.AppliedPromotion, error) {
+	applied := []models.AppliedPromotion{}
+	for _, promotion := range s.promotions {
+		if !s.matches(promotion, productID) || (len(applied) > 0 && !promotion.Stackable) {
+			continue
+		}
+		amount, err := discountValue(promotion.Discount_type, promotion.Percentage, promotion.Amount, s.rate, price)
+		if err != nil {
+			return price, nil, err
+		}
+		price = price.Sub(amount)
+		applied = append(applied, models.AppliedPromotion{Promotion_id: promotion.Id, Name: promotion.Name, Discount: amount})
+		if !promotion.Stackable {
+			break
+		}
+	}
+	return price, applied, nil
+}
+
+// apply sets the discounted price of a product and its variants. Products
+// without a running promotion keep only their regular price.
+func (s *promotionSet) apply(product *models.Product) error {
+	discounted, applied, err := s.discount(product.Id, product.Price)
+	if err != nil || len(applied) == 0 {
+		return err
+	}
+	product.Discounted_price = &discounted
+	product.Promotions = applied
+
+	for i := range product.Variants {
+		variant := &product.Variants[i]
+		price, _, err := s.discount(product.Id, variant.Effective_price)
+		if err != nil {
+			return err
+		}
+		variant.Discounted_price = &price
+	}
+	return nil
+}
+
+// applyPromotions discounts products that are already priced in currency.
+func applyPromotions(q dbtx, currency string, products []models.Product) error {
+	if len(products) == 0 {
+		return nil
+	}
+	ids := make([]int64, len(products))
+	for i, product := range products {
+		ids[i] = product.Id
+	}
+	set, err := loadPromotions(q, currency, ids)
+	if err != nil || len(set.promotions) == 0 {
+		return err
+	}
+	for i := range products {
+		if err := set.apply(&products[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// normalizeDiscount validates the discount of a promotion or coupon and
+// returns it with the field the discount type does not use cleared.
+func normalizeDiscount(discountType string, percentage string, amount *models.Money) (string, *models.Money, error) {
+	switch discountType {
+	case discountPercentage:
+		factor, err := models.ParseRate(percentage)
+		if err != nil || factor.Sign() <= 0 || factor.Cmp(big.NewRat(100, 1)) > 0 {
+			return "", nil, validationError("percentage must be greater than 0 and at most 100")
+		}
+		return strings.TrimSpace(percentage), nil, nil
+	case discountFixed:
+		if amount == nil || amount.IsZero() {
+			return "", nil, validationError("amount is required for fixed discounts")
+		}
+		if err := checkBasePrice("amount", *amount); err != nil {
+			return "", nil, err
+		}
+		return "", amount, nil
+	default:
+		return "", nil, validationError(fmt.Sprintf("discount_type must be %s or %s", discountPercentage, discountFixed))
+	}
+}
+
+func normalizePromotion(promotion *models.Promotion) error {
+	promotion.Name = strings.TrimSpace(promotion.Name)
+	if promotion.Name == "" {
+		return validationError("name is required")
+	}
+
+	var err error
+	promotion.Percentage, promotion.Amount, err = normalizeDiscount(promotion.Discount_type, promotion.Percentage, promotion.Amount)
+	if err != nil {
+		return err
+	}
+
+	switch promotion.Scope {
+	case scopeCatalogue:
+		promotion.Product_ids, promotion.Category_ids = nil, nil
+	case scopeProduct:
+		if len(promotion.Product_ids) == 0 {
+			return validationError("product_ids is required for product promotions")
+		}
+		promotion.Category_ids = nil
+	case scopeCategory:
+		if len(promotion.Category_ids) == 0 {
+			return validationError("category_ids is required for category promotions")
+		}
+		promotion.Product_ids = nil
+	default:
+		return validationError(fmt.Sprintf("scope must be %s, %s or %s", scopeCatalogue, scopeCategory, scopeProduct))
+	}
+	if promotion.Product_ids == nil {
+		promotion.Product_ids = []int64{}
+	}
+	if promotion.Category_ids == nil {
+		promotion.Category_ids = []int64{}
+	}
+
+	if promotion.Starts_at != nil && promotion.Ends_at != nil && !promotion.Ends_at.After(*promotion.Starts_at) {
+		return validationError("ends_at must be after starts_at")
+	}
+	return nil
+}
+
+func GetAllPromotions(w http.ResponseWriter, r *http.Request) {
+	page, limit := pagination(r)
+
+	db := createConnection()
+	defer db.Close()
+
+	sqlStatement := `SELECT ` + promotionColumns + ` FROM promotions`
+	if r.URL.Query().Get("running") == "true" {
+		sqlStatement += ` WHERE ` + activePromotionCondition
+	}
+	sqlStatement += ` ORDER BY priority DESC, id LIMIT $1 OFFSET $2`
+	promotions, err := queryPromotions(db, sqlStatement, limit, (page-1)*limit)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, promotions)
+}
+
+func GetPromotion(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	db := createConnection()
+	defer db.Close()
+
+	promotion, err := scanPromotion(db.QueryRow(`SELECT `+promotionColumns+` FROM promotions WHERE id=$1`, id))
+	if err == sql.ErrNoRows {
+		err = errPromotionNotFound
+	}
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, promotion)
+}
+
+func CreatePromotion(w http.ResponseWriter, r *http.Request) {
+	promotion := models.Promotion{Active: true}
+	if err := json.NewDecoder(r.Body).Decode(&promotion); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Unable to decode the request body %v", err))
+		return
+	}
+	if err := normalizePromotion(&promotion); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	db := createConnection()
+	defer db.Close()
+
+	sqlStatement := `INSERT INTO promotions(name, description, discount_type, percentage, amount, scope, product_ids, category_ids,
+	priority, stackable, active, starts_at, ends_at, created_at, updated_at)
+	VALUES ($1, $2, $3, NULLIF($4, '')::numeric, $5, $6, $7, $8, $9, $10, $11, $12, $13, Now(), Now()) RETURNING id`
+	var id int64
+	err := db.QueryRow(sqlStatement, promotion.Name, promotion.Description, promotion.Discount_type, promotion.Percentage, promotion.Amount, promotion.Scope,
+		pq.Array(promotion.Product_ids), pq.Array(promotion.Category_ids), promotion.Priority, promotion.Stackable, promotion.Active,
+		promotion.Starts_at, promotion.Ends_at).Scan(&id)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, response{
+		Id:      id,
+		Message: "Promotion created successfully",
+	})
+}
+
+func UpdatePromotion(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	promotion := models.Promotion{Active: true}
+	if err := json.NewDecoder(r.Body).Decode(&promotion); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Unable to decode the request body %v", err))
+		return
+	}
+	if err := normalizePromotion(&promotion); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	db := createConnection()
+	defer db.Close()
+
+	sqlStatement := `UPDATE promotions SET name=$2, description=$3, discount_type=$4, percentage=NULLIF($5, '')::numeric, amount=$6, scope=$7,
+	product_ids=$8, category_ids=$9, priority=$10, stackable=$11, active=$12, starts_at=$13, ends_at=$14, updated_at=Now() WHERE id=$1`
+	res, err := db.Exec(sqlStatement, id, promotion.Name, promotion.Description, promotion.Discount_type, promotion.Percentage, promotion.Amount, promotion.Scope,
+		pq.Array(promotion.Product_ids), pq.Array(promotion.Category_ids), promotion.Priority, promotion.Stackable, promotion.Active,
+		promotion.Starts_at, promotion.Ends_at)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	if affected, err := res.RowsAffected(); err != nil || affected == 0 {
+		if err == nil {
+			err = errPromotionNotFound
+		}
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, response{
+		Id:      id,
+		Message: "Promotion updated successfully",
+	})
+}
+
+func DeletePromotion(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	db := createConnection()
+	defer db.Close()
+
+	res, err := db.Exec(`DELETE FROM promotions WHERE id=$1`, id)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	if affected, err := res.RowsAffected(); err != nil || affected == 0 {
+		if err == nil {
+			err = errPromotionNotFound
+		}
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, response{
+		Id:      id,
+		Message: "Promotion deleted successfully",
+	})
+}
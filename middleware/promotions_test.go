@@ -0,0 +1,63 @@
+package middleware
+
+import (
+	"math/big"
+	"products/models"
+	"testing"
+)
+
+func TestDiscountValue(t *testing.T) {
+	five := models.NewMoney(500, "EUR")
+	fifty := models.NewMoney(5000, "EUR")
+
+	tests := []struct {
+		name         string
+		discountType string
+		percentage   string
+		amount       *models.Money
+		rate         *big.Rat
+		price        models.Money
+		want         models.Money
+	}{
+		{"percentage", discountPercentage, "10", nil, nil, models.NewMoney(1999, "EUR"), models.NewMoney(200, "EUR")},
+		{"fractional percentage", discountPercentage, "12.5", nil, nil, models.NewMoney(1000, "USD"), models.NewMoney(125, "USD")},
+		{"percentage over 100 is capped", discountPercentage, "150", nil, nil, models.NewMoney(1000, "EUR"), models.NewMoney(1000, "EUR")},
+		{"fixed", discountFixed, "", &five, big.NewRat(1, 1), models.NewMoney(1999, "EUR"), models.NewMoney(500, "EUR")},
+		{"fixed converted", discountFixed, "", &five, big.NewRat(11, 10), models.NewMoney(1999, "USD"), models.NewMoney(550, "USD")},
+		{"fixed converted to JPY", discountFixed, "", &five, big.NewRat(160, 1), models.NewMoney(2000, "JPY"), models.NewMoney(800, "JPY")},
+		{"fixed over price is capped", discountFixed, "", &fifty, big.NewRat(1, 1), models.NewMoney(1999, "EUR"), models.NewMoney(1999, "EUR")},
+	}
+	for _, tt := range tests {
+		got, err := discountValue(tt.discountType, tt.percentage, tt.amount, tt.rate, tt.price)
+		if err != nil {
+			t.Errorf("%s: discountValue: %v", tt.name, err)
+			continue
+		}
+		if got.Cmp(tt.want) != 0 || got.Currency() != tt.want.Currency() {
+			t.Errorf("%s: discountValue = %s %s, want %s %s", tt.name, got, got.Currency(), tt.want, tt.want.Currency())
+		}
+	}
+}
+
+func TestDiscountValueInvalid(t *testing.T) {
+	five := models.NewMoney(500, "EUR")
+	price := models.NewMoney(1999, "EUR")
+
+	tests := []struct {
+		name         string
+		discountType string
+		percentage   string
+		amount       *models.Money
+		rate         *big.Rat
+	}{
+		{"bad percentage", discountPercentage, "ten", nil, nil},
+		{"fixed without rate", discountFixed, "", &five, nil},
+		{"fixed without amount", discountFixed, "", nil, big.NewRat(1, 1)},
+		{"unknown type", "bogo", "10", &five, big.NewRat(1, 1)},
+	}
+	for _, tt := range tests {
+		if got, err := discountValue(tt.discountType, tt.percentage, tt.amount, tt.rate, price); err == nil {
+			t.Errorf("%s: discountValue = %s, want an error", tt.name, got)
+		}
+	}
+}
@@ -0,0 +1,564 @@
+package middleware
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"products/models"
+	"strconv"
+	"strings"
+)
+
+const (
+	poDraft             = "draft"
+	poSent              = "sent"
+	poPartiallyReceived = "partially_received"
+	poReceived          = "received"
+	poCancelled         = "cancelled"
+)
+
+var (
+	errPurchaseOrderNotFound = notFoundError("Purchase order not found")
+	errPurchaseLineNotFound  = notFoundError("Purchase order line not found")
+)
+
+const purchaseOrderColumns = `po.id, po.supplier_id, s.name, po.status, po.warehouse_id, po.notes, po.expected_at, po.created_by, po.sent_at, po.received_at, po.created_at, po.updated_at`
+
+const purchaseOrderQuery = `SELECT ` + purchaseOrderColumns + ` FROM purchase_orders po JOIN suppliers s ON s.id = po.supplier_id`
+
+func scanPurchaseOrder(row scanner) (models.PurchaseOrder, error) {
+	var order models.PurchaseOrder
+	var warehouseID sql.NullInt64
+	err := row.Scan(&order.Id, &order.Supplier_id, &order.Supplier_name, &order.Status, &warehouseID, &order.Notes, &order.Expected_at, &order.Created_by, &order.Sent_at, &order.Received_at, &order.Created_at, &order.Updated_at)
+	order.Warehouse_id = warehouseID.Int64
+	return order, err
+}
+
+func getPurchaseOrder(q dbtx, id int64, forUpdate bool) (models.PurchaseOrder, error) {
+	sqlStatement := purchaseOrderQuery + ` WHERE po.id=$1`
+	if forUpdate {
+		sqlStatement += ` FOR UPDATE OF po`
+	}
+	order, err := scanPurchaseOrder(q.QueryRow(sqlStatement, id))
+	if err == sql.ErrNoRows {
+		return order, errPurchaseOrderNotFound
+	}
+	if err != nil {
+		return order, err
+	}
+	order.Lines, err = getPurchaseOrderLines(q, id)
+	for _, line := range order.Lines {
+		order.Total = order.Total.Add(line.Line_total)
+	}
+	return order, err
+}
+
+func getPurchaseOrderLines(q dbtx, orderID int64) ([]models.PurchaseOrderLine, error) {
+	sqlStatement := `SELECT l.id, l.product_id, p.name, p.sku, l.supplier_sku, l.quantity_ordered, l.quantity_received, l.unit_cost
+	FROM purchase_order_lines l JOIN products p ON p.id = l.product_id
+	WHERE l.purchase_order_id=$1 ORDER BY l.id`
+	rows, err := q.Query(sqlStatement, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	lines := []models.PurchaseOrderLine{}
+	for rows.Next() {
+		var line models.PurchaseOrderLine
+		err := rows.Scan(&line.Id, &line.Product_id, &line.Product_name, &line.Sku, &line.Supplier_sku, &line.Quantity_ordered, &line.Quantity_received, &line.Unit_cost)
+		if err != nil {
+			return nil, err
+		}
+		line.Line_total = line.Unit_cost.Mul(line.Quantity_ordered)
+		lines = append(lines, line)
+	}
+	return lines, rows.Err()
+}
+
+func GetAllPurchaseOrders(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	page, limit := pagination(r)
+
+	var conditions []string
+	var args []any
+	if status := query.Get("status"); status != "" {
+		args = append(args, status)
+		conditions = append(conditions, fmt.Sprintf("po.status = $%d", len(args)))
+	}
+	if value := query.Get("supplier_id"); value != "" {
+		supplierID, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "Unable to convert supplier_id into int")
+			return
+		}
+		args = append(args, supplierID)
+		conditions = append(conditions, fmt.Sprintf("po.supplier_id = $%d", len(args)))
+	}
+
+	where := ""
+	if len(conditions) > 0 {
+		where = " WHERE " + strings.Join(conditions, " AND ")
+	}
+	args = append(args, limit, (page-1)*limit)
+	sqlStatement := fmt.Sprintf(`%s%s ORDER BY po.id DESC LIMIT $%d OFFSET $%d`, purchaseOrderQuery, where, len(args)-1, len(args))
+
+	db := createConnection()
+	defer db.Close()
+
+	rows, err := db.Query(sqlStatement, args...)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	defer rows.Close()
+
+	orders := []models.PurchaseOrder{}
+	for rows.Next() {
+		order, err := scanPurchaseOrder(rows)
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		orders = append(orders, order)
+	}
+	if err := rows.Err(); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, orders)
+}
+
+func GetPurchaseOrder(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	db := createConnection()
+	defer db.Close()
+
+	order, err := getPurchaseOrder(db, id, false)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, order)
+}
+
+func CreatePurchaseOrder(w http.ResponseWriter, r *http.Request) {
+	var order models.PurchaseOrder
+	if err := json.NewDecoder(r.Body).Decode(&order); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Unable to decode the request body %v", err))
+		return
+	}
+	var actorID *int64
+	if user, ok := currentUser(r); ok {
+		actorID = &user.Id
+	}
+
+	id, err := createPurchaseOrder(order, actorID)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, response{
+		Id:      id,
+		Message: "Purchase order created successfully",
+	})
+}
+
+// createPurchaseOrder stores a draft order together with any lines sent
+// along with it.
+func createPurchaseOrder(order models.PurchaseOrder, actorID *int64) (int64, error) {
+	db := createConnection()
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	supplier, err := getSupplier(tx, order.Supplier_id)
+	if err == errSupplierNotFound {
+		return 0, validationError("Supplier does not exist")
+	}
+	if err != nil {
+		return 0, err
+	}
+	if !supplier.Active {
+		return 0, validationError("Supplier is inactive")
+	}
+	if order.Warehouse_id != 0 {
+		if _, err := getWarehouse(tx, order.Warehouse_id); err != nil {
+			return 0, err
+		}
+	}
+	// Default the expected delivery to the supplier's lead time.
+	expected := order.Expected_at
+	if expected == nil && supplier.Lead_time_days > 0 {
+		if err := tx.QueryRow(`SELECT (Now() + $1 * interval '1 day')::timestamp`, supplier.Lead_time_days).Scan(&expected); err != nil {
+			return 0, err
+		}
+	}
+
+	sqlStatement := `INSERT INTO purchase_orders(supplier_id, status, warehouse_id, notes, expected_at, created_by, created_at, updated_at)
+	VALUES ($1, $2, NULLIF($3, 0), $4, $5, $6, Now(), Now()) RETURNING id`
+	var id int64
+	err = tx.QueryRow(sqlStatement, order.Supplier_id, poDraft, order.Warehouse_id, strings.TrimSpace(order.Notes), expected, actorID).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, line := range order.Lines {
+		if _, err := addPurchaseOrderLine(tx, id, order.Supplier_id, line); err != nil {
+			return 0, err
+		}
+	}
+	return id, tx.Commit()
+}
+
+// addPurchaseOrderLine adds a product to a draft order. The unit cost and
+// supplier SKU default to the supplier's terms for the product.
+func addPurchaseOrderLine(q dbtx, orderID int64, supplierID int64, line models.PurchaseOrderLine) (int64, error) {
+	if line.Quantity_ordered <= 0 {
+		return 0, validationError("quantity_ordered must be positive")
+	}
+	if err := checkBasePrice("unit_cost", line.Unit_cost); err != nil {
+		return 0, err
+	}
+	if err := productExists(q, line.Product_id); err != nil {
+		return 0, err
+	}
+
+	var supplierSku string
+	var cost *models.Money
+	err := q.QueryRow(`SELECT supplier_sku, cost_price FROM supplier_products WHERE supplier_id=$1 AND product_id=$2`, supplierID, line.Product_id).
+		Scan(&supplierSku, &cost)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, err
+	}
+	if line.Supplier_sku == "" {
+		line.Supplier_sku = supplierSku
+	}
+	if line.Unit_cost.IsZero() {
+		if cost == nil {
+			return 0, validationError(fmt.Sprintf("unit_cost is required for product %d, the supplier does not list it", line.Product_id))
+		}
+		line.Unit_cost = *cost
+	}
+
+	sqlStatement := `INSERT INTO purchase_order_lines(purchase_order_id, product_id, supplier_sku, quantity_ordered, quantity_received, unit_cost)
+	VALUES ($1, $2, $3, $4, 0, $5) RETURNING id`
+	var id int64
+	err = q.QueryRow(sqlStatement, orderID, line.Product_id, strings.TrimSpace(line.Supplier_sku), line.Quantity_ordered, line.Unit_cost).Scan(&id)
+	if isUniqueViolation(err) {
+		return 0, conflictError(fmt.Sprintf("Product %d is already on this purchase order", line.Product_id))
+	}
+	return id, err
+}
+
+// requireDraft rejects changes to the lines of an order that was sent.
+func requireDraft(order models.PurchaseOrder) error {
+	if order.Status != poDraft {
+		return conflictError(fmt.Sprintf("Purchase order is %s, only drafts can be edited", order.Status))
+	}
+	return nil
+}
+
+func AddPurchaseOrderLine(w http.ResponseWriter, r *http.Request) {
+	orderID, err := pathID(r, "id")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var line models.PurchaseOrderLine
+	if err := json.NewDecoder(r.Body).Decode(&line); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Unable to decode the request body %v", err))
+		return
+	}
+
+	var id int64
+	err = runPurchaseOrderUpdate(orderID, func(tx dbtx, order models.PurchaseOrder) error {
+		if err := requireDraft(order); err != nil {
+			return err
+		}
+		id, err = addPurchaseOrderLine(tx, orderID, order.Supplier_id, line)
+		return err
+	})
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, response{
+		Id:      id,
+		Message: "Purchase order line added successfully",
+	})
+}
+
+func UpdatePurchaseOrderLine(w http.ResponseWriter, r *http.Request) {
+	orderID, err := pathID(r, "id")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	lineID, err := pathID(r, "lineId")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var line models.PurchaseOrderLine
+	if err := json.NewDecoder(r.Body).Decode(&line); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Unable to decode the request body %v", err))
+		return
+	}
+	if line.Quantity_ordered <= 0 {
+		writeError(w, http.StatusBadRequest, "quantity_ordered must be positive")
+		return
+	}
+	if err := checkBasePrice("unit_cost", line.Unit_cost); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	err = runPurchaseOrderUpdate(orderID, func(tx dbtx, order models.PurchaseOrder) error {
+		if err := requireDraft(order); err != nil {
+			return err
+		}
+		sqlStatement := `UPDATE purchase_order_lines SET quantity_ordered=$3, unit_cost=$4, supplier_sku=COALESCE(NULLIF($5, ''), supplier_sku)
+		WHERE id=$1 AND purchase_order_id=$2`
+		res, err := tx.Exec(sqlStatement, lineID, orderID, line.Quantity_ordered, line.Unit_cost, strings.TrimSpace(line.Supplier_sku))
+		if err != nil {
+			return err
+		}
+		if affected, err := res.RowsAffected(); err != nil || affected == 0 {
+			if err == nil {
+				err = errPurchaseLineNotFound
+			}
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, response{
+		Id:      lineID,
+		Message: "Purchase order line updated successfully",
+	})
+}
+
+func DeletePurchaseOrderLine(w http.ResponseWriter, r *http.Request) {
+	orderID, err := pathID(r, "id")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	lineID, err := pathID(r, "lineId")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	err = runPurchaseOrderUpdate(orderID, func(tx dbtx, order models.PurchaseOrder) error {
+		if err := requireDraft(order); err != nil {
+			return err
+		}
+		res, err := tx.Exec(`DELETE FROM purchase_order_lines WHERE id=$1 AND purchase_order_id=$2`, lineID, orderID)
+		if err != nil {
+			return err
+		}
+		if affected, err := res.RowsAffected(); err != nil || affected == 0 {
+			if err == nil {
+				err = errPurchaseLineNotFound
+			}
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, response{
+		Id:      lineID,
+		Message: "Purchase order line deleted successfully",
+	})
+}
+
+func SendPurchaseOrder(w http.ResponseWriter, r *http.Request) {
+	runPurchaseOrderTransition(w, r, "purchase_order.send", func(tx dbtx, order models.PurchaseOrder, actorID *int64) (any, error) {
+		if order.Status != poDraft {
+			return nil, conflictError(fmt.Sprintf("Purchase order is %s, only drafts can be sent", order.Status))
+		}
+		if len(order.Lines) == 0 {
+			return nil, validationError("Purchase order has no lines")
+		}
+		_, err := tx.Exec(`UPDATE purchase_orders SET status=$2, sent_at=Now(), updated_at=Now() WHERE id=$1`, order.Id, poSent)
+		return nil, err
+	})
+}
+
+func CancelPurchaseOrder(w http.ResponseWriter, r *http.Request) {
+	runPurchaseOrderTransition(w, r, "purchase_order.cancel", func(tx dbtx, order models.PurchaseOrder, actorID *int64) (any, error) {
+		if order.Status != poDraft && order.Status != poSent {
+			return nil, conflictError(fmt.Sprintf("Purchase order is %s and can no longer be cancelled", order.Status))
+		}
+		_, err := tx.Exec(`UPDATE purchase_orders SET status=$2, updated_at=Now() WHERE id=$1`, order.Id, poCancelled)
+		return nil, err
+	})
+}
+
+func ReceivePurchaseOrder(w http.ResponseWriter, r *http.Request) {
+	var req models.ReceiveRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Unable to decode the request body %v", err))
+		return
+	}
+	runPurchaseOrderTransition(w, r, "purchase_order.receive", func(tx dbtx, order models.PurchaseOrder, actorID *int64) (any, error) {
+		return req, receivePurchaseOrder(tx, order, req, actorID)
+	})
+}
+
+// receivePurchaseOrder books delivered quantities into stock as receipts and
+// moves the order to partially_received or received.
+func receivePurchaseOrder(tx dbtx, order models.PurchaseOrder, req models.ReceiveRequest, actorID *int64) error {
+	if order.Status != poSent && order.Status != poPartiallyReceived {
+		return conflictError(fmt.Sprintf("Purchase order is %s, only sent orders can be received", order.Status))
+	}
+	if len(req.Lines) == 0 {
+		return validationError("lines is required")
+	}
+	warehouseID := req.Warehouse_id
+	if warehouseID == 0 {
+		warehouseID = order.Warehouse_id
+	}
+
+	lines := map[int64]models.PurchaseOrderLine{}
+	for _, line := range order.Lines {
+		lines[line.Id] = line
+	}
+	for _, received := range req.Lines {
+		line, ok := lines[received.Line_id]
+		if !ok {
+			return validationError(fmt.Sprintf("line %d is not on this purchase order", received.Line_id))
+		}
+		if received.Quantity <= 0 {
+			return validationError("received quantities must be positive")
+		}
+		if line.Quantity_received+received.Quantity > line.Quantity_ordered {
+			return validationError(fmt.Sprintf("line %d would receive %d of %d ordered", line.Id, line.Quantity_received+received.Quantity, line.Quantity_ordered))
+		}
+		line.Quantity_received += received.Quantity
+		lines[line.Id] = line
+
+		if _, err := tx.Exec(`UPDATE purchase_order_lines SET quantity_received=$2 WHERE id=$1`, line.Id, line.Quantity_received); err != nil {
+			return err
+		}
+		_, err := postStockMovement(tx, models.StockMovement{
+			Product_id:   line.Product_id,
+			Warehouse_id: warehouseID,
+			Type:         movementReceipt,
+			Quantity:     received.Quantity,
+			Reason:       fmt.Sprintf("Purchase order %d received", order.Id),
+			Reference:    fmt.Sprintf("PO-%d", order.Id),
+			Actor_id:     actorID,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	status := poReceived
+	for _, line := range lines {
+		if line.Quantity_received < line.Quantity_ordered {
+			status = poPartiallyReceived
+			break
+		}
+	}
+	sqlStatement := `UPDATE purchase_orders SET status=$2, updated_at=Now(), received_at=CASE WHEN $2='received' THEN Now() ELSE received_at END WHERE id=$1`
+	_, err := tx.Exec(sqlStatement, order.Id, status)
+	return err
+}
+
+// runPurchaseOrderUpdate locks an order and runs update in the same
+// transaction.
+func runPurchaseOrderUpdate(id int64, update func(tx dbtx, order models.PurchaseOrder) error) error {
+	db := createConnection()
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	order, err := getPurchaseOrder(tx, id, true)
+	if err != nil {
+		return err
+	}
+	if err := update(tx, order); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE purchase_orders SET updated_at=Now() WHERE id=$1`, id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// runPurchaseOrderTransition applies a lifecycle step, records it in the
+// audit log and responds with the updated order.
+func runPurchaseOrderTransition(w http.ResponseWriter, r *http.Request, action string, transition func(tx dbtx, order models.PurchaseOrder, actorID *int64) (any, error)) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	var actor int64
+	var actorID *int64
+	if user, ok := currentUser(r); ok {
+		actor = user.Id
+		actorID = &user.Id
+	}
+
+	db := createConnection()
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	defer tx.Rollback()
+
+	order, err := getPurchaseOrder(tx, id, true)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	details, err := transition(tx, order, actorID)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	if err := insertAuditLog(tx, actor, action, "purchase_order", id, details); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	order, err = getPurchaseOrder(tx, id, false)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, order)
+}
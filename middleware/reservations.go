@@ -0,0 +1,258 @@
+package middleware
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"products/models"
+	"strings"
+	"time"
+)
+
+const (
+	reservationActive    = "active"
+	reservationCommitted = "committed"
+	reservationReleased  = "released"
+	reservationExpired   = "expired"
+
+	defaultReservationTTL = 15 * time.Minute
+	maxReservationTTL     = 24 * time.Hour
+)
+
+var errReservationNotFound = notFoundError("Reservation not found")
+
+const reservationColumns = `id, product_id, quantity, status, reference, actor_id, expires_at, created_at, updated_at`
+
+func scanReservation(row scanner, extra ...any) (models.StockReservation, error) {
+	var reservation models.StockReservation
+	var reference sql.NullString
+	dest := []any{&reservation.Id, &reservation.Product_id, &reservation.Quantity, &reservation.Status, &reference, &reservation.Actor_id, &reservation.Expires_at, &reservation.Created_at, &reservation.Updated_at}
+	err := row.Scan(append(dest, extra...)...)
+	reservation.Reference = reference.String
+	return reservation, err
+}
+
+// reserveStock holds quantity units of a product for ttl. The check and the
+// increment of products.reserved happen in one conditional UPDATE, so two
+// concurrent reservations can never both take the last unit.
+func reserveStock(q dbtx, productID int64, quantity int64, ttl time.Duration, reference string, actorID *int64) (models.StockReservation, error) {
+	if quantity <= 0 {
+		return models.StockReservation{}, validationError("quantity must be positive")
+	}
+	if ttl <= 0 {
+		ttl = defaultReservationTTL
+	}
+	if ttl > maxReservationTTL {
+		return models.StockReservation{}, validationError(fmt.Sprintf("ttl must not be longer than %s", maxReservationTTL))
+	}
+
+	res, err := q.Exec(`UPDATE products SET reserved = reserved + $2 WHERE id=$1 AND quantity - reserved >= $2`, productID, quantity)
+	if err != nil {
+		return models.StockReservation{}, err
+	}
+	if affected, err := res.RowsAffected(); err != nil || affected == 0 {
+		if err == nil {
+			if err = productExists(q, productID); err == nil {
+				err = errInsufficientStock
+			}
+		}
+		return models.StockReservation{}, err
+	}
+
+	sqlStatement := `INSERT INTO stock_reservations(product_id, quantity, status, reference, actor_id, expires_at, created_at, updated_at)
+	VALUES ($1, $2, $3, NULLIF($4, ''), $5, Now() + $6 * interval '1 second', Now(), Now()) RETURNING ` + reservationColumns
+	return scanReservation(q.QueryRow(sqlStatement, productID, quantity, reservationActive, strings.TrimSpace(reference), actorID, int64(ttl/time.Second)))
+}
+
+// lockActiveReservation locks a reservation that can still be committed or
+// released. Expired reservations the sweeper has not reached yet are treated
+// as gone.
+func lockActiveReservation(q dbtx, id int64) (models.StockReservation, error) {
+	// Expiry is compared in the database so both sides use the same clock.
+	var expired bool
+	reservation, err := scanReservation(q.QueryRow(`SELECT `+reservationColumns+`, expires_at <= Now() FROM stock_reservations WHERE id=$1 FOR UPDATE`, id), &expired)
+	if err == sql.ErrNoRows {
+		return reservation, errReservationNotFound
+	}
+	if err != nil {
+		return reservation, err
+	}
+	if reservation.Status != reservationActive {
+		return reservation, conflictError(fmt.Sprintf("Reservation is already %s", reservation.Status))
+	}
+	if expired {
+		return reservation, conflictError("Reservation has expired")
+	}
+	return reservation, nil
+}
+
+// commitReservation turns a reservation into a sale: the held units leave
+// products.reserved and are removed from stock through the ledger.
+func commitReservation(q dbtx, id int64, reference string, actorID *int64) (models.StockReservation, error) {
+	reservation, err := lockActiveReservation(q, id)
+	if err != nil {
+		return reservation, err
+	}
+
+	if _, err := q.Exec(`UPDATE products SET reserved = reserved - $2 WHERE id=$1`, reservation.Product_id, reservation.Quantity); err != nil {
+		return reservation, err
+	}
+	if reference == "" {
+		reference = reservation.Reference
+	}
+	err = removeStock(q, models.StockMovement{
+		Product_id: reservation.Product_id,
+		Type:       movementSale,
+		Quantity:   -reservation.Quantity,
+		Reason:     fmt.Sprintf("Reservation %d committed", reservation.Id),
+		Reference:  reference,
+		Actor_id:   actorID,
+	})
+	if err != nil {
+		return reservation, err
+	}
+	return setReservationStatus(q, reservation.Id, reservationCommitted)
+}
+
+// releaseReservation gives the held units back to available stock.
+func releaseReservation(q dbtx, id int64) (models.StockReservation, error) {
+	reservation, err := lockActiveReservation(q, id)
+	if err != nil {
+		return reservation, err
+	}
+	if _, err := q.Exec(`UPDATE products SET reserved = reserved - $2 WHERE id=$1`, reservation.Product_id, reservation.Quantity); err != nil {
+		return reservation, err
+	}
+	return setReservationStatus(q, reservation.Id, reservationReleased)
+}
+
+func setReservationStatus(q dbtx, id int64, status string) (models.StockReservation, error) {
+	sqlStatement := `UPDATE stock_reservations SET status=$2, updated_at=Now() WHERE id=$1 RETURNING ` + reservationColumns
+	return scanReservation(q.QueryRow(sqlStatement, id, status))
+}
+
+// expireReservations releases every active reservation past its expiry. It
+// runs as a background job.
+func expireReservations(db *sql.DB) error {
+	sqlStatement := `WITH expired AS (
+		UPDATE stock_reservations SET status=$1, updated_at=Now() WHERE status=$2 AND expires_at <= Now() RETURNING product_id, quantity
+	), totals AS (
+		SELECT product_id, SUM(quantity) AS quantity FROM expired GROUP BY product_id
+	)
+	UPDATE products p SET reserved = p.reserved - t.quantity FROM totals t WHERE p.id = t.product_id`
+	_, err := db.Exec(sqlStatement, reservationExpired, reservationActive)
+	return err
+}
+
+func CreateReservation(w http.ResponseWriter, r *http.Request) {
+	productID, err := pathID(r, "id")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var req models.ReservationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Unable to decode the request body %v", err))
+		return
+	}
+	var actorID *int64
+	if user, ok := currentUser(r); ok {
+		actorID = &user.Id
+	}
+
+	db := createConnection()
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	defer tx.Rollback()
+
+	reservation, err := reserveStock(tx, productID, req.Quantity, time.Duration(req.Ttl_seconds)*time.Second, req.Reference, actorID)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, reservation)
+}
+
+func GetReservation(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	db := createConnection()
+	defer db.Close()
+
+	reservation, err := scanReservation(db.QueryRow(`SELECT `+reservationColumns+` FROM stock_reservations WHERE id=$1`, id))
+	if err == sql.ErrNoRows {
+		writeStoreError(w, errReservationNotFound)
+		return
+	}
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, reservation)
+}
+
+func CommitReservation(w http.ResponseWriter, r *http.Request) {
+	var req models.ReservationRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("Unable to decode the request body %v", err))
+			return
+		}
+	}
+	var actorID *int64
+	if user, ok := currentUser(r); ok {
+		actorID = &user.Id
+	}
+	runReservationTransition(w, r, func(tx dbtx, id int64) (models.StockReservation, error) {
+		return commitReservation(tx, id, strings.TrimSpace(req.Reference), actorID)
+	})
+}
+
+func ReleaseReservation(w http.ResponseWriter, r *http.Request) {
+	runReservationTransition(w, r, releaseReservation)
+}
+
+func runReservationTransition(w http.ResponseWriter, r *http.Request, transition func(tx dbtx, id int64) (models.StockReservation, error)) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	db := createConnection()
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	defer tx.Rollback()
+
+	reservation, err := transition(tx, id)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	stockChanged()
+	writeJSON(w, http.StatusOK, reservation)
+}
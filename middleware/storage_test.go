@@ -0,0 +1,137 @@
+package middleware
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeS3 is a minimal path-style S3 server keeping objects in memory. It
+// checks the parts of the signature it can verify without the secret key.
+type fakeS3 struct {
+	t       *testing.T
+	mu      sync.Mutex
+	objects map[string]fakeObject
+}
+
+type fakeObject struct {
+	data        []byte
+	contentType string
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKID/") || !strings.Contains(auth, "/us-east-1/s3/aws4_request") {
+		f.t.Errorf("%s %s: unexpected Authorization %q", r.Method, r.URL.Path, auth)
+	}
+	if !strings.Contains(auth, "SignedHeaders=") || !strings.Contains(auth, "x-amz-date") {
+		f.t.Errorf("%s %s: x-amz-date is not signed in %q", r.Method, r.URL.Path, auth)
+	}
+	if got := r.Header.Get("X-Amz-Content-Sha256"); got != sha256Hex(body) {
+		f.t.Errorf("%s %s: payload hash %q does not match the body", r.Method, r.URL.Path, got)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch r.Method {
+	case http.MethodPut:
+		f.objects[r.URL.Path] = fakeObject{data: body, contentType: r.Header.Get("Content-Type")}
+	case http.MethodGet:
+		object, ok := f.objects[r.URL.Path]
+		if !ok {
+			http.Error(w, "NoSuchKey", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", object.contentType)
+		w.Write(object.data)
+	case http.MethodDelete:
+		delete(f.objects, r.URL.Path)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "MethodNotAllowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func newTestS3Store(t *testing.T, handler http.Handler) *S3BlobStore {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	return &S3BlobStore{
+		Endpoint:  server.URL,
+		Region:    "us-east-1",
+		Bucket:    "media",
+		AccessKey: "AKID",
+		SecretKey: "secret",
+		BaseURL:   "/media",
+		Client:    server.Client(),
+	}
+}
+
+func TestS3BlobStoreRoundTrip(t *testing.T) {
+	fake := &fakeS3{t: t, objects: map[string]fakeObject{}}
+	store := newTestS3Store(t, fake)
+	ctx := context.Background()
+	key := "products/12/3f9a.jpg"
+
+	if err := store.Put(ctx, key, []byte("jpeg data"), "image/jpeg"); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if _, ok := fake.objects["/media/"+key]; !ok {
+		t.Fatalf("object was not stored under the bucket path, have %v", fake.objects)
+	}
+
+	body, contentType, err := store.Get(ctx, key)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	data, _ := io.ReadAll(body)
+	body.Close()
+	if string(data) != "jpeg data" || contentType != "image/jpeg" {
+		t.Errorf("Get = %q, %q, want %q, %q", data, contentType, "jpeg data", "image/jpeg")
+	}
+
+	if err := store.Delete(ctx, key); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, _, err := store.Get(ctx, key); err != errBlobNotFound {
+		t.Errorf("Get after Delete = %v, want errBlobNotFound", err)
+	}
+	// Deleting a missing key is not an error.
+	if err := store.Delete(ctx, key); err != nil {
+		t.Errorf("Delete of a missing key: %v", err)
+	}
+}
+
+func TestS3BlobStoreErrors(t *testing.T) {
+	store := newTestS3Store(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "AccessDenied", http.StatusForbidden)
+	}))
+	ctx := context.Background()
+
+	err := store.Put(ctx, "products/1/a.png", []byte("x"), "image/png")
+	if err == nil || !strings.Contains(err.Error(), "AccessDenied") {
+		t.Errorf("Put = %v, want an error carrying the S3 response", err)
+	}
+	if _, _, err := store.Get(ctx, "products/1/a.png"); err == nil || err == errBlobNotFound {
+		t.Errorf("Get = %v, want a request error", err)
+	}
+	if err := store.Put(ctx, "../escape", []byte("x"), "image/png"); err == nil {
+		t.Error("Put accepted an invalid key")
+	}
+}
+
+func TestS3BlobStoreURL(t *testing.T) {
+	store := &S3BlobStore{BaseURL: "/media/"}
+	if got := store.URL("products/1/a.jpg"); got != "/media/products/1/a.jpg" {
+		t.Errorf("URL = %q", got)
+	}
+	store.PublicURL = "https://cdn.example.com/"
+	if got := store.URL("products/1/a.jpg"); got != "https://cdn.example.com/products/1/a.jpg" {
+		t.Errorf("URL with PublicURL = %q", got)
+	}
+}
@@ -0,0 +1,367 @@
+package middleware
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"products/models"
+	"strings"
+)
+
+var (
+	errSupplierNotFound        = notFoundError("Supplier not found")
+	errSupplierProductNotFound = notFoundError("Supplier does not list this product")
+)
+
+const supplierColumns = `id, name, email, phone, address, lead_time_days, active, created_at, updated_at`
+
+func scanSupplier(row scanner) (models.Supplier, error) {
+	var supplier models.Supplier
+	err := row.Scan(&supplier.Id, &supplier.Name, &supplier.Email, &supplier.Phone, &supplier.Address, &supplier.Lead_time_days, &supplier.Active, &supplier.Created_at, &supplier.Updated_at)
+	return supplier, err
+}
+
+func getSupplier(q dbtx, id int64) (models.Supplier, error) {
+	supplier, err := scanSupplier(q.QueryRow(`SELECT `+supplierColumns+` FROM suppliers WHERE id=$1`, id))
+	if err == sql.ErrNoRows {
+		return supplier, errSupplierNotFound
+	}
+	return supplier, err
+}
+
+func normalizeSupplier(supplier *models.Supplier) error {
+	supplier.Name = strings.TrimSpace(supplier.Name)
+	supplier.Email = strings.TrimSpace(supplier.Email)
+	if supplier.Name == "" {
+		return validationError("name is required")
+	}
+	if supplier.Lead_time_days < 0 {
+		return validationError("lead_time_days must not be negative")
+	}
+	return nil
+}
+
+func GetAllSuppliers(w http.ResponseWriter, r *http.Request) {
+	db := createConnection()
+	defer db.Close()
+
+	rows, err := db.Query(`SELECT ` + supplierColumns + ` FROM suppliers ORDER BY name, id`)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	defer rows.Close()
+
+	suppliers := []models.Supplier{}
+	for rows.Next() {
+		supplier, err := scanSupplier(rows)
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		suppliers = append(suppliers, supplier)
+	}
+	if err := rows.Err(); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, suppliers)
+}
+
+func GetSupplier(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	db := createConnection()
+	defer db.Close()
+
+	supplier, err := getSupplier(db, id)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, supplier)
+}
+
+func CreateSupplier(w http.ResponseWriter, r *http.Request) {
+	supplier := models.Supplier{Active: true}
+	if err := json.NewDecoder(r.Body).Decode(&supplier); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Unable to decode the request body %v", err))
+		return
+	}
+	if err := normalizeSupplier(&supplier); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	db := createConnection()
+	defer db.Close()
+
+	sqlStatement := `INSERT INTO suppliers(name, email, phone, address, lead_time_days, active, created_at, updated_at)
+	VALUES ($1, $2, $3, $4, $5, $6, Now(), Now()) RETURNING id`
+	var id int64
+	err := db.QueryRow(sqlStatement, supplier.Name, supplier.Email, supplier.Phone, supplier.Address, supplier.Lead_time_days, supplier.Active).Scan(&id)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, response{
+		Id:      id,
+		Message: "Supplier created successfully",
+	})
+}
+
+func UpdateSupplier(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	supplier := models.Supplier{Active: true}
+	if err := json.NewDecoder(r.Body).Decode(&supplier); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Unable to decode the request body %v", err))
+		return
+	}
+	if err := normalizeSupplier(&supplier); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	db := createConnection()
+	defer db.Close()
+
+	sqlStatement := `UPDATE suppliers SET name=$2, email=$3, phone=$4, address=$5, lead_time_days=$6, active=$7, updated_at=Now() WHERE id=$1`
+	res, err := db.Exec(sqlStatement, id, supplier.Name, supplier.Email, supplier.Phone, supplier.Address, supplier.Lead_time_days, supplier.Active)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	if affected, err := res.RowsAffected(); err != nil || affected == 0 {
+		if err == nil {
+			err = errSupplierNotFound
+		}
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, response{
+		Id:      id,
+		Message: "Supplier updated successfully",
+	})
+}
+
+// DeleteSupplier removes a supplier that has no purchase orders. Suppliers
+// with history should be deactivated instead.
+func DeleteSupplier(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	db := createConnection()
+	defer db.Close()
+
+	res, err := db.Exec(`DELETE FROM suppliers WHERE id=$1`, id)
+	if isForeignKeyViolation(err) {
+		writeError(w, http.StatusConflict, "Supplier has purchase orders, deactivate it instead")
+		return
+	}
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	if affected, err := res.RowsAffected(); err != nil || affected == 0 {
+		if err == nil {
+			err = errSupplierNotFound
+		}
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, response{
+		Id:      id,
+		Message: "Supplier deleted successfully",
+	})
+}
+
+// supplierProductQuery resolves the lead time to the supplier default when
+// the link does not override it.
+const supplierProductQuery = `SELECT sp.supplier_id, s.name, sp.product_id, p.name, p.sku, sp.supplier_sku, sp.cost_price,
+	COALESCE(sp.lead_time_days, s.lead_time_days), sp.is_preferred
+	FROM supplier_products sp
+	JOIN suppliers s ON s.id = sp.supplier_id
+	JOIN products p ON p.id = sp.product_id`
+
+func querySupplierProducts(q dbtx, sqlStatement string, args ...any) ([]models.SupplierProduct, error) {
+	rows, err := q.Query(sqlStatement, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	links := []models.SupplierProduct{}
+	for rows.Next() {
+		var link models.SupplierProduct
+		err := rows.Scan(&link.Supplier_id, &link.Supplier_name, &link.Product.Id, &link.Product.Name, &link.Product.Sku, &link.Supplier_sku, &link.Cost_price, &link.Lead_time_days, &link.Is_preferred)
+		if err != nil {
+			return nil, err
+		}
+		links = append(links, link)
+	}
+	return links, rows.Err()
+}
+
+func GetSupplierProducts(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	db := createConnection()
+	defer db.Close()
+
+	if _, err := getSupplier(db, id); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	links, err := querySupplierProducts(db, supplierProductQuery+` WHERE sp.supplier_id=$1 ORDER BY p.name, p.id`, id)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, links)
+}
+
+func GetProductSuppliers(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	db := createConnection()
+	defer db.Close()
+
+	if err := productExists(db, id); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	links, err := querySupplierProducts(db, supplierProductQuery+` WHERE sp.product_id=$1 ORDER BY sp.is_preferred DESC, sp.cost_price, s.id`, id)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, links)
+}
+
+// SetSupplierProduct creates or replaces the terms under which a supplier
+// sells a product.
+func SetSupplierProduct(w http.ResponseWriter, r *http.Request) {
+	supplierID, err := pathID(r, "id")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	productID, err := pathID(r, "productId")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var link models.SupplierProduct
+	if err := json.NewDecoder(r.Body).Decode(&link); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Unable to decode the request body %v", err))
+		return
+	}
+	link.Supplier_sku = strings.TrimSpace(link.Supplier_sku)
+	if err := checkBasePrice("cost_price", link.Cost_price); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	var leadTime *int64
+	if link.Lead_time_days > 0 {
+		leadTime = &link.Lead_time_days
+	}
+
+	db := createConnection()
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	defer tx.Rollback()
+
+	if _, err := getSupplier(tx, supplierID); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	if err := productExists(tx, productID); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	// Only one supplier is preferred for a product.
+	if link.Is_preferred {
+		if _, err := tx.Exec(`UPDATE supplier_products SET is_preferred=false WHERE product_id=$1 AND supplier_id<>$2`, productID, supplierID); err != nil {
+			writeStoreError(w, err)
+			return
+		}
+	}
+
+	sqlStatement := `INSERT INTO supplier_products(supplier_id, product_id, supplier_sku, cost_price, lead_time_days, is_preferred, created_at, updated_at)
+	VALUES ($1, $2, $3, $4, $5, $6, Now(), Now())
+	ON CONFLICT (supplier_id, product_id) DO UPDATE SET supplier_sku=EXCLUDED.supplier_sku, cost_price=EXCLUDED.cost_price,
+	lead_time_days=EXCLUDED.lead_time_days, is_preferred=EXCLUDED.is_preferred, updated_at=Now()`
+	if _, err := tx.Exec(sqlStatement, supplierID, productID, link.Supplier_sku, link.Cost_price, leadTime, link.Is_preferred); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, response{
+		Id:      productID,
+		Message: "Supplier product saved successfully",
+	})
+}
+
+func DeleteSupplierProduct(w http.ResponseWriter, r *http.Request) {
+	supplierID, err := pathID(r, "id")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	productID, err := pathID(r, "productId")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	db := createConnection()
+	defer db.Close()
+
+	res, err := db.Exec(`DELETE FROM supplier_products WHERE supplier_id=$1 AND product_id=$2`, supplierID, productID)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	if affected, err := res.RowsAffected(); err != nil || affected == 0 {
+		if err == nil {
+			err = errSupplierProductNotFound
+		}
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, response{
+		Id:      productID,
+		Message: "Supplier product deleted successfully",
+	})
+}
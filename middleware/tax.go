@@ -0,0 +1,600 @@
+package middleware
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"products/models"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+var (
+	errTaxClassNotFound = notFoundError("Tax class not found")
+	errTaxRateNotFound  = notFoundError("Tax rate not found")
+
+	taxClassCodePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,31}$`)
+	countryPattern      = regexp.MustCompile(`^[A-Z]{2}$`)
+)
+
+// pricesIncludeTax reports whether catalogue prices are gross amounts that
+// already contain tax (PRICES_INCLUDE_TAX=true) or net amounts that tax is
+// added to.
+func pricesIncludeTax() bool {
+	include, _ := strconv.ParseBool(os.Getenv("PRICES_INCLUDE_TAX"))
+	return include
+}
+
+// taxableLine is one line of a cart or order: amount is the whole line,
+// after discounts, in the currency being charged.
+type taxableLine struct {
+	productID int64
+	amount    models.Money
+}
+
+type resolvedRate struct {
+	name string
+	rate string
+}
+
+// productTaxClasses resolves the tax class of each product: its own class,
+// then that of its nearest categorised ancestor (primary category first),
+// then the default class. Products without any class map to 0.
+func productTaxClasses(q dbtx, productIDs []int64) (map[int64]int64, error) {
+	sqlStatement := `SELECT p.id, COALESCE(p.tax_class_id,
+		(SELECT a.tax_class_id FROM product_categories pc
+		JOIN categories c ON c.category_id = pc.category_id
+		JOIN categories a ON c.path LIKE a.path || '%'
+		WHERE pc.product_id = p.id AND a.tax_class_id IS NOT NULL
+		ORDER BY pc.is_primary DESC, a.depth DESC LIMIT 1),
+		(SELECT id FROM tax_classes WHERE is_default), 0)
+	FROM products p WHERE p.id = ANY($1)`
+	rows, err := q.Query(sqlStatement, pq.Array(productIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	classes := map[int64]int64{}
+	for rows.Next() {
+		var productID, classID int64
+		if err := rows.Scan(&productID, &classID); err != nil {
+			return nil, err
+		}
+		classes[productID] = classID
+	}
+	return classes, rows.Err()
+}
+
+// taxRatesFor returns the rate of each tax class for a location, preferring
+// a rate for the region over the rate for the whole country.
+func taxRatesFor(q dbtx, classIDs []int64, country string, region string) (map[int64]resolvedRate, error) {
+	sqlStatement := `SELECT DISTINCT ON (tax_class_id) tax_class_id, name, rate::text FROM tax_rates
+	WHERE tax_class_id = ANY($1) AND country=$2 AND region IN ('', $3)
+	ORDER BY tax_class_id, region DESC`
+	rows, err := q.Query(sqlStatement, pq.Array(classIDs), country, region)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rates := map[int64]resolvedRate{}
+	for rows.Next() {
+		var classID int64
+		var rate resolvedRate
+		if err := rows.Scan(&classID, &rate.name, &rate.rate); err != nil {
+			return nil, err
+		}
+		rates[classID] = rate
+	}
+	return rates, rows.Err()
+}
+
+func taxClassCodes(q dbtx, classIDs []int64) (map[int64]string, error) {
+	rows, err := q.Query(`SELECT id, code FROM tax_classes WHERE id = ANY($1)`, pq.Array(classIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	codes := map[int64]string{}
+	for rows.Next() {
+		var id int64
+		var code string
+		if err := rows.Scan(&id, &code); err != nil {
+			return nil, err
+		}
+		codes[id] = code
+	}
+	return codes, rows.Err()
+}
+
+// splitTax splits a line amount into net, tax and gross at a percentage
+// rate. Tax is rounded per line and the totals are the sums of the lines.
+func splitTax(amount models.Money, rate *big.Rat, inclusive bool) (net, tax, gross models.Money) {
+	hundred := big.NewRat(100, 1)
+	if inclusive {
+		tax = amount.MulRate(new(big.Rat).Quo(rate, new(big.Rat).Add(hundred, rate)))
+		return amount.Sub(tax), tax, amount
+	}
+	tax = amount.MulRate(new(big.Rat).Quo(rate, hundred))
+	return amount, tax, amount.Add(tax)
+}
+
+// calculateTax returns the tax on lines delivered to country and region.
+// Lines whose tax class has no rate there are not taxed. All lines must be
+// in the same currency.
+func calculateTax(q dbtx, country string, region string, lines []taxableLine) (models.TaxBreakdown, error) {
+	country, region = strings.ToUpper(strings.TrimSpace(country)), strings.ToUpper(strings.TrimSpace(region))
+	breakdown := models.TaxBreakdown{
+		Country:            country,
+		Region:             region,
+		Prices_include_tax: pricesIncludeTax(),
+		Lines:              []models.TaxLine{},
+		Rates:              []models.TaxRateTotal{},
+	}
+	if !countryPattern.MatchString(country) {
+		return breakdown, validationError("country must be a two-letter ISO 3166 code")
+	}
+	if len(lines) == 0 {
+		return breakdown, nil
+	}
+
+	productIDs := make([]int64, len(lines))
+	for i, line := range lines {
+		productIDs[i] = line.productID
+	}
+	classes, err := productTaxClasses(q, productIDs)
+	if err != nil {
+		return breakdown, err
+	}
+	classIDs := make([]int64, 0, len(classes))
+	for _, classID := range classes {
+		classIDs = append(classIDs, classID)
+	}
+	rates, err := taxRatesFor(q, classIDs, country, region)
+	if err != nil {
+		return breakdown, err
+	}
+	codes, err := taxClassCodes(q, classIDs)
+	if err != nil {
+		return breakdown, err
+	}
+
+	currency := lines[0].amount.Currency()
+	breakdown.Net_total = models.NewMoney(0, currency)
+	breakdown.Tax_total = models.NewMoney(0, currency)
+	breakdown.Gross_total = models.NewMoney(0, currency)
+	totals := map[resolvedRate]*models.TaxRateTotal{}
+
+	for _, line := range lines {
+		classID, ok := classes[line.productID]
+		if !ok {
+			return breakdown, errProductNotFound
+		}
+		rate, ok := rates[classID]
+		if !ok {
+			rate = resolvedRate{rate: "0"}
+		}
+		value, err := models.ParseRate(rate.rate)
+		if err != nil {
+			return breakdown, err
+		}
+
+		net, tax, gross := splitTax(line.amount, value, breakdown.Prices_include_tax)
+		breakdown.Lines = append(breakdown.Lines, models.TaxLine{
+			Product_id: line.productID,
+			Tax_class:  codes[classID],
+			Tax_name:   rate.name,
+			Rate:       rate.rate,
+			Net:        net,
+			Tax:        tax,
+			Gross:      gross,
+		})
+		breakdown.Net_total = breakdown.Net_total.Add(net)
+		breakdown.Tax_total = breakdown.Tax_total.Add(tax)
+		breakdown.Gross_total = breakdown.Gross_total.Add(gross)
+
+		total, ok := totals[rate]
+		if !ok {
+			total = &models.TaxRateTotal{Name: rate.name, Rate: rate.rate, Net: models.NewMoney(0, currency), Tax: models.NewMoney(0, currency)}
+			totals[rate] = total
+		}
+		total.Net = total.Net.Add(net)
+		total.Tax = total.Tax.Add(tax)
+	}
+
+	for _, total := range totals {
+		breakdown.Rates = append(breakdown.Rates, *total)
+	}
+	sort.Slice(breakdown.Rates, func(i, j int) bool {
+		if breakdown.Rates[i].Name != breakdown.Rates[j].Name {
+			return breakdown.Rates[i].Name < breakdown.Rates[j].Name
+		}
+		return breakdown.Rates[i].Rate < breakdown.Rates[j].Rate
+	})
+	return breakdown, nil
+}
+
+// CalculateTax quotes tax for a list of products. Lines without a
+// unit_price are charged the current selling price in the requested
+// currency.
+func CalculateTax(w http.ResponseWriter, r *http.Request) {
+	var req models.TaxRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Unable to decode the request body %v", err))
+		return
+	}
+	currency := strings.ToUpper(strings.TrimSpace(req.Currency))
+	if currency == "" {
+		currency = models.BaseCurrency()
+	}
+	if !models.ValidCurrency(currency) {
+		writeError(w, http.StatusBadRequest, "currency must be a three-letter ISO 4217 code")
+		return
+	}
+	ids := make([]int64, len(req.Lines))
+	for i, line := range req.Lines {
+		if line.Quantity <= 0 {
+			writeError(w, http.StatusBadRequest, "quantity must be positive")
+			return
+		}
+		if line.Unit_price != nil {
+			if err := checkPrice("unit_price", *line.Unit_price, currency); err != nil {
+				writeStoreError(w, err)
+				return
+			}
+		}
+		ids[i] = line.Product_id
+	}
+
+	db := createConnection()
+	defer db.Close()
+
+	products, err := loadPricedProducts(db, currency, ids)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	lines := make([]taxableLine, len(req.Lines))
+	for i, line := range req.Lines {
+		product, ok := products[line.Product_id]
+		if !ok {
+			writeStoreError(w, errProductNotFound)
+			return
+		}
+		price := sellingPrice(product)
+		if line.Unit_price != nil {
+			price = *line.Unit_price
+		}
+		lines[i] = taxableLine{productID: line.Product_id, amount: price.Mul(line.Quantity)}
+	}
+
+	breakdown, err := calculateTax(db, req.Country, req.Region, lines)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, breakdown)
+}
+
+const taxRateColumns = `id, tax_class_id, country, region, name, rate::text, updated_at`
+
+func scanTaxRate(row scanner) (models.TaxRate, error) {
+	var rate models.TaxRate
+	err := row.Scan(&rate.Id, &rate.Tax_class_id, &rate.Country, &rate.Region, &rate.Name, &rate.Rate, &rate.Updated_at)
+	return rate, err
+}
+
+func GetTaxClasses(w http.ResponseWriter, r *http.Request) {
+	db := createConnection()
+	defer db.Close()
+
+	rows, err := db.Query(`SELECT id, code, name, is_default, created_at, updated_at FROM tax_classes ORDER BY code`)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	defer rows.Close()
+
+	classes := []models.TaxClass{}
+	index := map[int64]int{}
+	for rows.Next() {
+		class := models.TaxClass{Rates: []models.TaxRate{}}
+		if err := rows.Scan(&class.Id, &class.Code, &class.Name, &class.Is_default, &class.Created_at, &class.Updated_at); err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		index[class.Id] = len(classes)
+		classes = append(classes, class)
+	}
+	if err := rows.Err(); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	rateRows, err := db.Query(`SELECT ` + taxRateColumns + ` FROM tax_rates ORDER BY country, region, id`)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	defer rateRows.Close()
+	for rateRows.Next() {
+		rate, err := scanTaxRate(rateRows)
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		if i, ok := index[rate.Tax_class_id]; ok {
+			classes[i].Rates = append(classes[i].Rates, rate)
+		}
+	}
+	if err := rateRows.Err(); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, classes)
+}
+
+func normalizeTaxClass(class *models.TaxClass) error {
+	class.Code = strings.ToLower(strings.TrimSpace(class.Code))
+	class.Name = strings.TrimSpace(class.Name)
+	if !taxClassCodePattern.MatchString(class.Code) {
+		return validationError("code must be up to 32 lowercase letters, digits, dashes or underscores")
+	}
+	if class.Name == "" {
+		return validationError("name is required")
+	}
+	return nil
+}
+
+// saveTaxClass creates (id 0) or updates a tax class. Making a class the
+// default takes the flag away from the previous default.
+func saveTaxClass(db *sql.DB, id int64, class models.TaxClass) (int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if class.Is_default {
+		if _, err := tx.Exec(`UPDATE tax_classes SET is_default=false, updated_at=Now() WHERE is_default AND id<>$1`, id); err != nil {
+			return 0, err
+		}
+	}
+	if id == 0 {
+		sqlStatement := `INSERT INTO tax_classes(code, name, is_default, created_at, updated_at) VALUES ($1, $2, $3, Now(), Now()) RETURNING id`
+		err = tx.QueryRow(sqlStatement, class.Code, class.Name, class.Is_default).Scan(&id)
+	} else {
+		var res sql.Result
+		res, err = tx.Exec(`UPDATE tax_classes SET code=$2, name=$3, is_default=$4, updated_at=Now() WHERE id=$1`, id, class.Code, class.Name, class.Is_default)
+		if err == nil {
+			if affected, _ := res.RowsAffected(); affected == 0 {
+				err = errTaxClassNotFound
+			}
+		}
+	}
+	if err != nil {
+		return 0, err
+	}
+	return id, tx.Commit()
+}
+
+func CreateTaxClass(w http.ResponseWriter, r *http.Request) {
+	var class models.TaxClass
+	if err := json.NewDecoder(r.Body).Decode(&class); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Unable to decode the request body %v", err))
+		return
+	}
+	if err := normalizeTaxClass(&class); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	db := createConnection()
+	defer db.Close()
+
+	id, err := saveTaxClass(db, 0, class)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, response{
+		Id:      id,
+		Message: "Tax class created successfully",
+	})
+}
+
+func UpdateTaxClass(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var class models.TaxClass
+	if err := json.NewDecoder(r.Body).Decode(&class); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Unable to decode the request body %v", err))
+		return
+	}
+	if err := normalizeTaxClass(&class); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	db := createConnection()
+	defer db.Close()
+
+	if _, err := saveTaxClass(db, id, class); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, response{
+		Id:      id,
+		Message: "Tax class updated successfully",
+	})
+}
+
+// DeleteTaxClass removes a tax class and its rates. Products and categories
+// that used it fall back to the next class up.
+func DeleteTaxClass(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	db := createConnection()
+	defer db.Close()
+
+	res, err := db.Exec(`DELETE FROM tax_classes WHERE id=$1`, id)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	if affected, err := res.RowsAffected(); err != nil || affected == 0 {
+		if err == nil {
+			err = errTaxClassNotFound
+		}
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, response{
+		Id:      id,
+		Message: "Tax class deleted successfully",
+	})
+}
+
+// SetTaxRate creates or replaces the rate of a tax class in a country or
+// region.
+func SetTaxRate(w http.ResponseWriter, r *http.Request) {
+	classID, err := pathID(r, "id")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var rate models.TaxRate
+	if err := json.NewDecoder(r.Body).Decode(&rate); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Unable to decode the request body %v", err))
+		return
+	}
+	rate.Country = strings.ToUpper(strings.TrimSpace(rate.Country))
+	rate.Region = strings.ToUpper(strings.TrimSpace(rate.Region))
+	rate.Name = strings.TrimSpace(rate.Name)
+	if !countryPattern.MatchString(rate.Country) {
+		writeError(w, http.StatusBadRequest, "country must be a two-letter ISO 3166 code")
+		return
+	}
+	if rate.Name == "" {
+		writeError(w, http.StatusBadRequest, "name is required")
+		return
+	}
+	value, err := models.ParseRate(rate.Rate)
+	if err != nil || value.Sign() < 0 || value.Cmp(big.NewRat(100, 1)) > 0 {
+		writeError(w, http.StatusBadRequest, "rate must be a percentage between 0 and 100")
+		return
+	}
+
+	db := createConnection()
+	defer db.Close()
+
+	sqlStatement := `INSERT INTO tax_rates(tax_class_id, country, region, name, rate, created_at, updated_at) VALUES ($1, $2, $3, $4, $5, Now(), Now())
+	ON CONFLICT (tax_class_id, country, region) DO UPDATE SET name=EXCLUDED.name, rate=EXCLUDED.rate, updated_at=Now()
+	RETURNING id`
+	var id int64
+	err = db.QueryRow(sqlStatement, classID, rate.Country, rate.Region, rate.Name, strings.TrimSpace(rate.Rate)).Scan(&id)
+	if isForeignKeyViolation(err) {
+		err = errTaxClassNotFound
+	}
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, response{
+		Id:      id,
+		Message: "Tax rate saved successfully",
+	})
+}
+
+func DeleteTaxRate(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	db := createConnection()
+	defer db.Close()
+
+	res, err := db.Exec(`DELETE FROM tax_rates WHERE id=$1`, id)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	if affected, err := res.RowsAffected(); err != nil || affected == 0 {
+		if err == nil {
+			err = errTaxRateNotFound
+		}
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, response{
+		Id:      id,
+		Message: "Tax rate deleted successfully",
+	})
+}
+
+// assignTaxClass sets or, with a null tax_class_id, clears the tax class of
+// a product or category.
+func assignTaxClass(w http.ResponseWriter, r *http.Request, sqlStatement string, notFound error, message string) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var assignment models.TaxClassAssignment
+	if err := json.NewDecoder(r.Body).Decode(&assignment); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Unable to decode the request body %v", err))
+		return
+	}
+
+	db := createConnection()
+	defer db.Close()
+
+	res, err := db.Exec(sqlStatement, id, assignment.Tax_class_id)
+	if isForeignKeyViolation(err) {
+		err = errTaxClassNotFound
+	}
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	if affected, err := res.RowsAffected(); err != nil || affected == 0 {
+		if err == nil {
+			err = notFound
+		}
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, response{
+		Id:      id,
+		Message: message,
+	})
+}
+
+func SetProductTaxClass(w http.ResponseWriter, r *http.Request) {
+	assignTaxClass(w, r, `UPDATE products SET tax_class_id=$2, updated=Now() WHERE id=$1`, errProductNotFound, "Product tax class updated successfully")
+}
+
+func SetCategoryTaxClass(w http.ResponseWriter, r *http.Request) {
+	assignTaxClass(w, r, `UPDATE categories SET tax_class_id=$2, updated_at=Now() WHERE category_id=$1`, errCategoryNotFound, "Category tax class updated successfully")
+}
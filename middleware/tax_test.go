@@ -0,0 +1,49 @@
+package middleware
+
+import (
+	"products/models"
+	"testing"
+)
+
+func TestSplitTax(t *testing.T) {
+	tests := []struct {
+		amount    models.Money
+		rate      string
+		inclusive bool
+		net       int64
+		tax       int64
+		gross     int64
+	}{
+		{models.NewMoney(10000, "EUR"), "20", false, 10000, 2000, 12000},
+		{models.NewMoney(12000, "EUR"), "20", true, 10000, 2000, 12000},
+		{models.NewMoney(1999, "EUR"), "19", false, 1999, 380, 2379},
+		{models.NewMoney(1999, "EUR"), "19", true, 1680, 319, 1999},
+		{models.NewMoney(999, "USD"), "8.875", false, 999, 89, 1088},
+		{models.NewMoney(1000, "EUR"), "0", true, 1000, 0, 1000},
+		{models.NewMoney(1000, "JPY"), "10", false, 1000, 100, 1100},
+		{models.NewMoney(-1999, "EUR"), "19", true, -1680, -319, -1999},
+	}
+	for _, tt := range tests {
+		rate, err := models.ParseRate(tt.rate)
+		if err != nil {
+			t.Fatalf("ParseRate(%q): %v", tt.rate, err)
+		}
+		net, tax, gross := splitTax(tt.amount, rate, tt.inclusive)
+		if net.Minor() != tt.net || tax.Minor() != tt.tax || gross.Minor() != tt.gross {
+			t.Errorf("splitTax(%s, %s, %v) = %d, %d, %d, want %d, %d, %d",
+				tt.amount, tt.rate, tt.inclusive, net.Minor(), tax.Minor(), gross.Minor(), tt.net, tt.tax, tt.gross)
+		}
+		if net.Add(tax).Cmp(gross) != 0 {
+			t.Errorf("splitTax(%s, %s, %v): net %s + tax %s != gross %s", tt.amount, tt.rate, tt.inclusive, net, tax, gross)
+		}
+	}
+}
+
+func TestCalculateTaxRejectsInvalidCountries(t *testing.T) {
+	lines := []taxableLine{{productID: 1, amount: models.NewMoney(1000, "EUR")}}
+	for _, country := range []string{"", "D", "DEU", "1E"} {
+		if _, err := calculateTax(nil, country, "", lines); err == nil {
+			t.Errorf("calculateTax(%q) succeeded, want an error", country)
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package middleware
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"products/models"
+	"strings"
+)
+
+var errCategoryNotFound = notFoundError("Category not found")
+
+// lockCategoryTree serializes structural changes to the category tree for the
+// rest of the transaction and returns the locked category.
+func lockCategoryTree(tx *sql.Tx, id int64) (models.Category, error) {
+	if _, err := tx.Exec(`LOCK TABLE categories IN SHARE ROW EXCLUSIVE MODE`); err != nil {
+		return models.Category{}, err
+	}
+	return getCategoryByID(tx, id)
+}
+
+func getCategoryByID(q dbtx, id int64) (models.Category, error) {
+	sqlStatement := `SELECT ` + categoryColumns + ` FROM categories c WHERE c.category_id=$1`
+	category, err := scanCategory(q.QueryRow(sqlStatement, id))
+	if err == sql.ErrNoRows {
+		return category, errCategoryNotFound
+	}
+	return category, err
+}
+
+func queryCategories(q dbtx, sqlStatement string, args ...any) ([]models.Category, error) {
+	rows, err := q.Query(sqlStatement, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	categories := []models.Category{}
+	for rows.Next() {
+		category, err := scanCategory(rows)
+		if err != nil {
+			return nil, err
+		}
+		categories = append(categories, category)
+	}
+	return categories, rows.Err()
+}
+
+// buildCategoryTree nests categories under their parents. Categories whose
+// parent is not part of the list become roots, which lets the same function
+// build both the full tree and a subtree.
+func buildCategoryTree(categories []models.Category) []models.Category {
+	present := map[int64]bool{}
+	children := map[int64][]models.Category{}
+	for _, category := range categories {
+		present[category.Category_id] = true
+	}
+
+	var roots []models.Category
+	for _, category := range categories {
+		if category.Parent_id != nil && present[*category.Parent_id] {
+			children[*category.Parent_id] = append(children[*category.Parent_id], category)
+			continue
+		}
+		roots = append(roots, category)
+	}
+
+	var attach func(nodes []models.Category) []models.Category
+	attach = func(nodes []models.Category) []models.Category {
+		for i := range nodes {
+			nodes[i].Children = attach(children[nodes[i].Category_id])
+		}
+		return nodes
+	}
+
+	tree := attach(roots)
+	if tree == nil {
+		tree = []models.Category{}
+	}
+	return tree
+}
+
+func GetCategoryTree(w http.ResponseWriter, r *http.Request) {
+	stats, err := wantsStats(r)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	db := createConnection()
+	defer db.Close()
+
+	orderBy := `c.depth, c.category_name, c.category_id`
+	var categories []models.Category
+	if stats {
+		categories, err = getCategoriesWithStats(db, orderBy)
+	} else {
+		categories, err = queryCategories(db, `SELECT `+categoryColumns+` FROM categories c ORDER BY `+orderBy)
+	}
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, buildCategoryTree(categories))
+}
+
+func GetCategorySubtree(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	db := createConnection()
+	defer db.Close()
+
+	category, err := getCategoryByID(db, id)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	sqlStatement := `SELECT ` + categoryColumns + ` FROM categories c WHERE c.path LIKE $1::text || '%' ORDER BY c.depth, c.category_name, c.category_id`
+	categories, err := queryCategories(db, sqlStatement, category.Path)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	tree := buildCategoryTree(categories)
+	if len(tree) != 1 {
+		writeStoreError(w, fmt.Errorf("category %d has an inconsistent path %q", id, category.Path))
+		return
+	}
+	writeJSON(w, http.StatusOK, tree[0])
+}
+
+// GetCategoryAncestors returns the breadcrumb trail from the root down to the
+// category's parent.
+func GetCategoryAncestors(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	db := createConnection()
+	defer db.Close()
+
+	category, err := getCategoryByID(db, id)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	sqlStatement := `SELECT ` + categoryColumns + ` FROM categories c WHERE $1::text LIKE c.path || '%' AND c.category_id <> $2 ORDER BY c.depth`
+	ancestors, err := queryCategories(db, sqlStatement, category.Path, id)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, ancestors)
+}
+
+func MoveCategory(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var req models.MoveCategoryRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Unable to decode the request body %v", err))
+		return
+	}
+
+	movedRows, err := moveCategory(id, req.Parent_id)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, response{
+		Id:      id,
+		Message: fmt.Sprintf("Category moved successfully %v", movedRows),
+	})
+}
+
+// moveCategory re-parents a category and rewrites the paths of its whole
+// subtree. A nil parentID moves the category to the root.
+func moveCategory(id int64, parentID *int64) (int64, error) {
+	db := createConnection()
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	category, err := lockCategoryTree(tx, id)
+	if err != nil {
+		return 0, err
+	}
+
+	newPath, newDepth := fmt.Sprintf("/%d/", id), int64(0)
+	if parentID != nil {
+		parent, err := getCategoryByID(tx, *parentID)
+		if err == errCategoryNotFound {
+			return 0, validationError("Parent category does not exist")
+		}
+		if err != nil {
+			return 0, err
+		}
+		if strings.HasPrefix(parent.Path, category.Path) {
+			return 0, conflictError("A category cannot be moved below itself or one of its descendants")
+		}
+		newPath, newDepth = fmt.Sprintf("%s%d/", parent.Path, id), parent.Depth+1
+	}
+
+	sqlStatement := `UPDATE categories SET path = $2::text || substring(path from length($1::text) + 1), depth = depth + $3, updated_at = Now()
+	WHERE path LIKE $1::text || '%'`
+	res, err := tx.Exec(sqlStatement, category.Path, newPath, newDepth-category.Depth)
+	if err != nil {
+		return 0, err
+	}
+	movedRows, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := tx.Exec(`UPDATE categories SET parent_id=$2 WHERE category_id=$1`, id, parentID); err != nil {
+		return 0, err
+	}
+
+	return movedRows, tx.Commit()
+}
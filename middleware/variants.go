@@ -0,0 +1,735 @@
+package middleware
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"products/models"
+	"sort"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+var (
+	errOptionNotFound  = notFoundError("Product option not found")
+	errVariantNotFound = notFoundError("Product variant not found")
+)
+
+// variantSummaryQuery aggregates variant prices and stock per product. A
+// variant without its own price inherits the parent product's price.
+const variantSummaryQuery = `SELECT v.product_id, COUNT(*) AS variant_count,
+	MIN(COALESCE(v.price, pp.price)) AS min_price, MAX(COALESCE(v.price, pp.price)) AS max_price,
+	SUM(v.quantity) AS total_stock
+	FROM product_variants v JOIN products pp ON pp.id = v.product_id
+	GROUP BY v.product_id`
+
+// nullVariantSummary receives the LEFT JOINed variantSummaryQuery columns,
+// which are NULL for products without variants.
+type nullVariantSummary struct {
+	count    sql.NullInt64
+	minPrice *models.Money
+	maxPrice *models.Money
+	stock    sql.NullInt64
+}
+
+func (s *nullVariantSummary) dest() []any {
+	return []any{&s.count, &s.minPrice, &s.maxPrice, &s.stock}
+}
+
+func (s *nullVariantSummary) value() *models.VariantSummary {
+	if !s.count.Valid {
+		return nil
+	}
+	summary := &models.VariantSummary{
+		Variant_count: s.count.Int64,
+		Total_stock:   s.stock.Int64,
+	}
+	if s.minPrice != nil {
+		summary.Min_price = *s.minPrice
+		summary.Max_price = *s.maxPrice
+	}
+	return summary
+}
+
+// loadProductVariants fills in the options, variants and variant summary of
+// a single product.
+func loadProductVariants(product *models.Product) error {
+	db := createConnection()
+	defer db.Close()
+
+	options, err := getProductOptions(db, product.Id)
+	if err != nil {
+		return err
+	}
+	variants, err := getProductVariants(db, product.Id)
+	if err != nil {
+		return err
+	}
+
+	product.Options = options
+	product.Variants = variants
+	product.Variant_summary = summarizeVariants(variants)
+	return nil
+}
+
+// summarizeVariants aggregates loaded variants like variantSummaryQuery. It
+// returns nil when there are none.
+func summarizeVariants(variants []models.ProductVariant) *models.VariantSummary {
+	if len(variants) == 0 {
+		return nil
+	}
+	summary := &models.VariantSummary{
+		Variant_count: int64(len(variants)),
+		Min_price:     variants[0].Effective_price,
+		Max_price:     variants[0].Effective_price,
+	}
+	for _, variant := range variants {
+		if variant.Effective_price.Cmp(summary.Min_price) < 0 {
+			summary.Min_price = variant.Effective_price
+		}
+		if variant.Effective_price.Cmp(summary.Max_price) > 0 {
+			summary.Max_price = variant.Effective_price
+		}
+		summary.Total_stock += variant.Quantity
+	}
+	return summary
+}
+
+func productExists(q dbtx, id int64) error {
+	var exists bool
+	err := q.QueryRow(`SELECT EXISTS(SELECT 1 FROM products WHERE id=$1)`, id).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return errProductNotFound
+	}
+	return nil
+}
+
+func GetProductOptions(w http.ResponseWriter, r *http.Request) {
+	productID, err := pathID(r, "id")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	db := createConnection()
+	defer db.Close()
+
+	if err := productExists(db, productID); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	options, err := getProductOptions(db, productID)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, options)
+}
+
+func getProductOptions(q dbtx, productID int64) ([]models.ProductOption, error) {
+	sqlStatement := `SELECT id, product_id, name, "values", position FROM product_options WHERE product_id=$1 ORDER BY position, id`
+	rows, err := q.Query(sqlStatement, productID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	options := []models.ProductOption{}
+	for rows.Next() {
+		var option models.ProductOption
+		err := rows.Scan(&option.Id, &option.Product_id, &option.Name, pq.Array(&option.Values), &option.Position)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, option)
+	}
+	return options, rows.Err()
+}
+
+func CreateProductOption(w http.ResponseWriter, r *http.Request) {
+	productID, err := pathID(r, "id")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var option models.ProductOption
+	if err := json.NewDecoder(r.Body).Decode(&option); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Unable to decode the request body %v", err))
+		return
+	}
+	if err := normalizeOption(&option); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	db := createConnection()
+	defer db.Close()
+
+	if err := productExists(db, productID); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	sqlStatement := `INSERT INTO product_options(product_id, name, "values", position) VALUES ($1, $2, $3, $4) RETURNING id`
+	var id int64
+	err = db.QueryRow(sqlStatement, productID, option.Name, pq.Array(option.Values), option.Position).Scan(&id)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, response{
+		Id:      id,
+		Message: "Product option create successfully",
+	})
+}
+
+func UpdateProductOption(w http.ResponseWriter, r *http.Request) {
+	productID, err := pathID(r, "id")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	optionID, err := pathID(r, "optionId")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var option models.ProductOption
+	if err := json.NewDecoder(r.Body).Decode(&option); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Unable to decode the request %v", err))
+		return
+	}
+	if err := normalizeOption(&option); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	db := createConnection()
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	defer tx.Rollback()
+
+	var oldName string
+	err = tx.QueryRow(`SELECT name FROM product_options WHERE id=$1 AND product_id=$2 FOR UPDATE`, optionID, productID).Scan(&oldName)
+	if err == sql.ErrNoRows {
+		writeStoreError(w, errOptionNotFound)
+		return
+	}
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	// Variants store their option values by option name, so renaming an
+	// option or removing a value must not orphan existing variants.
+	if oldName != option.Name {
+		var used bool
+		err = tx.QueryRow(`SELECT EXISTS(SELECT 1 FROM product_variants WHERE product_id=$1 AND options ? $2)`, productID, oldName).Scan(&used)
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		if used {
+			writeStoreError(w, conflictError("Option is used by existing variants and cannot be renamed"))
+			return
+		}
+	}
+	if len(option.Values) > 0 {
+		var used bool
+		sqlStatement := `SELECT EXISTS(SELECT 1 FROM product_variants WHERE product_id=$1 AND options ? $2::text AND NOT (options->>$2::text = ANY($3)))`
+		err = tx.QueryRow(sqlStatement, productID, option.Name, pq.Array(option.Values)).Scan(&used)
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		if used {
+			writeStoreError(w, conflictError("A removed option value is still used by existing variants"))
+			return
+		}
+	}
+
+	sqlStatement := `UPDATE product_options SET name=$2, "values"=$3, position=$4 WHERE id=$1`
+	if _, err := tx.Exec(sqlStatement, optionID, option.Name, pq.Array(option.Values), option.Position); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, response{
+		Id:      optionID,
+		Message: "Product option updated successfully",
+	})
+}
+
+func DeleteProductOption(w http.ResponseWriter, r *http.Request) {
+	productID, err := pathID(r, "id")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	optionID, err := pathID(r, "optionId")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	db := createConnection()
+	defer db.Close()
+
+	sqlStatement := `DELETE FROM product_options o WHERE o.id=$1 AND o.product_id=$2
+	AND NOT EXISTS(SELECT 1 FROM product_variants v WHERE v.product_id=o.product_id AND v.options ? o.name)`
+	res, err := db.Exec(sqlStatement, optionID, productID)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	if rowsAffected == 0 {
+		var exists bool
+		err := db.QueryRow(`SELECT EXISTS(SELECT 1 FROM product_options WHERE id=$1 AND product_id=$2)`, optionID, productID).Scan(&exists)
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		if exists {
+			writeStoreError(w, conflictError("Option is used by existing variants"))
+			return
+		}
+		writeStoreError(w, errOptionNotFound)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, response{
+		Id:      optionID,
+		Message: "Product option deleted successfully",
+	})
+}
+
+func normalizeOption(option *models.ProductOption) error {
+	option.Name = strings.ToLower(strings.TrimSpace(option.Name))
+	if option.Name == "" {
+		return validationError("option name is required")
+	}
+
+	seen := map[string]bool{}
+	values := []string{}
+	for _, value := range option.Values {
+		value = strings.TrimSpace(value)
+		if value == "" || seen[value] {
+			continue
+		}
+		seen[value] = true
+		values = append(values, value)
+	}
+	option.Values = values
+	return nil
+}
+
+const variantColumns = `v.id, v.product_id, v.sku, v.price, COALESCE(v.price, p.price), v.quantity, v.options, v.images, v.created, v.updated`
+
+func scanVariant(row scanner) (models.ProductVariant, error) {
+	var variant models.ProductVariant
+	var options []byte
+	err := row.Scan(&variant.Id, &variant.Product_id, &variant.Sku, &variant.Price, &variant.Effective_price, &variant.Quantity, &options, pq.Array(&variant.Images), &variant.Created, &variant.Updated)
+	if err != nil {
+		return variant, err
+	}
+	if variant.Images == nil {
+		variant.Images = []string{}
+	}
+	err = json.Unmarshal(options, &variant.Options)
+	return variant, err
+}
+
+func getProductVariants(q dbtx, productID int64) ([]models.ProductVariant, error) {
+	sqlStatement := `SELECT ` + variantColumns + ` FROM product_variants v JOIN products p ON p.id = v.product_id WHERE v.product_id=$1 ORDER BY v.id`
+	rows, err := q.Query(sqlStatement, productID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	variants := []models.ProductVariant{}
+	for rows.Next() {
+		variant, err := scanVariant(rows)
+		if err != nil {
+			return nil, err
+		}
+		variants = append(variants, variant)
+	}
+	return variants, rows.Err()
+}
+
+func getProductVariant(q dbtx, productID int64, variantID int64) (models.ProductVariant, error) {
+	sqlStatement := `SELECT ` + variantColumns + ` FROM product_variants v JOIN products p ON p.id = v.product_id WHERE v.id=$1 AND v.product_id=$2`
+	variant, err := scanVariant(q.QueryRow(sqlStatement, variantID, productID))
+	if err == sql.ErrNoRows {
+		return variant, errVariantNotFound
+	}
+	return variant, err
+}
+
+func GetProductVariants(w http.ResponseWriter, r *http.Request) {
+	productID, err := pathID(r, "id")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	db := createConnection()
+	defer db.Close()
+
+	if err := productExists(db, productID); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	variants, err := getProductVariants(db, productID)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, variants)
+}
+
+func GetProductVariant(w http.ResponseWriter, r *http.Request) {
+	productID, err := pathID(r, "id")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	variantID, err := pathID(r, "variantId")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	db := createConnection()
+	defer db.Close()
+
+	variant, err := getProductVariant(db, productID, variantID)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, variant)
+}
+
+func CreateProductVariant(w http.ResponseWriter, r *http.Request) {
+	productID, err := pathID(r, "id")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var variant models.ProductVariant
+	if err := json.NewDecoder(r.Body).Decode(&variant); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Unable to decode the request body %v", err))
+		return
+	}
+	var actorID *int64
+	if user, ok := currentUser(r); ok {
+		actorID = &user.Id
+	}
+
+	db := createConnection()
+	defer db.Close()
+
+	if err := productExists(db, productID); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	options, err := validateVariant(db, productID, 0, &variant)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	defer tx.Rollback()
+
+	// Stock starts at zero and is booked through the ledger.
+	sqlStatement := `INSERT INTO product_variants(product_id, sku, price, quantity, options, images, created, updated)
+	VALUES ($1, $2, $3, 0, $4, $5, Now(), Now()) RETURNING id`
+	var id int64
+	err = tx.QueryRow(sqlStatement, productID, variant.Sku, variant.Price, options, pq.Array(variant.Images)).Scan(&id)
+	if err != nil {
+		writeVariantError(w, err)
+		return
+	}
+	if err := recordVariantPrice(tx, productID, id, nil, actorID); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	if err := setVariantStockLevel(tx, productID, id, variant.Quantity, "Initial stock", actorID); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, response{
+		Id:      id,
+		Message: "Product variant create successfully",
+	})
+}
+
+func UpdateProductVariant(w http.ResponseWriter, r *http.Request) {
+	productID, err := pathID(r, "id")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	variantID, err := pathID(r, "variantId")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// quantity is optional here: stock is only touched when the client sends it.
+	var body struct {
+		models.ProductVariant
+		Quantity *int64 `json:"quantity"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Unable to decode the request %v", err))
+		return
+	}
+	variant := body.ProductVariant
+	var actorID *int64
+	if user, ok := currentUser(r); ok {
+		actorID = &user.Id
+	}
+
+	db := createConnection()
+	defer db.Close()
+
+	options, err := validateVariant(db, productID, variantID, &variant)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	defer tx.Rollback()
+
+	oldPrice, err := lockVariantPrice(tx, productID, variantID)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	sqlStatement := `UPDATE product_variants SET sku=$3, price=$4, options=$5, images=$6, updated=Now() WHERE id=$1 AND product_id=$2`
+	if _, err := tx.Exec(sqlStatement, variantID, productID, variant.Sku, variant.Price, options, pq.Array(variant.Images)); err != nil {
+		writeVariantError(w, err)
+		return
+	}
+	if err := recordVariantPrice(tx, productID, variantID, oldPrice, actorID); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	if body.Quantity != nil {
+		if err := setVariantStockLevel(tx, productID, variantID, *body.Quantity, "Set by variant update", actorID); err != nil {
+			writeStoreError(w, err)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, response{
+		Id:      variantID,
+		Message: "Product variant updated successfully",
+	})
+}
+
+func DeleteProductVariant(w http.ResponseWriter, r *http.Request) {
+	productID, err := pathID(r, "id")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	variantID, err := pathID(r, "variantId")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	var actorID *int64
+	if user, ok := currentUser(r); ok {
+		actorID = &user.Id
+	}
+
+	db := createConnection()
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	defer tx.Rollback()
+
+	// Close the variant's ledger at zero so its history still adds up.
+	if err := setVariantStockLevel(tx, productID, variantID, 0, "Variant deleted", actorID); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	if _, err := tx.Exec(`DELETE FROM product_variants WHERE id=$1 AND product_id=$2`, variantID, productID); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, response{
+		Id:      variantID,
+		Message: "Product variant deleted successfully",
+	})
+}
+
+// recordVariantPrice adds the effective price of a variant to its price
+// history when it differs from oldPrice. The variant row must be locked.
+func recordVariantPrice(q dbtx, productID int64, variantID int64, oldPrice *models.Money, actorID *int64) error {
+	newPrice, err := lockVariantPrice(q, productID, variantID)
+	if err != nil || newPrice == nil || !priceChanged(oldPrice, *newPrice) {
+		return err
+	}
+	return recordVariantPriceChange(q, productID, variantID, oldPrice, *newPrice, actorID)
+}
+
+// validateVariant normalizes a variant and checks its option values against
+// the parent product's option types. It returns the options encoded for the
+// jsonb column.
+func validateVariant(q dbtx, productID int64, variantID int64, variant *models.ProductVariant) ([]byte, error) {
+	variant.Sku = strings.ToUpper(strings.TrimSpace(variant.Sku))
+	if !skuPattern.MatchString(variant.Sku) {
+		return nil, validationError("sku is required and may only contain letters, digits, '-' and '_' (max 64)")
+	}
+	if variant.Price != nil {
+		if err := checkBasePrice("price", *variant.Price); err != nil {
+			return nil, err
+		}
+	}
+	if variant.Quantity < 0 {
+		return nil, validationError("quantity must not be negative")
+	}
+
+	images := []string{}
+	for _, image := range variant.Images {
+		if image = strings.TrimSpace(image); image != "" {
+			images = append(images, image)
+		}
+	}
+	variant.Images = images
+
+	definitions, err := getProductOptions(q, productID)
+	if err != nil {
+		return nil, err
+	}
+
+	normalized := map[string]string{}
+	values := map[string]string{}
+	for name, value := range variant.Options {
+		name = strings.ToLower(strings.TrimSpace(name))
+		normalized[name] = strings.TrimSpace(value)
+		values[name] = normalized[name]
+	}
+
+	var missing []string
+	for _, definition := range definitions {
+		value, ok := values[definition.Name]
+		if !ok || value == "" {
+			missing = append(missing, definition.Name)
+			continue
+		}
+		if len(definition.Values) > 0 && !containsString(definition.Values, value) {
+			return nil, validationError(fmt.Sprintf("%q is not an allowed value for option %q", value, definition.Name))
+		}
+		delete(values, definition.Name)
+	}
+	if len(missing) > 0 {
+		return nil, validationError(fmt.Sprintf("missing values for options: %s", strings.Join(missing, ", ")))
+	}
+	if len(values) > 0 {
+		var unknown []string
+		for name := range values {
+			unknown = append(unknown, name)
+		}
+		sort.Strings(unknown)
+		return nil, validationError(fmt.Sprintf("unknown options: %s", strings.Join(unknown, ", ")))
+	}
+
+	variant.Options = normalized
+	encoded, err := json.Marshal(variant.Options)
+	if err != nil {
+		return nil, err
+	}
+
+	var duplicate bool
+	sqlStatement := `SELECT EXISTS(SELECT 1 FROM product_variants WHERE product_id=$1 AND id<>$2 AND options=$3::jsonb)`
+	if err := q.QueryRow(sqlStatement, productID, variantID, encoded).Scan(&duplicate); err != nil {
+		return nil, err
+	}
+	if duplicate {
+		return nil, conflictError("A variant with the same option values already exists")
+	}
+
+	var skuTaken bool
+	if err := q.QueryRow(`SELECT EXISTS(SELECT 1 FROM products WHERE sku=$1)`, variant.Sku).Scan(&skuTaken); err != nil {
+		return nil, err
+	}
+	if skuTaken {
+		return nil, conflictError("sku is already used by a product")
+	}
+
+	return encoded, nil
+}
+
+func writeVariantError(w http.ResponseWriter, err error) {
+	if isUniqueViolation(err) {
+		writeError(w, http.StatusConflict, "A variant with this sku already exists")
+		return
+	}
+	writeStoreError(w, err)
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
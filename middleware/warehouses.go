@@ -0,0 +1,460 @@
+package middleware
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"products/models"
+	"strings"
+)
+
+var (
+	errWarehouseNotFound  = notFoundError("Warehouse not found")
+	errNoDefaultWarehouse = conflictError("No default warehouse is configured")
+)
+
+const warehouseColumns = `id, code, name, address, is_default, active, created_at, updated_at`
+
+func scanWarehouse(row scanner) (models.Warehouse, error) {
+	var warehouse models.Warehouse
+	err := row.Scan(&warehouse.Id, &warehouse.Code, &warehouse.Name, &warehouse.Address, &warehouse.Is_default, &warehouse.Active, &warehouse.Created_at, &warehouse.Updated_at)
+	return warehouse, err
+}
+
+func getWarehouse(q dbtx, id int64) (models.Warehouse, error) {
+	warehouse, err := scanWarehouse(q.QueryRow(`SELECT `+warehouseColumns+` FROM warehouses WHERE id=$1`, id))
+	if err == sql.ErrNoRows {
+		return warehouse, errWarehouseNotFound
+	}
+	return warehouse, err
+}
+
+// defaultWarehouseID returns the warehouse that receives stock movements
+// which do not name a warehouse.
+func defaultWarehouseID(q dbtx) (int64, error) {
+	var id int64
+	err := q.QueryRow(`SELECT id FROM warehouses WHERE is_default`).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, errNoDefaultWarehouse
+	}
+	return id, err
+}
+
+// changeWarehouseStock adds delta to the stock a warehouse holds of a
+// product. Like the product total, it is a conditional update that fails
+// instead of going negative.
+func changeWarehouseStock(q dbtx, warehouseID int64, productID int64, delta int64) error {
+	var active bool
+	err := q.QueryRow(`SELECT active FROM warehouses WHERE id=$1`, warehouseID).Scan(&active)
+	if err == sql.ErrNoRows {
+		return errWarehouseNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if !active && delta > 0 {
+		return conflictError("Warehouse is inactive")
+	}
+
+	sqlStatement := `INSERT INTO warehouse_stock(warehouse_id, product_id, quantity, updated_at) VALUES ($1, $2, $3, Now())
+	ON CONFLICT (warehouse_id, product_id) DO UPDATE SET quantity = warehouse_stock.quantity + EXCLUDED.quantity, updated_at=Now()
+	WHERE warehouse_stock.quantity + EXCLUDED.quantity >= 0`
+	if delta < 0 {
+		sqlStatement = `UPDATE warehouse_stock SET quantity = quantity + $3, updated_at=Now()
+		WHERE warehouse_id=$1 AND product_id=$2 AND quantity + $3 >= 0`
+	}
+	res, err := q.Exec(sqlStatement, warehouseID, productID, delta)
+	if err != nil {
+		return err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return conflictError("Insufficient stock in warehouse")
+	}
+	return nil
+}
+
+func GetAllWarehouses(w http.ResponseWriter, r *http.Request) {
+	db := createConnection()
+	defer db.Close()
+
+	rows, err := db.Query(`SELECT ` + warehouseColumns + ` FROM warehouses ORDER BY id`)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	defer rows.Close()
+
+	warehouses := []models.Warehouse{}
+	for rows.Next() {
+		warehouse, err := scanWarehouse(rows)
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		warehouses = append(warehouses, warehouse)
+	}
+	if err := rows.Err(); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, warehouses)
+}
+
+func GetWarehouse(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	db := createConnection()
+	defer db.Close()
+
+	warehouse, err := getWarehouse(db, id)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, warehouse)
+}
+
+func normalizeWarehouse(warehouse *models.Warehouse) error {
+	warehouse.Code = strings.ToUpper(strings.TrimSpace(warehouse.Code))
+	warehouse.Name = strings.TrimSpace(warehouse.Name)
+	if !skuPattern.MatchString(warehouse.Code) {
+		return validationError("code must contain only letters, digits, '-' and '_'")
+	}
+	if warehouse.Name == "" {
+		return validationError("name is required")
+	}
+	return nil
+}
+
+func CreateWarehouse(w http.ResponseWriter, r *http.Request) {
+	warehouse := models.Warehouse{Active: true}
+	if err := json.NewDecoder(r.Body).Decode(&warehouse); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Unable to decode the request body %v", err))
+		return
+	}
+	if err := normalizeWarehouse(&warehouse); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	id, err := saveWarehouse(0, warehouse)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, response{
+		Id:      id,
+		Message: "Warehouse created successfully",
+	})
+}
+
+func UpdateWarehouse(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	warehouse := models.Warehouse{Active: true}
+	if err := json.NewDecoder(r.Body).Decode(&warehouse); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Unable to decode the request body %v", err))
+		return
+	}
+	if err := normalizeWarehouse(&warehouse); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	if _, err := saveWarehouse(id, warehouse); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, response{
+		Id:      id,
+		Message: "Warehouse updated successfully",
+	})
+}
+
+// saveWarehouse inserts (id 0) or updates a warehouse. Making a warehouse the
+// default takes the flag away from the previous default; the default itself
+// cannot be deactivated or lose the flag without a replacement.
+func saveWarehouse(id int64, warehouse models.Warehouse) (int64, error) {
+	db := createConnection()
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`LOCK TABLE warehouses IN SHARE ROW EXCLUSIVE MODE`); err != nil {
+		return 0, err
+	}
+
+	if id != 0 {
+		current, err := getWarehouse(tx, id)
+		if err != nil {
+			return 0, err
+		}
+		if current.Is_default && (!warehouse.Is_default || !warehouse.Active) {
+			return 0, conflictError("Make another warehouse the default first")
+		}
+	}
+	if warehouse.Is_default {
+		if !warehouse.Active {
+			return 0, validationError("the default warehouse must be active")
+		}
+		if _, err := tx.Exec(`UPDATE warehouses SET is_default=false, updated_at=Now() WHERE is_default AND id<>$1`, id); err != nil {
+			return 0, err
+		}
+	}
+
+	if id == 0 {
+		sqlStatement := `INSERT INTO warehouses(code, name, address, is_default, active, created_at, updated_at) VALUES ($1, $2, $3, $4, $5, Now(), Now()) RETURNING id`
+		err = tx.QueryRow(sqlStatement, warehouse.Code, warehouse.Name, warehouse.Address, warehouse.Is_default, warehouse.Active).Scan(&id)
+	} else {
+		sqlStatement := `UPDATE warehouses SET code=$2, name=$3, address=$4, is_default=$5, active=$6, updated_at=Now() WHERE id=$1`
+		_, err = tx.Exec(sqlStatement, id, warehouse.Code, warehouse.Name, warehouse.Address, warehouse.Is_default, warehouse.Active)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return id, tx.Commit()
+}
+
+func DeleteWarehouse(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := deleteWarehouse(id); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, response{
+		Id:      id,
+		Message: "Warehouse deleted successfully",
+	})
+}
+
+// deleteWarehouse removes an empty warehouse. Its ledger entries keep their
+// history with the warehouse reference cleared.
+func deleteWarehouse(id int64) error {
+	db := createConnection()
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var isDefault bool
+	err = tx.QueryRow(`SELECT is_default FROM warehouses WHERE id=$1 FOR UPDATE`, id).Scan(&isDefault)
+	if err == sql.ErrNoRows {
+		return errWarehouseNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if isDefault {
+		return conflictError("The default warehouse cannot be deleted")
+	}
+
+	var stock int64
+	if err := tx.QueryRow(`SELECT COALESCE(SUM(quantity), 0) FROM warehouse_stock WHERE warehouse_id=$1`, id).Scan(&stock); err != nil {
+		return err
+	}
+	if stock > 0 {
+		return conflictError(fmt.Sprintf("Warehouse still holds %d units, transfer them first", stock))
+	}
+
+	if _, err := tx.Exec(`DELETE FROM warehouse_stock WHERE warehouse_id=$1`, id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM warehouses WHERE id=$1`, id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func GetWarehouseStock(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	page, limit := pagination(r)
+
+	db := createConnection()
+	defer db.Close()
+
+	if _, err := getWarehouse(db, id); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	sqlStatement := `SELECT p.id, p.name, p.sku, s.quantity FROM warehouse_stock s JOIN products p ON p.id = s.product_id
+	WHERE s.warehouse_id=$1 AND s.quantity > 0 ORDER BY p.id LIMIT $2 OFFSET $3`
+	rows, err := db.Query(sqlStatement, id, limit, (page-1)*limit)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	defer rows.Close()
+
+	stock := []models.WarehouseProductStock{}
+	for rows.Next() {
+		var item models.WarehouseProductStock
+		if err := rows.Scan(&item.Product.Id, &item.Product.Name, &item.Product.Sku, &item.Quantity); err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		stock = append(stock, item)
+	}
+	if err := rows.Err(); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, stock)
+}
+
+// GetProductAvailability reports the stock of a product per warehouse along
+// with the totals across all locations.
+func GetProductAvailability(w http.ResponseWriter, r *http.Request) {
+	productID, err := pathID(r, "id")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	db := createConnection()
+	defer db.Close()
+
+	availability := models.ProductAvailability{Product_id: productID, Warehouses: []models.WarehouseStock{}}
+	err = db.QueryRow(`SELECT quantity, reserved FROM products WHERE id=$1`, productID).Scan(&availability.Quantity, &availability.Reserved)
+	if err == sql.ErrNoRows {
+		writeStoreError(w, errProductNotFound)
+		return
+	}
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	availability.Available = availability.Quantity - availability.Reserved
+
+	sqlStatement := `SELECT w.id, w.code, w.name, s.quantity FROM warehouse_stock s JOIN warehouses w ON w.id = s.warehouse_id
+	WHERE s.product_id=$1 AND s.quantity > 0 ORDER BY w.is_default DESC, w.id`
+	rows, err := db.Query(sqlStatement, productID)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var item models.WarehouseStock
+		if err := rows.Scan(&item.Warehouse_id, &item.Code, &item.Name, &item.Quantity); err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		availability.Warehouses = append(availability.Warehouses, item)
+	}
+	if err := rows.Err(); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, availability)
+}
+
+func TransferStock(w http.ResponseWriter, r *http.Request) {
+	var transfer models.StockTransfer
+	if err := json.NewDecoder(r.Body).Decode(&transfer); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Unable to decode the request body %v", err))
+		return
+	}
+	var actorID *int64
+	if user, ok := currentUser(r); ok {
+		actorID = &user.Id
+	}
+
+	movements, err := transferStock(transfer, actorID)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, movements)
+}
+
+// transferStock moves units between two warehouses. The product total does
+// not change, so the two ledger entries cancel out.
+func transferStock(transfer models.StockTransfer, actorID *int64) ([]models.StockMovement, error) {
+	if transfer.Quantity <= 0 {
+		return nil, validationError("quantity must be positive")
+	}
+	if transfer.From_warehouse_id == transfer.To_warehouse_id {
+		return nil, validationError("from_warehouse_id and to_warehouse_id must differ")
+	}
+	reason := strings.TrimSpace(transfer.Reason)
+	if reason == "" {
+		reason = fmt.Sprintf("Transfer from warehouse %d to %d", transfer.From_warehouse_id, transfer.To_warehouse_id)
+	}
+
+	db := createConnection()
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var total int64
+	err = tx.QueryRow(`SELECT quantity FROM products WHERE id=$1 FOR UPDATE`, transfer.Product_id).Scan(&total)
+	if err == sql.ErrNoRows {
+		return nil, errProductNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Always lock the two warehouse rows in id order.
+	legs := []models.StockMovement{
+		{Warehouse_id: transfer.From_warehouse_id, Quantity: -transfer.Quantity},
+		{Warehouse_id: transfer.To_warehouse_id, Quantity: transfer.Quantity},
+	}
+	if transfer.To_warehouse_id < transfer.From_warehouse_id {
+		legs[0], legs[1] = legs[1], legs[0]
+	}
+
+	movements := []models.StockMovement{}
+	for _, leg := range legs {
+		leg.Product_id = transfer.Product_id
+		leg.Type = movementTransfer
+		leg.Balance_after = total
+		leg.Reason = reason
+		leg.Reference = transfer.Reference
+		leg.Actor_id = actorID
+		if err := changeWarehouseStock(tx, leg.Warehouse_id, leg.Product_id, leg.Quantity); err != nil {
+			return nil, err
+		}
+		movement, err := insertMovement(tx, leg)
+		if err != nil {
+			return nil, err
+		}
+		movements = append(movements, movement)
+	}
+	return movements, tx.Commit()
+}
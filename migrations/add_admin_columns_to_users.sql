@@ -0,0 +1,9 @@
+ALTER TABLE users
+ADD COLUMN role varchar NOT NULL DEFAULT 'customer',
+ADD COLUMN disabled boolean NOT NULL DEFAULT false,
+ADD COLUMN password_reset_required boolean NOT NULL DEFAULT false,
+ADD COLUMN password_reset_token varchar NULL,
+ADD COLUMN password_reset_expires timestamp NULL;
+
+-- Promote the first administrator by hand, for example:
+-- UPDATE users SET role = 'admin' WHERE email = 'admin@example.com';
@@ -0,0 +1,2 @@
+ALTER TABLE products
+ADD COLUMN archived_at timestamp NULL;
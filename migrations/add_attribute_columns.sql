@@ -0,0 +1,7 @@
+ALTER TABLE categories
+ADD COLUMN attribute_schema jsonb NOT NULL DEFAULT '[]';
+
+ALTER TABLE products
+ADD COLUMN attributes jsonb NOT NULL DEFAULT '{}';
+
+CREATE INDEX products_attributes_idx ON products USING gin (attributes);
@@ -0,0 +1,17 @@
+ALTER TABLE products
+ADD COLUMN sku varchar NULL,
+ADD COLUMN barcode varchar NULL,
+ADD COLUMN slug varchar NULL;
+
+-- Backfill existing rows so the new columns can be made mandatory.
+UPDATE products SET sku = 'SKU-' || id WHERE sku IS NULL;
+UPDATE products SET slug = trim(both '-' from lower(regexp_replace(coalesce("name", ''), '[^a-zA-Z0-9]+', '-', 'g'))) || '-' || id WHERE slug IS NULL;
+
+ALTER TABLE products
+ALTER COLUMN sku SET NOT NULL,
+ALTER COLUMN slug SET NOT NULL;
+
+ALTER TABLE products
+ADD CONSTRAINT products_sku_key UNIQUE (sku),
+ADD CONSTRAINT products_barcode_key UNIQUE (barcode),
+ADD CONSTRAINT products_slug_key UNIQUE (slug);
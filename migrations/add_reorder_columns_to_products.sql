@@ -0,0 +1,9 @@
+ALTER TABLE products
+ADD COLUMN reorder_point int8 NULL,
+ADD COLUMN reorder_quantity int8 NOT NULL DEFAULT 0,
+-- Set when an alert was raised, cleared once the product is restocked.
+ADD COLUMN low_stock_alerted_at timestamp NULL,
+-- Notifiers that have not delivered the alert yet.
+ADD COLUMN low_stock_pending text[] NOT NULL DEFAULT '{}';
+
+CREATE INDEX products_low_stock_idx ON public.products (id) WHERE reorder_point IS NOT NULL AND quantity < reorder_point;
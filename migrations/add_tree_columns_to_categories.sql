@@ -0,0 +1,15 @@
+ALTER TABLE categories
+ADD COLUMN parent_id int8 NULL,
+ADD COLUMN "path" varchar NOT NULL DEFAULT '',
+ADD COLUMN depth int4 NOT NULL DEFAULT 0;
+
+ALTER TABLE categories
+ADD CONSTRAINT categories_parent_fk FOREIGN KEY (parent_id) REFERENCES categories(category_id),
+ADD CONSTRAINT categories_parent_check CHECK (parent_id <> category_id);
+
+-- Existing categories become roots. Paths look like /1/4/9/ and list the ids
+-- from the root down to the category itself.
+UPDATE categories SET "path" = '/' || category_id || '/' WHERE "path" = '';
+
+CREATE INDEX categories_path_idx ON categories ("path" varchar_pattern_ops);
+CREATE INDEX categories_parent_idx ON categories (parent_id);
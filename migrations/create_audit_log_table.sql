@@ -0,0 +1,17 @@
+-- Drop table
+
+-- DROP TABLE public.audit_log;
+
+CREATE TABLE public.audit_log (
+	id bigserial NOT NULL,
+	actor_id int8 NULL,
+	"action" varchar NOT NULL,
+	target_type varchar NOT NULL,
+	target_id int8 NOT NULL,
+	details jsonb NULL,
+	created_at timestamp NOT NULL DEFAULT Now(),
+	CONSTRAINT audit_log_pk PRIMARY KEY (id),
+	CONSTRAINT audit_log_actor_fk FOREIGN KEY (actor_id) REFERENCES users(id) ON DELETE SET NULL
+);
+
+CREATE INDEX audit_log_target_idx ON public.audit_log (target_type, target_id);
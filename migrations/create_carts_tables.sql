@@ -0,0 +1,41 @@
+-- Drop table
+
+-- DROP TABLE public.cart_lines;
+-- DROP TABLE public.carts;
+
+-- A cart belongs to a user or, for anonymous shoppers, is found by the hash
+-- of the token handed out when it was created.
+CREATE TABLE public.carts (
+	id bigserial NOT NULL,
+	user_id int8 NULL,
+	token_hash varchar(64) NULL,
+	currency char(3) NOT NULL,
+	coupon_code varchar(64) NULL,
+	status varchar(16) NOT NULL DEFAULT 'active',
+	created_at timestamp NULL,
+	updated_at timestamp NULL,
+	CONSTRAINT carts_pk PRIMARY KEY (id),
+	CONSTRAINT carts_user_fk FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+	CONSTRAINT carts_status_check CHECK (status IN ('active', 'merged', 'ordered')),
+	CONSTRAINT carts_owner_check CHECK (user_id IS NOT NULL OR token_hash IS NOT NULL)
+);
+
+CREATE UNIQUE INDEX carts_user_active_idx ON public.carts (user_id) WHERE status = 'active';
+CREATE UNIQUE INDEX carts_token_idx ON public.carts (token_hash);
+
+-- added_price is the unit price when the line was added, to tell the shopper
+-- about price changes.
+CREATE TABLE public.cart_lines (
+	id bigserial NOT NULL,
+	cart_id int8 NOT NULL,
+	product_id int8 NOT NULL,
+	quantity int4 NOT NULL,
+	added_price numeric NOT NULL,
+	created_at timestamp NULL,
+	updated_at timestamp NULL,
+	CONSTRAINT cart_lines_pk PRIMARY KEY (id),
+	CONSTRAINT cart_lines_cart_fk FOREIGN KEY (cart_id) REFERENCES carts(id) ON DELETE CASCADE,
+	CONSTRAINT cart_lines_product_fk FOREIGN KEY (product_id) REFERENCES products(id) ON DELETE CASCADE,
+	CONSTRAINT cart_lines_product_key UNIQUE (cart_id, product_id),
+	CONSTRAINT cart_lines_quantity_check CHECK (quantity > 0)
+);
@@ -0,0 +1,46 @@
+-- Drop table
+
+-- DROP TABLE public.coupon_redemptions;
+-- DROP TABLE public.coupons;
+
+-- max_uses caps redemptions across all users (1 for single-use codes) and
+-- max_uses_per_user caps them per user; NULL means unlimited. times_used
+-- counts redemptions that were not released.
+CREATE TABLE public.coupons (
+	id bigserial NOT NULL,
+	code varchar(64) NOT NULL,
+	description text NOT NULL DEFAULT '',
+	discount_type varchar(16) NOT NULL,
+	percentage numeric NULL,
+	amount numeric NULL,
+	min_order numeric NOT NULL DEFAULT 0,
+	max_uses int4 NULL,
+	max_uses_per_user int4 NULL,
+	times_used int4 NOT NULL DEFAULT 0,
+	expires_at timestamp NULL,
+	active boolean NOT NULL DEFAULT true,
+	batch varchar(64) NOT NULL DEFAULT '',
+	created_at timestamp NULL,
+	updated_at timestamp NULL,
+	CONSTRAINT coupons_pk PRIMARY KEY (id),
+	CONSTRAINT coupons_code_key UNIQUE (code),
+	CONSTRAINT coupons_discount_type_check CHECK (discount_type IN ('percentage', 'fixed')),
+	CONSTRAINT coupons_usage_check CHECK (max_uses IS NULL OR times_used <= max_uses)
+);
+
+CREATE INDEX coupons_batch_idx ON public.coupons (batch) WHERE batch <> '';
+
+CREATE TABLE public.coupon_redemptions (
+	id bigserial NOT NULL,
+	coupon_id int8 NOT NULL,
+	user_id int8 NULL,
+	reference varchar NOT NULL DEFAULT '',
+	discount numeric NOT NULL,
+	created_at timestamp NULL,
+	released_at timestamp NULL,
+	CONSTRAINT coupon_redemptions_pk PRIMARY KEY (id),
+	CONSTRAINT coupon_redemptions_coupon_fk FOREIGN KEY (coupon_id) REFERENCES coupons(id),
+	CONSTRAINT coupon_redemptions_user_fk FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE SET NULL
+);
+
+CREATE INDEX coupon_redemptions_coupon_user_idx ON public.coupon_redemptions (coupon_id, user_id) WHERE released_at IS NULL;
@@ -0,0 +1,25 @@
+-- Drop table
+
+-- DROP TABLE public.product_prices;
+-- DROP TABLE public.exchange_rates;
+
+-- rate is how many units of currency one unit of the base currency buys.
+CREATE TABLE public.exchange_rates (
+	currency char(3) NOT NULL,
+	rate numeric NOT NULL,
+	updated_at timestamp NULL,
+	CONSTRAINT exchange_rates_pk PRIMARY KEY (currency),
+	CONSTRAINT exchange_rates_rate_check CHECK (rate > 0)
+);
+
+-- Explicit prices override the converted base price.
+CREATE TABLE public.product_prices (
+	product_id int8 NOT NULL,
+	currency char(3) NOT NULL,
+	price numeric NOT NULL,
+	created_at timestamp NULL,
+	updated_at timestamp NULL,
+	CONSTRAINT product_prices_pk PRIMARY KEY (product_id, currency),
+	CONSTRAINT product_prices_product_fk FOREIGN KEY (product_id) REFERENCES products(id) ON DELETE CASCADE,
+	CONSTRAINT product_prices_price_check CHECK (price >= 0)
+);
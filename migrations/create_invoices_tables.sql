@@ -0,0 +1,41 @@
+-- Drop table
+
+-- DROP TABLE public.invoices;
+-- DROP TABLE public.invoice_sequences;
+
+-- The counter behind invoice numbers. It is incremented in the transaction
+-- that issues the invoice, so a rolled back invoice leaves no gap.
+CREATE TABLE public.invoice_sequences (
+	name varchar(32) NOT NULL,
+	last_number int8 NOT NULL DEFAULT 0,
+	CONSTRAINT invoice_sequences_pk PRIMARY KEY (name)
+);
+
+INSERT INTO public.invoice_sequences(name, last_number) VALUES ('invoice', 0);
+
+-- lines and tax_rates are JSON snapshots taken when the invoice was issued.
+CREATE TABLE public.invoices (
+	id bigserial NOT NULL,
+	sequence_number int8 NOT NULL,
+	number varchar(64) NOT NULL,
+	order_id int8 NOT NULL,
+	customer_name varchar(255) NOT NULL DEFAULT '',
+	email varchar(255) NOT NULL,
+	shipping_address text NOT NULL DEFAULT '',
+	country char(2) NOT NULL,
+	region varchar(64) NOT NULL DEFAULT '',
+	currency char(3) NOT NULL,
+	lines jsonb NOT NULL,
+	subtotal numeric NOT NULL,
+	discount numeric NOT NULL,
+	tax_total numeric NOT NULL,
+	total numeric NOT NULL,
+	prices_include_tax bool NOT NULL DEFAULT false,
+	tax_rates jsonb NOT NULL,
+	issued_at timestamp NOT NULL,
+	CONSTRAINT invoices_pk PRIMARY KEY (id),
+	CONSTRAINT invoices_sequence_key UNIQUE (sequence_number),
+	CONSTRAINT invoices_number_key UNIQUE (number),
+	CONSTRAINT invoices_order_key UNIQUE (order_id),
+	CONSTRAINT invoices_order_fk FOREIGN KEY (order_id) REFERENCES orders(id)
+);
@@ -0,0 +1,77 @@
+-- Drop table
+
+-- DROP TABLE public.order_transitions;
+-- DROP TABLE public.order_lines;
+-- DROP TABLE public.orders;
+
+-- Amounts are in the order currency. tax is the breakdown computed at
+-- checkout. expires_at is when an unpaid order gives its stock back.
+CREATE TABLE public.orders (
+	id bigserial NOT NULL,
+	user_id int8 NULL,
+	cart_id int8 NULL,
+	status varchar(16) NOT NULL DEFAULT 'pending',
+	email varchar(255) NOT NULL,
+	customer_name varchar(255) NOT NULL DEFAULT '',
+	shipping_address text NOT NULL DEFAULT '',
+	country char(2) NOT NULL,
+	region varchar(64) NOT NULL DEFAULT '',
+	currency char(3) NOT NULL,
+	coupon_code varchar(64) NULL,
+	coupon_redemption_id int8 NULL,
+	subtotal numeric NOT NULL DEFAULT 0,
+	discount numeric NOT NULL DEFAULT 0,
+	tax_total numeric NOT NULL DEFAULT 0,
+	total numeric NOT NULL DEFAULT 0,
+	tax jsonb NULL,
+	expires_at timestamp NULL,
+	created_at timestamp NULL,
+	updated_at timestamp NULL,
+	CONSTRAINT orders_pk PRIMARY KEY (id),
+	CONSTRAINT orders_user_fk FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE SET NULL,
+	CONSTRAINT orders_cart_fk FOREIGN KEY (cart_id) REFERENCES carts(id) ON DELETE SET NULL,
+	CONSTRAINT orders_coupon_redemption_fk FOREIGN KEY (coupon_redemption_id) REFERENCES coupon_redemptions(id),
+	CONSTRAINT orders_status_check CHECK (status IN ('pending', 'paid', 'fulfilled', 'shipped', 'delivered', 'cancelled', 'refunded'))
+);
+
+CREATE INDEX orders_user_idx ON public.orders (user_id);
+CREATE INDEX orders_status_idx ON public.orders (status, expires_at);
+
+-- product is the JSON of the product as it was sold.
+CREATE TABLE public.order_lines (
+	id bigserial NOT NULL,
+	order_id int8 NOT NULL,
+	product_id int8 NULL,
+	reservation_id int8 NULL,
+	product_name varchar NOT NULL,
+	sku varchar NOT NULL DEFAULT '',
+	quantity int4 NOT NULL,
+	unit_price numeric NOT NULL,
+	line_total numeric NOT NULL,
+	discount numeric NOT NULL DEFAULT 0,
+	tax numeric NOT NULL DEFAULT 0,
+	product jsonb NOT NULL,
+	CONSTRAINT order_lines_pk PRIMARY KEY (id),
+	CONSTRAINT order_lines_order_fk FOREIGN KEY (order_id) REFERENCES orders(id) ON DELETE CASCADE,
+	CONSTRAINT order_lines_product_fk FOREIGN KEY (product_id) REFERENCES products(id) ON DELETE SET NULL,
+	CONSTRAINT order_lines_reservation_fk FOREIGN KEY (reservation_id) REFERENCES stock_reservations(id) ON DELETE SET NULL,
+	CONSTRAINT order_lines_quantity_check CHECK (quantity > 0)
+);
+
+CREATE INDEX order_lines_order_idx ON public.order_lines (order_id);
+
+-- Every status change of an order, starting with its creation.
+CREATE TABLE public.order_transitions (
+	id bigserial NOT NULL,
+	order_id int8 NOT NULL,
+	from_status varchar(16) NULL,
+	to_status varchar(16) NOT NULL,
+	reason text NULL,
+	actor_id int8 NULL,
+	created_at timestamp NULL,
+	CONSTRAINT order_transitions_pk PRIMARY KEY (id),
+	CONSTRAINT order_transitions_order_fk FOREIGN KEY (order_id) REFERENCES orders(id) ON DELETE CASCADE,
+	CONSTRAINT order_transitions_actor_fk FOREIGN KEY (actor_id) REFERENCES users(id) ON DELETE SET NULL
+);
+
+CREATE INDEX order_transitions_order_idx ON public.order_transitions (order_id);
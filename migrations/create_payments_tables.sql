@@ -0,0 +1,50 @@
+-- Drop table
+
+-- DROP TABLE public.payment_events;
+-- ALTER TABLE public.orders DROP COLUMN payment_id;
+-- DROP TABLE public.payments;
+
+-- One row per payment attempt. reference is the provider's id for the
+-- payment and is known once the provider has answered.
+CREATE TABLE public.payments (
+	id bigserial NOT NULL,
+	order_id int8 NOT NULL,
+	provider varchar(32) NOT NULL,
+	idempotency_key varchar(64) NOT NULL,
+	reference varchar(128) NULL,
+	status varchar(16) NOT NULL DEFAULT 'pending',
+	amount numeric NOT NULL,
+	message text NULL,
+	created_at timestamp NULL,
+	updated_at timestamp NULL,
+	CONSTRAINT payments_pk PRIMARY KEY (id),
+	CONSTRAINT payments_order_fk FOREIGN KEY (order_id) REFERENCES orders(id) ON DELETE CASCADE,
+	CONSTRAINT payments_idempotency_key UNIQUE (provider, idempotency_key),
+	CONSTRAINT payments_reference_key UNIQUE (provider, reference),
+	CONSTRAINT payments_status_check CHECK (status IN ('pending', 'authorized', 'captured', 'voided', 'refunded', 'failed'))
+);
+
+CREATE INDEX payments_order_idx ON public.payments (order_id);
+
+-- Only one attempt per order may be in flight, so an order is never charged
+-- twice by concurrent attempts.
+CREATE UNIQUE INDEX payments_open_idx ON public.payments (order_id) WHERE status IN ('pending', 'authorized');
+
+-- The payment whose capture paid the order. Captures for an order that no
+-- longer waits for payment are refunded and do not touch the order.
+ALTER TABLE public.orders ADD COLUMN payment_id int8 NULL;
+ALTER TABLE public.orders ADD CONSTRAINT orders_payment_fk FOREIGN KEY (payment_id) REFERENCES payments(id) ON DELETE SET NULL;
+
+-- Webhook events already processed, so a redelivered event is ignored.
+CREATE TABLE public.payment_events (
+	id bigserial NOT NULL,
+	provider varchar(32) NOT NULL,
+	event_id varchar(128) NOT NULL,
+	payment_id int8 NULL,
+	status varchar(16) NOT NULL,
+	payload jsonb NOT NULL,
+	received_at timestamp NULL,
+	CONSTRAINT payment_events_pk PRIMARY KEY (id),
+	CONSTRAINT payment_events_event_key UNIQUE (provider, event_id),
+	CONSTRAINT payment_events_payment_fk FOREIGN KEY (payment_id) REFERENCES payments(id) ON DELETE SET NULL
+);
@@ -0,0 +1,40 @@
+-- Drop table
+
+-- DROP TABLE public.price_changes;
+
+-- Applied rows are the price history of a product, scheduled rows are
+-- applied by the price scheduler once effective_at has passed. Rows with a
+-- variant_id record the effective price of that variant.
+CREATE TABLE public.price_changes (
+	id bigserial NOT NULL,
+	product_id int8 NOT NULL,
+	variant_id int8 NULL,
+	old_price numeric NULL,
+	new_price numeric NOT NULL,
+	effective_at timestamp NOT NULL,
+	status varchar(16) NOT NULL,
+	"source" varchar(32) NOT NULL,
+	reason text NOT NULL DEFAULT '',
+	actor_id int8 NULL,
+	created_at timestamp NULL,
+	applied_at timestamp NULL,
+	CONSTRAINT price_changes_pk PRIMARY KEY (id),
+	CONSTRAINT price_changes_product_fk FOREIGN KEY (product_id) REFERENCES products(id) ON DELETE CASCADE,
+	CONSTRAINT price_changes_variant_fk FOREIGN KEY (variant_id) REFERENCES product_variants(id) ON DELETE CASCADE,
+	CONSTRAINT price_changes_variant_check CHECK (variant_id IS NULL OR status = 'applied'),
+	CONSTRAINT price_changes_status_check CHECK (status IN ('scheduled', 'applied', 'cancelled')),
+	CONSTRAINT price_changes_price_check CHECK (new_price >= 0)
+);
+
+CREATE INDEX price_changes_product_idx ON public.price_changes (product_id, effective_at);
+CREATE INDEX price_changes_variant_idx ON public.price_changes (variant_id, effective_at) WHERE variant_id IS NOT NULL;
+CREATE INDEX price_changes_due_idx ON public.price_changes (effective_at) WHERE status = 'scheduled';
+
+-- Start every history with the price the product has today.
+INSERT INTO public.price_changes(product_id, new_price, effective_at, status, "source", reason, created_at, applied_at)
+SELECT id, price, COALESCE(created, Now()), 'applied', 'initial', 'Price before history was recorded', Now(), Now()
+FROM public.products WHERE price IS NOT NULL;
+
+INSERT INTO public.price_changes(product_id, variant_id, new_price, effective_at, status, "source", reason, created_at, applied_at)
+SELECT v.product_id, v.id, COALESCE(v.price, p.price), COALESCE(v.created, Now()), 'applied', 'initial', 'Price before history was recorded', Now(), Now()
+FROM public.product_variants v JOIN public.products p ON p.id = v.product_id WHERE COALESCE(v.price, p.price) IS NOT NULL;
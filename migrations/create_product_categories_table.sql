@@ -0,0 +1,21 @@
+-- Drop table
+
+-- DROP TABLE public.product_categories;
+
+CREATE TABLE public.product_categories (
+	product_id int8 NOT NULL,
+	category_id int8 NOT NULL,
+	is_primary boolean NOT NULL DEFAULT false,
+	position int4 NOT NULL DEFAULT 0,
+	created_at timestamp NULL,
+	CONSTRAINT product_categories_pk PRIMARY KEY (product_id, category_id),
+	CONSTRAINT product_categories_product_fk FOREIGN KEY (product_id) REFERENCES products(id) ON DELETE CASCADE,
+	CONSTRAINT product_categories_category_fk FOREIGN KEY (category_id) REFERENCES categories(category_id) ON DELETE CASCADE
+);
+
+-- products.category_id keeps mirroring the primary category for older clients.
+CREATE UNIQUE INDEX product_categories_primary_idx ON public.product_categories (product_id) WHERE is_primary;
+CREATE INDEX product_categories_category_idx ON public.product_categories (category_id, position);
+
+INSERT INTO product_categories(product_id, category_id, is_primary, position, created_at)
+SELECT id, category_id, true, 0, Now() FROM products WHERE category_id IS NOT NULL;
@@ -0,0 +1,23 @@
+-- Drop table
+
+-- DROP TABLE public.product_images;
+
+CREATE TABLE public.product_images (
+	id bigserial NOT NULL,
+	product_id int8 NOT NULL,
+	storage_key text NOT NULL,
+	content_type varchar(64) NOT NULL,
+	width int4 NOT NULL,
+	height int4 NOT NULL,
+	size_bytes int8 NOT NULL,
+	alt_text text NOT NULL DEFAULT '',
+	position int4 NOT NULL DEFAULT 0,
+	is_primary boolean NOT NULL DEFAULT false,
+	thumbnails jsonb NOT NULL DEFAULT '{}',
+	created_at timestamp NULL,
+	CONSTRAINT product_images_pk PRIMARY KEY (id),
+	CONSTRAINT product_images_product_fk FOREIGN KEY (product_id) REFERENCES products(id) ON DELETE CASCADE
+);
+
+CREATE UNIQUE INDEX product_images_primary_idx ON public.product_images (product_id) WHERE is_primary;
+CREATE INDEX product_images_product_idx ON public.product_images (product_id, position);
@@ -0,0 +1,33 @@
+-- Drop table
+
+-- DROP TABLE public.product_variants;
+-- DROP TABLE public.product_options;
+
+CREATE TABLE public.product_options (
+	id bigserial NOT NULL,
+	product_id int8 NOT NULL,
+	"name" varchar NOT NULL,
+	"values" text[] NOT NULL DEFAULT '{}',
+	position int4 NOT NULL DEFAULT 0,
+	CONSTRAINT product_options_pk PRIMARY KEY (id),
+	CONSTRAINT product_options_product_fk FOREIGN KEY (product_id) REFERENCES products(id) ON DELETE CASCADE,
+	CONSTRAINT product_options_name_key UNIQUE (product_id, "name")
+);
+
+CREATE TABLE public.product_variants (
+	id bigserial NOT NULL,
+	product_id int8 NOT NULL,
+	sku varchar NOT NULL,
+	price numeric NULL,
+	quantity int4 NOT NULL DEFAULT 0,
+	options jsonb NOT NULL DEFAULT '{}',
+	images text[] NOT NULL DEFAULT '{}',
+	created timestamp NULL,
+	updated timestamp NULL,
+	CONSTRAINT product_variants_pk PRIMARY KEY (id),
+	CONSTRAINT product_variants_product_fk FOREIGN KEY (product_id) REFERENCES products(id) ON DELETE CASCADE,
+	CONSTRAINT product_variants_sku_key UNIQUE (sku),
+	CONSTRAINT product_variants_quantity_check CHECK (quantity >= 0)
+);
+
+CREATE INDEX product_variants_product_idx ON public.product_variants (product_id);
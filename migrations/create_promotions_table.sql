@@ -0,0 +1,30 @@
+-- Drop table
+
+-- DROP TABLE public.promotions;
+
+-- percentage is used by percentage discounts and amount, in the base
+-- currency, by fixed ones. Higher priority promotions are evaluated first.
+CREATE TABLE public.promotions (
+	id bigserial NOT NULL,
+	"name" varchar NOT NULL,
+	description text NOT NULL DEFAULT '',
+	discount_type varchar(16) NOT NULL,
+	percentage numeric NULL,
+	amount numeric NULL,
+	"scope" varchar(16) NOT NULL,
+	product_ids int8[] NOT NULL DEFAULT '{}',
+	category_ids int8[] NOT NULL DEFAULT '{}',
+	priority int4 NOT NULL DEFAULT 0,
+	stackable boolean NOT NULL DEFAULT false,
+	active boolean NOT NULL DEFAULT true,
+	starts_at timestamp NULL,
+	ends_at timestamp NULL,
+	created_at timestamp NULL,
+	updated_at timestamp NULL,
+	CONSTRAINT promotions_pk PRIMARY KEY (id),
+	CONSTRAINT promotions_discount_type_check CHECK (discount_type IN ('percentage', 'fixed')),
+	CONSTRAINT promotions_scope_check CHECK ("scope" IN ('catalogue', 'category', 'product')),
+	CONSTRAINT promotions_window_check CHECK (ends_at IS NULL OR starts_at IS NULL OR ends_at > starts_at)
+);
+
+CREATE INDEX promotions_active_idx ON public.promotions (priority DESC, id) WHERE active;
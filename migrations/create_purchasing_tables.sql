@@ -0,0 +1,74 @@
+-- Drop table
+
+-- DROP TABLE public.purchase_order_lines;
+-- DROP TABLE public.purchase_orders;
+-- DROP TABLE public.supplier_products;
+-- DROP TABLE public.suppliers;
+
+CREATE TABLE public.suppliers (
+	id bigserial NOT NULL,
+	"name" varchar NOT NULL,
+	email varchar NOT NULL DEFAULT '',
+	phone varchar NOT NULL DEFAULT '',
+	address text NOT NULL DEFAULT '',
+	lead_time_days int4 NOT NULL DEFAULT 0,
+	active boolean NOT NULL DEFAULT true,
+	created_at timestamp NULL,
+	updated_at timestamp NULL,
+	CONSTRAINT suppliers_pk PRIMARY KEY (id)
+);
+
+-- lead_time_days overrides the supplier default when set.
+CREATE TABLE public.supplier_products (
+	supplier_id int8 NOT NULL,
+	product_id int8 NOT NULL,
+	supplier_sku varchar NOT NULL DEFAULT '',
+	cost_price numeric NOT NULL DEFAULT 0,
+	lead_time_days int4 NULL,
+	is_preferred boolean NOT NULL DEFAULT false,
+	created_at timestamp NULL,
+	updated_at timestamp NULL,
+	CONSTRAINT supplier_products_pk PRIMARY KEY (supplier_id, product_id),
+	CONSTRAINT supplier_products_supplier_fk FOREIGN KEY (supplier_id) REFERENCES suppliers(id) ON DELETE CASCADE,
+	CONSTRAINT supplier_products_product_fk FOREIGN KEY (product_id) REFERENCES products(id) ON DELETE CASCADE
+);
+
+CREATE INDEX supplier_products_product_idx ON public.supplier_products (product_id);
+CREATE UNIQUE INDEX supplier_products_preferred_idx ON public.supplier_products (product_id) WHERE is_preferred;
+
+CREATE TABLE public.purchase_orders (
+	id bigserial NOT NULL,
+	supplier_id int8 NOT NULL,
+	status varchar(32) NOT NULL DEFAULT 'draft',
+	warehouse_id int8 NULL,
+	notes text NOT NULL DEFAULT '',
+	expected_at timestamp NULL,
+	created_by int8 NULL,
+	sent_at timestamp NULL,
+	received_at timestamp NULL,
+	created_at timestamp NULL,
+	updated_at timestamp NULL,
+	CONSTRAINT purchase_orders_pk PRIMARY KEY (id),
+	CONSTRAINT purchase_orders_status_check CHECK (status IN ('draft', 'sent', 'partially_received', 'received', 'cancelled')),
+	CONSTRAINT purchase_orders_supplier_fk FOREIGN KEY (supplier_id) REFERENCES suppliers(id),
+	CONSTRAINT purchase_orders_warehouse_fk FOREIGN KEY (warehouse_id) REFERENCES warehouses(id) ON DELETE SET NULL,
+	CONSTRAINT purchase_orders_created_by_fk FOREIGN KEY (created_by) REFERENCES users(id) ON DELETE SET NULL
+);
+
+CREATE INDEX purchase_orders_supplier_idx ON public.purchase_orders (supplier_id, status);
+
+CREATE TABLE public.purchase_order_lines (
+	id bigserial NOT NULL,
+	purchase_order_id int8 NOT NULL,
+	product_id int8 NOT NULL,
+	supplier_sku varchar NOT NULL DEFAULT '',
+	quantity_ordered int8 NOT NULL,
+	quantity_received int8 NOT NULL DEFAULT 0,
+	unit_cost numeric NOT NULL,
+	CONSTRAINT purchase_order_lines_pk PRIMARY KEY (id),
+	CONSTRAINT purchase_order_lines_product_key UNIQUE (purchase_order_id, product_id),
+	CONSTRAINT purchase_order_lines_quantity_check CHECK (quantity_ordered > 0 AND quantity_received >= 0 AND quantity_received <= quantity_ordered),
+	CONSTRAINT purchase_order_lines_order_fk FOREIGN KEY (purchase_order_id) REFERENCES purchase_orders(id) ON DELETE CASCADE,
+	-- Products on a purchase order cannot be deleted; the API answers 409.
+	CONSTRAINT purchase_order_lines_product_fk FOREIGN KEY (product_id) REFERENCES products(id) ON DELETE RESTRICT
+);
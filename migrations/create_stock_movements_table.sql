@@ -0,0 +1,41 @@
+-- Drop table
+
+-- DROP TABLE public.stock_movements;
+
+-- stock_movements is an append-only ledger: rows are only ever inserted and
+-- products.quantity must equal the sum of a product's movements. Deleting a
+-- product keeps its history with product_id cleared. Rows with a variant_id
+-- book the stock of that variant instead; it is not a foreign key so the
+-- history of a deleted variant is never mistaken for the product's own.
+CREATE TABLE public.stock_movements (
+	id bigserial NOT NULL,
+	product_id int8 NULL,
+	variant_id int8 NULL,
+	movement_type varchar(16) NOT NULL,
+	quantity int8 NOT NULL,
+	balance_after int8 NOT NULL,
+	reason text NOT NULL DEFAULT '',
+	reference varchar NULL,
+	actor_id int8 NULL,
+	created_at timestamp NOT NULL DEFAULT Now(),
+	CONSTRAINT stock_movements_pk PRIMARY KEY (id),
+	CONSTRAINT stock_movements_type_check CHECK (movement_type IN ('receipt', 'sale', 'adjustment', 'return', 'transfer')),
+	CONSTRAINT stock_movements_quantity_check CHECK (quantity <> 0),
+	CONSTRAINT stock_movements_product_fk FOREIGN KEY (product_id) REFERENCES products(id) ON DELETE SET NULL,
+	CONSTRAINT stock_movements_actor_fk FOREIGN KEY (actor_id) REFERENCES users(id) ON DELETE SET NULL
+);
+
+CREATE INDEX stock_movements_product_idx ON public.stock_movements (product_id, id);
+CREATE INDEX stock_movements_variant_idx ON public.stock_movements (variant_id, id) WHERE variant_id IS NOT NULL;
+
+UPDATE products SET quantity = 0 WHERE quantity IS NULL;
+ALTER TABLE products ALTER COLUMN quantity SET DEFAULT 0;
+ALTER TABLE products ALTER COLUMN quantity SET NOT NULL;
+ALTER TABLE products ADD CONSTRAINT products_quantity_check CHECK (quantity >= 0) NOT VALID;
+
+-- Open the ledger with the stock each product already has.
+INSERT INTO stock_movements(product_id, movement_type, quantity, balance_after, reason, created_at)
+SELECT id, 'adjustment', quantity, quantity, 'Opening balance', Now() FROM products WHERE quantity <> 0;
+
+INSERT INTO stock_movements(product_id, variant_id, movement_type, quantity, balance_after, reason, created_at)
+SELECT product_id, id, 'adjustment', quantity, quantity, 'Opening balance', Now() FROM product_variants WHERE quantity <> 0;
@@ -0,0 +1,27 @@
+-- Drop table
+
+-- DROP TABLE public.stock_reservations;
+
+-- products.reserved is the sum of the product's active reservations; the
+-- stock available for sale is quantity - reserved.
+ALTER TABLE products ADD COLUMN reserved int8 NOT NULL DEFAULT 0;
+ALTER TABLE products ADD CONSTRAINT products_reserved_check CHECK (reserved >= 0 AND reserved <= quantity);
+
+CREATE TABLE public.stock_reservations (
+	id bigserial NOT NULL,
+	product_id int8 NOT NULL,
+	quantity int8 NOT NULL,
+	status varchar(16) NOT NULL DEFAULT 'active',
+	reference varchar NULL,
+	actor_id int8 NULL,
+	expires_at timestamp NOT NULL,
+	created_at timestamp NOT NULL DEFAULT Now(),
+	updated_at timestamp NOT NULL DEFAULT Now(),
+	CONSTRAINT stock_reservations_pk PRIMARY KEY (id),
+	CONSTRAINT stock_reservations_quantity_check CHECK (quantity > 0),
+	CONSTRAINT stock_reservations_status_check CHECK (status IN ('active', 'committed', 'released', 'expired')),
+	CONSTRAINT stock_reservations_product_fk FOREIGN KEY (product_id) REFERENCES products(id) ON DELETE CASCADE,
+	CONSTRAINT stock_reservations_actor_fk FOREIGN KEY (actor_id) REFERENCES users(id) ON DELETE SET NULL
+);
+
+CREATE INDEX stock_reservations_expiry_idx ON public.stock_reservations (expires_at) WHERE status = 'active';
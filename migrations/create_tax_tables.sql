@@ -0,0 +1,46 @@
+-- Drop table
+
+-- DROP TABLE public.tax_rates;
+-- DROP TABLE public.tax_classes;
+
+-- Products without a tax class of their own use the class of their nearest
+-- category that has one, and the default class otherwise.
+CREATE TABLE public.tax_classes (
+	id bigserial NOT NULL,
+	code varchar(32) NOT NULL,
+	"name" varchar NOT NULL,
+	is_default boolean NOT NULL DEFAULT false,
+	created_at timestamp NULL,
+	updated_at timestamp NULL,
+	CONSTRAINT tax_classes_pk PRIMARY KEY (id),
+	CONSTRAINT tax_classes_code_key UNIQUE (code)
+);
+
+CREATE UNIQUE INDEX tax_classes_default_idx ON public.tax_classes (is_default) WHERE is_default;
+
+-- rate is a percentage. An empty region applies to the whole country unless
+-- a rate for the region itself exists.
+CREATE TABLE public.tax_rates (
+	id bigserial NOT NULL,
+	tax_class_id int8 NOT NULL,
+	country char(2) NOT NULL,
+	region varchar(64) NOT NULL DEFAULT '',
+	"name" varchar NOT NULL,
+	rate numeric NOT NULL,
+	created_at timestamp NULL,
+	updated_at timestamp NULL,
+	CONSTRAINT tax_rates_pk PRIMARY KEY (id),
+	CONSTRAINT tax_rates_class_fk FOREIGN KEY (tax_class_id) REFERENCES tax_classes(id) ON DELETE CASCADE,
+	CONSTRAINT tax_rates_location_key UNIQUE (tax_class_id, country, region),
+	CONSTRAINT tax_rates_rate_check CHECK (rate >= 0 AND rate <= 100)
+);
+
+ALTER TABLE products
+ADD COLUMN tax_class_id int8 NULL,
+ADD CONSTRAINT products_tax_class_fk FOREIGN KEY (tax_class_id) REFERENCES tax_classes(id) ON DELETE SET NULL;
+
+ALTER TABLE categories
+ADD COLUMN tax_class_id int8 NULL,
+ADD CONSTRAINT categories_tax_class_fk FOREIGN KEY (tax_class_id) REFERENCES tax_classes(id) ON DELETE SET NULL;
+
+INSERT INTO tax_classes(code, "name", is_default, created_at, updated_at) VALUES ('standard', 'Standard rate', true, Now(), Now());
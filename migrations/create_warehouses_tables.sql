@@ -0,0 +1,45 @@
+-- Drop table
+
+-- DROP TABLE public.warehouse_stock;
+-- DROP TABLE public.warehouses;
+
+CREATE TABLE public.warehouses (
+	id bigserial NOT NULL,
+	code varchar(64) NOT NULL,
+	"name" varchar NOT NULL,
+	address text NOT NULL DEFAULT '',
+	is_default boolean NOT NULL DEFAULT false,
+	active boolean NOT NULL DEFAULT true,
+	created_at timestamp NULL,
+	updated_at timestamp NULL,
+	CONSTRAINT warehouses_pk PRIMARY KEY (id),
+	CONSTRAINT warehouses_code_key UNIQUE (code)
+);
+
+CREATE UNIQUE INDEX warehouses_default_idx ON public.warehouses (is_default) WHERE is_default;
+
+-- products.quantity stays as the total over all warehouses for older clients.
+CREATE TABLE public.warehouse_stock (
+	warehouse_id int8 NOT NULL,
+	product_id int8 NOT NULL,
+	quantity int8 NOT NULL DEFAULT 0,
+	updated_at timestamp NULL,
+	CONSTRAINT warehouse_stock_pk PRIMARY KEY (warehouse_id, product_id),
+	CONSTRAINT warehouse_stock_quantity_check CHECK (quantity >= 0),
+	CONSTRAINT warehouse_stock_warehouse_fk FOREIGN KEY (warehouse_id) REFERENCES warehouses(id),
+	CONSTRAINT warehouse_stock_product_fk FOREIGN KEY (product_id) REFERENCES products(id) ON DELETE CASCADE
+);
+
+CREATE INDEX warehouse_stock_product_idx ON public.warehouse_stock (product_id);
+
+ALTER TABLE stock_movements ADD COLUMN warehouse_id int8 NULL;
+ALTER TABLE stock_movements ADD CONSTRAINT stock_movements_warehouse_fk FOREIGN KEY (warehouse_id) REFERENCES warehouses(id) ON DELETE SET NULL;
+
+-- Existing stock is assumed to sit in a single main warehouse.
+INSERT INTO warehouses(code, "name", is_default, active, created_at, updated_at) VALUES ('MAIN', 'Main warehouse', true, true, Now(), Now());
+
+INSERT INTO warehouse_stock(warehouse_id, product_id, quantity, updated_at)
+SELECT w.id, p.id, p.quantity, Now() FROM products p, warehouses w WHERE w.code = 'MAIN' AND p.quantity > 0;
+
+-- Variant stock is not split over warehouses.
+UPDATE stock_movements SET warehouse_id = (SELECT id FROM warehouses WHERE code = 'MAIN') WHERE variant_id IS NULL;
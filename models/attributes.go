@@ -0,0 +1,66 @@
+package models
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+)
+
+const (
+	AttributeString  = "string"
+	AttributeNumber  = "number"
+	AttributeInteger = "integer"
+	AttributeBoolean = "boolean"
+	AttributeEnum    = "enum"
+)
+
+type AttributeDefinition struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	Required bool `json:"required"`
+	Allowed_values []string `json:"allowed_values,omitempty"`
+	Unit string `json:"unit,omitempty"`
+}
+
+// AttributeSchema is the list of attributes a category declares for its
+// products. It is stored as a jsonb array.
+type AttributeSchema []AttributeDefinition
+
+func (s AttributeSchema) Value() (driver.Value, error) {
+	if s == nil {
+		return []byte("[]"), nil
+	}
+	return json.Marshal(s)
+}
+
+func (s *AttributeSchema) Scan(src any) error {
+	return scanJSON(src, s)
+}
+
+// Attributes holds typed attribute values of a product keyed by attribute
+// name. It is stored as a jsonb object.
+type Attributes map[string]any
+
+func (a Attributes) Value() (driver.Value, error) {
+	if a == nil {
+		return []byte("{}"), nil
+	}
+	return json.Marshal(a)
+}
+
+func (a *Attributes) Scan(src any) error {
+	return scanJSON(src, a)
+}
+
+func scanJSON(src any, dest any) error {
+	switch v := src.(type) {
+	case nil:
+		return nil
+	case []byte:
+		return json.Unmarshal(v, dest)
+	case string:
+		return json.Unmarshal([]byte(v), dest)
+	default:
+		return fmt.Errorf("cannot scan %T into %T", src, dest)
+	}
+}
@@ -1,17 +1,66 @@
 package models
 
-import "time"
+import (
+	"encoding/json"
+	"time"
+)
 
 type Product struct {
 	Id int64 `json:"id"`
 	Name string `json:"name"`
 	ShortDescription string `json:"shortDescription"`
 	Description string `json:"description"`
-	Price float64 `json:"price"`
+	Price Money `json:"price"`
+	Price_source string `json:"price_source,omitempty"`
+	Discounted_price *Money `json:"discounted_price,omitempty"`
+	Promotions []AppliedPromotion `json:"promotions,omitempty"`
 	Created time.Time `json:"created"`
 	Updated time.Time `json:"updated"`
 	Quantity int64 `json:"quantity"`
+	Reserved int64 `json:"reserved"`
+	Available int64 `json:"available"`
+	Reorder_point *int64 `json:"reorder_point"`
+	Reorder_quantity int64 `json:"reorder_quantity"`
 	Category_id int64 `json:"category_id"`
+	Tax_class_id *int64 `json:"tax_class_id"`
+	Sku string `json:"sku"`
+	Barcode *string `json:"barcode,omitempty"`
+	Slug string `json:"slug"`
+	Attributes Attributes `json:"attributes,omitempty"`
+	Archived_at *time.Time `json:"archived_at,omitempty"`
+	Options []ProductOption `json:"options,omitempty"`
+	Variants []ProductVariant `json:"variants,omitempty"`
+	Variant_summary *VariantSummary `json:"variant_summary,omitempty"`
+	Primary_image *ProductImage `json:"primary_image,omitempty"`
+}
+
+type ProductOption struct {
+	Id int64 `json:"id"`
+	Product_id int64 `json:"product_id"`
+	Name string `json:"name"`
+	Values []string `json:"values"`
+	Position int64 `json:"position"`
+}
+
+type ProductVariant struct {
+	Id int64 `json:"id"`
+	Product_id int64 `json:"product_id"`
+	Sku string `json:"sku"`
+	Price *Money `json:"price,omitempty"`
+	Effective_price Money `json:"effective_price"`
+	Discounted_price *Money `json:"discounted_price,omitempty"`
+	Quantity int64 `json:"quantity"`
+	Options map[string]string `json:"options"`
+	Images []string `json:"images"`
+	Created time.Time `json:"created"`
+	Updated time.Time `json:"updated"`
+}
+
+type VariantSummary struct {
+	Variant_count int64 `json:"variant_count"`
+	Min_price Money `json:"min_price"`
+	Max_price Money `json:"max_price"`
+	Total_stock int64 `json:"total_stock"`
 }
 
 type Category struct {
@@ -19,6 +68,30 @@ type Category struct {
 	Category_name string `json:"category_name"`
 	Created_at time.Time `json:"created_at"`
 	Updated_at time.Time `json:"updated_at"`
+	Attribute_schema AttributeSchema `json:"attribute_schema"`
+	Parent_id *int64 `json:"parent_id"`
+	Path string `json:"path"`
+	Depth int64 `json:"depth"`
+	Tax_class_id *int64 `json:"tax_class_id"`
+	Children []Category `json:"children,omitempty"`
+	Stats *CategoryStats `json:"stats,omitempty"`
+}
+
+type CategoryStats struct {
+	Direct ProductAggregate `json:"direct"`
+	Rollup ProductAggregate `json:"rollup"`
+}
+
+type ProductAggregate struct {
+	Product_count int64 `json:"product_count"`
+	In_stock_count int64 `json:"in_stock_count"`
+	Min_price *Money `json:"min_price"`
+	Max_price *Money `json:"max_price"`
+	Avg_price *Money `json:"avg_price"`
+}
+
+type MoveCategoryRequest struct {
+	Parent_id *int64 `json:"parent_id"`
 }
 
 type User struct {
@@ -28,11 +101,16 @@ type User struct {
 	Email string `json:"email"`
 	Password string `json:"password"`
 	Created_at time.Time `json:"created_at"`
+	Role string `json:"role"`
+	Disabled bool `json:"disabled"`
+	Password_reset_required bool `json:"password_reset_required"`
+	Erased_at *time.Time `json:"erased_at,omitempty"`
 }
 
 type LoginRequest struct {
 	Email string `json:"email"`
 	Password string `json:"password"`
+	Cart_token string `json:"cart_token,omitempty"`
 }
 
 type Response struct {
@@ -50,3 +128,607 @@ type UserResponse struct {
 	Response Response `json:"response"`
 	User User `json:"user"`
 }
+
+type UserListResponse struct {
+	Users []User `json:"users"`
+	Total int64 `json:"total"`
+	Page int `json:"page"`
+	Limit int `json:"limit"`
+}
+
+type RoleRequest struct {
+	Role string `json:"role"`
+}
+
+type PasswordResetResponse struct {
+	Response Response `json:"response"`
+	Reset_token string `json:"reset_token"`
+	Expires_at time.Time `json:"expires_at"`
+}
+
+type PasswordResetRequest struct {
+	Token string `json:"token"`
+	Password string `json:"password"`
+}
+
+type AuditEntry struct {
+	Id int64 `json:"id"`
+	Actor_id *int64 `json:"actor_id"`
+	Action string `json:"action"`
+	Target_type string `json:"target_type"`
+	Target_id int64 `json:"target_id"`
+	Details json.RawMessage `json:"details,omitempty"`
+	Created_at time.Time `json:"created_at"`
+}
+
+type UserExport struct {
+	Exported_at time.Time `json:"exported_at"`
+	User User `json:"user"`
+	Audit_entries []AuditEntry `json:"audit_entries"`
+	Orders []Order `json:"orders"`
+	Payments []Payment `json:"payments"`
+	Invoices []Invoice `json:"invoices"`
+	Coupon_redemptions []CouponRedemption `json:"coupon_redemptions"`
+	Carts []Cart `json:"carts"`
+}
+
+type ProductRef struct {
+	Id int64 `json:"id"`
+	Name string `json:"name"`
+	Sku string `json:"sku"`
+}
+
+type CategoryConflictResponse struct {
+	Response Response `json:"response"`
+	Products []ProductRef `json:"products,omitempty"`
+	Children []int64 `json:"children,omitempty"`
+}
+
+type ProductCategory struct {
+	Product_id int64 `json:"product_id"`
+	Category_id int64 `json:"category_id"`
+	Category_name string `json:"category_name"`
+	Is_primary bool `json:"is_primary"`
+	Position int64 `json:"position"`
+}
+
+type CategoryProduct struct {
+	Product
+	Is_primary bool `json:"is_primary"`
+	Position int64 `json:"position"`
+}
+
+type ProductImage struct {
+	Id int64 `json:"id"`
+	Product_id int64 `json:"product_id"`
+	Url string `json:"url"`
+	Content_type string `json:"content_type"`
+	Width int64 `json:"width"`
+	Height int64 `json:"height"`
+	Size_bytes int64 `json:"size_bytes"`
+	Alt_text string `json:"alt_text"`
+	Position int64 `json:"position"`
+	Is_primary bool `json:"is_primary"`
+	Thumbnails map[string]string `json:"thumbnails"`
+	Created_at time.Time `json:"created_at"`
+}
+
+type ImageOrderRequest struct {
+	Image_ids []int64 `json:"image_ids"`
+}
+
+type StockMovement struct {
+	Id int64 `json:"id"`
+	Product_id int64 `json:"product_id"`
+	Variant_id int64 `json:"variant_id,omitempty"`
+	Warehouse_id int64 `json:"warehouse_id,omitempty"`
+	Type string `json:"type"`
+	Quantity int64 `json:"quantity"`
+	Balance_after int64 `json:"balance_after"`
+	Reason string `json:"reason"`
+	Reference string `json:"reference,omitempty"`
+	Actor_id *int64 `json:"actor_id"`
+	Created_at time.Time `json:"created_at"`
+}
+
+type StockHistoryResponse struct {
+	Product_id int64 `json:"product_id"`
+	Variant_id int64 `json:"variant_id,omitempty"`
+	Quantity int64 `json:"quantity"`
+	Ledger_total int64 `json:"ledger_total"`
+	Movements []StockMovement `json:"movements"`
+	Page int `json:"page"`
+	Limit int `json:"limit"`
+}
+
+type StockDiscrepancy struct {
+	Product ProductRef `json:"product"`
+	Quantity int64 `json:"quantity"`
+	Ledger_total int64 `json:"ledger_total"`
+	Warehouse_total int64 `json:"warehouse_total"`
+}
+
+type StockReservation struct {
+	Id int64 `json:"id"`
+	Product_id int64 `json:"product_id"`
+	Quantity int64 `json:"quantity"`
+	Status string `json:"status"`
+	Reference string `json:"reference,omitempty"`
+	Actor_id *int64 `json:"actor_id"`
+	Expires_at time.Time `json:"expires_at"`
+	Created_at time.Time `json:"created_at"`
+	Updated_at time.Time `json:"updated_at"`
+}
+
+type ReservationRequest struct {
+	Quantity int64 `json:"quantity"`
+	Ttl_seconds int64 `json:"ttl_seconds"`
+	Reference string `json:"reference"`
+}
+
+type Warehouse struct {
+	Id int64 `json:"id"`
+	Code string `json:"code"`
+	Name string `json:"name"`
+	Address string `json:"address"`
+	Is_default bool `json:"is_default"`
+	Active bool `json:"active"`
+	Created_at time.Time `json:"created_at"`
+	Updated_at time.Time `json:"updated_at"`
+}
+
+type WarehouseStock struct {
+	Warehouse_id int64 `json:"warehouse_id"`
+	Code string `json:"code"`
+	Name string `json:"name"`
+	Quantity int64 `json:"quantity"`
+}
+
+type WarehouseProductStock struct {
+	Product ProductRef `json:"product"`
+	Quantity int64 `json:"quantity"`
+}
+
+type ProductAvailability struct {
+	Product_id int64 `json:"product_id"`
+	Quantity int64 `json:"quantity"`
+	Reserved int64 `json:"reserved"`
+	Available int64 `json:"available"`
+	Warehouses []WarehouseStock `json:"warehouses"`
+}
+
+type StockReconcileRequest struct {
+	Warehouse_id int64 `json:"warehouse_id"`
+}
+
+type StockTransfer struct {
+	Product_id int64 `json:"product_id"`
+	From_warehouse_id int64 `json:"from_warehouse_id"`
+	To_warehouse_id int64 `json:"to_warehouse_id"`
+	Quantity int64 `json:"quantity"`
+	Reason string `json:"reason"`
+	Reference string `json:"reference"`
+}
+
+type ReorderSettings struct {
+	Reorder_point *int64 `json:"reorder_point"`
+	Reorder_quantity int64 `json:"reorder_quantity"`
+}
+
+type LowStockItem struct {
+	Product ProductRef `json:"product"`
+	Quantity int64 `json:"quantity"`
+	Reserved int64 `json:"reserved"`
+	Reorder_point int64 `json:"reorder_point"`
+	Reorder_quantity int64 `json:"reorder_quantity"`
+	Suggested_order int64 `json:"suggested_order"`
+}
+
+type Supplier struct {
+	Id int64 `json:"id"`
+	Name string `json:"name"`
+	Email string `json:"email"`
+	Phone string `json:"phone"`
+	Address string `json:"address"`
+	Lead_time_days int64 `json:"lead_time_days"`
+	Active bool `json:"active"`
+	Created_at time.Time `json:"created_at"`
+	Updated_at time.Time `json:"updated_at"`
+}
+
+type SupplierProduct struct {
+	Supplier_id int64 `json:"supplier_id"`
+	Supplier_name string `json:"supplier_name"`
+	Product ProductRef `json:"product"`
+	Supplier_sku string `json:"supplier_sku"`
+	Cost_price Money `json:"cost_price"`
+	Lead_time_days int64 `json:"lead_time_days"`
+	Is_preferred bool `json:"is_preferred"`
+}
+
+type PurchaseOrder struct {
+	Id int64 `json:"id"`
+	Supplier_id int64 `json:"supplier_id"`
+	Supplier_name string `json:"supplier_name"`
+	Status string `json:"status"`
+	Warehouse_id int64 `json:"warehouse_id,omitempty"`
+	Notes string `json:"notes"`
+	Expected_at *time.Time `json:"expected_at"`
+	Created_by *int64 `json:"created_by"`
+	Sent_at *time.Time `json:"sent_at"`
+	Received_at *time.Time `json:"received_at"`
+	Created_at time.Time `json:"created_at"`
+	Updated_at time.Time `json:"updated_at"`
+	Total Money `json:"total"`
+	Lines []PurchaseOrderLine `json:"lines,omitempty"`
+}
+
+type PurchaseOrderLine struct {
+	Id int64 `json:"id"`
+	Product_id int64 `json:"product_id"`
+	Product_name string `json:"product_name"`
+	Sku string `json:"sku"`
+	Supplier_sku string `json:"supplier_sku"`
+	Quantity_ordered int64 `json:"quantity_ordered"`
+	Quantity_received int64 `json:"quantity_received"`
+	Unit_cost Money `json:"unit_cost"`
+	Line_total Money `json:"line_total"`
+}
+
+type ReceiveRequest struct {
+	Warehouse_id int64 `json:"warehouse_id,omitempty"`
+	Lines []ReceivedLine `json:"lines"`
+}
+
+type ReceivedLine struct {
+	Line_id int64 `json:"line_id"`
+	Quantity int64 `json:"quantity"`
+}
+
+type ExchangeRate struct {
+	Currency string `json:"currency"`
+	Rate string `json:"rate"`
+	Updated_at time.Time `json:"updated_at"`
+}
+
+type ProductPrice struct {
+	Product_id int64 `json:"product_id"`
+	Currency string `json:"currency"`
+	Price Money `json:"price"`
+	Updated_at time.Time `json:"updated_at"`
+}
+
+type PriceChange struct {
+	Id int64 `json:"id"`
+	Product_id int64 `json:"product_id"`
+	Variant_id int64 `json:"variant_id,omitempty"`
+	Old_price *Money `json:"old_price"`
+	New_price Money `json:"new_price"`
+	Effective_at time.Time `json:"effective_at"`
+	Status string `json:"status"`
+	Source string `json:"source"`
+	Reason string `json:"reason"`
+	Actor_id *int64 `json:"actor_id"`
+	Created_at time.Time `json:"created_at"`
+	Applied_at *time.Time `json:"applied_at"`
+}
+
+type PriceTimeline struct {
+	Product_id int64 `json:"product_id"`
+	Variant_id int64 `json:"variant_id,omitempty"`
+	Current_price Money `json:"current_price"`
+	Changes []PriceChange `json:"changes"`
+}
+
+type PriceChangeRequest struct {
+	Price Money `json:"price"`
+	Effective_at time.Time `json:"effective_at"`
+	Reason string `json:"reason"`
+}
+
+type Promotion struct {
+	Id int64 `json:"id"`
+	Name string `json:"name"`
+	Description string `json:"description"`
+	Discount_type string `json:"discount_type"`
+	Percentage string `json:"percentage,omitempty"`
+	Amount *Money `json:"amount,omitempty"`
+	Scope string `json:"scope"`
+	Product_ids []int64 `json:"product_ids"`
+	Category_ids []int64 `json:"category_ids"`
+	Priority int64 `json:"priority"`
+	Stackable bool `json:"stackable"`
+	Active bool `json:"active"`
+	Starts_at *time.Time `json:"starts_at"`
+	Ends_at *time.Time `json:"ends_at"`
+	Created_at time.Time `json:"created_at"`
+	Updated_at time.Time `json:"updated_at"`
+}
+
+type AppliedPromotion struct {
+	Promotion_id int64 `json:"promotion_id"`
+	Name string `json:"name"`
+	Discount Money `json:"discount"`
+}
+
+type Coupon struct {
+	Id int64 `json:"id"`
+	Code string `json:"code"`
+	Description string `json:"description"`
+	Discount_type string `json:"discount_type"`
+	Percentage string `json:"percentage,omitempty"`
+	Amount *Money `json:"amount,omitempty"`
+	Min_order Money `json:"min_order"`
+	Max_uses *int64 `json:"max_uses"`
+	Max_uses_per_user *int64 `json:"max_uses_per_user"`
+	Times_used int64 `json:"times_used"`
+	Expires_at *time.Time `json:"expires_at"`
+	Active bool `json:"active"`
+	Batch string `json:"batch"`
+	Created_at time.Time `json:"created_at"`
+	Updated_at time.Time `json:"updated_at"`
+}
+
+type CouponBatchRequest struct {
+	Count int `json:"count"`
+	Prefix string `json:"prefix"`
+	Length int `json:"length"`
+	Batch string `json:"batch"`
+	Template Coupon `json:"template"`
+}
+
+type CouponBatch struct {
+	Batch string `json:"batch"`
+	Codes []string `json:"codes"`
+}
+
+type CouponCheckRequest struct {
+	Code string `json:"code"`
+	Subtotal Money `json:"subtotal"`
+}
+
+type CouponQuote struct {
+	Code string `json:"code"`
+	Subtotal Money `json:"subtotal"`
+	Discount Money `json:"discount"`
+	Total Money `json:"total"`
+}
+
+type CouponRedemption struct {
+	Id int64 `json:"id"`
+	Coupon_id int64 `json:"coupon_id"`
+	Code string `json:"code"`
+	User_id *int64 `json:"user_id"`
+	Reference string `json:"reference"`
+	Discount Money `json:"discount"`
+	Created_at time.Time `json:"created_at"`
+	Released_at *time.Time `json:"released_at"`
+}
+
+type TaxClass struct {
+	Id int64 `json:"id"`
+	Code string `json:"code"`
+	Name string `json:"name"`
+	Is_default bool `json:"is_default"`
+	Rates []TaxRate `json:"rates"`
+	Created_at time.Time `json:"created_at"`
+	Updated_at time.Time `json:"updated_at"`
+}
+
+type TaxRate struct {
+	Id int64 `json:"id"`
+	Tax_class_id int64 `json:"tax_class_id"`
+	Country string `json:"country"`
+	Region string `json:"region"`
+	Name string `json:"name"`
+	Rate string `json:"rate"`
+	Updated_at time.Time `json:"updated_at"`
+}
+
+type TaxClassAssignment struct {
+	Tax_class_id *int64 `json:"tax_class_id"`
+}
+
+type TaxRequest struct {
+	Country string `json:"country"`
+	Region string `json:"region"`
+	Currency string `json:"currency"`
+	Lines []TaxRequestLine `json:"lines"`
+}
+
+type TaxRequestLine struct {
+	Product_id int64 `json:"product_id"`
+	Quantity int64 `json:"quantity"`
+	Unit_price *Money `json:"unit_price,omitempty"`
+}
+
+type TaxBreakdown struct {
+	Country string `json:"country"`
+	Region string `json:"region"`
+	Prices_include_tax bool `json:"prices_include_tax"`
+	Lines []TaxLine `json:"lines"`
+	Rates []TaxRateTotal `json:"rates"`
+	Net_total Money `json:"net_total"`
+	Tax_total Money `json:"tax_total"`
+	Gross_total Money `json:"gross_total"`
+}
+
+type TaxLine struct {
+	Product_id int64 `json:"product_id"`
+	Tax_class string `json:"tax_class"`
+	Tax_name string `json:"tax_name"`
+	Rate string `json:"rate"`
+	Net Money `json:"net"`
+	Tax Money `json:"tax"`
+	Gross Money `json:"gross"`
+}
+
+type TaxRateTotal struct {
+	Name string `json:"name"`
+	Rate string `json:"rate"`
+	Net Money `json:"net"`
+	Tax Money `json:"tax"`
+}
+
+type Cart struct {
+	Id int64 `json:"id"`
+	User_id *int64 `json:"user_id"`
+	Currency string `json:"currency"`
+	Coupon_code string `json:"coupon_code,omitempty"`
+	Coupon_error string `json:"coupon_error,omitempty"`
+	Lines []CartLine `json:"lines"`
+	Subtotal Money `json:"subtotal"`
+	Discount Money `json:"discount"`
+	Total Money `json:"total"`
+	Tax *TaxBreakdown `json:"tax,omitempty"`
+	Valid bool `json:"valid"`
+	Created_at time.Time `json:"created_at"`
+	Updated_at time.Time `json:"updated_at"`
+}
+
+type CartLine struct {
+	Id int64 `json:"id"`
+	Product_id int64 `json:"product_id"`
+	Product_name string `json:"product_name"`
+	Sku string `json:"sku"`
+	Quantity int64 `json:"quantity"`
+	Available int64 `json:"available"`
+	Unit_price Money `json:"unit_price"`
+	Added_price Money `json:"added_price"`
+	Price_changed bool `json:"price_changed"`
+	Line_total Money `json:"line_total"`
+	Issues []string `json:"issues,omitempty"`
+}
+
+type CartLineRequest struct {
+	Product_id int64 `json:"product_id"`
+	Quantity int64 `json:"quantity"`
+}
+
+type CartSettings struct {
+	Currency string `json:"currency"`
+	Coupon_code string `json:"coupon_code"`
+}
+
+type AnonymousCart struct {
+	Token string `json:"token"`
+	Cart Cart `json:"cart"`
+}
+
+type Order struct {
+	Id int64 `json:"id"`
+	User_id *int64 `json:"user_id"`
+	Status string `json:"status"`
+	Email string `json:"email"`
+	Customer_name string `json:"customer_name"`
+	Shipping_address string `json:"shipping_address"`
+	Country string `json:"country"`
+	Region string `json:"region"`
+	Currency string `json:"currency"`
+	Coupon_code string `json:"coupon_code,omitempty"`
+	Subtotal Money `json:"subtotal"`
+	Discount Money `json:"discount"`
+	Tax_total Money `json:"tax_total"`
+	Total Money `json:"total"`
+	Tax *TaxBreakdown `json:"tax,omitempty"`
+	Lines []OrderLine `json:"lines"`
+	Transitions []OrderTransition `json:"transitions"`
+	Payments []Payment `json:"payments"`
+	Expires_at *time.Time `json:"expires_at,omitempty"`
+	Created_at time.Time `json:"created_at"`
+	Updated_at time.Time `json:"updated_at"`
+}
+
+// OrderLine keeps a snapshot of the product as it was sold, so later catalogue
+// changes do not alter past orders.
+type OrderLine struct {
+	Id int64 `json:"id"`
+	Product_id *int64 `json:"product_id"`
+	Product_name string `json:"product_name"`
+	Sku string `json:"sku"`
+	Quantity int64 `json:"quantity"`
+	Unit_price Money `json:"unit_price"`
+	Line_total Money `json:"line_total"`
+	Discount Money `json:"discount"`
+	Tax Money `json:"tax"`
+	Product json.RawMessage `json:"product"`
+}
+
+type OrderTransition struct {
+	Id int64 `json:"id"`
+	From_status string `json:"from_status,omitempty"`
+	To_status string `json:"to_status"`
+	Reason string `json:"reason,omitempty"`
+	Actor_id *int64 `json:"actor_id"`
+	Created_at time.Time `json:"created_at"`
+}
+
+type CheckoutRequest struct {
+	Email string `json:"email"`
+	Customer_name string `json:"customer_name"`
+	Shipping_address string `json:"shipping_address"`
+	Country string `json:"country"`
+	Region string `json:"region"`
+	Payment_method string `json:"payment_method"`
+}
+
+type OrderTransitionRequest struct {
+	Status string `json:"status"`
+	Reason string `json:"reason"`
+}
+
+type Payment struct {
+	Id int64 `json:"id"`
+	Order_id int64 `json:"order_id"`
+	Provider string `json:"provider"`
+	Reference string `json:"reference,omitempty"`
+	Status string `json:"status"`
+	Amount Money `json:"amount"`
+	Message string `json:"message,omitempty"`
+	Created_at time.Time `json:"created_at"`
+	Updated_at time.Time `json:"updated_at"`
+}
+
+type PaymentMethodRequest struct {
+	Payment_method string `json:"payment_method"`
+}
+
+// RefundRequest is the optional body of a refund. Orders refunded while paid
+// always get their stock back; Restock also books the goods back in for
+// orders that were already fulfilled, shipped or delivered.
+type RefundRequest struct {
+	Restock bool `json:"restock"`
+}
+
+// Invoice is a snapshot of an order at the time it was invoiced. Numbers are
+// sequential without gaps.
+type Invoice struct {
+	Id int64 `json:"id"`
+	Number string `json:"number"`
+	Order_id int64 `json:"order_id"`
+	Customer_name string `json:"customer_name"`
+	Email string `json:"email"`
+	Shipping_address string `json:"shipping_address"`
+	Country string `json:"country"`
+	Region string `json:"region"`
+	Currency string `json:"currency"`
+	Lines []InvoiceLine `json:"lines"`
+	Subtotal Money `json:"subtotal"`
+	Discount Money `json:"discount"`
+	Tax_total Money `json:"tax_total"`
+	Total Money `json:"total"`
+	Prices_include_tax bool `json:"prices_include_tax"`
+	Tax_rates []TaxRateTotal `json:"tax_rates"`
+	Issued_at time.Time `json:"issued_at"`
+}
+
+type InvoiceLine struct {
+	Description string `json:"description"`
+	Sku string `json:"sku"`
+	Quantity int64 `json:"quantity"`
+	Unit_price Money `json:"unit_price"`
+	Discount Money `json:"discount"`
+	Tax_rate string `json:"tax_rate"`
+	Tax Money `json:"tax"`
+	Total Money `json:"total"`
+}
@@ -0,0 +1,312 @@
+package models
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// minorUnits lists currencies whose minor unit is not 1/100.
+var minorUnits = map[string]int{
+	"BHD": 3, "IQD": 3, "JOD": 3, "KWD": 3, "LYD": 3, "OMR": 3, "TND": 3,
+	"BIF": 0, "CLP": 0, "DJF": 0, "GNF": 0, "ISK": 0, "JPY": 0, "KMF": 0, "KRW": 0,
+	"PYG": 0, "RWF": 0, "UGX": 0, "VND": 0, "VUV": 0, "XAF": 0, "XOF": 0, "XPF": 0,
+}
+
+// BaseCurrency is the currency product prices are stored in, configured with
+// BASE_CURRENCY and EUR by default.
+func BaseCurrency() string {
+	if code := os.Getenv("BASE_CURRENCY"); code != "" {
+		return strings.ToUpper(code)
+	}
+	return "EUR"
+}
+
+// ValidCurrency reports whether code looks like an ISO 4217 code.
+func ValidCurrency(code string) bool {
+	if len(code) != 3 {
+		return false
+	}
+	for i := 0; i < len(code); i++ {
+		if code[i] < 'A' || code[i] > 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
+// decimalPattern is the only number syntax accepted for amounts and rates.
+// big.Rat alone would also take fractions, exponents and 0x/0b/0o prefixes.
+var decimalPattern = regexp.MustCompile(`^[+-]?([0-9]+(\.[0-9]*)?|\.[0-9]+)$`)
+
+func currencyExponent(code string) int {
+	if exponent, ok := minorUnits[code]; ok {
+		return exponent
+	}
+	return 2
+}
+
+// Money is an exact amount in the minor unit of a currency (cents for EUR).
+// The zero value is zero in the base currency.
+//
+// In JSON it is {"amount":"19.99","currency":"EUR"}; a bare number or string
+// is also accepted as an amount in the base currency. In SQL it is stored as
+// numeric without the currency, which comes from the context.
+type Money struct {
+	minor    int64
+	currency string
+}
+
+func NewMoney(minor int64, currency string) Money {
+	return Money{minor: minor, currency: strings.ToUpper(currency)}
+}
+
+// ParseMoney parses a decimal string such as "19.99" or "-3". Digits beyond
+// the currency's minor unit are rounded half away from zero.
+func ParseMoney(value string, currency string) (Money, error) {
+	currency = strings.ToUpper(currency)
+	if currency == "" {
+		currency = BaseCurrency()
+	}
+	if !ValidCurrency(currency) {
+		return Money{}, fmt.Errorf("invalid currency %q", currency)
+	}
+
+	value = strings.TrimSpace(value)
+	if !decimalPattern.MatchString(value) {
+		return Money{}, fmt.Errorf("invalid amount %q", value)
+	}
+	rat, ok := new(big.Rat).SetString(value)
+	if !ok {
+		return Money{}, fmt.Errorf("invalid amount %q", value)
+	}
+	minor, err := roundRat(rat.Mul(rat, scaleRat(currency)))
+	if err != nil {
+		return Money{}, err
+	}
+	return Money{minor: minor, currency: currency}, nil
+}
+
+func scaleRat(currency string) *big.Rat {
+	scale := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(currencyExponent(currency))), nil)
+	return new(big.Rat).SetInt(scale)
+}
+
+// roundRat rounds half away from zero to an int64.
+func roundRat(r *big.Rat) (int64, error) {
+	num := new(big.Int).Abs(r.Num())
+	quotient, remainder := new(big.Int).QuoRem(num, r.Denom(), new(big.Int))
+	if remainder.Lsh(remainder, 1).Cmp(r.Denom()) >= 0 {
+		quotient.Add(quotient, big.NewInt(1))
+	}
+	if r.Sign() < 0 {
+		quotient.Neg(quotient)
+	}
+	if !quotient.IsInt64() {
+		return 0, fmt.Errorf("amount %s is out of range", r.FloatString(4))
+	}
+	return quotient.Int64(), nil
+}
+
+// ParseRate parses an exact decimal factor such as an exchange rate "1.0823"
+// or a percentage expressed as "0.19".
+func ParseRate(value string) (*big.Rat, error) {
+	value = strings.TrimSpace(value)
+	if !decimalPattern.MatchString(value) {
+		return nil, fmt.Errorf("invalid rate %q", value)
+	}
+	rate, ok := new(big.Rat).SetString(value)
+	if !ok {
+		return nil, fmt.Errorf("invalid rate %q", value)
+	}
+	return rate, nil
+}
+
+func (m Money) Minor() int64 {
+	return m.minor
+}
+
+func (m Money) Currency() string {
+	if m.currency == "" {
+		return BaseCurrency()
+	}
+	return m.currency
+}
+
+func (m Money) IsZero() bool {
+	return m.minor == 0
+}
+
+func (m Money) IsNegative() bool {
+	return m.minor < 0
+}
+
+func (m Money) sameCurrency(o Money) {
+	if m.Currency() != o.Currency() {
+		panic(fmt.Sprintf("money: cannot combine %s and %s", m.Currency(), o.Currency()))
+	}
+}
+
+func (m Money) Add(o Money) Money {
+	m.sameCurrency(o)
+	return Money{minor: m.minor + o.minor, currency: m.Currency()}
+}
+
+func (m Money) Sub(o Money) Money {
+	m.sameCurrency(o)
+	return Money{minor: m.minor - o.minor, currency: m.Currency()}
+}
+
+func (m Money) Neg() Money {
+	return Money{minor: -m.minor, currency: m.currency}
+}
+
+// Mul multiplies by a quantity.
+func (m Money) Mul(quantity int64) Money {
+	return Money{minor: m.minor * quantity, currency: m.currency}
+}
+
+// MulRate multiplies by an exact factor, rounding half away from zero.
+func (m Money) MulRate(rate *big.Rat) Money {
+	product := new(big.Rat).Mul(new(big.Rat).SetInt64(m.minor), rate)
+	minor, err := roundRat(product)
+	if err != nil {
+		panic("money: " + err.Error())
+	}
+	return Money{minor: minor, currency: m.currency}
+}
+
+// Convert expresses m in another currency given how many units of currency
+// one unit of m's currency buys.
+func (m Money) Convert(rate *big.Rat, currency string) Money {
+	currency = strings.ToUpper(currency)
+	value := new(big.Rat).SetFrac(big.NewInt(m.minor), scaleRat(m.Currency()).Num())
+	value.Mul(value, rate)
+	value.Mul(value, scaleRat(currency))
+	minor, err := roundRat(value)
+	if err != nil {
+		panic("money: " + err.Error())
+	}
+	return Money{minor: minor, currency: currency}
+}
+
+// Cmp compares two amounts of the same currency and returns -1, 0 or +1.
+func (m Money) Cmp(o Money) int {
+	m.sameCurrency(o)
+	switch {
+	case m.minor < o.minor:
+		return -1
+	case m.minor > o.minor:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// String returns the amount as a plain decimal such as "19.99".
+func (m Money) String() string {
+	exponent := currencyExponent(m.Currency())
+	if exponent == 0 {
+		return fmt.Sprintf("%d", m.minor)
+	}
+	sign := ""
+	minor := m.minor
+	if minor < 0 {
+		sign = "-"
+		minor = -minor
+	}
+	digits := fmt.Sprintf("%0*d", exponent+1, minor)
+	return sign + digits[:len(digits)-exponent] + "." + digits[len(digits)-exponent:]
+}
+
+type moneyJSON struct {
+	Amount   json.Number `json:"amount"`
+	Currency string      `json:"currency"`
+}
+
+func (m Money) MarshalJSON() ([]byte, error) {
+	return json.Marshal(moneyJSON{Amount: json.Number(m.String()), Currency: m.Currency()})
+}
+
+func (m *Money) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	if bytes.Equal(data, []byte("null")) {
+		return nil
+	}
+
+	var value moneyJSON
+	switch {
+	case len(data) > 0 && data[0] == '{':
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.UseNumber()
+		var raw struct {
+			Amount   any    `json:"amount"`
+			Currency string `json:"currency"`
+		}
+		if err := decoder.Decode(&raw); err != nil {
+			return err
+		}
+		switch amount := raw.Amount.(type) {
+		case json.Number:
+			value.Amount = amount
+		case string:
+			value.Amount = json.Number(amount)
+		default:
+			return fmt.Errorf("money amount must be a number or a string")
+		}
+		value.Currency = raw.Currency
+	case len(data) > 0 && data[0] == '"':
+		var amount string
+		if err := json.Unmarshal(data, &amount); err != nil {
+			return err
+		}
+		value.Amount = json.Number(amount)
+	default:
+		value.Amount = json.Number(data)
+	}
+
+	parsed, err := ParseMoney(string(value.Amount), value.Currency)
+	if err != nil {
+		return err
+	}
+	*m = parsed
+	return nil
+}
+
+// Value stores the amount as a numeric string.
+func (m Money) Value() (driver.Value, error) {
+	return m.String(), nil
+}
+
+// Scan reads a numeric column. The currency is kept when already set and is
+// the base currency otherwise.
+func (m *Money) Scan(src any) error {
+	var text string
+	switch v := src.(type) {
+	case nil:
+		*m = Money{currency: m.currency}
+		return nil
+	case []byte:
+		text = string(v)
+	case string:
+		text = v
+	case int64:
+		text = fmt.Sprintf("%d", v)
+	case float64:
+		text = fmt.Sprintf("%.6f", v)
+	default:
+		return fmt.Errorf("cannot scan %T into Money", src)
+	}
+
+	parsed, err := ParseMoney(text, m.currency)
+	if err != nil {
+		return err
+	}
+	*m = parsed
+	return nil
+}
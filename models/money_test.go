@@ -0,0 +1,182 @@
+package models
+
+import (
+	"encoding/json"
+	"math/big"
+	"testing"
+)
+
+func TestParseMoneyRounding(t *testing.T) {
+	t.Setenv("BASE_CURRENCY", "EUR")
+
+	tests := []struct {
+		value    string
+		currency string
+		minor    int64
+		text     string
+	}{
+		{"19.99", "EUR", 1999, "19.99"},
+		{"1.005", "EUR", 101, "1.01"},
+		{"1.004", "eur", 100, "1.00"},
+		{"-1.005", "EUR", -101, "-1.01"},
+		{"-0.05", "", -5, "-0.05"},
+		{" 3 ", "USD", 300, "3.00"},
+		{"1.5", "JPY", 2, "2"},
+		{"-2.5", "JPY", -3, "-3"},
+		{"1.0005", "KWD", 1001, "1.001"},
+	}
+	for _, tt := range tests {
+		m, err := ParseMoney(tt.value, tt.currency)
+		if err != nil {
+			t.Errorf("ParseMoney(%q, %q): %v", tt.value, tt.currency, err)
+			continue
+		}
+		if m.Minor() != tt.minor || m.String() != tt.text {
+			t.Errorf("ParseMoney(%q, %q) = %d (%s), want %d (%s)", tt.value, tt.currency, m.Minor(), m, tt.minor, tt.text)
+		}
+	}
+}
+
+func TestParseMoneyInvalid(t *testing.T) {
+	tests := []struct {
+		value    string
+		currency string
+	}{
+		{"", "EUR"},
+		{"abc", "EUR"},
+		{"1e3", "EUR"},
+		{"1/2", "EUR"},
+		{"0x10", "EUR"},
+		{"1.00", "EU"},
+		{"1.00", "E1R"},
+		{"99999999999999999999", "EUR"},
+	}
+	for _, tt := range tests {
+		if m, err := ParseMoney(tt.value, tt.currency); err == nil {
+			t.Errorf("ParseMoney(%q, %q) = %s, want an error", tt.value, tt.currency, m)
+		}
+	}
+}
+
+func TestMoneyArithmetic(t *testing.T) {
+	price := NewMoney(1999, "EUR")
+	if got := price.Add(NewMoney(1, "EUR")); got.Minor() != 2000 || got.Currency() != "EUR" {
+		t.Errorf("Add = %d %s", got.Minor(), got.Currency())
+	}
+	if got := price.Sub(NewMoney(2000, "EUR")); got.Minor() != -1 || !got.IsNegative() {
+		t.Errorf("Sub = %d", got.Minor())
+	}
+	if got := price.Mul(3); got.Minor() != 5997 {
+		t.Errorf("Mul = %d", got.Minor())
+	}
+	// 19.99 * 0.19 = 3.7981, rounded half away from zero.
+	if got := price.MulRate(big.NewRat(19, 100)); got.Minor() != 380 {
+		t.Errorf("MulRate = %d, want 380", got.Minor())
+	}
+	if got := NewMoney(-5, "EUR").MulRate(big.NewRat(1, 2)); got.Minor() != -3 {
+		t.Errorf("MulRate of a negative half = %d, want -3", got.Minor())
+	}
+	if price.Cmp(NewMoney(1999, "eur")) != 0 || price.Cmp(NewMoney(2000, "EUR")) != -1 || price.Cmp(NewMoney(1, "EUR")) != 1 {
+		t.Error("Cmp does not order amounts")
+	}
+}
+
+func TestMoneyConvert(t *testing.T) {
+	rate, err := ParseRate("1.0823")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 19.99 EUR * 1.0823 = 21.635177 USD.
+	if got := NewMoney(1999, "EUR").Convert(rate, "usd"); got.Minor() != 2164 || got.Currency() != "USD" {
+		t.Errorf("Convert to USD = %d %s, want 2164 USD", got.Minor(), got.Currency())
+	}
+	// 19.99 EUR * 161.5 = 3228.385 JPY, which has no minor unit.
+	if got := NewMoney(1999, "EUR").Convert(big.NewRat(1615, 10), "JPY"); got.Minor() != 3228 {
+		t.Errorf("Convert to JPY = %d, want 3228", got.Minor())
+	}
+}
+
+func TestMoneyMixedCurrenciesPanic(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("Add of EUR and USD did not panic")
+		}
+	}()
+	NewMoney(1, "EUR").Add(NewMoney(1, "USD"))
+}
+
+func TestMoneyJSON(t *testing.T) {
+	t.Setenv("BASE_CURRENCY", "EUR")
+
+	data, err := json.Marshal(NewMoney(-1050, "USD"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != `{"amount":-10.50,"currency":"USD"}` {
+		t.Errorf("Marshal = %s", data)
+	}
+
+	var back Money
+	if err := json.Unmarshal(data, &back); err != nil {
+		t.Fatal(err)
+	}
+	if back != NewMoney(-1050, "USD") {
+		t.Errorf("round trip = %d %s", back.Minor(), back.Currency())
+	}
+
+	tests := []struct {
+		input    string
+		minor    int64
+		currency string
+	}{
+		{`{"amount":"19.99","currency":"usd"}`, 1999, "USD"},
+		{`{"amount":19.999}`, 2000, "EUR"},
+		{`"5"`, 500, "EUR"},
+		{`12.5`, 1250, "EUR"},
+	}
+	for _, tt := range tests {
+		var m Money
+		if err := json.Unmarshal([]byte(tt.input), &m); err != nil {
+			t.Errorf("Unmarshal(%s): %v", tt.input, err)
+			continue
+		}
+		if m.Minor() != tt.minor || m.Currency() != tt.currency {
+			t.Errorf("Unmarshal(%s) = %d %s, want %d %s", tt.input, m.Minor(), m.Currency(), tt.minor, tt.currency)
+		}
+	}
+
+	for _, input := range []string{`{"amount":true}`, `"1e3"`, `{"amount":"1","currency":"EURO"}`} {
+		var m Money
+		if err := json.Unmarshal([]byte(input), &m); err == nil {
+			t.Errorf("Unmarshal(%s) = %s, want an error", input, m)
+		}
+	}
+
+	m := NewMoney(7, "USD")
+	if err := json.Unmarshal([]byte("null"), &m); err != nil || m != NewMoney(7, "USD") {
+		t.Errorf("Unmarshal(null) changed the value to %d %s (%v)", m.Minor(), m.Currency(), err)
+	}
+}
+
+func TestMoneyScan(t *testing.T) {
+	t.Setenv("BASE_CURRENCY", "EUR")
+
+	m := NewMoney(0, "JPY")
+	if err := m.Scan([]byte("1500")); err != nil || m != NewMoney(1500, "JPY") {
+		t.Errorf("Scan into JPY = %d %s (%v)", m.Minor(), m.Currency(), err)
+	}
+
+	var base Money
+	if err := base.Scan("12.34"); err != nil || base.Minor() != 1234 || base.Currency() != "EUR" {
+		t.Errorf("Scan into zero value = %d %s (%v)", base.Minor(), base.Currency(), err)
+	}
+
+	value, err := NewMoney(1234, "EUR").Value()
+	if err != nil || value != "12.34" {
+		t.Errorf("Value = %v (%v)", value, err)
+	}
+
+	if err := base.Scan(true); err == nil {
+		t.Error("Scan of a bool did not fail")
+	}
+}
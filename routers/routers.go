@@ -13,22 +13,170 @@ func Router() *mux.Router{
 	//Route Handlers
 	router.HandleFunc("/api/product/{id}", middleware.GetProduct).Methods("GET", "OPTIONS")
 	router.HandleFunc("/api/product", middleware.GetAllProducts).Methods("GET", "OPTIONS")
-	router.HandleFunc("/api/newproduct", middleware.CreateProduct).Methods("POST", "OPTIONS")
-	router.HandleFunc("/api/product/{id}", middleware.UpdateProduct).Methods("PUT", "OPTIONS")
-	router.HandleFunc("/api/deleteproduct/{id}", middleware.DeleteProduct).Methods("DELETE", "OPTIONS")
+	router.HandleFunc("/api/newproduct", middleware.WithAdminAuth(middleware.CreateProduct)).Methods("POST", "OPTIONS")
+	router.HandleFunc("/api/product/{id}", middleware.WithAdminAuth(middleware.UpdateProduct)).Methods("PUT", "OPTIONS")
+	router.HandleFunc("/api/deleteproduct/{id}", middleware.WithAdminAuth(middleware.DeleteProduct)).Methods("DELETE", "OPTIONS")
+	router.HandleFunc("/api/product/{id}/options", middleware.GetProductOptions).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/product/{id}/options", middleware.WithAdminAuth(middleware.CreateProductOption)).Methods("POST", "OPTIONS")
+	router.HandleFunc("/api/product/{id}/options/{optionId}", middleware.WithAdminAuth(middleware.UpdateProductOption)).Methods("PUT", "OPTIONS")
+	router.HandleFunc("/api/product/{id}/options/{optionId}", middleware.WithAdminAuth(middleware.DeleteProductOption)).Methods("DELETE", "OPTIONS")
+	router.HandleFunc("/api/product/{id}/variants", middleware.GetProductVariants).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/product/{id}/variants", middleware.WithAdminAuth(middleware.CreateProductVariant)).Methods("POST", "OPTIONS")
+	router.HandleFunc("/api/product/{id}/variants/{variantId}", middleware.GetProductVariant).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/product/{id}/variants/{variantId}", middleware.WithAdminAuth(middleware.UpdateProductVariant)).Methods("PUT", "OPTIONS")
+	router.HandleFunc("/api/product/{id}/variants/{variantId}", middleware.WithAdminAuth(middleware.DeleteProductVariant)).Methods("DELETE", "OPTIONS")
+	router.HandleFunc("/api/product/{id}/categories", middleware.GetProductCategories).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/product/{id}/categories", middleware.WithAdminAuth(middleware.AttachProductCategory)).Methods("POST", "OPTIONS")
+	router.HandleFunc("/api/product/{id}/categories/{categoryId}", middleware.WithAdminAuth(middleware.DetachProductCategory)).Methods("DELETE", "OPTIONS")
+	router.HandleFunc("/api/product/{id}/images", middleware.GetProductImages).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/product/{id}/images", middleware.WithAdminAuth(middleware.UploadProductImage)).Methods("POST", "OPTIONS")
+	router.HandleFunc("/api/product/{id}/images/order", middleware.WithAdminAuth(middleware.ReorderProductImages)).Methods("PUT", "OPTIONS")
+	router.HandleFunc("/api/product/{id}/images/{imageId}", middleware.WithAdminAuth(middleware.UpdateProductImage)).Methods("PUT", "OPTIONS")
+	router.HandleFunc("/api/product/{id}/images/{imageId}", middleware.WithAdminAuth(middleware.DeleteProductImage)).Methods("DELETE", "OPTIONS")
+	router.HandleFunc("/api/product/{id}/stock/movements", middleware.WithAdminAuth(middleware.GetStockMovements)).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/product/{id}/stock/movements", middleware.WithAdminAuth(middleware.PostStockMovement)).Methods("POST", "OPTIONS")
+	router.HandleFunc("/api/product/{id}/stock/reconcile", middleware.WithAdminAuth(middleware.ReconcileStock)).Methods("POST", "OPTIONS")
+	router.HandleFunc("/api/product/{id}/reservations", middleware.WithAdminAuth(middleware.CreateReservation)).Methods("POST", "OPTIONS")
+	router.HandleFunc("/api/reservations/{id}", middleware.WithAdminAuth(middleware.GetReservation)).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/reservations/{id}/commit", middleware.WithAdminAuth(middleware.CommitReservation)).Methods("POST", "OPTIONS")
+	router.HandleFunc("/api/reservations/{id}/release", middleware.WithAdminAuth(middleware.ReleaseReservation)).Methods("POST", "OPTIONS")
+	router.HandleFunc("/api/product/{id}/availability", middleware.GetProductAvailability).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/product/{id}/reorder", middleware.WithAdminAuth(middleware.UpdateReorderSettings)).Methods("PUT", "OPTIONS")
+	router.HandleFunc("/api/product/{id}/suppliers", middleware.WithAdminAuth(middleware.GetProductSuppliers)).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/product/{id}/taxclass", middleware.WithAdminAuth(middleware.SetProductTaxClass)).Methods("PUT", "OPTIONS")
+	router.HandleFunc("/api/product/{id}/pricehistory", middleware.GetPriceHistory).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/product/{id}/pricechanges", middleware.WithAdminAuth(middleware.SchedulePriceChange)).Methods("POST", "OPTIONS")
+	router.HandleFunc("/api/product/{id}/pricechanges/{changeId}", middleware.WithAdminAuth(middleware.CancelPriceChange)).Methods("DELETE", "OPTIONS")
+	router.HandleFunc("/api/product/{id}/prices", middleware.GetProductPrices).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/product/{id}/prices/{currency}", middleware.WithAdminAuth(middleware.SetProductPrice)).Methods("PUT", "OPTIONS")
+	router.HandleFunc("/api/product/{id}/prices/{currency}", middleware.WithAdminAuth(middleware.DeleteProductPrice)).Methods("DELETE", "OPTIONS")
+	router.HandleFunc("/api/productsku/{sku}", middleware.GetProductBySku).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/productbarcode/{barcode}", middleware.GetProductByBarcode).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/productslug/{slug}", middleware.GetProductBySlug).Methods("GET", "OPTIONS")
 
-	router.HandleFunc("/api/newcategory", middleware.CreateCategory).Methods("POST", "OPTIONS")
+	router.HandleFunc("/api/newcategory", middleware.WithAdminAuth(middleware.CreateCategory)).Methods("POST", "OPTIONS")
 	router.HandleFunc("/api/category/{id}", middleware.GetCategory).Methods("GET", "OPTIONS")
 	router.HandleFunc("/api/category", middleware.GetAllCategories).Methods("GET", "OPTIONS")
-	router.HandleFunc("/api/category/{id}", middleware.UpdateCategory).Methods("PUT", "OPTIONS")
-	router.HandleFunc("/api/deletecategory/{id}", middleware.DeleteCategory).Methods("DELETE", "OPTIONS")
+	router.HandleFunc("/api/category/{id}", middleware.WithAdminAuth(middleware.UpdateCategory)).Methods("PUT", "OPTIONS")
+	router.HandleFunc("/api/deletecategory/{id}", middleware.WithAdminAuth(middleware.DeleteCategory)).Methods("DELETE", "OPTIONS")
+	router.HandleFunc("/api/categorytree", middleware.GetCategoryTree).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/category/{id}/subtree", middleware.GetCategorySubtree).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/category/{id}/ancestors", middleware.GetCategoryAncestors).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/category/{id}/move", middleware.WithAdminAuth(middleware.MoveCategory)).Methods("PUT", "OPTIONS")
+	router.HandleFunc("/api/category/{id}/taxclass", middleware.WithAdminAuth(middleware.SetCategoryTaxClass)).Methods("PUT", "OPTIONS")
+	router.HandleFunc("/api/category/{id}/products", middleware.GetCategoryProducts).Methods("GET", "OPTIONS")
 
 
+	router.HandleFunc("/media/{key:.+}", middleware.ServeMedia).Methods("GET", "OPTIONS")
+
+	router.HandleFunc("/api/warehouses", middleware.WithAdminAuth(middleware.GetAllWarehouses)).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/warehouses", middleware.WithAdminAuth(middleware.CreateWarehouse)).Methods("POST", "OPTIONS")
+	router.HandleFunc("/api/warehouses/transfers", middleware.WithAdminAuth(middleware.TransferStock)).Methods("POST", "OPTIONS")
+	router.HandleFunc("/api/warehouses/{id}", middleware.WithAdminAuth(middleware.GetWarehouse)).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/warehouses/{id}", middleware.WithAdminAuth(middleware.UpdateWarehouse)).Methods("PUT", "OPTIONS")
+	router.HandleFunc("/api/warehouses/{id}", middleware.WithAdminAuth(middleware.DeleteWarehouse)).Methods("DELETE", "OPTIONS")
+	router.HandleFunc("/api/warehouses/{id}/stock", middleware.WithAdminAuth(middleware.GetWarehouseStock)).Methods("GET", "OPTIONS")
+
+	router.HandleFunc("/api/suppliers", middleware.WithAdminAuth(middleware.GetAllSuppliers)).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/suppliers", middleware.WithAdminAuth(middleware.CreateSupplier)).Methods("POST", "OPTIONS")
+	router.HandleFunc("/api/suppliers/{id}", middleware.WithAdminAuth(middleware.GetSupplier)).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/suppliers/{id}", middleware.WithAdminAuth(middleware.UpdateSupplier)).Methods("PUT", "OPTIONS")
+	router.HandleFunc("/api/suppliers/{id}", middleware.WithAdminAuth(middleware.DeleteSupplier)).Methods("DELETE", "OPTIONS")
+	router.HandleFunc("/api/suppliers/{id}/products", middleware.WithAdminAuth(middleware.GetSupplierProducts)).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/suppliers/{id}/products/{productId}", middleware.WithAdminAuth(middleware.SetSupplierProduct)).Methods("PUT", "OPTIONS")
+	router.HandleFunc("/api/suppliers/{id}/products/{productId}", middleware.WithAdminAuth(middleware.DeleteSupplierProduct)).Methods("DELETE", "OPTIONS")
+
+	router.HandleFunc("/api/purchaseorders", middleware.WithAdminAuth(middleware.GetAllPurchaseOrders)).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/purchaseorders", middleware.WithAdminAuth(middleware.CreatePurchaseOrder)).Methods("POST", "OPTIONS")
+	router.HandleFunc("/api/purchaseorders/{id}", middleware.WithAdminAuth(middleware.GetPurchaseOrder)).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/purchaseorders/{id}/lines", middleware.WithAdminAuth(middleware.AddPurchaseOrderLine)).Methods("POST", "OPTIONS")
+	router.HandleFunc("/api/purchaseorders/{id}/lines/{lineId}", middleware.WithAdminAuth(middleware.UpdatePurchaseOrderLine)).Methods("PUT", "OPTIONS")
+	router.HandleFunc("/api/purchaseorders/{id}/lines/{lineId}", middleware.WithAdminAuth(middleware.DeletePurchaseOrderLine)).Methods("DELETE", "OPTIONS")
+	router.HandleFunc("/api/purchaseorders/{id}/send", middleware.WithAdminAuth(middleware.SendPurchaseOrder)).Methods("POST", "OPTIONS")
+	router.HandleFunc("/api/purchaseorders/{id}/receive", middleware.WithAdminAuth(middleware.ReceivePurchaseOrder)).Methods("POST", "OPTIONS")
+	router.HandleFunc("/api/purchaseorders/{id}/cancel", middleware.WithAdminAuth(middleware.CancelPurchaseOrder)).Methods("POST", "OPTIONS")
+
+	router.HandleFunc("/api/promotions", middleware.WithAdminAuth(middleware.GetAllPromotions)).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/promotions", middleware.WithAdminAuth(middleware.CreatePromotion)).Methods("POST", "OPTIONS")
+	router.HandleFunc("/api/promotions/{id}", middleware.WithAdminAuth(middleware.GetPromotion)).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/promotions/{id}", middleware.WithAdminAuth(middleware.UpdatePromotion)).Methods("PUT", "OPTIONS")
+	router.HandleFunc("/api/promotions/{id}", middleware.WithAdminAuth(middleware.DeletePromotion)).Methods("DELETE", "OPTIONS")
+
+	router.HandleFunc("/api/coupons", middleware.WithAdminAuth(middleware.GetAllCoupons)).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/coupons", middleware.WithAdminAuth(middleware.CreateCoupon)).Methods("POST", "OPTIONS")
+	router.HandleFunc("/api/coupons/generate", middleware.WithAdminAuth(middleware.GenerateCoupons)).Methods("POST", "OPTIONS")
+	router.HandleFunc("/api/coupons/check", middleware.CheckCoupon).Methods("POST", "OPTIONS")
+	router.HandleFunc("/api/coupons/{id}", middleware.WithAdminAuth(middleware.GetCoupon)).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/coupons/{id}", middleware.WithAdminAuth(middleware.UpdateCoupon)).Methods("PUT", "OPTIONS")
+	router.HandleFunc("/api/coupons/{id}", middleware.WithAdminAuth(middleware.DeleteCoupon)).Methods("DELETE", "OPTIONS")
+	router.HandleFunc("/api/coupons/{id}/redemptions", middleware.WithAdminAuth(middleware.GetCouponRedemptions)).Methods("GET", "OPTIONS")
+
+	router.HandleFunc("/api/taxclasses", middleware.WithAdminAuth(middleware.GetTaxClasses)).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/taxclasses", middleware.WithAdminAuth(middleware.CreateTaxClass)).Methods("POST", "OPTIONS")
+	router.HandleFunc("/api/taxclasses/{id}", middleware.WithAdminAuth(middleware.UpdateTaxClass)).Methods("PUT", "OPTIONS")
+	router.HandleFunc("/api/taxclasses/{id}", middleware.WithAdminAuth(middleware.DeleteTaxClass)).Methods("DELETE", "OPTIONS")
+	router.HandleFunc("/api/taxclasses/{id}/rates", middleware.WithAdminAuth(middleware.SetTaxRate)).Methods("PUT", "OPTIONS")
+	router.HandleFunc("/api/taxrates/{id}", middleware.WithAdminAuth(middleware.DeleteTaxRate)).Methods("DELETE", "OPTIONS")
+	router.HandleFunc("/api/tax/calculate", middleware.CalculateTax).Methods("POST", "OPTIONS")
+
+	router.HandleFunc("/api/carts", middleware.CreateAnonymousCart).Methods("POST", "OPTIONS")
+	router.HandleFunc("/api/carts/{token}", middleware.GetAnonymousCart).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/carts/{token}", middleware.UpdateAnonymousCart).Methods("PUT", "OPTIONS")
+	router.HandleFunc("/api/carts/{token}", middleware.ClearAnonymousCart).Methods("DELETE", "OPTIONS")
+	router.HandleFunc("/api/carts/{token}/lines", middleware.AddAnonymousCartLine).Methods("POST", "OPTIONS")
+	router.HandleFunc("/api/carts/{token}/lines/{lineId}", middleware.UpdateAnonymousCartLine).Methods("PUT", "OPTIONS")
+	router.HandleFunc("/api/carts/{token}/lines/{lineId}", middleware.RemoveAnonymousCartLine).Methods("DELETE", "OPTIONS")
+	router.HandleFunc("/api/carts/{token}/checkout", middleware.CheckoutAnonymousCart).Methods("POST", "OPTIONS")
+	router.HandleFunc("/api/carts/{token}/orders/{orderId}", middleware.GetAnonymousOrder).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/carts/{token}/orders/{orderId}/pay", middleware.PayAnonymousOrder).Methods("POST", "OPTIONS")
+
+	router.HandleFunc("/api/orders", middleware.WithAdminAuth(middleware.GetAllOrders)).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/orders/{id}", middleware.WithAdminAuth(middleware.GetOrder)).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/orders/{id}/transitions", middleware.WithAdminAuth(middleware.TransitionOrder)).Methods("POST", "OPTIONS")
+	router.HandleFunc("/api/orders/{id}/refund", middleware.WithAdminAuth(middleware.RefundOrder)).Methods("POST", "OPTIONS")
+	router.HandleFunc("/api/orders/{id}/invoice", middleware.WithAdminAuth(middleware.GetOrderInvoice)).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/invoices", middleware.WithAdminAuth(middleware.GetAllInvoices)).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/invoices/{id}", middleware.WithAdminAuth(middleware.GetInvoice)).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/payments/webhook", middleware.PaymentWebhook).Methods("POST", "OPTIONS")
+
+	router.HandleFunc("/api/exchangerates", middleware.GetExchangeRates).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/exchangerates", middleware.WithAdminAuth(middleware.SetExchangeRates)).Methods("PUT", "OPTIONS")
+	router.HandleFunc("/api/exchangerates/import", middleware.WithAdminAuth(middleware.ImportExchangeRates)).Methods("POST", "OPTIONS")
+	router.HandleFunc("/api/exchangerates/{currency}", middleware.WithAdminAuth(middleware.DeleteExchangeRate)).Methods("DELETE", "OPTIONS")
+
+	router.HandleFunc("/api/reports/low-stock", middleware.WithAdminAuth(middleware.GetLowStockReport)).Methods("GET", "OPTIONS")
+
 	router.HandleFunc("/api/register", middleware.UserRegister).Methods("POST", "OPTIONS")
 	router.HandleFunc("/api/login", middleware.UserLogin).Methods("POST", "OPTIONS")
 	router.HandleFunc("/api/user/{id}", middleware.WithJWTAuth(middleware.UpdateUser)).Methods("PUT", "OPTIONS")
 	router.HandleFunc("/api/user/{id}", middleware.GetUserByID).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/user/{id}", middleware.WithJWTAuth(middleware.EraseUser)).Methods("DELETE", "OPTIONS")
+	router.HandleFunc("/api/user/{id}/export", middleware.WithJWTAuth(middleware.ExportUserData)).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/user/{id}/cart", middleware.WithJWTAuth(middleware.GetUserCart)).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/user/{id}/cart", middleware.WithJWTAuth(middleware.UpdateUserCart)).Methods("PUT", "OPTIONS")
+	router.HandleFunc("/api/user/{id}/cart", middleware.WithJWTAuth(middleware.ClearUserCart)).Methods("DELETE", "OPTIONS")
+	router.HandleFunc("/api/user/{id}/cart/lines", middleware.WithJWTAuth(middleware.AddUserCartLine)).Methods("POST", "OPTIONS")
+	router.HandleFunc("/api/user/{id}/cart/lines/{lineId}", middleware.WithJWTAuth(middleware.UpdateUserCartLine)).Methods("PUT", "OPTIONS")
+	router.HandleFunc("/api/user/{id}/cart/lines/{lineId}", middleware.WithJWTAuth(middleware.RemoveUserCartLine)).Methods("DELETE", "OPTIONS")
+	router.HandleFunc("/api/user/{id}/cart/checkout", middleware.WithJWTAuth(middleware.CheckoutUserCart)).Methods("POST", "OPTIONS")
+	router.HandleFunc("/api/user/{id}/orders", middleware.WithJWTAuth(middleware.GetUserOrders)).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/user/{id}/orders/{orderId}", middleware.WithJWTAuth(middleware.GetUserOrder)).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/user/{id}/orders/{orderId}/cancel", middleware.WithJWTAuth(middleware.CancelUserOrder)).Methods("POST", "OPTIONS")
+	router.HandleFunc("/api/user/{id}/orders/{orderId}/pay", middleware.WithJWTAuth(middleware.PayUserOrder)).Methods("POST", "OPTIONS")
+	router.HandleFunc("/api/user/{id}/orders/{orderId}/invoice", middleware.WithJWTAuth(middleware.GetUserOrderInvoice)).Methods("GET", "OPTIONS")
 	router.HandleFunc("/api/useremail/{email}", middleware.GetUserByEmail).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/resetpassword", middleware.ResetPassword).Methods("POST", "OPTIONS")
+
+	router.HandleFunc("/api/admin/users", middleware.WithAdminAuth(middleware.GetAllUsers)).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/admin/users/{id}/disable", middleware.WithAdminAuth(middleware.DisableUser)).Methods("PUT", "OPTIONS")
+	router.HandleFunc("/api/admin/users/{id}/enable", middleware.WithAdminAuth(middleware.EnableUser)).Methods("PUT", "OPTIONS")
+	router.HandleFunc("/api/admin/users/{id}/role", middleware.WithAdminAuth(middleware.AssignUserRole)).Methods("PUT", "OPTIONS")
+	router.HandleFunc("/api/admin/users/{id}/resetpassword", middleware.WithAdminAuth(middleware.ForcePasswordReset)).Methods("POST", "OPTIONS")
+	router.HandleFunc("/api/admin/users/{id}", middleware.WithAdminAuth(middleware.AdminDeleteUser)).Methods("DELETE", "OPTIONS")
+	router.HandleFunc("/api/admin/users/{id}/export", middleware.WithAdminAuth(middleware.ExportUserData)).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/admin/users/{id}/erase", middleware.WithAdminAuth(middleware.EraseUser)).Methods("POST", "OPTIONS")
+	router.HandleFunc("/api/admin/inventory/discrepancies", middleware.WithAdminAuth(middleware.GetStockDiscrepancies)).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/admin/auditlog", middleware.WithAdminAuth(middleware.GetAuditLog)).Methods("GET", "OPTIONS")
 
 
 	return router